@@ -1,7 +1,12 @@
 db.logs.createIndex({build_id:1, test_id:1, seq:1})
+db.logs.createIndex({build_id:1, test_id:1, batch_id:1})
 db.logs.createIndex({started:1}, {expireAfterSeconds: 60*60*24*90}) // 90 days retention?
 db.tests.createIndex({started:1}, {expireAfterSeconds: 60*60*24*90}) // 90 days retention?
 db.builds.createIndex({started:1}, {expireAfterSeconds: 60*60*24*90}) // 90 days retention?
 db.builds.createIndex({buildnum:1, builder:1})
 db.tests.createIndex({build_id:1, started:1})
 db.logs.createIndex({build_id:1, started:1})
+db.builds.createIndex({builder:1, started:-1})
+db.tests.createIndex({name:1, _id:-1})
+db.tests.createIndex({build_id:1, _id:-1})
+db.tests.createIndex({builder:1, _id:-1})
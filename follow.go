@@ -0,0 +1,356 @@
+package logkeeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	eventStreamContentType = "text/event-stream"
+
+	// followPollInterval is how often a follow stream polls the store for
+	// lines appended through other processes and checks whether its test has
+	// ended. A keepalive comment is sent at the same interval so that proxies
+	// don't close idle streams.
+	followPollInterval = 5 * time.Second
+)
+
+// logBroker notifies the clients following a test in this process when lines
+// are appended to the test or to its build's global log by appendLog and
+// appendGlobalLog, so that they poll the store right away rather than waiting
+// for their next poll.
+type logBroker struct {
+	mu        sync.Mutex
+	followers map[string]map[*logFollower]struct{}
+}
+
+// logFollower is notified of appends to a test and to the global log of its
+// build. Notifications that arrive before the previous one is received are
+// coalesced. The appended channel is closed when the test ends.
+type logFollower struct {
+	testID   bson.ObjectId
+	appended chan struct{}
+}
+
+func newLogBroker() *logBroker {
+	return &logBroker{followers: map[string]map[*logFollower]struct{}{}}
+}
+
+// follow registers a follower for the test. The caller must call unfollow once
+// it's done reading.
+func (b *logBroker) follow(buildID string, testID bson.ObjectId) *logFollower {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	follower := &logFollower{testID: testID, appended: make(chan struct{}, 1)}
+	if b.followers[buildID] == nil {
+		b.followers[buildID] = map[*logFollower]struct{}{}
+	}
+	b.followers[buildID][follower] = struct{}{}
+
+	return follower
+}
+
+func (b *logBroker) unfollow(buildID string, follower *logFollower) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.removeLocked(buildID, follower)
+}
+
+func (b *logBroker) removeLocked(buildID string, follower *logFollower) {
+	followers, ok := b.followers[buildID]
+	if !ok {
+		return
+	}
+	if _, ok = followers[follower]; !ok {
+		return
+	}
+
+	delete(followers, follower)
+	close(follower.appended)
+	if len(followers) == 0 {
+		delete(b.followers, buildID)
+	}
+}
+
+// publish notifies the followers of the test, or the followers of every test
+// in the build if testID is nil, that lines were appended.
+func (b *logBroker) publish(buildID string, testID *bson.ObjectId) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for follower := range b.followers[buildID] {
+		if testID != nil && *testID != follower.testID {
+			continue
+		}
+		select {
+		case follower.appended <- struct{}{}:
+		default:
+			// The follower hasn't received the last notification yet, and
+			// it will poll for these lines along with those.
+		}
+	}
+}
+
+// endTest closes the streams of every follower of the test.
+func (b *logBroker) endTest(buildID string, testID bson.ObjectId) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for follower := range b.followers[buildID] {
+		if follower.testID == testID {
+			b.removeLocked(buildID, follower)
+		}
+	}
+}
+
+// followRequested returns true if the client asked to follow a test's log as
+// a stream of server-sent events.
+func followRequested(r *http.Request) bool {
+	return len(r.FormValue("follow")) > 0 || r.Header.Get("Accept") == eventStreamContentType
+}
+
+// testEnded returns true if the test has been marked as ended.
+func (lk *logKeeper) testEnded(r *http.Request, build *model.Build, testID string) bool {
+	test, err := lk.opts.Store.FindTestByID(r.Context(), build, testID)
+	if err != nil {
+		lk.logWarningf(r, "Error checking whether followed test ended: %v", err)
+		return false
+	}
+
+	return test != nil && test.Ended != nil
+}
+
+// connContextKey is the context key of the connection a request was read
+// from.
+type connContextKey struct{}
+
+// ConnContext stores the connection in the context of the requests read from
+// it, so that follow streams can lift the server's read and write timeouts,
+// which would otherwise end them. It's meant to be used as the ConnContext of
+// the http.Server serving the router.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// liftConnTimeouts clears the read and write deadlines of the connection the
+// request was read from, if it was stored by ConnContext. A follow stream
+// lasts as long as its test, which is longer than the server's timeouts
+// allow for any other request.
+func (lk *logKeeper) liftConnTimeouts(r *http.Request) {
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		lk.logWarningf(r, "Error clearing follow stream read deadline: %v", err)
+	}
+	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+		lk.logWarningf(r, "Error clearing follow stream write deadline: %v", err)
+	}
+}
+
+// writeEvent writes a single server-sent event and flushes it to the client.
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
+
+// followTestLogs follows the test's lines within the window with followTest.
+// A window with a tail is followed from the time of the tail's first line.
+func (lk *logKeeper) followTestLogs(w http.ResponseWriter, r *http.Request, follower *logFollower, status *model.StreamStatus, build *model.Build, test *model.Test, window logWindow) {
+	from := window.timeRange().StartAt
+	if window.tail > 0 {
+		tail, fetchError := lk.testLogs(r, build, test, window)
+		if fetchError != nil {
+			lk.render.WriteJSON(w, fetchError.code, *fetchError)
+			return
+		}
+		first := true
+		for line := range tail {
+			if first {
+				from = line.Timestamp
+				first = false
+			}
+		}
+	}
+
+	testID := test.Id.Hex()
+	fetch := func(cursor storage.LogCursor) (chan *model.LogLineItem, error) {
+		// Find the test again, since the global lines returned with its
+		// lines depend on whether it has ended.
+		test, err := lk.opts.Store.FindTestByID(r.Context(), build, testID)
+		if err != nil {
+			return nil, err
+		}
+		if test == nil {
+			return nil, errors.New("test not found")
+		}
+		return lk.opts.Store.GetTestLogLinesFrom(r.Context(), build, test, window.timeRange(), cursor)
+	}
+	lk.followTest(w, r, follower, status, from, fetch, func() bool {
+		return lk.testEnded(r, build, testID)
+	})
+}
+
+// followTest streams the test's lines from the given time on as "line" events,
+// followed by the lines appended to it. The lines are read by polling the
+// store with fetch every followPollInterval, since they may be appended
+// through another process, and as soon as the broker reports an append through
+// this one. Each poll resumes reading the test's log and the global log from
+// the time of the last line sent from each, so lines appended to one of them
+// with timestamps older than lines already sent from the other are still
+// sent. The stream ends with an "end" event once the test has ended. If
+// reading the lines fails, the stream ends with an "error" event instead.
+//
+// The lines aren't numbered, since appended lines can be merged in ahead of
+// lines that were already sent.
+func (lk *logKeeper) followTest(w http.ResponseWriter, r *http.Request, follower *logFollower, status *model.StreamStatus, from time.Time, fetch func(cursor storage.LogCursor) (chan *model.LogLineItem, error), ended func() bool) {
+	lk.liftConnTimeouts(r)
+	w.Header().Set("Content-Type", eventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	testCursor := &followCursor{at: from}
+	globalCursor := &followCursor{at: from}
+	fail := func(err error) {
+		lk.logErrorf(r, "Error streaming followed logs: %v", err)
+		if err = writeEvent(w, "error", streamErrorRecord{Err: err.Error()}); err != nil {
+			lk.logErrorf(r, "Error writing followed log error: %v", err)
+		}
+	}
+	poll := func() bool {
+		lines, err := fetch(storage.LogCursor{Test: testCursor.at, Global: globalCursor.at})
+		if err != nil {
+			fail(err)
+			return false
+		}
+		testCursor.read, globalCursor.read = 0, 0
+		for line := range lines {
+			cursor := testCursor
+			if line.Global() {
+				cursor = globalCursor
+			}
+			if !cursor.advance(line.Timestamp) {
+				continue
+			}
+			line.LineNum = model.UnknownLineNum
+			if err := writeEvent(w, "line", newLogLineRecord(line)); err != nil {
+				lk.logErrorf(r, "Error writing followed log line: %v", err)
+				return false
+			}
+		}
+		if err := status.Err(); err != nil {
+			fail(err)
+			return false
+		}
+		return true
+	}
+	// finish sends the lines that were appended before the test ended and
+	// closes the stream.
+	finish := func() {
+		if poll() {
+			lk.endFollow(w, r)
+		}
+	}
+
+	if ended() {
+		finish()
+		return
+	}
+	if !poll() {
+		return
+	}
+
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if ended() {
+				finish()
+				return
+			}
+			if !poll() {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		case _, ok := <-follower.appended:
+			if !ok {
+				finish()
+				return
+			}
+			if !poll() {
+				return
+			}
+		}
+	}
+}
+
+// followCursor is the position of a follow stream in one of the logs merged
+// into a test's lines: the time of the last line sent from the log, and the
+// number of lines at that time that were sent. A log's lines are expected to
+// be appended in chronological order, as the stores' time range reads already
+// expect, so every poll reads the lines at that time in the same order
+// followed by any lines appended since.
+type followCursor struct {
+	at   time.Time
+	sent int
+	// read is the number of lines at the cursor's time read by the current
+	// poll.
+	read int
+}
+
+// advance moves the cursor past a line read from the log and returns true if
+// the line hasn't been sent yet.
+func (c *followCursor) advance(timestamp time.Time) bool {
+	switch {
+	case timestamp.Before(c.at):
+		return false
+	case timestamp.Equal(c.at):
+		c.read++
+		if c.read <= c.sent {
+			return false
+		}
+		c.sent++
+		return true
+	default:
+		c.at = timestamp
+		c.sent, c.read = 1, 1
+		return true
+	}
+}
+
+func (lk *logKeeper) endFollow(w http.ResponseWriter, r *http.Request) {
+	if err := writeEvent(w, "end", struct{}{}); err != nil {
+		lk.logErrorf(r, "Error ending followed log: %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package logkeeper
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLogBroker(t *testing.T) {
+	t.Run("PublishTestAndGlobalLines", func(t *testing.T) {
+		broker := newLogBroker()
+		testID := bson.NewObjectId()
+		otherTestID := bson.NewObjectId()
+		follower := broker.follow("b0", testID)
+		defer broker.unfollow("b0", follower)
+
+		broker.publish("b0", &otherTestID)
+		broker.publish("b1", nil)
+		assert.Empty(t, follower.appended)
+
+		broker.publish("b0", &testID)
+		assert.Len(t, follower.appended, 1)
+		<-follower.appended
+		broker.publish("b0", nil)
+		assert.Len(t, follower.appended, 1)
+	})
+
+	t.Run("NotificationsAreCoalesced", func(t *testing.T) {
+		broker := newLogBroker()
+		testID := bson.NewObjectId()
+		follower := broker.follow("b0", testID)
+		defer broker.unfollow("b0", follower)
+
+		for i := 0; i < 3; i++ {
+			broker.publish("b0", &testID)
+		}
+		assert.Len(t, follower.appended, 1)
+		assert.Len(t, broker.followers["b0"], 1)
+	})
+
+	t.Run("EndTest", func(t *testing.T) {
+		broker := newLogBroker()
+		testID := bson.NewObjectId()
+		follower := broker.follow("b0", testID)
+		broker.endTest("b0", testID)
+
+		_, ok := <-follower.appended
+		assert.False(t, ok)
+		assert.Empty(t, broker.followers)
+		broker.unfollow("b0", follower)
+	})
+}
+
+// readEvents returns the events written to the recorder, with the data of line
+// events decoded.
+func readEvents(t *testing.T, w *httptest.ResponseRecorder) ([]logLineRecord, []string) {
+	var lines []logLineRecord
+	var others []string
+	for _, event := range strings.Split(strings.TrimSpace(w.Body.String()), "\n\n") {
+		if !strings.HasPrefix(event, "event: line\ndata: ") {
+			others = append(others, event)
+			continue
+		}
+		record := logLineRecord{}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(event, "event: line\ndata: ")), &record))
+		lines = append(lines, record)
+	}
+
+	return lines, others
+}
+
+func TestFollowTest(t *testing.T) {
+	lk := New(Options{})
+	testID := bson.NewObjectId()
+	follower := lk.broker.follow("b0", testID)
+	defer lk.broker.unfollow("b0", follower)
+
+	now := time.Now()
+	var mu sync.Mutex
+	stored := []*model.LogLineItem{{Timestamp: now, Data: "existing", TestId: &testID}}
+	appendLine := func(msg string, at time.Time, lineTestID *bson.ObjectId) {
+		mu.Lock()
+		defer mu.Unlock()
+		stored = append(stored, &model.LogLineItem{Timestamp: at, Data: msg, TestId: lineTestID})
+	}
+	// fetch merges the stored lines by timestamp, limited to those that
+	// aren't older than the cursor's time for their log, and reports each
+	// poll.
+	polls := make(chan storage.LogCursor, 10)
+	fetch := func(cursor storage.LogCursor) (chan *model.LogLineItem, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { polls <- cursor }()
+
+		var lines []*model.LogLineItem
+		for _, line := range stored {
+			from := cursor.Test
+			if line.Global() {
+				from = cursor.Global
+			}
+			if !line.Timestamp.Before(from) {
+				line := *line
+				lines = append(lines, &line)
+			}
+		}
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].Timestamp.Before(lines[j].Timestamp) })
+		linesChan := make(chan *model.LogLineItem, len(lines))
+		for _, line := range lines {
+			linesChan <- line
+		}
+		close(linesChan)
+		return linesChan, nil
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/build/b0/test/"+testID.Hex()+"?follow=1", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lk.followTest(w, r, follower, &model.StreamStatus{}, time.Time{}, fetch, func() bool { return false })
+	}()
+	<-polls
+
+	// The appended test line has the same timestamp as the existing one,
+	// and the global line is older than the test lines already sent.
+	appendLine("same time", now, &testID)
+	lk.broker.publish("b0", &testID)
+	assert.True(t, (<-polls).Test.Equal(now), "polls resume from the last test line")
+	appendLine("older global", now.Add(-time.Second), nil)
+	lk.broker.publish("b0", nil)
+	<-polls
+	appendLine("last", now.Add(time.Second), &testID)
+	lk.broker.endTest("b0", testID)
+	<-done
+
+	assert.Equal(t, eventStreamContentType, w.Header().Get("Content-Type"))
+	lines, others := readEvents(t, w)
+	require.Len(t, lines, 4)
+	for i, msg := range []string{"existing", "same time", "older global", "last"} {
+		assert.Equal(t, msg, lines[i].Msg)
+		assert.Nil(t, lines[i].LineNum)
+	}
+	assert.Equal(t, []string{"event: end\ndata: {}"}, others)
+}
+
+func TestFollowTestWithStreamError(t *testing.T) {
+	lk := New(Options{})
+	testID := bson.NewObjectId()
+	follower := lk.broker.follow("b0", testID)
+	defer lk.broker.unfollow("b0", follower)
+
+	ctx, status := model.WithStreamStatus(context.Background())
+	polled := false
+	fetch := func(storage.LogCursor) (chan *model.LogLineItem, error) {
+		if polled {
+			return nil, errors.New("polled after an error")
+		}
+		polled = true
+		lines := make(chan *model.LogLineItem, 1)
+		lines <- &model.LogLineItem{Timestamp: time.Now(), Data: "existing", TestId: &testID}
+		close(lines)
+		model.ReportStreamError(ctx, errors.New("corrupt data"))
+		return lines, nil
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/build/b0/test/"+testID.Hex()+"?follow=1", nil)
+	lk.followTest(w, r, follower, status, time.Time{}, fetch, func() bool { return false })
+
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	require.Len(t, events, 2)
+	assert.True(t, strings.HasPrefix(events[0], "event: line\n"))
+	assert.Equal(t, "event: error\ndata: {\"error\":\"corrupt data\"}", events[1])
+}
+
+func TestFollowTestWithPollError(t *testing.T) {
+	lk := New(Options{})
+	testID := bson.NewObjectId()
+	follower := lk.broker.follow("b0", testID)
+	defer lk.broker.unfollow("b0", follower)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/build/b0/test/"+testID.Hex()+"?follow=1", nil)
+	lk.followTest(w, r, follower, &model.StreamStatus{}, time.Time{}, func(storage.LogCursor) (chan *model.LogLineItem, error) {
+		return nil, errors.New("store unavailable")
+	}, func() bool { return true })
+
+	assert.Equal(t, "event: error\ndata: {\"error\":\"store unavailable\"}", strings.TrimSpace(w.Body.String()))
+}
+
+func TestFollowCursor(t *testing.T) {
+	now := time.Now()
+	cursor := &followCursor{}
+	for _, at := range []time.Time{now, now, now.Add(time.Second)} {
+		assert.True(t, cursor.advance(at))
+	}
+
+	// A later poll reads the lines from the last line's time again.
+	cursor.read = 0
+	assert.False(t, cursor.advance(now), "older lines are skipped")
+	assert.False(t, cursor.advance(now.Add(time.Second)))
+	assert.True(t, cursor.advance(now.Add(time.Second)), "lines appended at the same time are sent")
+	assert.Equal(t, 2, cursor.sent)
+}
+
+// createFollowedTest creates a build and a test through the router, appends
+// the given lines to the test, and returns the test's path.
+func createFollowedTest(t *testing.T, router http.Handler, lines [][]interface{}) string {
+	w := serveTestRequest(t, router, http.MethodPost, "/build", map[string]interface{}{"builder": "builder", "buildnum": 1})
+	require.Equal(t, http.StatusCreated, w.Code)
+	created := createdResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	buildID := created.Id
+	w = serveTestRequest(t, router, http.MethodPost, "/build/"+buildID+"/test", map[string]interface{}{"test_filename": "test"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	testPath := fmt.Sprintf("/build/%s/test/%s", buildID, created.Id)
+
+	w = serveTestRequest(t, router, http.MethodPost, testPath, lines)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	return testPath
+}
+
+func TestFollowTestWithMemoryStore(t *testing.T) {
+	router := New(Options{MaxRequestSize: 1024 * 1024, Store: storage.NewMemoryStore()}).NewRouter()
+	now := time.Now().Unix()
+	testPath := createFollowedTest(t, router, [][]interface{}{{now, "line 0"}, {now + 1, "line 1"}, {now + 2, "line 2"}})
+	w := serveTestRequest(t, router, http.MethodPost, testPath+"/end", map[string]interface{}{"status": statusPassed})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serveTestRequest(t, router, http.MethodGet, testPath+"?follow=1&tail=1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	lines, others := readEvents(t, w)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "line 2", lines[0].Msg)
+	assert.Equal(t, []string{"event: end\ndata: {}"}, others)
+
+	w = serveTestRequest(t, router, http.MethodGet, testPath+"?follow=1&from_line=1", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestFollowTestOutlastsServerTimeouts(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	router := New(Options{MaxRequestSize: 1024 * 1024, Store: storage.NewMemoryStore()}).NewRouter()
+	server := httptest.NewUnstartedServer(router)
+	server.Config.ReadTimeout = timeout
+	server.Config.WriteTimeout = timeout
+	server.Config.ConnContext = ConnContext
+	server.Start()
+	defer server.Close()
+
+	now := time.Now().Unix()
+	testPath := createFollowedTest(t, router, [][]interface{}{{now, "line 0"}})
+	resp, err := http.Get(server.URL + testPath + "?follow=1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	events := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var event []string
+		for {
+			line, err := events.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\n" {
+				return strings.Join(event, "")
+			}
+			event = append(event, line)
+		}
+	}
+	assert.Contains(t, readEvent(), "line 0")
+
+	time.Sleep(3 * timeout)
+	w := serveTestRequest(t, router, http.MethodPost, testPath, [][]interface{}{{now + 1, "line 1"}})
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, readEvent(), "line 1")
+
+	time.Sleep(3 * timeout)
+	w = serveTestRequest(t, router, http.MethodPost, testPath+"/end", map[string]interface{}{"status": statusPassed})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "event: end\ndata: {}\n", readEvent())
+}
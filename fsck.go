@@ -0,0 +1,43 @@
+package logkeeper
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// NewAdminRouter returns a router for the endpoints that are expensive or
+// modify stored data, which are only served to the local host, like the pprof
+// endpoints.
+func (lk *logKeeper) NewAdminRouter() *mux.Router {
+	r := mux.NewRouter().StrictSlash(false)
+	r.StrictSlash(true).Path("/build/{build_id}/fsck").Methods("GET", "POST").HandlerFunc(lk.checkBuildStorage)
+
+	return r
+}
+
+// checkBuildStorage walks the build's keys in the bucket and reports problems
+// with its chunks and metadata. A POST also repairs what it can, which is
+// described in the report.
+func (lk *logKeeper) checkBuildStorage(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if lk.opts.Bucket == nil {
+		lk.render.WriteJSON(w, http.StatusNotImplemented, apiError{Err: "checking build storage: no bucket is configured"})
+		return
+	}
+
+	repair := r.Method == http.MethodPost
+	report, err := lk.opts.Bucket.CheckBuild(r.Context(), mux.Vars(r)["build_id"], repair)
+	if err != nil {
+		lk.logErrorf(r, "Error checking build storage: %v", err)
+		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+		return
+	}
+	if report.Keys == 0 {
+		lk.render.WriteJSON(w, http.StatusNotFound, apiError{Err: "checking build storage: build not found in the bucket"})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, report)
+}
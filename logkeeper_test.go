@@ -13,6 +13,7 @@ import (
 	"github.com/evergreen-ci/logkeeper/db"
 	"github.com/evergreen-ci/logkeeper/env"
 	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/mongodb/grip"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/smartystreets/goconvey/convey/reporting"
@@ -42,7 +43,7 @@ func TestLogKeeper(t *testing.T) {
 	defer closer()
 
 	Convey("LogKeeper instance running on testdatabase", t, func() {
-		lk := New(Options{MaxRequestSize: 1024 * 1024 * 10})
+		lk := New(Options{MaxRequestSize: 1024 * 1024 * 10, Store: storage.NewMongoStore()})
 		router := lk.NewRouter()
 
 		Convey("Call POST /build creates a build with the given builder/buildnum", func() {
@@ -169,6 +170,157 @@ func TestLogKeeper(t *testing.T) {
 			So(test.Info.TaskID, ShouldEqual, "abc123")
 		})
 
+		Convey("Requesting JSON returns build and test metadata", func() {
+			r := newTestRequest(lk, "POST", "/build", map[string]interface{}{"builder": "myBuilder", "buildnum": 123})
+			data := checkEndpointResponse(router, r, http.StatusCreated)
+			buildId := data["id"].(string)
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test", map[string]interface{}{"test_filename": "myTestFileName", "command": "myCommand", "phase": "myPhase"})
+			data = checkEndpointResponse(router, r, http.StatusCreated)
+			testId := data["id"].(string)
+
+			r = newTestRequest(lk, "GET", "/build/"+buildId+"?format=json", nil)
+			data = checkEndpointResponse(router, r, http.StatusOK)
+			build := data["build"].(map[string]interface{})
+			So(build["id"], ShouldEqual, buildId)
+			So(build["builder"], ShouldEqual, "myBuilder")
+			tests := data["tests"].([]interface{})
+			So(len(tests), ShouldEqual, 1)
+			So(tests[0].(map[string]interface{})["id"], ShouldEqual, testId)
+
+			r = newTestRequest(lk, "GET", "/build/"+buildId+"/test/"+testId, nil)
+			r.Header.Set("Accept", "application/json")
+			data = checkEndpointResponse(router, r, http.StatusOK)
+			test := data["test"].(map[string]interface{})
+			So(test["id"], ShouldEqual, testId)
+			So(test["name"], ShouldEqual, "myTestFileName")
+			So(test["phase"], ShouldEqual, "myPhase")
+			So(test["seq"], ShouldEqual, 0)
+			So(test["failed"], ShouldEqual, false)
+			So(test["ended"], ShouldBeNil)
+
+			r = newTestRequest(lk, "GET", "/build/"+buildId+"/test/"+bson.NewObjectId().Hex()+"?format=json", nil)
+			checkEndpointResponse(router, r, http.StatusNotFound)
+		})
+
+		Convey("Requesting NDJSON streams structured log lines", func() {
+			r := newTestRequest(lk, "POST", "/build", map[string]interface{}{"builder": "myBuilder", "buildnum": 123})
+			data := checkEndpointResponse(router, r, http.StatusCreated)
+			buildId := data["id"].(string)
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test", map[string]interface{}{"test_filename": "myTestFileName", "command": "myCommand", "phase": "myPhase"})
+			data = checkEndpointResponse(router, r, http.StatusCreated)
+			testId := data["id"].(string)
+
+			now := time.Now().Unix()
+			r = newTestRequest(lk, "POST", "/build/"+buildId, [][]interface{}{{now + 1, "global"}})
+			checkEndpointResponse(router, r, http.StatusCreated)
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test/"+testId, [][]interface{}{{now, "test"}})
+			checkEndpointResponse(router, r, http.StatusCreated)
+
+			for _, path := range []string{"/build/" + buildId + "/all?format=ndjson", "/build/" + buildId + "/test/" + testId + "?format=ndjson"} {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, newTestRequest(lk, "GET", path, nil))
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Content-Type"), ShouldEqual, "application/x-ndjson")
+
+				records := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+				So(len(records), ShouldEqual, 2)
+
+				first := map[string]interface{}{}
+				So(json.Unmarshal([]byte(records[0]), &first), ShouldBeNil)
+				So(first["msg"], ShouldEqual, "test")
+				So(first["line"], ShouldEqual, 0)
+				So(first["test_id"], ShouldEqual, testId)
+				So(first["global"], ShouldBeFalse)
+				So(first["ts"], ShouldNotBeNil)
+
+				second := map[string]interface{}{}
+				So(json.Unmarshal([]byte(records[1]), &second), ShouldBeNil)
+				So(second["msg"], ShouldEqual, "global")
+				So(second["line"], ShouldEqual, 1)
+				So(second["test_id"], ShouldBeNil)
+				So(second["global"], ShouldBeTrue)
+			}
+		})
+
+		Convey("Ending a test records its status and end time", func() {
+			r := newTestRequest(lk, "POST", "/build", map[string]interface{}{"builder": "myBuilder", "buildnum": 123})
+			data := checkEndpointResponse(router, r, http.StatusCreated)
+			buildId := data["id"].(string)
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test", map[string]interface{}{"test_filename": "myTestFileName", "command": "myCommand", "phase": "myPhase"})
+			data = checkEndpointResponse(router, r, http.StatusCreated)
+			testId := data["id"].(string)
+
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test/"+testId+"/end", map[string]interface{}{"status": "bogus"})
+			checkEndpointResponse(router, r, http.StatusBadRequest)
+
+			ended := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test/"+testId+"/end", map[string]interface{}{"status": "failed", "ended": ended})
+			data = checkEndpointResponse(router, r, http.StatusOK)
+			So(data["test"].(map[string]interface{})["failed"], ShouldBeTrue)
+
+			test, err := model.FindTestByID(testId)
+			So(err, ShouldBeNil)
+			So(test.Failed, ShouldBeTrue)
+			So(test.Ended, ShouldNotBeNil)
+			So(test.Ended.Equal(ended), ShouldBeTrue)
+		})
+
+		Convey("Finishing a build rejects further writes", func() {
+			r := newTestRequest(lk, "POST", "/build", map[string]interface{}{"builder": "myBuilder", "buildnum": 123})
+			data := checkEndpointResponse(router, r, http.StatusCreated)
+			buildId := data["id"].(string)
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test", map[string]interface{}{"test_filename": "myTestFileName", "command": "myCommand", "phase": "myPhase"})
+			data = checkEndpointResponse(router, r, http.StatusCreated)
+			testId := data["id"].(string)
+
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/finish", map[string]interface{}{"status": "failed", "phases": []string{"myPhase"}})
+			data = checkEndpointResponse(router, r, http.StatusOK)
+			So(data["failed"], ShouldBeTrue)
+			So(data["ended"], ShouldNotBeNil)
+
+			build, err := model.FindBuildById(buildId)
+			So(err, ShouldBeNil)
+			So(build.Finished(), ShouldBeTrue)
+			So(build.Phases, ShouldResemble, []string{"myPhase"})
+
+			now := time.Now().Unix()
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/finish", map[string]interface{}{"status": "passed"})
+			checkEndpointResponse(router, r, http.StatusConflict)
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test", map[string]interface{}{"test_filename": "another"})
+			checkEndpointResponse(router, r, http.StatusConflict)
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/test/"+testId, [][]interface{}{{now, "line"}})
+			checkEndpointResponse(router, r, http.StatusConflict)
+			r = newTestRequest(lk, "POST", "/build/"+buildId, [][]interface{}{{now, "line"}})
+			checkEndpointResponse(router, r, http.StatusConflict)
+		})
+
+		Convey("Pinning a build holds it until it's unpinned", func() {
+			r := newTestRequest(lk, "POST", "/build", map[string]interface{}{"builder": "myBuilder", "buildnum": 123})
+			data := checkEndpointResponse(router, r, http.StatusCreated)
+			buildId := data["id"].(string)
+
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/pin", map[string]interface{}{"reason": "investigating", "expires": time.Now().Add(-time.Hour)})
+			checkEndpointResponse(router, r, http.StatusBadRequest)
+			r = newTestRequest(lk, "POST", "/build/nonexistent/pin", map[string]interface{}{"reason": "investigating"})
+			checkEndpointResponse(router, r, http.StatusNotFound)
+
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/pin", map[string]interface{}{"reason": "investigating"})
+			data = checkEndpointResponse(router, r, http.StatusOK)
+			So(data["hold"].(map[string]interface{})["reason"], ShouldEqual, "investigating")
+
+			build, err := model.FindBuildById(buildId)
+			So(err, ShouldBeNil)
+			So(build.Held(time.Now()), ShouldBeTrue)
+
+			r = newTestRequest(lk, "POST", "/build/"+buildId+"/unpin", nil)
+			data = checkEndpointResponse(router, r, http.StatusOK)
+			So(data["hold"], ShouldBeNil)
+
+			build, err = model.FindBuildById(buildId)
+			So(err, ShouldBeNil)
+			So(build.Held(time.Now()), ShouldBeFalse)
+		})
+
 		// Clear database
 		Reset(func() { resetDatabase(db) })
 	})
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/evergreen-ci/logkeeper"
 	"github.com/evergreen-ci/logkeeper/env"
+	"github.com/evergreen-ci/logkeeper/model"
 	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/evergreen-ci/logkeeper/units"
 	"github.com/mongodb/amboy/pool"
@@ -26,19 +28,60 @@ import (
 	"gopkg.in/mgo.v2"
 )
 
-const dbName = "buildlogs"
+const (
+	dbName = "buildlogs"
+
+	storageMongo  = "mongo"
+	storageMemory = "memory"
+
+	checkConsistencyCommand = "check-consistency"
+	fsckCommand             = "fsck"
+
+	// checkPageSize is the number of builds checked per query when checking
+	// every build in the bucket.
+	checkPageSize = 100
+)
 
 func main() {
 	defer recovery.LogStackTraceAndExit("logkeeper.main")
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case checkConsistencyCommand:
+			checkConsistency(os.Args[2:])
+			return
+		case fsckCommand:
+			fsck(os.Args[2:])
+			return
+		}
+	}
+
 	httpPort := flag.Int("port", 8080, "port to listen on for HTTP.")
 	dbHost := flag.String("dbhost", "localhost:27017", "host/port to connect to DB server. Comma separated.")
 	rsName := flag.String("rsName", "", "name of replica set that the DB instances belong to. "+
 		"Leave empty for stand-alone and mongos instances.")
-	localPath := flag.String("localPath", "_bucketdata", "local path to save data to")
+	newBucket := addBucketFlags(flag.CommandLine)
 	logPath := flag.String("logpath", "logkeeperapp.log", "path to log file")
 	maxRequestSize := flag.Int("maxRequestSize", 1024*1024*32,
 		"maximum size for a request in bytes, defaults to 32 MB (in bytes)")
+	taskStatusProvider := flag.String("taskStatusProvider", units.TaskStatusEvergreen,
+		"where cleanup jobs look up task statuses: 'evergreen', 'build', or 'webhook'")
+	taskStatusURL := flag.String("taskStatusURL", "", "URL of the Evergreen tasks API or the task status webhook")
+	taskStatusSuccess := flag.String("taskStatusSuccess", "", "status the task status webhook reports for successful tasks")
+	migrationInterval := flag.Duration("migrationInterval", 0,
+		"how often to queue builds for migration from the database to the bucket, disabled if zero")
+	migrationBatchSize := flag.Int("migrationBatchSize", 10, "number of builds to queue for migration per interval")
+	migrationMinAge := flag.Duration("migrationMinAge", time.Hour,
+		"how long ago builds must have finished before they're migrated. Unfinished builds aren't migrated")
+	compactionInterval := flag.Duration("compactionInterval", 0,
+		"how often to queue finished builds in the bucket to have their log chunks compacted, disabled if zero")
+	compactionBatchSize := flag.Int("compactionBatchSize", 10, "number of builds to queue for compaction per interval")
+	replayInterval := flag.Duration("replayInterval", time.Minute,
+		"how often to queue log appends that failed to reach the bucket to be replayed, disabled if zero")
+	replayBatchSize := flag.Int("replayBatchSize", 100, "number of pending bucket writes to queue for replay per interval")
+	retentionConfig := flag.String("retentionConfig", "", "path to a JSON file of per-builder retention policies")
+	storageType := flag.String("storage", storageMongo,
+		"where to store builds, tests, and logs: 'mongo', or 'memory' to run without a database for tests and local development")
 	flag.Parse()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -50,18 +93,6 @@ func main() {
 
 	grip.EmergencyFatal(grip.SetSender(sender))
 
-	dialInfo := mgo.DialInfo{
-		Addrs: strings.Split(*dbHost, ","),
-	}
-
-	if *rsName != "" {
-		dialInfo.ReplicaSetName = *rsName
-	}
-
-	session, err := mgo.DialWithInfo(&dialInfo)
-	grip.EmergencyFatal(err)
-	grip.EmergencyFatal(env.SetSession(session))
-
 	cleanupQueue := queue.NewLocalLimitedSize(logkeeper.AmboyWorkers, logkeeper.QueueSizeCap)
 	runner, err := pool.NewMovingAverageRateLimitedWorkers(logkeeper.AmboyWorkers, logkeeper.AmboyTargetNumJobs, logkeeper.AmboyInterval, cleanupQueue)
 	grip.EmergencyFatal(errors.Wrap(err, "problem constructing worker pool"))
@@ -69,17 +100,69 @@ func main() {
 	grip.EmergencyFatal(cleanupQueue.Start(ctx))
 	grip.EmergencyFatal(env.SetCleanupQueue(cleanupQueue))
 
-	grip.EmergencyFatal(units.StartCrons(ctx, cleanupQueue))
+	taskStatus, err := units.NewTaskStatusProvider(units.TaskStatusOptions{
+		Provider:      *taskStatusProvider,
+		URL:           *taskStatusURL,
+		User:          os.Getenv("EVG_API_USER"),
+		Key:           os.Getenv("EVG_API_KEY"),
+		Token:         os.Getenv("LOGKEEPER_TASK_STATUS_TOKEN"),
+		SuccessStatus: *taskStatusSuccess,
+	})
+	if err != nil && *taskStatusProvider == units.TaskStatusEvergreen {
+		// Evergreen is the default, so deployments without credentials can
+		// still serve logs; their cleanup jobs fail until it's configured.
+		grip.Warning(message.WrapError(err, "cleanup jobs cannot get task statuses"))
+	} else {
+		grip.EmergencyFatal(errors.Wrap(err, "configuring task status provider"))
+		grip.EmergencyFatal(units.SetTaskStatusProvider(taskStatus))
+	}
 
-	bucket, err := makeBucket(localPath)
-	grip.EmergencyFatal(errors.Wrap(err, "getting bucket"))
+	retention := model.DefaultRetentionPolicies()
+	if *retentionConfig != "" {
+		retention, err = model.LoadRetentionPolicies(*retentionConfig)
+		grip.EmergencyFatal(errors.Wrap(err, "loading retention policies"))
+	}
+	units.SetRetentionPolicies(retention)
+
+	var (
+		store  storage.LogStore
+		bucket *storage.Bucket
+	)
+	switch *storageType {
+	case storageMongo:
+		grip.EmergencyFatal(connectDB(*dbHost, *rsName))
+
+		dataBucket, err := newBucket()
+		grip.EmergencyFatal(errors.Wrap(err, "getting bucket"))
+		grip.EmergencyFatal(units.SetBucket(&dataBucket))
+		bucket = &dataBucket
+		store = storage.NewDualStore(storage.NewMongoStore(), storage.NewBucketStore(dataBucket), storage.NewMongoJournal())
+
+		// The cleanup, migration, compaction, and replay jobs work on the
+		// database, so they only run when it's used.
+		grip.EmergencyFatal(units.StartCrons(ctx, cleanupQueue, units.CronOptions{
+			MigrationInterval:   *migrationInterval,
+			MigrationBatchSize:  *migrationBatchSize,
+			MigrationMinAge:     *migrationMinAge,
+			CompactionInterval:  *compactionInterval,
+			CompactionBatchSize: *compactionBatchSize,
+			ReplayInterval:      *replayInterval,
+			ReplayBatchSize:     *replayBatchSize,
+		}))
+	case storageMemory:
+		grip.Warning("storing data in memory, so it will be lost when logkeeper exits")
+		store = storage.NewMemoryStore()
+	default:
+		grip.EmergencyFatal(errors.Errorf("unknown storage '%s'", *storageType))
+	}
 
 	lk := logkeeper.New(logkeeper.Options{
-		URL:            fmt.Sprintf("http://localhost:%v", *httpPort),
-		MaxRequestSize: *maxRequestSize,
-		Bucket:         bucket,
+		URL:               fmt.Sprintf("http://localhost:%v", *httpPort),
+		MaxRequestSize:    *maxRequestSize,
+		Store:             store,
+		Bucket:            bucket,
+		RetentionPolicies: &retention,
 	})
-	env.SetDBName(dbName)
 	go logkeeper.BackgroundLogging(ctx)
 
 	catcher := grip.NewCatcher()
@@ -106,9 +189,19 @@ func main() {
 		catcher.Add(listenServeAndHandleErrs(pprofService))
 	}()
 
+	adminRouter := lk.NewAdminRouter()
+	adminRouter.Use(logkeeper.NewLogger(ctx).Middleware)
+	adminService := getService("127.0.0.1:2286", adminRouter)
+	serviceWait.Add(1)
+	go func() {
+		defer recovery.LogStackTraceAndContinue("admin service")
+		defer serviceWait.Done()
+		catcher.Add(listenServeAndHandleErrs(adminService))
+	}()
+
 	gracefulWait := &sync.WaitGroup{}
 	gracefulWait.Add(1)
-	go gracefulShutdownForSIGTERM(ctx, []*http.Server{lkService, pprofService}, gracefulWait, catcher)
+	go gracefulShutdownForSIGTERM(ctx, []*http.Server{lkService, pprofService, adminService}, gracefulWait, catcher)
 
 	serviceWait.Wait()
 
@@ -118,6 +211,140 @@ func main() {
 	grip.EmergencyFatal(catcher.Resolve())
 }
 
+// connectDB connects to the database at the comma separated hosts, which
+// belong to the named replica set unless rsName is empty.
+func connectDB(dbHost, rsName string) error {
+	dialInfo := mgo.DialInfo{
+		Addrs: strings.Split(dbHost, ","),
+	}
+
+	if rsName != "" {
+		dialInfo.ReplicaSetName = rsName
+	}
+
+	session, err := mgo.DialWithInfo(&dialInfo)
+	if err != nil {
+		return errors.Wrap(err, "connecting to the database")
+	}
+	if err = env.SetSession(session); err != nil {
+		return err
+	}
+	env.SetDBName(dbName)
+
+	return nil
+}
+
+// checkConsistency compares the line counts of builds in the database and the
+// bucket. It checks the builds whose IDs are given as arguments after the
+// flags, or every build in the bucket if none are given, and writes a JSON
+// report per build to stdout. It exits with status 1 if any build's counts
+// differ.
+func checkConsistency(args []string) {
+	flags := flag.NewFlagSet(checkConsistencyCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] [build ID...]\n", os.Args[0], checkConsistencyCommand)
+		flags.PrintDefaults()
+	}
+	dbHost := flags.String("dbhost", "localhost:27017", "host/port to connect to DB server. Comma separated.")
+	rsName := flags.String("rsName", "", "name of replica set that the DB instances belong to. "+
+		"Leave empty for stand-alone and mongos instances.")
+	newBucket := addBucketFlags(flags)
+	grip.EmergencyFatal(flags.Parse(args))
+
+	grip.EmergencyFatal(connectDB(*dbHost, *rsName))
+	bucket, err := newBucket()
+	grip.EmergencyFatal(errors.Wrap(err, "getting bucket"))
+
+	ctx := context.Background()
+	encoder := json.NewEncoder(os.Stdout)
+	checked, inconsistent := 0, 0
+	check := func(buildID string) {
+		report, err := units.CheckBuildConsistency(ctx, &bucket, buildID)
+		grip.EmergencyFatal(err)
+		grip.EmergencyFatal(encoder.Encode(report))
+		checked++
+		if !report.Consistent() {
+			inconsistent++
+		}
+	}
+
+	forEachBucketBuild(flags.Args(), check)
+
+	fmt.Fprintf(os.Stderr, "checked %d builds, %d inconsistent\n", checked, inconsistent)
+	if inconsistent > 0 {
+		os.Exit(1)
+	}
+}
+
+// fsck checks builds' data in the bucket for invalid chunk keys, chunks whose
+// line counts don't match their keys, unparseable metadata, and tests without
+// metadata. It checks the builds whose IDs are given as arguments after the
+// flags, or every build in the bucket if none are given, and writes a JSON
+// report per build to stdout. With -repair it also moves chunks to keys that
+// match their contents and fixes manifests. It exits with status 1 if any
+// build has problems that weren't repaired.
+func fsck(args []string) {
+	flags := flag.NewFlagSet(fsckCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] [build ID...]\n", os.Args[0], fsckCommand)
+		flags.PrintDefaults()
+	}
+	dbHost := flags.String("dbhost", "localhost:27017", "host/port to connect to DB server, to find the builds to check if none are given. Comma separated.")
+	rsName := flags.String("rsName", "", "name of replica set that the DB instances belong to. "+
+		"Leave empty for stand-alone and mongos instances.")
+	newBucket := addBucketFlags(flags)
+	repair := flags.Bool("repair", false, "move chunks whose keys don't match their contents and fix manifests")
+	grip.EmergencyFatal(flags.Parse(args))
+
+	if flags.NArg() == 0 {
+		grip.EmergencyFatal(connectDB(*dbHost, *rsName))
+	}
+	bucket, err := newBucket()
+	grip.EmergencyFatal(errors.Wrap(err, "getting bucket"))
+
+	ctx := context.Background()
+	encoder := json.NewEncoder(os.Stdout)
+	checked, unclean := 0, 0
+	forEachBucketBuild(flags.Args(), func(buildID string) {
+		report, err := bucket.CheckBuild(ctx, buildID, *repair)
+		grip.EmergencyFatal(err)
+		grip.EmergencyFatal(encoder.Encode(report))
+		checked++
+		if !report.Clean() {
+			unclean++
+		}
+	})
+
+	fmt.Fprintf(os.Stderr, "checked %d builds, %d with problems\n", checked, unclean)
+	if unclean > 0 {
+		os.Exit(1)
+	}
+}
+
+// forEachBucketBuild calls check with each of the build IDs, or with the ID of
+// every build in the bucket if there are none, which requires the database.
+func forEachBucketBuild(buildIDs []string, check func(buildID string)) {
+	if len(buildIDs) > 0 {
+		for _, buildID := range buildIDs {
+			check(buildID)
+		}
+		return
+	}
+
+	lastID := ""
+	for {
+		builds, err := model.FindBucketBuilds(lastID, checkPageSize)
+		grip.EmergencyFatal(err)
+		for _, build := range builds {
+			check(build.Id)
+		}
+		if len(builds) < checkPageSize {
+			return
+		}
+		lastID = builds[len(builds)-1].Id
+	}
+}
+
 func listenServeAndHandleErrs(s *http.Server) error {
 	if s == nil {
 		return errors.New("no server defined")
@@ -143,6 +370,8 @@ func getService(addr string, n http.Handler) *http.Server {
 		ReadTimeout:       time.Minute,
 		ReadHeaderTimeout: 30 * time.Second,
 		WriteTimeout:      time.Minute,
+		// Follow streams lift the timeouts for their connections.
+		ConnContext: logkeeper.ConnContext,
 	}
 
 }
@@ -170,13 +399,39 @@ func gracefulShutdownForSIGTERM(ctx context.Context, servers []*http.Server, gra
 	wg.Wait()
 }
 
-func makeBucket(localPath *string) (storage.Bucket, error) {
+// addBucketFlags adds the flags that configure the bucket to the flag set. It
+// returns a function that makes the bucket they configure once they're parsed,
+// so that the commands that check the bucket open the same one as the server.
+func addBucketFlags(flags *flag.FlagSet) func() (storage.Bucket, error) {
+	localPath := flags.String("localPath", "_bucketdata", "local path to save data to, or empty to store it in S3")
+	chunkEncoding := flags.String("chunkEncoding", "",
+		"compression of new log chunks in the bucket: 'none', 'gzip', or 'zstd'. Defaults to 'gzip' for a local bucket and to 'none' for S3, "+
+			"which already compresses what it stores. Chunks are read with the encoding they were written with")
+
+	return func() (storage.Bucket, error) {
+		if *localPath == "" {
+			return makeBucket(nil, *chunkEncoding)
+		}
+		return makeBucket(localPath, *chunkEncoding)
+	}
+}
+
+// makeBucket returns the bucket that new chunks are written to with the named
+// encoding, or with the location's default encoding if the name is empty.
+func makeBucket(localPath *string, encodingName string) (storage.Bucket, error) {
+	opts := storage.BucketOpts{Location: storage.PailS3}
 	if localPath != nil {
-		return storage.NewBucket(storage.BucketOpts{
-			Location: storage.PailLocal,
-			Path:     *localPath,
-		})
+		opts.Location = storage.PailLocal
+		opts.Path = *localPath
+	}
+	opts.Encoding = storage.DefaultChunkEncoding(opts.Location)
+	if encodingName != "" {
+		encoding, err := storage.ParseChunkEncoding(encodingName)
+		if err != nil {
+			return storage.Bucket{}, err
+		}
+		opts.Encoding = encoding
 	}
 
-	return storage.NewBucket(storage.BucketOpts{Location: storage.PailS3})
+	return storage.NewBucket(opts)
 }
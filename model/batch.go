@@ -0,0 +1,73 @@
+package model
+
+import (
+	"regexp"
+
+	"github.com/evergreen-ci/logkeeper/db"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MaxRememberedBatches is the number of most recently applied batch IDs that
+// are remembered per build and test to recognize retried appends.
+const MaxRememberedBatches = 100
+
+var batchIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// ValidateBatchID returns an error if the batch ID that a client sent with an
+// append can't be used to identify the batch. An empty batch ID is valid and
+// means that the append isn't deduplicated.
+func ValidateBatchID(batchID string) error {
+	if batchID == "" || batchIDPattern.MatchString(batchID) {
+		return nil
+	}
+
+	return errors.New("batch ID must be at most 128 letters, digits, '.', '_', or '-'")
+}
+
+// incrementSequenceForBatch increments the sequence number of the document
+// with the given ID and records the batch ID in the same update, unless the
+// batch ID is already recorded. It returns false if the batch was already
+// applied, in which case result isn't updated, and mgo.ErrNotFound if there's
+// no document with the ID.
+func incrementSequenceForBatch(collection string, id interface{}, count int, batchID string, result interface{}) (bool, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	change := mgo.Change{
+		Update: bson.M{
+			"$inc":  bson.M{"seq": count},
+			"$push": bson.M{"batches": bson.M{"$each": []string{batchID}, "$slice": -MaxRememberedBatches}},
+		},
+		ReturnNew: true,
+	}
+	_, err := db.C(collection).Find(bson.M{"_id": id, "batches": bson.M{"$ne": batchID}}).Apply(change, result)
+	if err == nil {
+		return true, nil
+	}
+	if err != mgo.ErrNotFound {
+		return false, err
+	}
+
+	// Nothing matched either because the batch was already applied or
+	// because the document doesn't exist.
+	matching, err := db.C(collection).FindId(id).Count()
+	if err != nil {
+		return false, err
+	}
+	if matching == 0 {
+		return false, mgo.ErrNotFound
+	}
+
+	return false, nil
+}
+
+// forgetBatch removes the batch ID from the document with the given ID, so
+// that a batch that failed to be written can be retried.
+func forgetBatch(collection string, id interface{}, batchID string) error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	return db.C(collection).UpdateId(id, bson.M{"$pull": bson.M{"batches": batchID}})
+}
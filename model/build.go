@@ -15,7 +15,7 @@ import (
 )
 
 const (
-	// DeletePassedTestCutoff is the TTL for passed tests.
+	// DeletePassedTestCutoff is the default TTL for passed tests.
 	DeletePassedTestCutoff = 30 * (24 * time.Hour)
 	// BuildsCollection is the name of the builds collection in the database.
 	BuildsCollection = "builds"
@@ -23,16 +23,36 @@ const (
 
 // Build contains metadata about a build.
 type Build struct {
-	Id       string    `bson:"_id"`
-	Builder  string    `bson:"builder"`
-	BuildNum int       `bson:"buildnum"`
-	Started  time.Time `bson:"started"`
-	Name     string    `bson:"name"`
-	Info     BuildInfo `bson:"info"`
-	Failed   bool      `bson:"failed"`
-	Phases   []string  `bson:"phases"`
-	Seq      int       `bson:"seq"`
-	S3       bool      `bson:"s3,omitempty"`
+	Id       string     `bson:"_id" json:"id"`
+	Builder  string     `bson:"builder" json:"builder"`
+	BuildNum int        `bson:"buildnum" json:"buildnum"`
+	Started  time.Time  `bson:"started" json:"started"`
+	Ended    *time.Time `bson:"ended,omitempty" json:"ended"`
+	Name     string     `bson:"name" json:"name"`
+	Info     BuildInfo  `bson:"info" json:"info"`
+	Failed   bool       `bson:"failed" json:"failed"`
+	Phases   []string   `bson:"phases" json:"phases"`
+	Seq      int        `bson:"seq" json:"seq"`
+	S3       bool       `bson:"s3,omitempty" json:"s3"`
+	// Compacted is true once the build's log chunks in the bucket have been
+	// merged into larger ones and the chunks they replaced are removed.
+	Compacted bool `bson:"compacted,omitempty" json:"compacted"`
+	// ChunksMerged is when the build's log chunks were merged, if they
+	// were. The chunks they replaced are removed some time later.
+	ChunksMerged *time.Time `bson:"chunks_merged,omitempty" json:"chunks_merged,omitempty"`
+	Hold         *BuildHold `bson:"hold,omitempty" json:"hold,omitempty"`
+	// Batches holds the IDs of the most recently applied global log
+	// batches.
+	Batches []string `bson:"batches,omitempty" json:"-"`
+}
+
+// BuildHold keeps a build from being deleted by the retention policies, for
+// example while a failure is investigated.
+type BuildHold struct {
+	Reason  string    `bson:"reason" json:"reason"`
+	Created time.Time `bson:"created" json:"created"`
+	// Expires is when the hold lapses. The hold never lapses if it's nil.
+	Expires *time.Time `bson:"expires,omitempty" json:"expires,omitempty"`
 }
 
 // BuildInfo contains additional metadata about a build.
@@ -90,6 +110,189 @@ func UpdateFailedBuild(id string) error {
 	return errors.Wrapf(err, "problem setting failed state on build %v", id)
 }
 
+// Finish marks the build as finished at the given time with the given outcome.
+// The build's phases are only replaced if phases is not nil.
+func (b *Build) Finish(ended time.Time, failed bool, phases []string) error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	update := bson.M{"ended": ended, "failed": failed}
+	if phases != nil {
+		update["phases"] = phases
+	}
+	change := mgo.Change{Update: bson.M{"$set": update}, ReturnNew: true}
+	_, err := db.C(BuildsCollection).Find(bson.M{"_id": b.Id}).Apply(change, b)
+	return errors.Wrapf(err, "finishing build '%s'", b.Id)
+}
+
+// Finished returns true if the build has been marked as finished, after which
+// no more tests or logs may be added to it.
+func (b *Build) Finished() bool {
+	return b.Ended != nil
+}
+
+// Held returns true if the build has a hold that hasn't expired.
+func (b *Build) Held(now time.Time) bool {
+	if b.Hold == nil {
+		return false
+	}
+
+	return b.Hold.Expires == nil || now.Before(*b.Hold.Expires)
+}
+
+// Pin places a hold on the build, replacing any existing hold.
+func (b *Build) Pin(hold BuildHold) error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"hold": hold}}, ReturnNew: true}
+	_, err := db.C(BuildsCollection).Find(bson.M{"_id": b.Id}).Apply(change, b)
+	return errors.Wrapf(err, "pinning build '%s'", b.Id)
+}
+
+// Unpin removes the build's hold.
+func (b *Build) Unpin() error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	change := mgo.Change{Update: bson.M{"$unset": bson.M{"hold": 1}}, ReturnNew: true}
+	_, err := db.C(BuildsCollection).Find(bson.M{"_id": b.Id}).Apply(change, b)
+	return errors.Wrapf(err, "unpinning build '%s'", b.Id)
+}
+
+// SetS3 marks the build as stored in the bucket.
+func (b *Build) SetS3() error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	if err := db.C(BuildsCollection).UpdateId(b.Id, bson.M{"$set": bson.M{"s3": true}}); err != nil {
+		return errors.Wrapf(err, "setting S3 for build '%s'", b.Id)
+	}
+	b.S3 = true
+
+	return nil
+}
+
+// FindUnmigratedBuilds returns up to limit builds, in ID order after the given
+// ID, that are only stored in the database and finished before the given
+// time.
+func FindUnmigratedBuilds(finishedBefore time.Time, afterID string, limit int) ([]Build, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	query := bson.M{
+		"s3":    bson.M{"$ne": true},
+		"ended": bson.M{"$lte": finishedBefore},
+	}
+	if afterID != "" {
+		query["_id"] = bson.M{"$gt": afterID}
+	}
+
+	builds := []Build{}
+	if err := db.C(BuildsCollection).Find(query).Sort("_id").Limit(limit).All(&builds); err != nil {
+		return nil, errors.Wrap(err, "finding unmigrated builds")
+	}
+
+	return builds, nil
+}
+
+// SetCompacted records that the build's log chunks in the bucket have been
+// compacted.
+func (b *Build) SetCompacted() error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	if err := db.C(BuildsCollection).UpdateId(b.Id, bson.M{"$set": bson.M{"compacted": true}}); err != nil {
+		return errors.Wrapf(err, "setting compacted for build '%s'", b.Id)
+	}
+	b.Compacted = true
+
+	return nil
+}
+
+// SetChunksMerged records when the build's log chunks in the bucket were
+// merged.
+func (b *Build) SetChunksMerged(merged time.Time) error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	if err := db.C(BuildsCollection).UpdateId(b.Id, bson.M{"$set": bson.M{"chunks_merged": merged}}); err != nil {
+		return errors.Wrapf(err, "setting chunks merged time for build '%s'", b.Id)
+	}
+	b.ChunksMerged = &merged
+
+	return nil
+}
+
+// FindUncompactedBuilds returns up to limit builds, in ID order after the
+// given ID, that are stored in the bucket and finished but whose log chunks
+// haven't been merged.
+func FindUncompactedBuilds(afterID string, limit int) ([]Build, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	query := bson.M{
+		"s3":            true,
+		"ended":         bson.M{"$exists": true},
+		"compacted":     bson.M{"$ne": true},
+		"chunks_merged": bson.M{"$exists": false},
+	}
+	if afterID != "" {
+		query["_id"] = bson.M{"$gt": afterID}
+	}
+
+	builds := []Build{}
+	if err := db.C(BuildsCollection).Find(query).Sort("_id").Limit(limit).All(&builds); err != nil {
+		return nil, errors.Wrap(err, "finding uncompacted builds")
+	}
+
+	return builds, nil
+}
+
+// FindBuildsWithRetiredChunks returns up to limit builds, in ID order after
+// the given ID, whose log chunks were merged at or before mergedBefore but
+// that aren't compacted yet because the chunks they replaced haven't been
+// removed.
+func FindBuildsWithRetiredChunks(mergedBefore time.Time, afterID string, limit int) ([]Build, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	query := bson.M{
+		"s3":            true,
+		"compacted":     bson.M{"$ne": true},
+		"chunks_merged": bson.M{"$lte": mergedBefore},
+	}
+	if afterID != "" {
+		query["_id"] = bson.M{"$gt": afterID}
+	}
+
+	builds := []Build{}
+	if err := db.C(BuildsCollection).Find(query).Sort("_id").Limit(limit).All(&builds); err != nil {
+		return nil, errors.Wrap(err, "finding builds with retired chunks")
+	}
+
+	return builds, nil
+}
+
+// FindBucketBuilds returns up to limit builds, in ID order after the given ID,
+// that are stored in the bucket.
+func FindBucketBuilds(afterID string, limit int) ([]Build, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	query := bson.M{"s3": true}
+	if afterID != "" {
+		query["_id"] = bson.M{"$gt": afterID}
+	}
+
+	builds := []Build{}
+	if err := db.C(BuildsCollection).Find(query).Sort("_id").Limit(limit).All(&builds); err != nil {
+		return nil, errors.Wrap(err, "finding builds in the bucket")
+	}
+
+	return builds, nil
+}
+
 // IncrementSequence increments the build's sequence number by the given count.
 func (b *Build) IncrementSequence(count int) error {
 	db, closeSession := db.DB()
@@ -100,10 +303,24 @@ func (b *Build) IncrementSequence(count int) error {
 	return errors.Wrapf(err, "incrementing sequence number for build '%s'", b.Id)
 }
 
-// StreamingGetOldBuilds returns a channel containing builds that are ready to be deleted
-// and a channel for any errors encountered.
+// IncrementSequenceForBatch increments the build's sequence number by the
+// given count and records the batch ID, unless a global log batch with the
+// same ID was already applied, in which case it returns false.
+func (b *Build) IncrementSequenceForBatch(count int, batchID string) (bool, error) {
+	applied, err := incrementSequenceForBatch(BuildsCollection, b.Id, count, batchID, b)
+	return applied, errors.Wrapf(err, "incrementing sequence number for batch '%s' of build '%s'", batchID, b.Id)
+}
+
+// ForgetBatch removes the record of the global log batch, so that a batch
+// that failed to be written can be retried.
+func (b *Build) ForgetBatch(batchID string) error {
+	return errors.Wrapf(forgetBatch(BuildsCollection, b.Id, batchID), "forgetting batch '%s' of build '%s'", batchID, b.Id)
+}
+
+// StreamingGetOldBuilds returns a channel containing builds that the retention policies
+// allow to be deleted and a channel for any errors encountered.
 // The channels are closed when all the matching builds have been returned or we encounter an error.
-func StreamingGetOldBuilds(ctx context.Context) (<-chan Build, <-chan error) {
+func StreamingGetOldBuilds(ctx context.Context, policies RetentionPolicies) (<-chan Build, <-chan error) {
 	db, closeSession := db.DB()
 
 	errOut := make(chan error)
@@ -115,20 +332,22 @@ func StreamingGetOldBuilds(ctx context.Context) (<-chan Build, <-chan error) {
 		defer close(out)
 		defer recovery.LogStackTraceAndContinue("streaming query")
 
-		iter := db.C(BuildsCollection).Find(bson.M{
-			"started": bson.M{"$lte": time.Now().Add(-DeletePassedTestCutoff)},
-			"$or": []bson.M{
-				{"failed": bson.M{"$exists": false}},
-				{"failed": bson.M{"$eq": false}},
-			},
-			"$and": []bson.M{
-				{"info.task_id": bson.M{"$exists": true}},
-				{"info.task_id": bson.M{"$ne": ""}},
-			},
-		}).Iter()
+		now := time.Now()
+		query := policies.candidateQuery(now)
+		if query == nil {
+			return
+		}
+
+		iter := db.C(BuildsCollection).Find(query).Iter()
 		build := Build{}
 		for iter.Next(&build) {
-			out <- build
+			if policies.Expired(&build, now) {
+				select {
+				case out <- build:
+				case <-ctx.Done():
+					return
+				}
+			}
 			build = Build{}
 
 			if ctx.Err() != nil {
@@ -137,7 +356,10 @@ func StreamingGetOldBuilds(ctx context.Context) (<-chan Build, <-chan error) {
 		}
 
 		if err := iter.Err(); err != nil {
-			errOut <- err
+			select {
+			case errOut <- err:
+			case <-ctx.Done():
+			}
 			return
 		}
 	}()
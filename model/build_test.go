@@ -62,6 +62,161 @@ func TestUpdateFailedBuild(t *testing.T) {
 	assert.True(t, b.Failed)
 }
 
+func TestFinishBuild(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(BuildsCollection))
+
+	b0 := &Build{Id: "b0", Phases: []string{"p0"}}
+	require.NoError(t, b0.Insert())
+	assert.False(t, b0.Finished())
+
+	ended := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	require.NoError(t, b0.Finish(ended, true, nil))
+	assert.True(t, b0.Finished())
+	assert.True(t, b0.Failed)
+	assert.Equal(t, []string{"p0"}, b0.Phases)
+
+	b, err := FindBuildById(b0.Id)
+	require.NoError(t, err)
+	require.NotNil(t, b.Ended)
+	assert.True(t, ended.Equal(*b.Ended))
+	assert.True(t, b.Failed)
+
+	require.NoError(t, b0.Finish(ended, false, []string{"p1", "p2"}))
+	assert.False(t, b0.Failed)
+	assert.Equal(t, []string{"p1", "p2"}, b0.Phases)
+}
+
+func TestPinBuild(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(BuildsCollection))
+
+	b0 := &Build{Id: "b0"}
+	require.NoError(t, b0.Insert())
+	now := time.Now()
+	assert.False(t, b0.Held(now))
+
+	expires := now.Add(time.Hour).Round(time.Millisecond)
+	require.NoError(t, b0.Pin(BuildHold{Reason: "investigating", Created: now, Expires: &expires}))
+	require.NotNil(t, b0.Hold)
+	assert.Equal(t, "investigating", b0.Hold.Reason)
+	assert.True(t, b0.Held(now))
+	assert.False(t, b0.Held(expires))
+
+	b, err := FindBuildById(b0.Id)
+	require.NoError(t, err)
+	require.NotNil(t, b.Hold)
+	require.NotNil(t, b.Hold.Expires)
+	assert.True(t, expires.Equal(*b.Hold.Expires))
+
+	require.NoError(t, b0.Unpin())
+	assert.Nil(t, b0.Hold)
+	b, err = FindBuildById(b0.Id)
+	require.NoError(t, err)
+	assert.Nil(t, b.Hold)
+}
+
+func TestFindUnmigratedBuilds(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(BuildsCollection))
+
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour)
+	for _, build := range []Build{
+		{Id: "b0", Started: hourAgo, Ended: &hourAgo},
+		{Id: "b1", Started: hourAgo},
+		{Id: "b2", Started: hourAgo, Ended: &hourAgo},
+		{Id: "b3", Started: hourAgo, Ended: &hourAgo, S3: true},
+		{Id: "b4", Started: hourAgo, Ended: &hourAgo},
+		{Id: "b5", Started: hourAgo, Ended: &now},
+	} {
+		require.NoError(t, build.Insert())
+	}
+
+	builds, err := FindUnmigratedBuilds(now.Add(-time.Minute), "", 10)
+	require.NoError(t, err)
+	require.Len(t, builds, 3)
+	assert.Equal(t, "b0", builds[0].Id)
+	assert.Equal(t, "b2", builds[1].Id)
+	assert.Equal(t, "b4", builds[2].Id)
+
+	builds, err = FindUnmigratedBuilds(now.Add(-time.Minute), "b0", 1)
+	require.NoError(t, err)
+	require.Len(t, builds, 1)
+	assert.Equal(t, "b2", builds[0].Id)
+
+	require.NoError(t, builds[0].SetS3())
+	assert.True(t, builds[0].S3)
+	builds, err = FindUnmigratedBuilds(now.Add(-time.Minute), "", 10)
+	require.NoError(t, err)
+	assert.Len(t, builds, 2)
+}
+
+func TestFindUncompactedBuilds(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(BuildsCollection))
+
+	now := time.Now()
+	for _, build := range []Build{
+		{Id: "b0", Started: now, Ended: &now, S3: true},
+		{Id: "b1", Started: now, S3: true},
+		{Id: "b2", Started: now, Ended: &now},
+		{Id: "b3", Started: now, Ended: &now, S3: true, Compacted: true},
+		{Id: "b4", Started: now, Ended: &now, S3: true},
+	} {
+		require.NoError(t, build.Insert())
+	}
+
+	builds, err := FindUncompactedBuilds("", 10)
+	require.NoError(t, err)
+	require.Len(t, builds, 2)
+	assert.Equal(t, "b0", builds[0].Id)
+	assert.Equal(t, "b4", builds[1].Id)
+
+	builds, err = FindUncompactedBuilds("b0", 1)
+	require.NoError(t, err)
+	require.Len(t, builds, 1)
+	assert.Equal(t, "b4", builds[0].Id)
+
+	require.NoError(t, builds[0].SetCompacted())
+	assert.True(t, builds[0].Compacted)
+	builds, err = FindUncompactedBuilds("", 10)
+	require.NoError(t, err)
+	require.Len(t, builds, 1)
+
+	require.NoError(t, builds[0].SetChunksMerged(now))
+	require.NotNil(t, builds[0].ChunksMerged)
+	builds, err = FindUncompactedBuilds("", 10)
+	require.NoError(t, err)
+	assert.Empty(t, builds, "builds whose chunks were merged aren't merged again")
+}
+
+func TestFindBuildsWithRetiredChunks(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(BuildsCollection))
+
+	now := time.Now().Truncate(time.Millisecond)
+	earlier := now.Add(-time.Hour)
+	for _, build := range []Build{
+		{Id: "b0", Started: now, Ended: &now, S3: true, ChunksMerged: &earlier},
+		{Id: "b1", Started: now, Ended: &now, S3: true, ChunksMerged: &now},
+		{Id: "b2", Started: now, Ended: &now, S3: true},
+		{Id: "b3", Started: now, Ended: &now, S3: true, ChunksMerged: &earlier, Compacted: true},
+	} {
+		require.NoError(t, build.Insert())
+	}
+
+	builds, err := FindBuildsWithRetiredChunks(now.Add(-time.Minute), "", 10)
+	require.NoError(t, err)
+	require.Len(t, builds, 1)
+	assert.Equal(t, "b0", builds[0].Id)
+
+	builds, err = FindBuildsWithRetiredChunks(now, "b0", 10)
+	require.NoError(t, err)
+	require.Len(t, builds, 1)
+	assert.Equal(t, "b1", builds[0].Id)
+}
+
 func TestIncrementBuildSequence(t *testing.T) {
 	require.NoError(t, testutil.InitDB())
 	require.NoError(t, testutil.ClearCollections(BuildsCollection))
@@ -104,8 +259,15 @@ func TestStreamingGetOldBuilds(t *testing.T) {
 		Failed:  true,
 	}
 	require.NoError(t, failedBuild.Insert())
+	heldBuild := Build{
+		Id:      "held_build",
+		Started: time.Date(2009, time.November, 10, 0, 0, 0, 0, time.UTC),
+		Info:    BuildInfo{TaskID: "t0"},
+		Hold:    &BuildHold{Reason: "investigating"},
+	}
+	require.NoError(t, heldBuild.Insert())
 
-	buildsChan, errChan := StreamingGetOldBuilds(ctx)
+	buildsChan, errChan := StreamingGetOldBuilds(ctx, DefaultRetentionPolicies())
 	require.Never(t, func() bool {
 		select {
 		case <-errChan:
@@ -1,15 +1,18 @@
 package model
 
 import (
+	"context"
 	"encoding/json"
 	"math"
 	"reflect"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/evergreen-ci/logkeeper/db"
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/recovery"
 	"github.com/pkg/errors"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -45,6 +48,8 @@ type Log struct {
 	Seq     int            `bson:"seq"`
 	Started *time.Time     `bson:"started"`
 	Lines   []LogLine      `bson:"lines"`
+	// BatchId is the ID of the batch the log was appended with, if any.
+	BatchId string `bson:"batch_id,omitempty"`
 }
 
 // RemoveLogsForBuild removes all logs created by the specificed build.
@@ -60,10 +65,139 @@ func RemoveLogsForBuild(buildID string) (int, error) {
 	return info.Removed, nil
 }
 
-func findLogsInWindow(query bson.M, sort []string, minTime, maxTime *time.Time) chan *LogLineItem {
+// StreamingGetBuildLogs returns a channel containing the build's logs, ordered
+// by test and then by sequence number, and a channel for any errors
+// encountered. The channels are closed when all the logs have been returned or
+// an error is encountered.
+func StreamingGetBuildLogs(ctx context.Context, buildID string) (<-chan Log, <-chan error) {
+	db, closeSession := db.DB()
+
+	errOut := make(chan error)
+	out := make(chan Log)
+	go func() {
+		defer closeSession()
+		defer close(errOut)
+		defer close(out)
+		defer recovery.LogStackTraceAndContinue("streaming build logs")
+
+		iter := db.C(LogsCollection).Find(bson.M{"build_id": buildID}).Sort("test_id", "seq").Iter()
+		log := Log{}
+		for iter.Next(&log) {
+			select {
+			case out <- log:
+			case <-ctx.Done():
+				return
+			}
+			log = Log{}
+		}
+
+		if err := iter.Err(); err != nil {
+			select {
+			case errOut <- errors.Wrapf(err, "finding logs for build '%s'", buildID):
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return out, errOut
+}
+
+// FindLogsInSeqRange returns the build's global logs, if testID is nil, or the
+// test's logs with sequence numbers from first through last, in sequence
+// order.
+func FindLogsInSeqRange(buildID string, testID *bson.ObjectId, first, last int) ([]Log, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	query := bson.M{
+		"build_id": buildID,
+		"test_id":  testID,
+		"seq":      bson.M{"$gte": first, "$lte": last},
+	}
+	logs := []Log{}
+	if err := db.C(LogsCollection).Find(query).Sort("seq").All(&logs); err != nil {
+		return nil, errors.Wrapf(err, "finding logs %d through %d for build '%s'", first, last, buildID)
+	}
+
+	return logs, nil
+}
+
+// FindLogsForBatch returns the logs that were appended to the build's global
+// logs, if testID is nil, or to the test's logs with the batch ID, in sequence
+// order.
+func FindLogsForBatch(buildID string, testID *bson.ObjectId, batchID string) ([]Log, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	query := bson.M{
+		"build_id": buildID,
+		"test_id":  testID,
+		"batch_id": batchID,
+	}
+	logs := []Log{}
+	if err := db.C(LogsCollection).Find(query).Sort("seq").All(&logs); err != nil {
+		return nil, errors.Wrapf(err, "finding logs of batch '%s' for build '%s'", batchID, buildID)
+	}
+
+	return logs, nil
+}
+
+// CountLogLines returns the number of lines in the build's logs keyed by test
+// ID, with the build's global logs keyed by the empty string.
+func CountLogLines(buildID string) (map[string]int, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"build_id": buildID}},
+		{"$group": bson.M{"_id": "$test_id", "lines": bson.M{"$sum": bson.M{"$size": "$lines"}}}},
+	}
+	results := []struct {
+		TestId *bson.ObjectId `bson:"_id"`
+		Lines  int            `bson:"lines"`
+	}{}
+	if err := db.C(LogsCollection).Pipe(pipeline).All(&results); err != nil {
+		return nil, errors.Wrapf(err, "counting lines for build '%s'", buildID)
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		testID := ""
+		if result.TestId != nil {
+			testID = result.TestId.Hex()
+		}
+		counts[testID] = result.Lines
+	}
+
+	return counts, nil
+}
+
+func findLogsInWindow(ctx context.Context, query bson.M, sort []string, minTime, maxTime *time.Time) chan *LogLineItem {
+	return findLogs(ctx, query, sort, minTime, maxTime, false)
+}
+
+// findLogs returns a channel with the lines of the logs matching the query
+// that fall between minTime and maxTime. If reverse is true, both the logs and
+// their lines are returned in the opposite of the given sort order. The
+// channel is closed and the cursor released once the context is done, and an
+// error that stops the query early is reported to the context's stream status.
+func findLogs(ctx context.Context, query bson.M, sort []string, minTime, maxTime *time.Time, reverse bool) chan *LogLineItem {
 	outputLog := make(chan *LogLineItem)
 	logItem := &Log{}
 
+	if maxTime != nil {
+		// Logs that started after the window can't contain any lines in it.
+		// Older logs may not have a start time, so those are always included.
+		query["$or"] = []bson.M{
+			{"started": bson.M{"$lte": *maxTime}},
+			{"started": nil},
+		}
+	}
+
+	if reverse {
+		sort = reverseSort(sort)
+	}
+
 	go func() {
 		db, closeSession := db.DB()
 		defer closeSession()
@@ -71,20 +205,33 @@ func findLogsInWindow(query bson.M, sort []string, minTime, maxTime *time.Time)
 		defer close(outputLog)
 		lineNum := 0
 		log := db.C("logs").Find(query).Sort(sort...).Iter()
+		defer func() {
+			if err := log.Close(); err != nil && ctx.Err() == nil {
+				grip.Error(message.WrapError(err, "iterating over logs"))
+				ReportStreamError(ctx, errors.Wrap(err, "iterating over logs"))
+			}
+		}()
 		for log.Next(logItem) {
-			for _, line := range logItem.Lines {
+			for i := range logItem.Lines {
+				line := logItem.Lines[i]
+				if reverse {
+					line = logItem.Lines[len(logItem.Lines)-1-i]
+				}
 				if minTime != nil && line.Time.Before(*minTime) {
 					continue
 				}
 				if maxTime != nil && line.Time.After(*maxTime) {
 					continue
 				}
-				outputLog <- &LogLineItem{
+				item := &LogLineItem{
 					LineNum:   lineNum,
 					Timestamp: line.Time,
 					Data:      line.Msg,
 					TestId:    logItem.TestId,
 				}
+				if !sendLine(ctx, outputLog, item) {
+					return
+				}
 				lineNum++
 			}
 		}
@@ -92,63 +239,149 @@ func findLogsInWindow(query bson.M, sort []string, minTime, maxTime *time.Time)
 	return outputLog
 }
 
-// AllLogs returns a channel with all build and test logs for the build merged together by timestamp.
-func AllLogs(buildID string) (chan *LogLineItem, error) {
-	globalLogs := findLogsInWindow(bson.M{"build_id": buildID, "test_id": nil}, []string{"seq"}, nil, nil)
-	testLogs := findLogsInWindow(bson.M{"build_id": buildID, "test_id": bson.M{"$ne": nil}}, []string{"build_id", "started"}, nil, nil)
-	return MergeLogChannels(testLogs, globalLogs), nil
+// reverseSort returns the sort fields with their directions flipped.
+func reverseSort(sort []string) []string {
+	reversed := make([]string, 0, len(sort))
+	for _, field := range sort {
+		if strings.HasPrefix(field, "-") {
+			reversed = append(reversed, strings.TrimPrefix(field, "-"))
+		} else {
+			reversed = append(reversed, "-"+field)
+		}
+	}
+
+	return reversed
 }
 
-// MergedTetsLogs returns a channel with the test's logs merged with the concurrent global logs.
-func MergedTestLogs(test *Test) (chan *LogLineItem, error) {
-	globalLogs, err := findGlobalLogsDuringTest(test)
+// findSeqBefore returns the sequence number of the last log matching the query
+// that started before the given time, or nil if there is no such log. Since a
+// log's lines can extend past its start time, this is the first log that may
+// contain lines at or after the given time.
+func findSeqBefore(query bson.M, before time.Time) (*int, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	seqQuery := bson.M{"started": bson.M{"$lt": before}}
+	for key, value := range query {
+		seqQuery[key] = value
+	}
+
+	log := &Log{}
+	err := db.C("logs").Find(seqQuery).Sort("-seq").Limit(1).One(log)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "finding global logs during test")
+		return nil, err
 	}
-	testLogs := findLogsInWindow(bson.M{"build_id": test.BuildId, "test_id": test.Id}, []string{"seq"}, nil, nil)
 
-	return MergeLogChannels(testLogs, globalLogs), nil
+	return &log.Seq, nil
 }
 
-func findGlobalLogsDuringTest(test *Test) (chan *LogLineItem, error) {
-	db, closeSession := db.DB()
-	defer closeSession()
+// AllLogs returns a channel with all build and test logs for the build merged
+// together by timestamp. The lines are limited to those between minTime and
+// maxTime; a nil bound leaves that side of the window open.
+func AllLogs(ctx context.Context, buildID string, minTime, maxTime *time.Time) (chan *LogLineItem, error) {
+	return allLogs(ctx, buildID, minTime, maxTime, false)
+}
+
+// AllLogsReverse is the same as AllLogs, except that the lines are returned
+// newest first.
+func AllLogsReverse(ctx context.Context, buildID string, minTime, maxTime *time.Time) (chan *LogLineItem, error) {
+	return allLogs(ctx, buildID, minTime, maxTime, true)
+}
+
+func allLogs(ctx context.Context, buildID string, minTime, maxTime *time.Time, reverse bool) (chan *LogLineItem, error) {
+	globalQuery := bson.M{"build_id": buildID, "test_id": nil}
+	if minTime != nil {
+		firstSeq, err := findSeqBefore(globalQuery, *minTime)
+		if err != nil {
+			return nil, errors.Wrap(err, "finding first global log in window")
+		}
+		if firstSeq != nil {
+			globalQuery["seq"] = bson.M{"$gte": *firstSeq}
+		}
+	}
+
+	globalLogs := findLogs(ctx, globalQuery, []string{"seq"}, minTime, maxTime, reverse)
+	testLogs := findLogs(ctx, bson.M{"build_id": buildID, "test_id": bson.M{"$ne": nil}}, []string{"build_id", "started"}, minTime, maxTime, reverse)
+	return mergeLogChannels(ctx, testLogs, globalLogs, reverse), nil
+}
+
+// MergedTestLogs returns a channel with the test's logs merged with the
+// concurrent global logs. The lines are limited to those between minTime and
+// maxTime; a nil bound leaves that side of the window open.
+func MergedTestLogs(ctx context.Context, test *Test, minTime, maxTime *time.Time) (chan *LogLineItem, error) {
+	return mergedTestLogs(ctx, test, minTime, minTime, maxTime, false)
+}
+
+// MergedTestLogsReverse is the same as MergedTestLogs, except that the lines
+// are returned newest first.
+func MergedTestLogsReverse(ctx context.Context, test *Test, minTime, maxTime *time.Time) (chan *LogLineItem, error) {
+	return mergedTestLogs(ctx, test, minTime, minTime, maxTime, true)
+}
+
+// MergedTestLogsFrom is the same as MergedTestLogs, except that the test's
+// lines are limited to those not before testMinTime and the global lines to
+// those not before globalMinTime, so that each log can be read from where an
+// earlier read of it left off.
+func MergedTestLogsFrom(ctx context.Context, test *Test, testMinTime, globalMinTime, maxTime *time.Time) (chan *LogLineItem, error) {
+	return mergedTestLogs(ctx, test, testMinTime, globalMinTime, maxTime, false)
+}
+
+func mergedTestLogs(ctx context.Context, test *Test, testMinTime, globalMinTime, maxTime *time.Time, reverse bool) (chan *LogLineItem, error) {
+	globalLogs, err := findGlobalLogsDuringTest(ctx, test, globalMinTime, maxTime, reverse)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding global logs during test")
+	}
+
+	testQuery := bson.M{"build_id": test.BuildId, "test_id": test.Id}
+	if testMinTime != nil {
+		firstSeq, err := findSeqBefore(testQuery, *testMinTime)
+		if err != nil {
+			return nil, errors.Wrap(err, "finding first test log in window")
+		}
+		if firstSeq != nil {
+			testQuery["seq"] = bson.M{"$gte": *firstSeq}
+		}
+	}
+	testLogs := findLogs(ctx, testQuery, []string{"seq"}, testMinTime, maxTime, reverse)
 
-	var globalSeqFirst, globalSeqLast *int
+	return mergeLogChannels(ctx, testLogs, globalLogs, reverse), nil
+}
 
-	minTime, maxTime, err := test.GetExecutionWindow()
+// findGlobalLogsDuringTest returns the global logs that were written during the
+// test's execution window, further limited to those between minTime and
+// maxTime if they're not nil.
+func findGlobalLogsDuringTest(ctx context.Context, test *Test, minTime, maxTime *time.Time, reverse bool) (chan *LogLineItem, error) {
+	testMinTime, testMaxTime, err := test.GetExecutionWindow()
 	if err != nil {
 		return nil, errors.Wrap(err, "getting execution window")
 	}
+	if minTime == nil || minTime.Before(testMinTime) {
+		minTime = &testMinTime
+	}
+	if maxTime == nil || (testMaxTime != nil && testMaxTime.Before(*maxTime)) {
+		maxTime = testMaxTime
+	}
+
+	globalQuery := bson.M{"build_id": test.BuildId, "test_id": nil}
 
 	// Find the first global log entry before this test started.
 	// This may not actually contain any global log lines during the test run, if the entry returned
 	// by this query comes from after the *next* test stared.
-	firstGlobalLog := &Log{}
-	err = db.C("logs").Find(bson.M{"build_id": test.BuildId, "test_id": nil, "started": bson.M{"$lt": minTime}}).Sort("-seq").Limit(1).One(firstGlobalLog)
+	globalSeqFirst, err := findSeqBefore(globalQuery, *minTime)
 	if err != nil {
-		if err != mgo.ErrNotFound {
-			return nil, err
-		}
-		// There are no global entries after this test started.
-		globalSeqFirst = nil
-	} else {
-		globalSeqFirst = &firstGlobalLog.Seq
+		return nil, err
 	}
 
-	lastGlobalLog := &Log{}
-
+	var globalSeqLast *int
 	if maxTime != nil {
 		// Find the last global log entry that covers this test. This may return a global log entry
 		// that started before the test itself.
-		err = db.C("logs").Find(bson.M{"build_id": test.BuildId, "test_id": nil, "started": bson.M{"$lt": maxTime}}).Sort("-seq").Limit(1).One(lastGlobalLog)
+		globalSeqLast, err = findSeqBefore(globalQuery, *maxTime)
 		if err != nil {
-			if err != mgo.ErrNotFound {
-				return nil, err
-			}
-			globalSeqLast = nil
-		} else {
-			globalSeqLast = &lastGlobalLog.Seq
+			return nil, err
 		}
 	}
 
@@ -163,7 +396,8 @@ func findGlobalLogsDuringTest(test *Test) (chan *LogLineItem, error) {
 		globalLogsSeq["$lte"] = *globalSeqLast
 	}
 
-	return findLogsInWindow(bson.M{"build_id": test.BuildId, "test_id": nil, "seq": globalLogsSeq}, []string{"seq"}, &minTime, maxTime), nil
+	globalQuery["seq"] = globalLogsSeq
+	return findLogs(ctx, globalQuery, []string{"seq"}, minTime, maxTime, reverse), nil
 }
 
 // LogLine is a single line and its timestamp.
@@ -206,6 +440,12 @@ func GroupLines(lines []LogLine, maxSize int) ([]LogChunk, error) {
 
 // InsertLogChunks inserts log chunks as Logs in the logs collection.
 func InsertLogChunks(buildID string, testID *bson.ObjectId, lastSequence int, chunks []LogChunk) error {
+	return InsertLogBatch(buildID, testID, "", lastSequence, chunks)
+}
+
+// InsertLogBatch inserts log chunks as Logs in the logs collection and records
+// the batch ID they were appended with on each of them.
+func InsertLogBatch(buildID string, testID *bson.ObjectId, batchID string, lastSequence int, chunks []LogChunk) error {
 	for i, chunk := range chunks {
 		if len(chunk) == 0 {
 			continue
@@ -217,6 +457,7 @@ func InsertLogChunks(buildID string, testID *bson.ObjectId, lastSequence int, ch
 			Seq:     lastSequence - len(chunks) + i + 1,
 			Lines:   chunk,
 			Started: &chunk[0].Time,
+			BatchId: batchID,
 		}
 
 		if err := logEntry.Insert(); err != nil {
@@ -300,6 +541,11 @@ func (ll *LogLine) SetBSON(raw bson.Raw) error {
 	return nil
 }
 
+// UnknownLineNum is the line number of a line whose position in the whole log
+// isn't known, such as a line read from a window that starts after the log
+// does.
+const UnknownLineNum = -1
+
 // LogLineItem represents a single line in a log.
 type LogLineItem struct {
 	LineNum   int
@@ -308,6 +554,12 @@ type LogLineItem struct {
 	TestId    *bson.ObjectId
 }
 
+// Numbered returns true if the line is numbered by its position in the whole
+// log.
+func (lli LogLineItem) Numbered() bool {
+	return lli.LineNum != UnknownLineNum
+}
+
 // Global returns true if this log line comes from a global log, otherwise false (from a test log).
 func (lli LogLineItem) Global() bool {
 	return lli.TestId == nil
@@ -339,31 +591,214 @@ func (item *LogLineItem) OlderThanThreshold(previousItem interface{}) bool {
 }
 
 // MergeLogChannels takes two channels of LogLineItem and returns a single channel that feeds
-// the result of merging the two input channels sorted by timestamp.
-func MergeLogChannels(logger1 chan *LogLineItem, logger2 chan *LogLineItem) chan *LogLineItem {
+// the result of merging the two input channels sorted by timestamp. The output
+// channel is closed early once the context is done.
+func MergeLogChannels(ctx context.Context, logger1 chan *LogLineItem, logger2 chan *LogLineItem) chan *LogLineItem {
+	return mergeLogChannels(ctx, logger1, logger2, false)
+}
+
+// mergeLogChannels merges the two channels by timestamp. If reverse is true the
+// input channels are expected to be newest first, and so is the output.
+func mergeLogChannels(ctx context.Context, logger1 chan *LogLineItem, logger2 chan *LogLineItem, reverse bool) chan *LogLineItem {
 	outputChan := make(chan *LogLineItem)
 	go func() {
-		next1, ok1 := <-logger1
-		next2, ok2 := <-logger2
+		defer close(outputChan)
+
+		next1, ok1 := receiveLine(ctx, logger1)
+		next2, ok2 := receiveLine(ctx, logger2)
 		for {
 			if !ok1 && !ok2 { // both channels are empty - so stop.
-				close(outputChan)
 				return
 			}
 			if !ok2 { // only channel 1 had a value, so send that to output
-				outputChan <- next1
-				next1, ok1 = <-logger1 // get the next item from chan 1
+				if !sendLine(ctx, outputChan, next1) {
+					return
+				}
+				next1, ok1 = receiveLine(ctx, logger1) // get the next item from chan 1
 			} else if !ok1 { // only channel 2 had a value, so send that to output
-				outputChan <- next2
-				next2, ok2 = <-logger2 // get the next item from chan 2
+				if !sendLine(ctx, outputChan, next2) {
+					return
+				}
+				next2, ok2 = receiveLine(ctx, logger2) // get the next item from chan 2
 			} else {
-				if next1.Timestamp.Before(next2.Timestamp) {
-					outputChan <- next1
-					next1, ok1 = <-logger1
+				first := next1.Timestamp.Before(next2.Timestamp)
+				if reverse {
+					first = next1.Timestamp.After(next2.Timestamp)
+				}
+				if first {
+					if !sendLine(ctx, outputChan, next1) {
+						return
+					}
+					next1, ok1 = receiveLine(ctx, logger1)
 				} else {
-					outputChan <- next2
-					next2, ok2 = <-logger2
+					if !sendLine(ctx, outputChan, next2) {
+						return
+					}
+					next2, ok2 = receiveLine(ctx, logger2)
+				}
+			}
+		}
+	}()
+	return outputChan
+}
+
+// sendLine sends the line on the channel and returns true, or returns false
+// if the context is done first.
+func sendLine(ctx context.Context, lines chan<- *LogLineItem, line *LogLineItem) bool {
+	select {
+	case lines <- line:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// receiveLine receives a line from the channel. Like a receive, it returns
+// false if the channel is closed, and it also returns false if the context is
+// done first.
+func receiveLine(ctx context.Context, lines <-chan *LogLineItem) (*LogLineItem, bool) {
+	select {
+	case line, ok := <-lines:
+		return line, ok
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// TailLines reads up to n lines from a channel of lines ordered newest first
+// and returns a channel with those lines in chronological order. It stops
+// reading early if the context is done. The lines after the first n aren't
+// read, so the caller should cancel the context the channel was produced with
+// once TailLines returns.
+func TailLines(ctx context.Context, reversed chan *LogLineItem, n int) chan *LogLineItem {
+	lines := make([]*LogLineItem, 0, n)
+	for len(lines) < n {
+		item, ok := receiveLine(ctx, reversed)
+		if !ok {
+			break
+		}
+		lines = append(lines, item)
+	}
+
+	outputChan := make(chan *LogLineItem, len(lines))
+	for i := len(lines) - 1; i >= 0; i-- {
+		outputChan <- lines[i]
+	}
+	close(outputChan)
+
+	return outputChan
+}
+
+// UnnumberLines returns a channel with the lines with their line numbers set
+// to UnknownLineNum, for lines whose position in the whole log isn't known.
+// The output channel is closed early once the context is done.
+func UnnumberLines(ctx context.Context, logs chan *LogLineItem) chan *LogLineItem {
+	outputChan := make(chan *LogLineItem)
+	go func() {
+		defer close(outputChan)
+
+		for {
+			item, ok := receiveLine(ctx, logs)
+			if !ok {
+				return
+			}
+			item.LineNum = UnknownLineNum
+			if !sendLine(ctx, outputChan, item) {
+				return
+			}
+		}
+	}()
+	return outputChan
+}
+
+// SelectLineRange numbers the lines of a merged log in the order they're
+// received and returns a channel with only the lines numbered from first to
+// last, inclusive. A negative last leaves the range open-ended. The output
+// channel is closed early once the context is done.
+func SelectLineRange(ctx context.Context, logs chan *LogLineItem, first, last int) chan *LogLineItem {
+	outputChan := make(chan *LogLineItem)
+	go func() {
+		defer close(outputChan)
+
+		lineNum := 0
+		for {
+			item, ok := receiveLine(ctx, logs)
+			if !ok {
+				return
+			}
+			if last >= 0 && lineNum > last {
+				return
+			}
+			if lineNum >= first {
+				item.LineNum = lineNum
+				if !sendLine(ctx, outputChan, item) {
+					return
+				}
+			}
+			lineNum++
+		}
+	}()
+	return outputChan
+}
+
+// SearchResult is a line returned by SearchLines. Match is false for the lines
+// of context around a matching line.
+type SearchResult struct {
+	*LogLineItem
+	Match bool
+}
+
+// SearchLines returns a channel with the lines for which matches returns true,
+// each surrounded by up to contextLines lines before and after it. Lines are
+// sent at most once even when the context of two matches overlaps. The output
+// channel is closed early once the context is done.
+func SearchLines(ctx context.Context, logs chan *LogLineItem, matches func(string) bool, contextLines int) chan SearchResult {
+	outputChan := make(chan SearchResult)
+	go func() {
+		defer close(outputChan)
+
+		send := func(result SearchResult) bool {
+			select {
+			case outputChan <- result:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		before := make([]*LogLineItem, 0, contextLines)
+		afterRemaining := 0
+		for {
+			item, ok := receiveLine(ctx, logs)
+			if !ok {
+				return
+			}
+			if matches(item.Data) {
+				for _, contextItem := range before {
+					if !send(SearchResult{LogLineItem: contextItem}) {
+						return
+					}
+				}
+				before = before[:0]
+				if !send(SearchResult{LogLineItem: item, Match: true}) {
+					return
+				}
+				afterRemaining = contextLines
+				continue
+			}
+
+			if afterRemaining > 0 {
+				if !send(SearchResult{LogLineItem: item}) {
+					return
+				}
+				afterRemaining--
+				continue
+			}
+
+			if contextLines > 0 {
+				if len(before) == contextLines {
+					before = append(before[:0], before[1:]...)
 				}
+				before = append(before, item)
 			}
 		}
 	}()
@@ -1,7 +1,10 @@
 package model
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -32,6 +35,59 @@ func TestRemoveLogsForBuild(t *testing.T) {
 	})
 }
 
+func TestFindLogsInSeqRange(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(LogsCollection))
+
+	now := time.Now()
+	testID := bson.NewObjectId()
+	require.NoError(t, InsertLogChunks("b0", nil, 3, []LogChunk{
+		{{Time: now, Msg: "global 1"}},
+		{{Time: now, Msg: "global 2"}},
+		{{Time: now, Msg: "global 3"}},
+	}))
+	require.NoError(t, InsertLogChunks("b0", &testID, 2, []LogChunk{
+		{{Time: now, Msg: "test 1"}},
+		{{Time: now, Msg: "test 2"}, {Time: now, Msg: "test 3"}},
+	}))
+
+	logs, err := FindLogsInSeqRange("b0", nil, 2, 3)
+	require.NoError(t, err)
+	require.Len(t, logs, 2)
+	assert.Equal(t, "global 2", logs[0].Lines[0].Msg)
+	assert.Equal(t, "global 3", logs[1].Lines[0].Msg)
+
+	logs, err = FindLogsInSeqRange("b0", &testID, 1, 2)
+	require.NoError(t, err)
+	require.Len(t, logs, 2)
+	assert.Equal(t, 2, logs[1].Seq)
+
+	counts, err := CountLogLines("b0")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"": 3, testID.Hex(): 3}, counts)
+}
+
+func TestFindLogsForBatch(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(LogsCollection))
+
+	now := time.Now()
+	testID := bson.NewObjectId()
+	require.NoError(t, InsertLogChunks("b0", &testID, 1, []LogChunk{{{Time: now, Msg: "test 1"}}}))
+	require.NoError(t, InsertLogBatch("b0", &testID, "batch0", 3, []LogChunk{
+		{{Time: now, Msg: "test 2"}},
+		{{Time: now, Msg: "test 3"}},
+	}))
+	require.NoError(t, InsertLogBatch("b0", nil, "batch0", 1, []LogChunk{{{Time: now, Msg: "global 1"}}}))
+
+	logs, err := FindLogsForBatch("b0", &testID, "batch0")
+	require.NoError(t, err)
+	require.Len(t, logs, 2)
+	assert.Equal(t, 2, logs[0].Seq)
+	assert.Equal(t, "test 3", logs[1].Lines[0].Msg)
+	assert.Equal(t, "batch0", logs[1].BatchId)
+}
+
 func TestFindLogsInWindow(t *testing.T) {
 	require.NoError(t, testutil.InitDB())
 	require.NoError(t, testutil.ClearCollections(LogsCollection))
@@ -47,7 +103,7 @@ func TestFindLogsInWindow(t *testing.T) {
 		{Time: latestTime.Add(time.Hour), Msg: "line3"},
 	}}).Insert())
 
-	logChan := findLogsInWindow(bson.M{}, []string{"seq"}, &earliestTime, &latestTime)
+	logChan := findLogsInWindow(context.Background(), bson.M{}, []string{"seq"}, &earliestTime, &latestTime)
 	var lines []*LogLineItem
 	require.Eventually(t, func() bool {
 		select {
@@ -116,7 +172,7 @@ func TestMergeLogChannels(t *testing.T) {
 	logger1 <- &LogLineItem{Data: "m1", Timestamp: time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC)}
 	close(logger1)
 
-	outChan := MergeLogChannels(logger0, logger1)
+	outChan := MergeLogChannels(context.Background(), logger0, logger1)
 	var items []*LogLineItem
 	assert.Eventually(t, func() bool {
 		select {
@@ -132,6 +188,218 @@ func TestMergeLogChannels(t *testing.T) {
 	assert.Equal(t, "m1", items[1].Data)
 }
 
+func TestSelectLineRange(t *testing.T) {
+	makeLogs := func() chan *LogLineItem {
+		logs := make(chan *LogLineItem, 5)
+		for i := 0; i < 5; i++ {
+			logs <- &LogLineItem{LineNum: 100, Data: fmt.Sprintf("m%d", i)}
+		}
+		close(logs)
+		return logs
+	}
+
+	t.Run("OpenEnded", func(t *testing.T) {
+		var items []*LogLineItem
+		for item := range SelectLineRange(context.Background(), makeLogs(), 0, -1) {
+			items = append(items, item)
+		}
+		require.Len(t, items, 5)
+		for i, item := range items {
+			assert.Equal(t, i, item.LineNum)
+		}
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		var items []*LogLineItem
+		for item := range SelectLineRange(context.Background(), makeLogs(), 1, 3) {
+			items = append(items, item)
+		}
+		require.Len(t, items, 3)
+		assert.Equal(t, "m1", items[0].Data)
+		assert.Equal(t, 1, items[0].LineNum)
+		assert.Equal(t, "m3", items[2].Data)
+		assert.Equal(t, 3, items[2].LineNum)
+	})
+}
+
+func TestTailLines(t *testing.T) {
+	reversed := make(chan *LogLineItem, 5)
+	for i := 4; i >= 0; i-- {
+		reversed <- &LogLineItem{Data: fmt.Sprintf("m%d", i)}
+	}
+	close(reversed)
+
+	var items []string
+	for item := range TailLines(context.Background(), reversed, 3) {
+		items = append(items, item.Data)
+	}
+	assert.Equal(t, []string{"m2", "m3", "m4"}, items)
+}
+
+func TestUnnumberLines(t *testing.T) {
+	logs := make(chan *LogLineItem, 3)
+	for i := 0; i < 3; i++ {
+		logs <- &LogLineItem{LineNum: i, Data: fmt.Sprintf("m%d", i)}
+	}
+	close(logs)
+
+	var items []string
+	for item := range UnnumberLines(context.Background(), logs) {
+		assert.False(t, item.Numbered())
+		items = append(items, item.Data)
+	}
+	assert.Equal(t, []string{"m0", "m1", "m2"}, items)
+}
+
+func TestSearchLines(t *testing.T) {
+	makeLogs := func(msgs ...string) chan *LogLineItem {
+		logs := make(chan *LogLineItem, len(msgs))
+		for i, msg := range msgs {
+			logs <- &LogLineItem{LineNum: i, Data: msg}
+		}
+		close(logs)
+		return logs
+	}
+	search := func(logs chan *LogLineItem, contextLines int) ([]int, []bool) {
+		var lineNums []int
+		var matches []bool
+		for result := range SearchLines(context.Background(), logs, func(line string) bool { return strings.Contains(line, "error") }, contextLines) {
+			lineNums = append(lineNums, result.LineNum)
+			matches = append(matches, result.Match)
+		}
+		return lineNums, matches
+	}
+
+	t.Run("NoContext", func(t *testing.T) {
+		lineNums, matches := search(makeLogs("ok", "error 1", "ok", "error 2"), 0)
+		assert.Equal(t, []int{1, 3}, lineNums)
+		assert.Equal(t, []bool{true, true}, matches)
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		lineNums, matches := search(makeLogs("ok", "ok", "ok", "error", "ok", "ok", "ok"), 2)
+		assert.Equal(t, []int{1, 2, 3, 4, 5}, lineNums)
+		assert.Equal(t, []bool{false, false, true, false, false}, matches)
+	})
+
+	t.Run("OverlappingContext", func(t *testing.T) {
+		lineNums, matches := search(makeLogs("error 1", "ok", "ok", "error 2", "ok"), 2)
+		assert.Equal(t, []int{0, 1, 2, 3, 4}, lineNums)
+		assert.Equal(t, []bool{true, false, false, true, false}, matches)
+	})
+
+	t.Run("NoMatches", func(t *testing.T) {
+		lineNums, _ := search(makeLogs("ok", "ok"), 1)
+		assert.Empty(t, lineNums)
+	})
+}
+
+func TestReadPipelineStopsWithContext(t *testing.T) {
+	// endless returns a channel of lines that never ends, like a reader of a
+	// huge log, and closes it once the context is done.
+	endless := func(ctx context.Context) chan *LogLineItem {
+		lines := make(chan *LogLineItem)
+		go func() {
+			defer close(lines)
+			for sendLine(ctx, lines, &LogLineItem{Timestamp: time.Now(), Data: "error"}) {
+			}
+		}()
+		return lines
+	}
+	baseline := runtime.NumGoroutine()
+
+	t.Run("AbandonedReader", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		merged := MergeLogChannels(ctx, endless(ctx), endless(ctx))
+		results := SearchLines(ctx, SelectLineRange(ctx, merged, 0, -1), func(string) bool { return true }, 1)
+		<-results
+		cancel()
+
+		assert.NoError(t, testutil.WaitForGoroutines(baseline, 5*time.Second))
+	})
+
+	t.Run("LineRange", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		lines := SelectLineRange(ctx, endless(ctx), 0, 2)
+		count := 0
+		for range lines {
+			count++
+		}
+		assert.Equal(t, 3, count)
+		cancel()
+
+		assert.NoError(t, testutil.WaitForGoroutines(baseline, 5*time.Second))
+	})
+
+	t.Run("Tail", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		assert.Len(t, TailLines(ctx, endless(ctx), 2), 2)
+		cancel()
+
+		assert.NoError(t, testutil.WaitForGoroutines(baseline, 5*time.Second))
+	})
+
+	t.Run("Unnumber", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		lines := UnnumberLines(ctx, endless(ctx))
+		<-lines
+		cancel()
+
+		assert.NoError(t, testutil.WaitForGoroutines(baseline, 5*time.Second))
+	})
+}
+
+func TestMergedTestLogsInWindow(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(LogsCollection, TestsCollection))
+
+	start := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	test := Test{Id: bson.NewObjectId(), BuildId: "b0", Started: start}
+	require.NoError(t, test.Insert())
+
+	firstStarted := start
+	require.NoError(t, (&Log{BuildId: "b0", TestId: &test.Id, Seq: 1, Started: &firstStarted, Lines: []LogLine{
+		{Time: start, Msg: "line0"},
+		{Time: start.Add(time.Minute), Msg: "line1"},
+	}}).Insert())
+	secondStarted := start.Add(2 * time.Minute)
+	require.NoError(t, (&Log{BuildId: "b0", TestId: &test.Id, Seq: 2, Started: &secondStarted, Lines: []LogLine{
+		{Time: start.Add(2 * time.Minute), Msg: "line2"},
+		{Time: start.Add(3 * time.Minute), Msg: "line3"},
+	}}).Insert())
+
+	minTime := start.Add(time.Minute)
+	maxTime := start.Add(2 * time.Minute)
+	logChan, err := MergedTestLogs(context.Background(), &test, &minTime, &maxTime)
+	require.NoError(t, err)
+	var lines []string
+	for line := range logChan {
+		lines = append(lines, line.Data)
+	}
+	assert.Equal(t, []string{"line1", "line2"}, lines)
+
+	logChan, err = MergedTestLogsReverse(context.Background(), &test, nil, nil)
+	require.NoError(t, err)
+	lines = nil
+	for line := range logChan {
+		lines = append(lines, line.Data)
+	}
+	assert.Equal(t, []string{"line3", "line2", "line1", "line0"}, lines)
+
+	globalStarted := start.Add(time.Minute)
+	require.NoError(t, (&Log{BuildId: "b0", Seq: 1, Started: &globalStarted, Lines: []LogLine{
+		{Time: start.Add(time.Minute), Msg: "global0"},
+	}}).Insert())
+	testMinTime := start.Add(2 * time.Minute)
+	logChan, err = MergedTestLogsFrom(context.Background(), &test, &testMinTime, &start, nil)
+	require.NoError(t, err)
+	lines = nil
+	for line := range logChan {
+		lines = append(lines, line.Data)
+	}
+	assert.Equal(t, []string{"global0", "line2", "line3"}, lines)
+}
+
 func TestFindGlobalLogsDuringTest(t *testing.T) {
 	require.NoError(t, testutil.InitDB())
 	require.NoError(t, testutil.ClearCollections(LogsCollection))
@@ -189,7 +457,7 @@ func TestFindGlobalLogsDuringTest(t *testing.T) {
 
 	// build logs from during a test should be returned as part of the test, even
 	// if the build itself started after the test
-	logChan, err := findGlobalLogsDuringTest(&t0)
+	logChan, err := findGlobalLogsDuringTest(context.Background(), &t0, nil, nil, false)
 	assert.NoError(t, err)
 	count := 0
 	for logLine := range logChan {
@@ -199,7 +467,7 @@ func TestFindGlobalLogsDuringTest(t *testing.T) {
 	assert.Equal(t, 1, count)
 
 	// test that we can correctly find global logs during a test that start before the test starts
-	logChan, err = findGlobalLogsDuringTest(&t1)
+	logChan, err = findGlobalLogsDuringTest(context.Background(), &t1, nil, nil, false)
 	assert.NoError(t, err)
 	count = 0
 	for logLine := range logChan {
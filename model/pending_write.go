@@ -0,0 +1,159 @@
+package model
+
+import (
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/db"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// PendingWritesCollection is the name of the collection of log appends
+	// that haven't been confirmed in the bucket.
+	PendingWritesCollection = "pending_bucket_writes"
+)
+
+// PendingWrite records a log append to a build stored in the bucket from
+// before it's written to the database until it's confirmed in the bucket. The
+// lines themselves aren't copied; they're the build's or test's logs with
+// sequence numbers from FirstSeq through LastSeq. Until the append is in the
+// database, its sequence numbers aren't known and LastSeq is less than
+// FirstSeq, which is then the first sequence number the append could have.
+type PendingWrite struct {
+	Id      bson.ObjectId  `bson:"_id"`
+	BuildId string         `bson:"build_id"`
+	TestId  *bson.ObjectId `bson:"test_id,omitempty"`
+	// BatchId is the client's ID for the append, if it sent one, so that
+	// replaying the append is recognized as a retry.
+	BatchId   string    `bson:"batch_id,omitempty"`
+	FirstSeq  int       `bson:"first_seq"`
+	LastSeq   int       `bson:"last_seq"`
+	Created   time.Time `bson:"created"`
+	Attempts  int       `bson:"attempts"`
+	LastError string    `bson:"last_error,omitempty"`
+}
+
+// Insert inserts the pending write into the pending writes collection.
+func (w *PendingWrite) Insert() error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	return errors.Wrapf(db.C(PendingWritesCollection).Insert(w), "inserting pending write for build '%s'", w.BuildId)
+}
+
+// Sequenced returns true if the pending write's sequence numbers are known.
+func (w *PendingWrite) Sequenced() bool {
+	return w.LastSeq >= w.FirstSeq
+}
+
+// SetSeqRange records the sequence numbers the append was written to the
+// database with.
+func (w *PendingWrite) SetSeqRange(first, last int) error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	update := bson.M{"$set": bson.M{"first_seq": first, "last_seq": last}}
+	if err := db.C(PendingWritesCollection).UpdateId(w.Id, update); err != nil {
+		return errors.Wrapf(err, "setting sequence range of pending write '%s'", w.Id.Hex())
+	}
+	w.FirstSeq = first
+	w.LastSeq = last
+
+	return nil
+}
+
+// Remove removes the pending write once it's confirmed in the bucket.
+func (w *PendingWrite) Remove() error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	err := db.C(PendingWritesCollection).RemoveId(w.Id)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return errors.Wrapf(err, "removing pending write '%s'", w.Id.Hex())
+}
+
+// RecordAttempt records a failed attempt to replay the pending write.
+func (w *PendingWrite) RecordAttempt(attemptErr error) error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	update := bson.M{
+		"$inc": bson.M{"attempts": 1},
+		"$set": bson.M{"last_error": attemptErr.Error()},
+	}
+	if err := db.C(PendingWritesCollection).UpdateId(w.Id, update); err != nil {
+		return errors.Wrapf(err, "recording attempt for pending write '%s'", w.Id.Hex())
+	}
+	w.Attempts++
+	w.LastError = attemptErr.Error()
+
+	return nil
+}
+
+// FindPendingWriteByID returns the pending write with the given ID, or nil if
+// it has been removed.
+func FindPendingWriteByID(id string) (*PendingWrite, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.Errorf("invalid pending write ID '%s'", id)
+	}
+
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	write := &PendingWrite{}
+	err := db.C(PendingWritesCollection).FindId(bson.ObjectIdHex(id)).One(write)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding pending write '%s'", id)
+	}
+
+	return write, nil
+}
+
+// FindPendingWrites returns up to limit pending writes, in ID order after the
+// given ID, that were created before the given time.
+func FindPendingWrites(createdBefore time.Time, afterID string, limit int) ([]PendingWrite, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	query := bson.M{"created": bson.M{"$lte": createdBefore}}
+	if bson.IsObjectIdHex(afterID) {
+		query["_id"] = bson.M{"$gt": bson.ObjectIdHex(afterID)}
+	}
+
+	writes := []PendingWrite{}
+	if err := db.C(PendingWritesCollection).Find(query).Sort("_id").Limit(limit).All(&writes); err != nil {
+		return nil, errors.Wrap(err, "finding pending writes")
+	}
+
+	return writes, nil
+}
+
+// CountPendingWritesForBuild returns the number of the build's pending writes.
+func CountPendingWritesForBuild(buildID string) (int, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	count, err := db.C(PendingWritesCollection).Find(bson.M{"build_id": buildID}).Count()
+	return count, errors.Wrapf(err, "counting pending writes for build '%s'", buildID)
+}
+
+// RemovePendingWritesForBuild removes the build's pending writes.
+func RemovePendingWritesForBuild(buildID string) (int, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	info, err := db.C(PendingWritesCollection).RemoveAll(bson.M{"build_id": buildID})
+	if err != nil {
+		return 0, errors.Wrapf(err, "deleting pending writes for build '%s'", buildID)
+	}
+
+	return info.Removed, nil
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPendingWrites(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(PendingWritesCollection))
+
+	now := time.Now().Truncate(time.Millisecond)
+	testID := bson.NewObjectId()
+	old := PendingWrite{Id: bson.NewObjectId(), BuildId: "b0", TestId: &testID, FirstSeq: 1, LastSeq: 2, Created: now.Add(-time.Hour)}
+	recent := PendingWrite{Id: bson.NewObjectId(), BuildId: "b1", BatchId: "batch0", FirstSeq: 1, LastSeq: 1, Created: now}
+	require.NoError(t, old.Insert())
+	require.NoError(t, recent.Insert())
+
+	writes, err := FindPendingWrites(now.Add(-time.Minute), "", 10)
+	require.NoError(t, err)
+	require.Len(t, writes, 1)
+	assert.Equal(t, old.Id, writes[0].Id)
+	writes, err = FindPendingWrites(now, old.Id.Hex(), 10)
+	require.NoError(t, err)
+	require.Len(t, writes, 1)
+	assert.Equal(t, recent.Id, writes[0].Id)
+
+	require.NoError(t, old.RecordAttempt(errors.New("bucket unavailable")))
+	found, err := FindPendingWriteByID(old.Id.Hex())
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, 1, found.Attempts)
+	assert.Equal(t, "bucket unavailable", found.LastError)
+	require.NotNil(t, found.TestId)
+	assert.Equal(t, testID, *found.TestId)
+
+	unsequenced := PendingWrite{Id: bson.NewObjectId(), BuildId: "b0", FirstSeq: 3, LastSeq: 2, Created: now}
+	require.NoError(t, unsequenced.Insert())
+	assert.False(t, unsequenced.Sequenced())
+	require.NoError(t, unsequenced.SetSeqRange(4, 5))
+	found, err = FindPendingWriteByID(unsequenced.Id.Hex())
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.True(t, found.Sequenced())
+	assert.Equal(t, 4, found.FirstSeq)
+	assert.Equal(t, 5, found.LastSeq)
+	require.NoError(t, unsequenced.Remove())
+
+	count, err := CountPendingWritesForBuild("b0")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	require.NoError(t, old.Remove())
+	require.NoError(t, old.Remove(), "removing a removed write is a no-op")
+	found, err = FindPendingWriteByID(old.Id.Hex())
+	require.NoError(t, err)
+	assert.Nil(t, found)
+
+	removed, err := RemovePendingWritesForBuild("b1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+}
@@ -0,0 +1,282 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// RetentionPassed is the category of builds that passed and have a task.
+	RetentionPassed = "passed"
+	// RetentionFailed is the category of builds that failed and have a task.
+	RetentionFailed = "failed"
+	// RetentionNoTask is the category of builds that weren't generated by a
+	// task.
+	RetentionNoTask = "no_task"
+
+	retentionForever = "forever"
+)
+
+// RetentionRule is how long the builds of the builders matching a glob
+// pattern are kept. A zero duration keeps the builds forever.
+type RetentionRule struct {
+	// Builder is a glob pattern, in the syntax of path.Match, matched
+	// against the build's builder.
+	Builder string
+	Passed  time.Duration
+	Failed  time.Duration
+	NoTask  time.Duration
+}
+
+// RetentionPolicies are the rules deciding when builds are deleted. The first
+// rule matching a build's builder applies, and the default applies to builds
+// no rule matches.
+type RetentionPolicies struct {
+	Rules   []RetentionRule
+	Default RetentionRule
+}
+
+// DefaultRetentionPolicies returns the policies used when none are configured,
+// which delete passed builds after DeletePassedTestCutoff and keep everything
+// else.
+func DefaultRetentionPolicies() RetentionPolicies {
+	return RetentionPolicies{Default: RetentionRule{Passed: DeletePassedTestCutoff}}
+}
+
+type retentionRuleConfig struct {
+	Builder string `json:"builder"`
+	Passed  string `json:"passed"`
+	Failed  string `json:"failed"`
+	NoTask  string `json:"no_task"`
+}
+
+type retentionConfig struct {
+	Default *retentionRuleConfig  `json:"default"`
+	Rules   []retentionRuleConfig `json:"rules"`
+}
+
+// LoadRetentionPolicies reads retention policies from a JSON file of the form
+//
+//	{
+//	    "default": {"passed": "30d"},
+//	    "rules": [
+//	        {"builder": "perf_*", "passed": "7d", "failed": "90d", "no_task": "12h"}
+//	    ]
+//	}
+//
+// Durations are either a number of days ("30d"), a Go duration ("12h"), or
+// empty or "forever" to keep the builds forever. The default rule falls back
+// to that of DefaultRetentionPolicies if it's omitted.
+func LoadRetentionPolicies(fileName string) (RetentionPolicies, error) {
+	policies := DefaultRetentionPolicies()
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return policies, errors.Wrapf(err, "reading retention config '%s'", fileName)
+	}
+	config := retentionConfig{}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return policies, errors.Wrapf(err, "parsing retention config '%s'", fileName)
+	}
+
+	if config.Default != nil {
+		if policies.Default, err = config.Default.rule(); err != nil {
+			return policies, errors.Wrap(err, "parsing default retention rule")
+		}
+		policies.Default.Builder = ""
+	}
+	for i, ruleConfig := range config.Rules {
+		if ruleConfig.Builder == "" {
+			return policies, errors.Errorf("retention rule %d has no builder", i)
+		}
+		if _, err = path.Match(ruleConfig.Builder, ""); err != nil {
+			return policies, errors.Wrapf(err, "invalid builder pattern '%s'", ruleConfig.Builder)
+		}
+		rule, err := ruleConfig.rule()
+		if err != nil {
+			return policies, errors.Wrapf(err, "parsing retention rule for '%s'", ruleConfig.Builder)
+		}
+		policies.Rules = append(policies.Rules, rule)
+	}
+
+	return policies, nil
+}
+
+func (c retentionRuleConfig) rule() (RetentionRule, error) {
+	rule := RetentionRule{Builder: c.Builder}
+	var err error
+	if rule.Passed, err = parseRetentionDuration(c.Passed); err != nil {
+		return rule, errors.Wrap(err, "parsing passed duration")
+	}
+	if rule.Failed, err = parseRetentionDuration(c.Failed); err != nil {
+		return rule, errors.Wrap(err, "parsing failed duration")
+	}
+	if rule.NoTask, err = parseRetentionDuration(c.NoTask); err != nil {
+		return rule, errors.Wrap(err, "parsing no task duration")
+	}
+
+	return rule, nil
+}
+
+func parseRetentionDuration(value string) (time.Duration, error) {
+	if value == "" || value == retentionForever {
+		return 0, nil
+	}
+
+	var duration time.Duration
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, errors.Errorf("invalid number of days '%s'", value)
+		}
+		duration = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if duration, err = time.ParseDuration(value); err != nil {
+			return 0, errors.Wrapf(err, "invalid duration '%s'", value)
+		}
+	}
+	if duration <= 0 {
+		return 0, errors.Errorf("duration '%s' must be positive", value)
+	}
+
+	return duration, nil
+}
+
+// ForBuilder returns the rule that applies to the builder's builds.
+func (p RetentionPolicies) ForBuilder(builder string) RetentionRule {
+	for _, rule := range p.Rules {
+		if matched, _ := path.Match(rule.Builder, builder); matched {
+			return rule
+		}
+	}
+
+	return p.Default
+}
+
+// RetentionCategory returns which of the retention rule's durations applies
+// to the build.
+func (b *Build) RetentionCategory() string {
+	switch {
+	case b.Info.TaskID == "":
+		return RetentionNoTask
+	case b.Failed:
+		return RetentionFailed
+	default:
+		return RetentionPassed
+	}
+}
+
+// Retention returns how long builds in the category are kept.
+func (r RetentionRule) Retention(category string) time.Duration {
+	switch category {
+	case RetentionPassed:
+		return r.Passed
+	case RetentionFailed:
+		return r.Failed
+	case RetentionNoTask:
+		return r.NoTask
+	default:
+		return 0
+	}
+}
+
+// Expired returns true if the policies allow the build to be deleted. Held
+// builds are never expired.
+func (p RetentionPolicies) Expired(build *Build, now time.Time) bool {
+	if build.Held(now) {
+		return false
+	}
+
+	retention := p.ForBuilder(build.Builder).Retention(build.RetentionCategory())
+	if retention == 0 {
+		return false
+	}
+
+	return !build.Started.After(now.Add(-retention))
+}
+
+// candidateQuery returns a query matching every unheld build that any rule
+// might consider expired, or nil if the policies keep every build forever. The
+// query only narrows by start time, so matching builds must still be checked
+// with Expired.
+func (p RetentionPolicies) candidateQuery(now time.Time) bson.M {
+	hasTask := []bson.M{
+		{"info.task_id": bson.M{"$exists": true}},
+		{"info.task_id": bson.M{"$ne": ""}},
+	}
+	categories := []struct {
+		name   string
+		filter bson.M
+	}{
+		{
+			name: RetentionPassed,
+			filter: bson.M{
+				"$or": []bson.M{
+					{"failed": bson.M{"$exists": false}},
+					{"failed": bson.M{"$eq": false}},
+				},
+				"$and": hasTask,
+			},
+		},
+		{
+			name:   RetentionFailed,
+			filter: bson.M{"failed": true, "$and": hasTask},
+		},
+		{
+			name: RetentionNoTask,
+			filter: bson.M{"$or": []bson.M{
+				{"info.task_id": bson.M{"$exists": false}},
+				{"info.task_id": ""},
+			}},
+		},
+	}
+
+	var clauses []bson.M
+	for _, category := range categories {
+		shortest := p.shortestRetention(category.name)
+		if shortest == 0 {
+			continue
+		}
+		category.filter["started"] = bson.M{"$lte": now.Add(-shortest)}
+		clauses = append(clauses, category.filter)
+	}
+
+	var categoriesQuery bson.M
+	switch len(clauses) {
+	case 0:
+		return nil
+	case 1:
+		categoriesQuery = clauses[0]
+	default:
+		categoriesQuery = bson.M{"$or": clauses}
+	}
+
+	notHeld := bson.M{"$or": []bson.M{
+		{"hold": bson.M{"$exists": false}},
+		{"hold.expires": bson.M{"$lte": now}},
+	}}
+
+	return bson.M{"$and": []bson.M{categoriesQuery, notHeld}}
+}
+
+// shortestRetention returns the shortest non-zero retention of the category
+// across all the rules.
+func (p RetentionPolicies) shortestRetention(category string) time.Duration {
+	shortest := p.Default.Retention(category)
+	for _, rule := range p.Rules {
+		retention := rule.Retention(category)
+		if retention != 0 && (shortest == 0 || retention < shortest) {
+			shortest = retention
+		}
+	}
+
+	return shortest
+}
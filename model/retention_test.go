@@ -0,0 +1,153 @@
+package model
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLoadRetentionPolicies(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(t *testing.T, config string) string {
+		fileName := filepath.Join(t.TempDir(), "retention.json")
+		require.NoError(t, ioutil.WriteFile(fileName, []byte(config), 0644))
+		return fileName
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		policies, err := LoadRetentionPolicies(writeConfig(t, `{
+			"default": {"passed": "14d", "failed": "forever"},
+			"rules": [{"builder": "perf_*", "passed": "7d", "failed": "90d", "no_task": "12h"}]
+		}`))
+		require.NoError(t, err)
+		assert.Equal(t, RetentionRule{Passed: 14 * 24 * time.Hour}, policies.Default)
+		require.Len(t, policies.Rules, 1)
+		assert.Equal(t, RetentionRule{
+			Builder: "perf_*",
+			Passed:  7 * 24 * time.Hour,
+			Failed:  90 * 24 * time.Hour,
+			NoTask:  12 * time.Hour,
+		}, policies.Rules[0])
+	})
+
+	t.Run("DefaultOmitted", func(t *testing.T) {
+		policies, err := LoadRetentionPolicies(writeConfig(t, `{"rules": [{"builder": "perf_*", "passed": "7d"}]}`))
+		require.NoError(t, err)
+		assert.Equal(t, DefaultRetentionPolicies().Default, policies.Default)
+	})
+
+	for name, config := range map[string]string{
+		"InvalidJSON":     `{"rules": [`,
+		"MissingBuilder":  `{"rules": [{"passed": "7d"}]}`,
+		"InvalidPattern":  `{"rules": [{"builder": "[", "passed": "7d"}]}`,
+		"InvalidDays":     `{"default": {"passed": "sevend"}}`,
+		"InvalidDuration": `{"default": {"failed": "7 weeks"}}`,
+		"NegativeDays":    `{"default": {"no_task": "-1d"}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadRetentionPolicies(writeConfig(t, config))
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := LoadRetentionPolicies(filepath.Join(dir, "missing.json"))
+		assert.Error(t, err)
+	})
+}
+
+func TestRetentionPoliciesExpired(t *testing.T) {
+	now := time.Now()
+	policies := RetentionPolicies{
+		Rules: []RetentionRule{
+			{Builder: "perf_*", Passed: 24 * time.Hour, Failed: 48 * time.Hour},
+			{Builder: "*", NoTask: time.Hour},
+		},
+		Default: RetentionRule{Passed: 72 * time.Hour},
+	}
+
+	for name, test := range map[string]struct {
+		build   Build
+		expired bool
+	}{
+		"PassedExpired": {
+			build:   Build{Builder: "perf_linux", Started: now.Add(-25 * time.Hour), Info: BuildInfo{TaskID: "t0"}},
+			expired: true,
+		},
+		"PassedNotExpired": {
+			build: Build{Builder: "perf_linux", Started: now.Add(-23 * time.Hour), Info: BuildInfo{TaskID: "t0"}},
+		},
+		"FailedExpired": {
+			build:   Build{Builder: "perf_linux", Started: now.Add(-49 * time.Hour), Info: BuildInfo{TaskID: "t0"}, Failed: true},
+			expired: true,
+		},
+		"FailedNotExpired": {
+			build: Build{Builder: "perf_linux", Started: now.Add(-25 * time.Hour), Info: BuildInfo{TaskID: "t0"}, Failed: true},
+		},
+		"NoTaskExpired": {
+			build:   Build{Builder: "unit", Started: now.Add(-2 * time.Hour)},
+			expired: true,
+		},
+		"FirstMatchingRuleApplies": {
+			build: Build{Builder: "unit", Started: now.Add(-25 * time.Hour), Info: BuildInfo{TaskID: "t0"}},
+		},
+		"KeptForever": {
+			build: Build{Builder: "unit", Started: now.Add(-1000 * time.Hour), Info: BuildInfo{TaskID: "t0"}, Failed: true},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expired, policies.Expired(&test.build, now))
+		})
+	}
+
+	t.Run("Held", func(t *testing.T) {
+		build := Build{Builder: "perf_linux", Started: now.Add(-25 * time.Hour), Info: BuildInfo{TaskID: "t0"}}
+		build.Hold = &BuildHold{Reason: "investigating", Created: now}
+		assert.False(t, policies.Expired(&build, now))
+
+		expires := now.Add(time.Hour)
+		build.Hold.Expires = &expires
+		assert.False(t, policies.Expired(&build, now))
+
+		expires = now.Add(-time.Hour)
+		assert.True(t, policies.Expired(&build, now))
+	})
+
+	t.Run("DefaultRule", func(t *testing.T) {
+		policies := RetentionPolicies{
+			Rules:   []RetentionRule{{Builder: "perf_*", Passed: 24 * time.Hour}},
+			Default: RetentionRule{Passed: 72 * time.Hour},
+		}
+		build := Build{Builder: "unit", Started: now.Add(-25 * time.Hour), Info: BuildInfo{TaskID: "t0"}}
+		assert.False(t, policies.Expired(&build, now))
+		build.Started = now.Add(-73 * time.Hour)
+		assert.True(t, policies.Expired(&build, now))
+	})
+}
+
+func TestRetentionCandidateQuery(t *testing.T) {
+	now := time.Now()
+	assert.Nil(t, RetentionPolicies{}.candidateQuery(now))
+
+	query := DefaultRetentionPolicies().candidateQuery(now)
+	require.NotNil(t, query)
+	clauses := query["$and"].([]bson.M)
+	require.Len(t, clauses, 2)
+	assert.Equal(t, now.Add(-DeletePassedTestCutoff), clauses[0]["started"].(bson.M)["$lte"])
+
+	policies := RetentionPolicies{
+		Rules:   []RetentionRule{{Builder: "perf_*", Passed: time.Hour, NoTask: 2 * time.Hour}},
+		Default: RetentionRule{Passed: 3 * time.Hour},
+	}
+	query = policies.candidateQuery(now)
+	require.NotNil(t, query)
+	assert.Len(t, query["$and"].([]bson.M)[0]["$or"], 2)
+	assert.Equal(t, time.Hour, policies.shortestRetention(RetentionPassed))
+	assert.Equal(t, 2*time.Hour, policies.shortestRetention(RetentionNoTask))
+	assert.Zero(t, policies.shortestRetention(RetentionFailed))
+}
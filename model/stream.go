@@ -0,0 +1,52 @@
+package model
+
+import (
+	"context"
+	"sync"
+)
+
+// StreamStatus records the first error encountered by the log streams started
+// with its context, so that a reader can tell a stream that ended early from
+// a complete one once the stream's channel is closed.
+type StreamStatus struct {
+	mu  sync.Mutex
+	err error
+}
+
+// Err returns the first error reported to the status, or nil if the streams
+// haven't reported any.
+func (s *StreamStatus) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *StreamStatus) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+type streamStatusKey struct{}
+
+// WithStreamStatus returns a context for starting log streams that report
+// their errors to the returned status.
+func WithStreamStatus(ctx context.Context) (context.Context, *StreamStatus) {
+	status := &StreamStatus{}
+	return context.WithValue(ctx, streamStatusKey{}, status), status
+}
+
+// ReportStreamError records the error in the context's stream status, if it
+// has one. A log stream reports an error before closing its channel.
+func ReportStreamError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	if status, ok := ctx.Value(streamStatusKey{}).(*StreamStatus); ok {
+		status.fail(err)
+	}
+}
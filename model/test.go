@@ -16,23 +16,26 @@ const (
 
 // Test contains metadata about a test's logs.
 type Test struct {
-	Id        bson.ObjectId `bson:"_id"`
-	BuildId   string        `bson:"build_id"`
-	BuildName string        `bson:"build_name"`
-	Name      string        `bson:"name"`
-	Command   string        `bson:"command"`
-	Started   time.Time     `bson:"started"`
-	Ended     *time.Time    `bson:"ended"`
-	Info      TestInfo      `bson:"info"`
-	Failed    bool          `bson:"failed,omitempty"`
-	Phase     string        `bson:"phase"`
-	Seq       int           `bson:"seq"`
+	Id        bson.ObjectId `bson:"_id" json:"id"`
+	BuildId   string        `bson:"build_id" json:"build_id"`
+	BuildName string        `bson:"build_name" json:"build_name"`
+	Builder   string        `bson:"builder,omitempty" json:"builder,omitempty"`
+	Name      string        `bson:"name" json:"name"`
+	Command   string        `bson:"command" json:"command"`
+	Started   time.Time     `bson:"started" json:"started"`
+	Ended     *time.Time    `bson:"ended" json:"ended"`
+	Info      TestInfo      `bson:"info" json:"info"`
+	Failed    bool          `bson:"failed,omitempty" json:"failed"`
+	Phase     string        `bson:"phase" json:"phase"`
+	Seq       int           `bson:"seq" json:"seq"`
+	// Batches holds the IDs of the most recently applied log batches.
+	Batches []string `bson:"batches,omitempty" json:"-"`
 }
 
 // TestInfo contains additional metadata about a test.
 type TestInfo struct {
 	// TaskID is the ID of the task in Evergreen that generated this test.
-	TaskID string `bson:"task_id"`
+	TaskID string `bson:"task_id" json:"task_id"`
 }
 
 // Insert inserts the test into the test collection.
@@ -53,6 +56,30 @@ func (t *Test) IncrementSequence(count int) error {
 	return errors.Wrap(err, "incrementing test sequence number")
 }
 
+// IncrementSequenceForBatch increments the test's sequence number by the given
+// count and records the batch ID, unless a batch with the same ID was already
+// applied, in which case it returns false.
+func (t *Test) IncrementSequenceForBatch(count int, batchID string) (bool, error) {
+	applied, err := incrementSequenceForBatch(TestsCollection, t.Id, count, batchID, t)
+	return applied, errors.Wrapf(err, "incrementing sequence number for batch '%s' of test '%s'", batchID, t.Id.Hex())
+}
+
+// ForgetBatch removes the record of the batch, so that a batch that failed to
+// be written can be retried.
+func (t *Test) ForgetBatch(batchID string) error {
+	return errors.Wrapf(forgetBatch(TestsCollection, t.Id, batchID), "forgetting batch '%s' of test '%s'", batchID, t.Id.Hex())
+}
+
+// End marks the test as ended at the given time with the given outcome.
+func (t *Test) End(ended time.Time, failed bool) error {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"ended": ended, "failed": failed}}, ReturnNew: true}
+	_, err := db.C(TestsCollection).Find(bson.M{"_id": t.Id}).Apply(change, t)
+	return errors.Wrapf(err, "ending test '%s'", t.Id.Hex())
+}
+
 // FindTestByID returns the test with the specified ID.
 func FindTestByID(id string) (*Test, error) {
 	db, closeSession := db.DB()
@@ -86,6 +113,61 @@ func FindTestsForBuild(buildID string) ([]Test, error) {
 	return tests, nil
 }
 
+// TestQuery describes a search for tests across builds. Empty fields don't
+// restrict the search.
+type TestQuery struct {
+	// Builder limits the search to tests from the given builder's builds.
+	// Tests created before the builder was recorded on tests aren't matched.
+	Builder string
+	// Name limits the search to tests with the given name.
+	Name string
+	// Failed, if set, limits the search to tests that did or didn't fail.
+	Failed *bool
+	// Since limits the search to tests that started at or after the time.
+	Since *time.Time
+	// After continues a previous search from the test with the given ID.
+	After string
+	// Limit is the maximum number of tests to return.
+	Limit int
+}
+
+// FindTests returns the tests matching the query, most recent first.
+func FindTests(query TestQuery) ([]Test, error) {
+	db, closeSession := db.DB()
+	defer closeSession()
+
+	filter := bson.M{}
+	if query.Builder != "" {
+		filter["builder"] = query.Builder
+	}
+	if query.Name != "" {
+		filter["name"] = query.Name
+	}
+	if query.Failed != nil {
+		if *query.Failed {
+			filter["failed"] = true
+		} else {
+			filter["failed"] = bson.M{"$ne": true}
+		}
+	}
+	if query.Since != nil {
+		filter["started"] = bson.M{"$gte": *query.Since}
+	}
+	if query.After != "" {
+		if !bson.IsObjectIdHex(query.After) {
+			return nil, errors.Errorf("invalid test ID '%s'", query.After)
+		}
+		filter["_id"] = bson.M{"$lt": bson.ObjectIdHex(query.After)}
+	}
+
+	tests := []Test{}
+	err := db.C(TestsCollection).Find(filter).Sort("-_id").Limit(query.Limit).All(&tests)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding tests")
+	}
+	return tests, nil
+}
+
 // RemoveTestsForBuild removes all tests that are part of the given build.
 func RemoveTestsForBuild(buildID string) (int, error) {
 	db, closeSession := db.DB()
@@ -114,8 +196,14 @@ func (t *Test) findNext() (*Test, error) {
 	return nextTest, nil
 }
 
-// GetExecutionWindow returns the extents of the test.
+// GetExecutionWindow returns the extents of the test. If the test hasn't been
+// marked as ended, its end is assumed to be the start of the next test in the
+// build, if there is one.
 func (t *Test) GetExecutionWindow() (time.Time, *time.Time, error) {
+	if t.Ended != nil {
+		return t.Started, t.Ended, nil
+	}
+
 	var maxTime *time.Time
 	nextTest, err := t.findNext()
 	if err != nil {
@@ -1,12 +1,15 @@
 package model
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -26,11 +29,47 @@ func TestIncrementTestSequence(t *testing.T) {
 	assert.Equal(t, test.Seq, 2)
 }
 
+func TestIncrementTestSequenceForBatch(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(TestsCollection))
+
+	test := &Test{Id: bson.NewObjectId()}
+	require.NoError(t, test.Insert())
+
+	applied, err := test.IncrementSequenceForBatch(2, "batch0")
+	require.NoError(t, err)
+	assert.True(t, applied)
+	assert.Equal(t, 2, test.Seq)
+
+	applied, err = test.IncrementSequenceForBatch(2, "batch0")
+	require.NoError(t, err)
+	assert.False(t, applied)
+	assert.Equal(t, 2, test.Seq)
+
+	require.NoError(t, test.ForgetBatch("batch0"))
+	applied, err = test.IncrementSequenceForBatch(2, "batch0")
+	require.NoError(t, err)
+	assert.True(t, applied)
+	assert.Equal(t, 4, test.Seq)
+
+	for i := 0; i < MaxRememberedBatches+1; i++ {
+		_, err = test.IncrementSequenceForBatch(1, fmt.Sprintf("batch%d", i+1))
+		require.NoError(t, err)
+	}
+	assert.Len(t, test.Batches, MaxRememberedBatches)
+	assert.NotContains(t, test.Batches, "batch0", "the oldest batches are forgotten")
+
+	missing := &Test{Id: bson.NewObjectId()}
+	applied, err = missing.IncrementSequenceForBatch(1, "batch0")
+	assert.Equal(t, mgo.ErrNotFound, errors.Cause(err), "a missing test isn't mistaken for a duplicate batch")
+	assert.False(t, applied)
+}
+
 func TestFindTestsForBuild(t *testing.T) {
 	require.NoError(t, testutil.InitDB())
 	require.NoError(t, testutil.ClearCollections(TestsCollection))
 
-	require.NoError(t, (&Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}).Insert())
+	require.NoError(t, (&Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Builder: "builder0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}).Insert())
 	require.NoError(t, (&Test{Id: bson.NewObjectId(), Name: "t1", BuildId: "b0", Started: time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC)}).Insert())
 	require.NoError(t, (&Test{Id: bson.NewObjectId(), BuildId: "b1"}).Insert())
 
@@ -41,6 +80,67 @@ func TestFindTestsForBuild(t *testing.T) {
 	assert.Equal(t, tests[1].Name, "t1")
 }
 
+func TestFindTests(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(TestsCollection, BuildsCollection))
+
+	start := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	require.NoError(t, (&Build{Id: "b0", Builder: "builder0", Started: start}).Insert())
+	require.NoError(t, (&Build{Id: "b1", Builder: "builder0", Started: start.Add(time.Hour)}).Insert())
+	require.NoError(t, (&Build{Id: "b2", Builder: "builder1", Started: start.Add(time.Hour)}).Insert())
+
+	t0 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Builder: "builder0", Started: start, Failed: true}
+	t1 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b1", Builder: "builder0", Started: start.Add(time.Hour)}
+	t2 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b2", Builder: "builder1", Started: start.Add(time.Hour), Failed: true}
+	t3 := Test{Id: bson.NewObjectId(), Name: "t1", BuildId: "b1", Builder: "builder0", Started: start.Add(time.Hour)}
+	for _, test := range []Test{t0, t1, t2, t3} {
+		require.NoError(t, test.Insert())
+	}
+
+	testIDs := func(tests []Test) []bson.ObjectId {
+		ids := []bson.ObjectId{}
+		for _, test := range tests {
+			ids = append(ids, test.Id)
+		}
+		return ids
+	}
+
+	t.Run("Name", func(t *testing.T) {
+		tests, err := FindTests(TestQuery{Name: "t0"})
+		require.NoError(t, err)
+		assert.Equal(t, []bson.ObjectId{t2.Id, t1.Id, t0.Id}, testIDs(tests))
+	})
+
+	t.Run("BuilderAndFailed", func(t *testing.T) {
+		failed := true
+		tests, err := FindTests(TestQuery{Builder: "builder0", Name: "t0", Failed: &failed})
+		require.NoError(t, err)
+		assert.Equal(t, []bson.ObjectId{t0.Id}, testIDs(tests))
+
+		failed = false
+		tests, err = FindTests(TestQuery{Builder: "builder0", Failed: &failed})
+		require.NoError(t, err)
+		assert.Equal(t, []bson.ObjectId{t3.Id, t1.Id}, testIDs(tests))
+	})
+
+	t.Run("Since", func(t *testing.T) {
+		since := start.Add(time.Minute)
+		tests, err := FindTests(TestQuery{Builder: "builder0", Since: &since})
+		require.NoError(t, err)
+		assert.Equal(t, []bson.ObjectId{t3.Id, t1.Id}, testIDs(tests))
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		tests, err := FindTests(TestQuery{Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []bson.ObjectId{t3.Id, t2.Id}, testIDs(tests))
+
+		tests, err = FindTests(TestQuery{After: t2.Id.Hex(), Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []bson.ObjectId{t1.Id, t0.Id}, testIDs(tests))
+	})
+}
+
 func TestRemoveTestsForBuild(t *testing.T) {
 	require.NoError(t, testutil.InitDB())
 	require.NoError(t, testutil.ClearCollections(TestsCollection))
@@ -58,7 +158,7 @@ func TestFindNext(t *testing.T) {
 	require.NoError(t, testutil.InitDB())
 	require.NoError(t, testutil.ClearCollections(TestsCollection))
 
-	t0 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}
+	t0 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Builder: "builder0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}
 	t1 := Test{Id: bson.NewObjectId(), Name: "t1", BuildId: "b0", Started: time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC)}
 	require.NoError(t, t0.Insert())
 	require.NoError(t, t1.Insert())
@@ -74,7 +174,7 @@ func TestGetExecutionWindow(t *testing.T) {
 	t.Run("NoLaterTest", func(t *testing.T) {
 		require.NoError(t, testutil.ClearCollections(TestsCollection))
 
-		t0 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}
+		t0 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Builder: "builder0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}
 		assert.NoError(t, t0.Insert())
 		minTime, maxTime, err := t0.GetExecutionWindow()
 		assert.NoError(t, err)
@@ -85,7 +185,7 @@ func TestGetExecutionWindow(t *testing.T) {
 	t.Run("LaterTest", func(t *testing.T) {
 		require.NoError(t, testutil.ClearCollections(TestsCollection))
 
-		t0 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}
+		t0 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Builder: "builder0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}
 		assert.NoError(t, t0.Insert())
 		t1 := Test{Id: bson.NewObjectId(), Name: "t1", BuildId: "b0", Started: time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC)}
 		assert.NoError(t, t1.Insert())
@@ -95,4 +195,40 @@ func TestGetExecutionWindow(t *testing.T) {
 		require.NotNil(t, maxTime)
 		assert.True(t, t1.Started.Equal(*maxTime))
 	})
+
+	t.Run("Ended", func(t *testing.T) {
+		require.NoError(t, testutil.ClearCollections(TestsCollection))
+
+		t0 := Test{Id: bson.NewObjectId(), Name: "t0", BuildId: "b0", Builder: "builder0", Started: time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)}
+		assert.NoError(t, t0.Insert())
+		t1 := Test{Id: bson.NewObjectId(), Name: "t1", BuildId: "b0", Started: time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC)}
+		assert.NoError(t, t1.Insert())
+		ended := time.Date(2009, time.November, 10, 23, 0, 30, 0, time.UTC)
+		require.NoError(t, t0.End(ended, false))
+		minTime, maxTime, err := t0.GetExecutionWindow()
+		assert.NoError(t, err)
+		assert.True(t, t0.Started.Equal(minTime))
+		require.NotNil(t, maxTime)
+		assert.True(t, ended.Equal(*maxTime))
+	})
+}
+
+func TestEndTest(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(TestsCollection))
+
+	test := &Test{Id: bson.NewObjectId(), BuildId: "b0"}
+	require.NoError(t, test.Insert())
+
+	ended := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	require.NoError(t, test.End(ended, true))
+	require.NotNil(t, test.Ended)
+	assert.True(t, ended.Equal(*test.Ended))
+	assert.True(t, test.Failed)
+
+	test, err := FindTestByID(test.Id.Hex())
+	require.NoError(t, err)
+	require.NotNil(t, test.Ended)
+	assert.True(t, ended.Equal(*test.Ended))
+	assert.True(t, test.Failed)
 }
@@ -7,7 +7,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var ErrReadSizeLimitExceeded = errors.New("read size limit exceeded")
@@ -73,6 +80,257 @@ func (lk *logKeeper) checkContentLength(r *http.Request) *apiError {
 	return nil
 }
 
+// batchIDHeader is the header in which clients may identify a batch of log
+// lines they append, so that a retried append isn't written twice.
+const batchIDHeader = "Idempotency-Key"
+
+// readBatchID returns the batch ID from the request's headers, which is empty
+// if the client didn't send one.
+func readBatchID(r *http.Request) (string, *apiError) {
+	batchID := r.Header.Get(batchIDHeader)
+	if err := model.ValidateBatchID(batchID); err != nil {
+		return "", &apiError{
+			Err:  fmt.Sprintf("invalid %s header: %s", batchIDHeader, err),
+			code: http.StatusBadRequest,
+		}
+	}
+
+	return batchID, nil
+}
+
+// logWindow describes the subset of a log requested by the client. The time
+// bounds are nil when open-ended, and toLine is negative when there's no last
+// line. If tail is positive only the last tail lines of the window are
+// returned.
+type logWindow struct {
+	start    *time.Time
+	end      *time.Time
+	fromLine int
+	toLine   int
+	tail     int
+}
+
+// numbered returns true if the window's lines can be numbered by their
+// position in the whole log, which is only the case when the window starts
+// with the log's first line.
+func (w logWindow) numbered() bool {
+	return w.start == nil && w.tail == 0
+}
+
+// timeRange returns the window's time bounds as a storage.TimeRange.
+func (w logWindow) timeRange() storage.TimeRange {
+	timeRange := storage.NewTimeRange(storage.TimeRangeMin, storage.TimeRangeMax)
+	if w.start != nil {
+		timeRange.StartAt = *w.start
+	}
+	if w.end != nil {
+		timeRange.EndAt = *w.end
+	}
+
+	return timeRange
+}
+
+// readLogWindow parses the start, end, from_line, to_line, and tail query
+// parameters of a log request. Times may be given either in RFC3339 format or
+// as milliseconds since the epoch.
+func readLogWindow(r *http.Request) (logWindow, *apiError) {
+	window := logWindow{toLine: -1}
+
+	for _, bound := range []struct {
+		name string
+		out  **time.Time
+	}{
+		{name: "start", out: &window.start},
+		{name: "end", out: &window.end},
+	} {
+		value := r.FormValue(bound.name)
+		if value == "" {
+			continue
+		}
+		t, err := parseTimeParam(value)
+		if err != nil {
+			return logWindow{}, &apiError{
+				Err:  fmt.Sprintf("invalid %s time '%s'", bound.name, value),
+				code: http.StatusBadRequest,
+			}
+		}
+		*bound.out = &t
+	}
+
+	for _, bound := range []struct {
+		name string
+		out  *int
+	}{
+		{name: "from_line", out: &window.fromLine},
+		{name: "to_line", out: &window.toLine},
+		{name: "tail", out: &window.tail},
+	} {
+		value := r.FormValue(bound.name)
+		if value == "" {
+			continue
+		}
+		line, err := strconv.Atoi(value)
+		if err != nil || line < 0 {
+			return logWindow{}, &apiError{
+				Err:  fmt.Sprintf("invalid %s '%s'", bound.name, value),
+				code: http.StatusBadRequest,
+			}
+		}
+		*bound.out = line
+	}
+
+	if !window.numbered() && (window.fromLine > 0 || window.toLine >= 0) {
+		return logWindow{}, &apiError{
+			Err:  "from_line and to_line can't be combined with start or tail",
+			code: http.StatusBadRequest,
+		}
+	}
+
+	return window, nil
+}
+
+// logSearch describes a search over a log's lines.
+type logSearch struct {
+	matches func(string) bool
+	context int
+}
+
+// readLogSearch parses the q, regex, and context query parameters of a search
+// request. The query is matched as a substring unless regex is set, in which
+// case it's compiled as an RE2 regular expression.
+func readLogSearch(r *http.Request) (logSearch, *apiError) {
+	query := r.FormValue("q")
+	if query == "" {
+		return logSearch{}, &apiError{Err: "missing search query", code: http.StatusBadRequest}
+	}
+
+	search := logSearch{
+		matches: func(line string) bool { return strings.Contains(line, query) },
+	}
+	if len(r.FormValue("regex")) > 0 {
+		pattern, err := regexp.Compile(query)
+		if err != nil {
+			return logSearch{}, &apiError{
+				Err:  fmt.Sprintf("invalid regular expression '%s': %s", query, err.Error()),
+				code: http.StatusBadRequest,
+			}
+		}
+		search.matches = pattern.MatchString
+	}
+
+	if value := r.FormValue("context"); value != "" {
+		numLines, err := strconv.Atoi(value)
+		if err != nil || numLines < 0 {
+			return logSearch{}, &apiError{
+				Err:  fmt.Sprintf("invalid context '%s'", value),
+				code: http.StatusBadRequest,
+			}
+		}
+		search.context = numLines
+	}
+
+	return search, nil
+}
+
+const (
+	defaultTestQueryLimit = 100
+	maxTestQueryLimit     = 1000
+)
+
+// readTestQuery parses the builder, name, failed, since, after, and limit
+// query parameters of a cross-build test search.
+func readTestQuery(r *http.Request) (model.TestQuery, *apiError) {
+	query := model.TestQuery{
+		Builder: r.FormValue("builder"),
+		Name:    r.FormValue("name"),
+		Limit:   defaultTestQueryLimit,
+	}
+
+	if value := r.FormValue("failed"); value != "" {
+		failed, err := strconv.ParseBool(value)
+		if err != nil {
+			return model.TestQuery{}, &apiError{Err: fmt.Sprintf("invalid failed '%s'", value), code: http.StatusBadRequest}
+		}
+		query.Failed = &failed
+	}
+
+	if value := r.FormValue("since"); value != "" {
+		since, err := parseTimeParam(value)
+		if err != nil {
+			return model.TestQuery{}, &apiError{Err: fmt.Sprintf("invalid since time '%s'", value), code: http.StatusBadRequest}
+		}
+		query.Since = &since
+	}
+
+	if value := r.FormValue("after"); value != "" {
+		if !bson.IsObjectIdHex(value) {
+			return model.TestQuery{}, &apiError{Err: fmt.Sprintf("invalid after '%s'", value), code: http.StatusBadRequest}
+		}
+		query.After = value
+	}
+
+	if value := r.FormValue("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxTestQueryLimit {
+			return model.TestQuery{}, &apiError{
+				Err:  fmt.Sprintf("invalid limit '%s', must be between 1 and %d", value, maxTestQueryLimit),
+				code: http.StatusBadRequest,
+			}
+		}
+		query.Limit = limit
+	}
+
+	return query, nil
+}
+
+const (
+	defaultRetentionReportLimit = 1000
+	maxRetentionReportLimit     = 10000
+)
+
+// readRetentionReportLimit returns the maximum number of builds to list in a
+// retention report.
+func readRetentionReportLimit(r *http.Request) (int, *apiError) {
+	value := r.FormValue("limit")
+	if value == "" {
+		return defaultRetentionReportLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxRetentionReportLimit {
+		return 0, &apiError{
+			Err:  fmt.Sprintf("invalid limit '%s', must be between 1 and %d", value, maxRetentionReportLimit),
+			code: http.StatusBadRequest,
+		}
+	}
+
+	return limit, nil
+}
+
+// parseStatus returns true if the status reported for a test or build is
+// failed.
+func parseStatus(status string) (bool, *apiError) {
+	switch status {
+	case statusPassed:
+		return false, nil
+	case statusFailed:
+		return true, nil
+	default:
+		return false, &apiError{
+			Err:  fmt.Sprintf("invalid status '%s', must be '%s' or '%s'", status, statusPassed, statusFailed),
+			code: http.StatusBadRequest,
+		}
+	}
+}
+
+func parseTimeParam(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond)).UTC(), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
 type ctxKey int
 
 const (
@@ -0,0 +1,164 @@
+package logkeeper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReadLogWindow(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		window, err := readLogWindow(httptest.NewRequest(http.MethodGet, "/build/b0/all", nil))
+		require.Nil(t, err)
+		assert.Nil(t, window.start)
+		assert.Nil(t, window.end)
+		assert.Equal(t, 0, window.fromLine)
+		assert.Equal(t, -1, window.toLine)
+		assert.Zero(t, window.tail)
+		assert.Equal(t, storage.NewTimeRange(storage.TimeRangeMin, storage.TimeRangeMax), window.timeRange())
+	})
+
+	t.Run("AllParameters", func(t *testing.T) {
+		window, err := readLogWindow(httptest.NewRequest(http.MethodGet, "/build/b0/all?start=2009-11-10T23:00:00Z&end=1257894060000&tail=5", nil))
+		require.Nil(t, err)
+		require.NotNil(t, window.start)
+		require.NotNil(t, window.end)
+		assert.True(t, window.start.Equal(time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)))
+		assert.True(t, window.end.Equal(time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC)))
+		assert.Equal(t, 5, window.tail)
+		assert.False(t, window.numbered())
+		assert.Equal(t, storage.NewTimeRange(*window.start, *window.end), window.timeRange())
+
+		window, err = readLogWindow(httptest.NewRequest(http.MethodGet, "/build/b0/all?end=1257894060000&from_line=10&to_line=20", nil))
+		require.Nil(t, err)
+		assert.Equal(t, 10, window.fromLine)
+		assert.Equal(t, 20, window.toLine)
+		assert.True(t, window.numbered())
+	})
+
+	t.Run("LineRangeWithoutLineNumbers", func(t *testing.T) {
+		for _, query := range []string{"start=1257894000000&from_line=10", "tail=5&to_line=20"} {
+			_, err := readLogWindow(httptest.NewRequest(http.MethodGet, "/build/b0/all?"+query, nil))
+			require.NotNil(t, err, query)
+			assert.Equal(t, http.StatusBadRequest, err.code, query)
+		}
+	})
+
+	t.Run("InvalidTime", func(t *testing.T) {
+		_, err := readLogWindow(httptest.NewRequest(http.MethodGet, "/build/b0/all?start=yesterday", nil))
+		require.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.code)
+	})
+
+	t.Run("InvalidLine", func(t *testing.T) {
+		_, err := readLogWindow(httptest.NewRequest(http.MethodGet, "/build/b0/all?to_line=-3", nil))
+		require.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.code)
+
+		_, err = readLogWindow(httptest.NewRequest(http.MethodGet, "/build/b0/all?tail=last", nil))
+		require.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.code)
+	})
+}
+
+func TestReadLogSearch(t *testing.T) {
+	t.Run("Substring", func(t *testing.T) {
+		search, err := readLogSearch(httptest.NewRequest(http.MethodGet, "/build/b0/test/t0/search?q=a.c&context=3", nil))
+		require.Nil(t, err)
+		assert.True(t, search.matches("xa.cx"))
+		assert.False(t, search.matches("abc"))
+		assert.Equal(t, 3, search.context)
+	})
+
+	t.Run("Regex", func(t *testing.T) {
+		search, err := readLogSearch(httptest.NewRequest(http.MethodGet, "/build/b0/test/t0/search?q=a.c&regex=1", nil))
+		require.Nil(t, err)
+		assert.True(t, search.matches("abc"))
+		assert.Zero(t, search.context)
+	})
+
+	t.Run("MissingQuery", func(t *testing.T) {
+		_, err := readLogSearch(httptest.NewRequest(http.MethodGet, "/build/b0/test/t0/search", nil))
+		require.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.code)
+	})
+
+	t.Run("InvalidRegex", func(t *testing.T) {
+		_, err := readLogSearch(httptest.NewRequest(http.MethodGet, "/build/b0/test/t0/search?q=(&regex=1", nil))
+		require.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.code)
+	})
+
+	t.Run("InvalidContext", func(t *testing.T) {
+		_, err := readLogSearch(httptest.NewRequest(http.MethodGet, "/build/b0/test/t0/search?q=a&context=many", nil))
+		require.NotNil(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.code)
+	})
+}
+
+func TestReadTestQuery(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		query, err := readTestQuery(httptest.NewRequest(http.MethodGet, "/tests", nil))
+		require.Nil(t, err)
+		assert.Equal(t, model.TestQuery{Limit: defaultTestQueryLimit}, query)
+	})
+
+	t.Run("AllParameters", func(t *testing.T) {
+		after := bson.NewObjectId().Hex()
+		query, err := readTestQuery(httptest.NewRequest(http.MethodGet, "/tests?builder=b&name=n&failed=true&since=1257894000000&after="+after+"&limit=10", nil))
+		require.Nil(t, err)
+		assert.Equal(t, "b", query.Builder)
+		assert.Equal(t, "n", query.Name)
+		require.NotNil(t, query.Failed)
+		assert.True(t, *query.Failed)
+		require.NotNil(t, query.Since)
+		assert.True(t, query.Since.Equal(time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)))
+		assert.Equal(t, after, query.After)
+		assert.Equal(t, 10, query.Limit)
+	})
+
+	t.Run("InvalidParameters", func(t *testing.T) {
+		for _, params := range []string{"failed=maybe", "since=yesterday", "after=abc", "limit=0", "limit=1001"} {
+			_, err := readTestQuery(httptest.NewRequest(http.MethodGet, "/tests?"+params, nil))
+			require.NotNil(t, err, params)
+			assert.Equal(t, http.StatusBadRequest, err.code)
+		}
+	})
+}
+
+func TestParseStatus(t *testing.T) {
+	failed, err := parseStatus("passed")
+	require.Nil(t, err)
+	assert.False(t, failed)
+
+	failed, err = parseStatus("failed")
+	require.Nil(t, err)
+	assert.True(t, failed)
+
+	_, err = parseStatus("")
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusBadRequest, err.code)
+}
+
+func TestReadRetentionReportLimit(t *testing.T) {
+	limit, err := readRetentionReportLimit(httptest.NewRequest(http.MethodGet, "/retention/report", nil))
+	require.Nil(t, err)
+	assert.Equal(t, defaultRetentionReportLimit, limit)
+
+	limit, err = readRetentionReportLimit(httptest.NewRequest(http.MethodGet, "/retention/report?limit=10", nil))
+	require.Nil(t, err)
+	assert.Equal(t, 10, limit)
+
+	for _, value := range []string{"0", "-1", "ten", "10001"} {
+		_, err = readRetentionReportLimit(httptest.NewRequest(http.MethodGet, "/retention/report?limit="+value, nil))
+		require.NotNil(t, err, value)
+		assert.Equal(t, http.StatusBadRequest, err.code)
+	}
+}
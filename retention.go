@@ -0,0 +1,88 @@
+package logkeeper
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+)
+
+// retentionReportBuild is a build that the retention policies allow to be
+// deleted.
+type retentionReportBuild struct {
+	Id      string    `json:"id"`
+	Builder string    `json:"builder"`
+	Started time.Time `json:"started"`
+	TaskID  string    `json:"task_id,omitempty"`
+	// Category is the retention category the build was evaluated in. Builds
+	// in the passed category are only deleted once the task status provider
+	// confirms that their task succeeded.
+	Category string `json:"category"`
+	// Retention is how long the build's rule keeps builds in its category.
+	Retention string `json:"retention"`
+}
+
+type retentionReport struct {
+	Builds []retentionReportBuild `json:"builds"`
+	// Truncated is true if more builds would be deleted than were listed.
+	Truncated bool `json:"truncated"`
+}
+
+func (lk *logKeeper) retentionPolicies() model.RetentionPolicies {
+	if lk.opts.RetentionPolicies == nil {
+		return model.DefaultRetentionPolicies()
+	}
+
+	return *lk.opts.RetentionPolicies
+}
+
+// retentionReport lists the builds that the cleanup jobs would delete under
+// the current retention policies, without deleting anything.
+func (lk *logKeeper) retentionReport(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	limit, limitErr := readRetentionReportLimit(r)
+	if limitErr != nil {
+		lk.render.WriteJSON(w, limitErr.code, *limitErr)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	policies := lk.retentionPolicies()
+	builds, errs := lk.opts.Store.StreamingGetOldBuilds(ctx, policies)
+	report := retentionReport{Builds: []retentionReportBuild{}}
+reportLoop:
+	for {
+		select {
+		case err := <-errs:
+			if err != nil {
+				lk.logErrorf(r, "Error finding expired builds: %v", err)
+				lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+				return
+			}
+			break reportLoop
+		case build, ok := <-builds:
+			if !ok {
+				break reportLoop
+			}
+			if len(report.Builds) == limit {
+				report.Truncated = true
+				break reportLoop
+			}
+			category := build.RetentionCategory()
+			report.Builds = append(report.Builds, retentionReportBuild{
+				Id:        build.Id,
+				Builder:   build.Builder,
+				Started:   build.Started,
+				TaskID:    build.Info.TaskID,
+				Category:  category,
+				Retention: policies.ForBuilder(build.Builder).Retention(category).String(),
+			})
+		}
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/pkg/errors"
+)
+
+// bucketStore is a LogStore backed by pail-based offline storage.
+type bucketStore struct {
+	bucket Bucket
+}
+
+// NewBucketStore returns a LogStore that keeps everything in the bucket. The
+// bucket has no index of tests across builds or of build ages, so searching
+// tests and finding old builds aren't supported.
+func NewBucketStore(bucket Bucket) LogStore {
+	return &bucketStore{bucket: bucket}
+}
+
+func (s *bucketStore) InsertBuild(ctx context.Context, build model.Build) error {
+	return s.bucket.UploadBuildMetadata(ctx, build)
+}
+
+func (s *bucketStore) FindBuildByID(ctx context.Context, id string) (*model.Build, error) {
+	build, err := s.bucket.FindBuildByID(ctx, id)
+	if err != nil || build == nil {
+		return nil, err
+	}
+
+	// The metadata doesn't record where the build is stored, but anything
+	// read from the bucket is evidently stored there.
+	build.S3 = true
+	return build, nil
+}
+
+func (s *bucketStore) FindBuildByBuilder(ctx context.Context, builder string, buildNum int) (*model.Build, error) {
+	id, err := model.NewBuildId(builder, buildNum)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.FindBuildByID(ctx, id)
+}
+
+func (s *bucketStore) FinishBuild(ctx context.Context, build *model.Build, ended time.Time, failed bool, phases []string) error {
+	build.Ended = &ended
+	build.Failed = failed
+	if phases != nil {
+		build.Phases = phases
+	}
+
+	return s.bucket.UploadBuildMetadata(ctx, *build)
+}
+
+func (s *bucketStore) SetBuildHold(ctx context.Context, build *model.Build, hold *model.BuildHold) error {
+	build.Hold = hold
+	return s.bucket.UploadBuildMetadata(ctx, *build)
+}
+
+func (s *bucketStore) InsertTest(ctx context.Context, _ *model.Build, test model.Test) error {
+	return s.bucket.UploadTestMetadata(ctx, test)
+}
+
+func (s *bucketStore) FindTestByID(ctx context.Context, build *model.Build, testID string) (*model.Test, error) {
+	return s.bucket.FindTestByID(ctx, build.Id, testID)
+}
+
+func (s *bucketStore) FindTestsForBuild(ctx context.Context, build *model.Build) ([]model.Test, error) {
+	return s.bucket.FindTestsForBuild(ctx, build.Id)
+}
+
+func (s *bucketStore) FindTests(_ context.Context, _ model.TestQuery) ([]model.Test, error) {
+	return nil, errors.New("searching tests is not supported by bucket storage")
+}
+
+func (s *bucketStore) EndTest(ctx context.Context, _ *model.Build, test *model.Test, ended time.Time, failed bool) error {
+	test.Ended = &ended
+	test.Failed = failed
+	return s.bucket.UploadTestMetadata(ctx, *test)
+}
+
+func (s *bucketStore) InsertLogChunks(ctx context.Context, build *model.Build, test *model.Test, batchID string, chunks []model.LogChunk) (bool, error) {
+	testID := ""
+	if test != nil {
+		testID = test.Id.Hex()
+	}
+
+	return s.bucket.InsertLogBatch(ctx, build.Id, testID, batchID, chunks)
+}
+
+func (s *bucketStore) GetTestLogLines(ctx context.Context, build *model.Build, test *model.Test, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error) {
+	if reverse {
+		return s.bucket.GetTestLogLinesReverse(ctx, build.Id, test.Id.Hex(), timeRange)
+	}
+
+	return s.bucket.GetTestLogLines(ctx, build.Id, test.Id.Hex(), timeRange)
+}
+
+func (s *bucketStore) GetTestLogLinesFrom(ctx context.Context, build *model.Build, test *model.Test, timeRange TimeRange, cursor LogCursor) (chan *model.LogLineItem, error) {
+	return s.bucket.GetTestLogLinesFrom(ctx, build.Id, test.Id.Hex(), timeRange.from(cursor.Test), timeRange.from(cursor.Global))
+}
+
+func (s *bucketStore) GetAllLogLines(ctx context.Context, build *model.Build, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error) {
+	if reverse {
+		return s.bucket.GetAllLogLinesReverse(ctx, build.Id, timeRange)
+	}
+
+	return s.bucket.GetAllLogLines(ctx, build.Id, timeRange)
+}
+
+func (s *bucketStore) StreamingGetOldBuilds(ctx context.Context, _ model.RetentionPolicies) (<-chan model.Build, <-chan error) {
+	return unsupportedBuildStream(ctx, errors.New("finding old builds is not supported by bucket storage"))
+}
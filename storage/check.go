@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of problems that CheckBuild finds.
+const (
+	// ProblemInvalidKey is a key under the build's prefix that isn't
+	// metadata, a manifest, a batch record, or a valid chunk key.
+	ProblemInvalidKey = "invalid_key"
+	// ProblemUnreadableChunk is a chunk that can't be fetched, decoded, or
+	// parsed into log lines.
+	ProblemUnreadableChunk = "unreadable_chunk"
+	// ProblemLineCount is a chunk whose number of lines differs from the
+	// number in its key, which readers report as corrupt data.
+	ProblemLineCount = "line_count"
+	// ProblemMissingMetadata is a build without metadata.
+	ProblemMissingMetadata = "missing_metadata"
+	// ProblemInvalidMetadata is build or test metadata that doesn't parse
+	// or doesn't match its key.
+	ProblemInvalidMetadata = "invalid_metadata"
+	// ProblemOrphanTest is a test with chunks or batch records but without
+	// metadata, so its logs can't be found.
+	ProblemOrphanTest = "orphan_test"
+	// ProblemInvalidManifest is a manifest that doesn't parse, or a test
+	// manifest that the build's manifest names but that doesn't exist,
+	// which makes reading the build's logs fail.
+	ProblemInvalidManifest = "invalid_manifest"
+	// ProblemMissingChunk is a chunk in the manifest that isn't in the
+	// bucket.
+	ProblemMissingChunk = "missing_chunk"
+)
+
+// CheckProblem is a problem with one of a build's keys.
+type CheckProblem struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key"`
+	Message string `json:"message"`
+	// Repaired is true if the problem was fixed in repair mode.
+	Repaired bool `json:"repaired,omitempty"`
+	// RepairedKey is the key a chunk was moved to in repair mode.
+	RepairedKey string `json:"repaired_key,omitempty"`
+}
+
+// CheckReport describes the problems found with a build's data in the bucket.
+type CheckReport struct {
+	BuildID string `json:"build_id"`
+	Keys    int    `json:"keys"`
+	Chunks  int    `json:"chunks"`
+	Tests   int    `json:"tests"`
+	// Lines is the number of lines in the build's readable chunks keyed by
+	// test ID, with the global logs keyed by the empty string.
+	Lines    map[string]int `json:"lines"`
+	Problems []CheckProblem `json:"problems"`
+}
+
+// Clean returns true if the build has no problems that remain unrepaired.
+func (r CheckReport) Clean() bool {
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addProblem adds a problem to the report and returns its index.
+func (r *CheckReport) addProblem(kind, key, message string) int {
+	r.Problems = append(r.Problems, CheckProblem{Kind: kind, Key: key, Message: message})
+	return len(r.Problems) - 1
+}
+
+// CheckBuild walks the keys under the build's prefix and reports invalid
+// chunk keys, chunks whose contents don't match their keys, metadata that
+// doesn't parse, tests without metadata, and manifest entries without chunks.
+//
+// In repair mode, chunks with the wrong number of lines in their key are
+// moved to the key that matches their contents, unreadable manifests are
+// removed so that readers list the build's chunks, and manifests are rewritten
+// to refer to the moved chunks and to drop missing ones. Other problems are
+// only reported.
+func (b *Bucket) CheckBuild(ctx context.Context, buildID string, repair bool) (CheckReport, error) {
+	report := CheckReport{BuildID: buildID, Lines: map[string]int{}, Problems: []CheckProblem{}}
+
+	// The keys are listed up front, since repairs add keys under the
+	// prefix.
+	keys := []string{}
+	iterator, err := b.List(ctx, buildPrefix(buildID))
+	if err != nil {
+		return report, errors.Wrapf(err, "listing keys for build '%s'", buildID)
+	}
+	for iterator.Next(ctx) {
+		keys = append(keys, iterator.Item().Name())
+	}
+	if err = iterator.Err(); err != nil {
+		return report, errors.Wrapf(err, "iterating keys for build '%s'", buildID)
+	}
+	report.Keys = len(keys)
+
+	var (
+		hasMetadata     bool
+		manifestKeys    []string
+		existing        = map[string]bool{}
+		hasTestMetadata = map[string]bool{}
+		testKeys        = map[string]string{}
+		moved           = map[string]LogChunkInfo{}
+	)
+	for _, key := range keys {
+		existing[key] = true
+		if testID, err := testIdFromKey(key); err == nil {
+			if _, ok := testKeys[testID]; !ok {
+				testKeys[testID] = key
+			}
+		}
+
+		switch {
+		case key == metadataKeyForBuildId(buildID):
+			hasMetadata = true
+			metadata := buildMetadata{}
+			if err = b.readJSON(ctx, key, &metadata); err != nil {
+				report.addProblem(ProblemInvalidMetadata, key, err.Error())
+			} else if metadata.ID != buildID {
+				report.addProblem(ProblemInvalidMetadata, key, fmt.Sprintf("metadata is for build '%s'", metadata.ID))
+			}
+		case strings.HasSuffix(key, "/"+manifestFilename):
+			testID, err := testIdFromKey(key)
+			if key != manifestKeyForBuildId(buildID) && (err != nil || key != manifestKeyForTest(buildID, testID)) {
+				report.addProblem(ProblemInvalidKey, key, "manifest isn't for the build or one of its tests")
+				continue
+			}
+			manifestKeys = append(manifestKeys, key)
+		case isAppendManifestKey(buildID, key):
+			manifestKeys = append(manifestKeys, key)
+		case strings.Contains(key, "/"+batchesDirectory):
+		case strings.HasSuffix(key, "/"+metadataFilename):
+			testID, err := testIdFromKey(key)
+			if err != nil || key != metadataKeyForTest(buildID, testID) {
+				report.addProblem(ProblemInvalidKey, key, "metadata isn't for the build or one of its tests")
+				continue
+			}
+			metadata := testMetadata{}
+			if err = b.readJSON(ctx, key, &metadata); err != nil {
+				report.addProblem(ProblemInvalidMetadata, key, err.Error())
+				continue
+			}
+			if metadata.ID != testID || metadata.BuildID != buildID {
+				report.addProblem(ProblemInvalidMetadata, key, fmt.Sprintf("metadata is for test '%s' of build '%s'", metadata.ID, metadata.BuildID))
+				continue
+			}
+			hasTestMetadata[testID] = true
+		default:
+			if err = b.checkChunk(ctx, &report, buildID, key, repair, moved); err != nil {
+				return report, err
+			}
+		}
+	}
+	report.Tests = len(hasTestMetadata)
+
+	if !hasMetadata {
+		report.addProblem(ProblemMissingMetadata, metadataKeyForBuildId(buildID), "build has no metadata")
+	}
+	for testID, key := range testKeys {
+		if !hasTestMetadata[testID] {
+			report.addProblem(ProblemOrphanTest, key, fmt.Sprintf("test '%s' has no metadata", testID))
+		}
+	}
+	if len(manifestKeys) > 0 {
+		if err = b.checkManifests(ctx, &report, buildID, repair, manifestKeys, existing, moved); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// checkChunk checks that the key is a valid chunk key of the build and that
+// the chunk's contents match it, moving the chunk to a key that matches its
+// contents in repair mode.
+func (b *Bucket) checkChunk(ctx context.Context, report *CheckReport, buildID, key string, repair bool, moved map[string]LogChunkInfo) error {
+	info := LogChunkInfo{}
+	if err := info.fromKey(key); err != nil {
+		report.addProblem(ProblemInvalidKey, key, err.Error())
+		return nil
+	}
+	if info.BuildID != buildID || info.key() != key {
+		report.addProblem(ProblemInvalidKey, key, "key doesn't match the chunk it describes")
+		return nil
+	}
+	report.Chunks++
+
+	reader, err := getChunk(ctx, b, info)
+	if err != nil {
+		report.addProblem(ProblemUnreadableChunk, key, err.Error())
+		return nil
+	}
+	actual, err := readChunkInfo(reader, info)
+	_ = reader.Close()
+	if err != nil {
+		report.addProblem(ProblemUnreadableChunk, key, err.Error())
+		return nil
+	}
+	report.Lines[info.TestID] += actual.NumLines
+	if actual.NumLines == info.NumLines {
+		return nil
+	}
+
+	problem := report.addProblem(ProblemLineCount, key, fmt.Sprintf("key has %d lines but the chunk has %d", info.NumLines, actual.NumLines))
+	if !repair || actual.NumLines == 0 {
+		return nil
+	}
+	newKey := actual.key()
+	if taken, err := b.Get(ctx, newKey); err == nil {
+		_ = taken.Close()
+		report.Problems[problem].Message += ", and the key that matches it is taken"
+		return nil
+	}
+
+	data, err := b.readObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err = b.putConfirmed(ctx, newKey, data); err != nil {
+		return errors.Wrapf(err, "moving chunk '%s'", key)
+	}
+	if err = b.removeKeys(ctx, []string{key}); err != nil {
+		return errors.Wrapf(err, "removing moved chunk '%s'", key)
+	}
+	report.Problems[problem].Repaired = true
+	report.Problems[problem].RepairedKey = newKey
+	moved[key] = actual
+
+	return nil
+}
+
+// checkManifests checks that the build's manifests parse and that their
+// chunks exist, updating them for moved chunks in repair mode.
+func (b *Bucket) checkManifests(ctx context.Context, report *CheckReport, buildID string, repair bool, keys []string, existing map[string]bool, moved map[string]LogChunkInfo) error {
+	unlock := b.manifestLocks.lock(buildID)
+	defer unlock()
+
+	manifests, err := b.readBuildManifests(ctx, buildID)
+	if err != nil {
+		problem := report.addProblem(ProblemInvalidManifest, manifestKeyForBuildId(buildID), err.Error())
+		if repair {
+			if err = b.removeKeys(ctx, keys); err != nil {
+				return errors.Wrapf(err, "removing manifests for build '%s'", buildID)
+			}
+			report.Problems[problem].Repaired = true
+		}
+		return nil
+	}
+
+	chunks := manifests.chunks
+	updated := make([]LogChunkInfo, 0, len(chunks))
+	missing := []int{}
+	for _, chunk := range chunks {
+		if info, ok := moved[chunk.key()]; ok {
+			updated = append(updated, info)
+			continue
+		}
+		if !existing[chunk.key()] {
+			missing = append(missing, report.addProblem(ProblemMissingChunk, chunk.key(), "manifest refers to a chunk that doesn't exist"))
+			continue
+		}
+		updated = append(updated, chunk)
+	}
+	if !repair || len(updated) == len(chunks) && len(moved) == 0 {
+		return nil
+	}
+
+	if err = b.putManifests(ctx, buildID, updated, manifests.build.Retired); err != nil {
+		return err
+	}
+	if err = b.removeAppendManifests(ctx, buildID, manifests.appended); err != nil {
+		return err
+	}
+	for _, problem := range missing {
+		report.Problems[problem].Repaired = true
+	}
+
+	return nil
+}
+
+// readChunkInfo parses the chunk's lines and returns the info that matches
+// them, which is the given info if the chunk isn't corrupt.
+func readChunkInfo(reader io.Reader, info LogChunkInfo) (LogChunkInfo, error) {
+	actual := LogChunkInfo{BuildID: info.BuildID, TestID: info.TestID, Encoding: info.Encoding, Tag: info.Tag}
+	lines := bufio.NewReader(reader)
+	for {
+		// Like the iterators, this ignores anything after the last newline.
+		data, err := lines.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return actual, errors.Wrap(err, "reading chunk")
+		}
+
+		line, err := parseLogLineString(data)
+		if err != nil {
+			return actual, errors.Wrapf(err, "parsing line %d", actual.NumLines+1)
+		}
+		if actual.NumLines == 0 || line.Timestamp.Before(actual.Start) {
+			actual.Start = line.Timestamp
+		}
+		if line.Timestamp.After(actual.End) {
+			actual.End = line.Timestamp
+		}
+		actual.NumLines++
+	}
+
+	// Line timestamps only have millisecond precision, so the key's times
+	// are kept if they agree with the lines.
+	if info.Start.Truncate(1e6).Equal(actual.Start) && info.End.Truncate(1e6).Equal(actual.End) {
+		actual.Start, actual.End = info.Start, info.End
+	}
+
+	return actual, nil
+}
+
+// readJSON parses the JSON object at the key into out.
+func (b *Bucket) readJSON(ctx context.Context, key string, out interface{}) error {
+	reader, err := b.Get(ctx, key)
+	if err != nil {
+		return errors.Wrapf(err, "fetching '%s'", key)
+	}
+	defer reader.Close()
+
+	return errors.Wrapf(json.NewDecoder(reader).Decode(out), "parsing '%s'", key)
+}
+
+// readObject returns the object's raw contents.
+func (b *Bucket) readObject(ctx context.Context, key string) ([]byte, error) {
+	reader, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching '%s'", key)
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	return data, errors.Wrapf(err, "reading '%s'", key)
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckBuild(t *testing.T) {
+	const (
+		buildID   = "5a75f537726934e4b62833ab6d5dca41"
+		testID    = "62dba0159041307f697e6ccc"
+		chunkName = "1658560534848000000_1658560534869000000_11"
+	)
+	ctx := context.Background()
+	problemKinds := func(report CheckReport) []string {
+		kinds := []string{}
+		for _, problem := range report.Problems {
+			kinds = append(kinds, problem.Kind)
+		}
+		return kinds
+	}
+
+	t.Run("Clean", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+
+		report, err := storage.CheckBuild(ctx, buildID, false)
+		require.NoError(t, err)
+		assert.True(t, report.Clean())
+		assert.Empty(t, report.Problems)
+		assert.Equal(t, 6, report.Keys)
+		assert.Equal(t, 2, report.Chunks)
+		assert.Equal(t, 1, report.Tests)
+		assert.Equal(t, map[string]int{"": 4, testID: 11}, report.Lines)
+	})
+
+	t.Run("ReportsProblems", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+
+		require.NoError(t, storage.Put(ctx, metadataKeyForBuildId(buildID), bytes.NewReader([]byte("not json"))))
+		require.NoError(t, storage.Put(ctx, buildPrefix(buildID)+"not-a-chunk", bytes.NewReader([]byte("line"))))
+		require.NoError(t, storage.Put(ctx, buildPrefix(buildID)+"tests/orphan/1658560534848000000_1658560534848000000_1", bytes.NewReader([]byte(makeLogLineString(model.LogLine{Time: time.Unix(0, 1658560534848000000), Msg: "orphan"})))))
+
+		report, err := storage.CheckBuild(ctx, buildID, true)
+		require.NoError(t, err)
+		assert.False(t, report.Clean())
+		assert.ElementsMatch(t, []string{ProblemInvalidMetadata, ProblemInvalidKey, ProblemOrphanTest}, problemKinds(report))
+	})
+
+	t.Run("RepairsLineCount", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+
+		// Claim that the chunk has one line fewer than it does.
+		badKey := testPrefix(buildID, testID) + "1658560534848000000_1658560534869000000_10"
+		data, err := storage.readObject(ctx, testPrefix(buildID, testID)+chunkName)
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(ctx, badKey, bytes.NewReader(data)))
+		require.NoError(t, storage.removeKeys(ctx, []string{testPrefix(buildID, testID) + chunkName}))
+		test, _, err := storage.readManifest(ctx, buildID, testID)
+		require.NoError(t, err)
+		for i := range test.Chunks {
+			test.Chunks[i].NumLines = 10
+		}
+		require.NoError(t, storage.putManifest(ctx, test))
+
+		report, err := storage.CheckBuild(ctx, buildID, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{ProblemLineCount}, problemKinds(report))
+		assert.False(t, report.Clean())
+
+		report, err = storage.CheckBuild(ctx, buildID, true)
+		require.NoError(t, err)
+		require.Len(t, report.Problems, 1)
+		assert.True(t, report.Clean())
+		assert.Equal(t, testPrefix(buildID, testID)+chunkName, report.Problems[0].RepairedKey)
+
+		report, err = storage.CheckBuild(ctx, buildID, false)
+		require.NoError(t, err)
+		assert.Empty(t, report.Problems)
+		counts, err := storage.CountLogLines(ctx, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"": 4, testID: 11}, counts, "the manifest refers to the moved chunk")
+	})
+
+	t.Run("RepairsManifest", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+		require.NoError(t, storage.removeKeys(ctx, []string{buildPrefix(buildID) + "1658560532739000000_1658560535740000000_4"}))
+
+		report, err := storage.CheckBuild(ctx, buildID, true)
+		require.NoError(t, err)
+		assert.Equal(t, []string{ProblemMissingChunk}, problemKinds(report))
+		assert.True(t, report.Clean())
+		chunks, _, err := storage.readManifests(ctx, buildID)
+		require.NoError(t, err)
+		assert.Len(t, chunks, 1)
+
+		require.NoError(t, storage.Put(ctx, manifestKeyForTest(buildID, testID), bytes.NewReader([]byte("not json"))))
+		report, err = storage.CheckBuild(ctx, buildID, true)
+		require.NoError(t, err)
+		assert.Equal(t, []string{ProblemInvalidManifest}, problemKinds(report))
+		assert.True(t, report.Clean())
+		for _, logID := range []string{"", testID} {
+			_, ok, err := storage.readManifest(ctx, buildID, logID)
+			require.NoError(t, err)
+			assert.False(t, ok, "the build's manifests are removed if any is unparseable")
+		}
+		counts, err := storage.CountLogLines(ctx, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{testID: 11}, counts)
+	})
+
+	t.Run("MissingBuild", func(t *testing.T) {
+		storage := makeTestStorage(t, "")
+		defer cleanTestStorage(t)
+
+		report, err := storage.CheckBuild(ctx, buildID, false)
+		require.NoError(t, err)
+		assert.Zero(t, report.Keys)
+		assert.Equal(t, []string{ProblemMissingMetadata}, problemKinds(report))
+	})
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CompactionStats describes the chunks replaced by a compaction.
+type CompactionStats struct {
+	// Merged is the number of chunks that were merged into larger ones and
+	// retired.
+	Merged int
+	// Written is the number of chunks written in their place.
+	Written int
+}
+
+// CompactBuild merges runs of adjacent log chunks of each of the build's tests,
+// and of its global logs, into chunks of at most targetBytes of log lines
+// before encoding. Chunks whose time ranges overlap are never merged, since
+// the lines within a chunk must be in order. Merged chunks are written with
+// the bucket's encoding.
+//
+// The build must be finished, so that no chunks are added to it while it's
+// compacted. Only the chunks in the build's manifests are merged, or the
+// listed chunks if it doesn't have any. The merged chunks are written and read
+// back before the manifests are replaced to refer to them, which also folds
+// the build's append manifests into them. The chunks they replace are then
+// retired rather than removed, since readers may still be reading them
+// through the earlier manifests, until RemoveRetiredChunks removes them.
+// Nothing else under the build's prefix is removed.
+func (b *Bucket) CompactBuild(ctx context.Context, buildID string, targetBytes int) (CompactionStats, error) {
+	stats := CompactionStats{}
+	unlock := b.manifestLocks.lock(buildID)
+	defer unlock()
+
+	manifests, err := b.readBuildManifests(ctx, buildID)
+	if err != nil {
+		return stats, errors.Wrapf(err, "reading manifests for build '%s'", buildID)
+	}
+	chunks := manifests.chunks
+	if !manifests.ok {
+		if chunks, err = b.listChunks(ctx, buildID); err != nil {
+			return stats, errors.Wrapf(err, "listing chunks for build '%s'", buildID)
+		}
+	}
+	build := manifests.build
+
+	original := map[string]bool{}
+	referenced := map[string]bool{}
+	byTest := map[string][]LogChunkInfo{}
+	for _, chunk := range chunks {
+		original[chunk.key()] = true
+		referenced[chunk.key()] = true
+		byTest[chunk.TestID] = append(byTest[chunk.TestID], chunk)
+	}
+
+	compacted := []LogChunkInfo{}
+	for _, testChunks := range byTest {
+		sortByStartTime(testChunks)
+		merged, err := b.compactChunks(ctx, testChunks, targetBytes, referenced)
+		if err != nil {
+			return stats, errors.Wrapf(err, "compacting chunks for build '%s'", buildID)
+		}
+		compacted = append(compacted, merged...)
+	}
+
+	for _, chunk := range compacted {
+		if original[chunk.key()] {
+			delete(original, chunk.key())
+		} else {
+			stats.Written++
+		}
+	}
+	stats.Merged = len(original)
+	if manifests.ok && stats.Merged == 0 && len(manifests.appended) == 0 {
+		return stats, nil
+	}
+
+	// What's left of the original chunks was merged into the written ones.
+	retired := build.Retired
+	now := time.Now().UnixNano()
+	for key := range original {
+		retired = append(retired, retiredChunk{Key: key, Retired: now})
+	}
+	sort.Slice(retired, func(i, j int) bool { return retired[i].Key < retired[j].Key })
+
+	if err = b.putManifests(ctx, buildID, compacted, retired); err != nil {
+		return stats, err
+	}
+
+	return stats, b.removeAppendManifests(ctx, buildID, manifests.appended)
+}
+
+// RemoveRetiredChunks removes the build's chunks that compaction retired
+// before the given time, unless a manifest refers to them again. It returns
+// the number of chunks it removed and the number of retired chunks that
+// remain.
+func (b *Bucket) RemoveRetiredChunks(ctx context.Context, buildID string, retiredBefore time.Time) (int, int, error) {
+	unlock := b.manifestLocks.lock(buildID)
+	defer unlock()
+
+	chunks, ok, err := b.readManifests(ctx, buildID)
+	if err != nil || !ok {
+		return 0, 0, errors.Wrapf(err, "reading manifests for build '%s'", buildID)
+	}
+	build, _, err := b.readManifest(ctx, buildID, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	referenced := map[string]bool{}
+	for _, chunk := range chunks {
+		referenced[chunk.key()] = true
+	}
+
+	expired := []string{}
+	kept := []retiredChunk{}
+	for _, chunk := range build.Retired {
+		switch {
+		case referenced[chunk.Key]:
+		case time.Unix(0, chunk.Retired).After(retiredBefore):
+			kept = append(kept, chunk)
+		default:
+			expired = append(expired, chunk.Key)
+		}
+	}
+	if len(kept) == len(build.Retired) {
+		return 0, len(kept), nil
+	}
+
+	// The chunks are removed before the manifest stops listing them, so
+	// that they're removed by a later call if this one fails partway.
+	if len(expired) > 0 {
+		if err = b.removeKeys(ctx, expired); err != nil {
+			return 0, len(build.Retired), errors.Wrapf(err, "removing retired chunks for build '%s'", buildID)
+		}
+	}
+	build.Retired = kept
+	if err = b.putManifest(ctx, build); err != nil {
+		return 0, len(build.Retired), err
+	}
+
+	return len(expired), len(kept), nil
+}
+
+// compactChunks merges runs of the chunks, which must belong to the same test
+// and be sorted by start time, and returns the chunks that replace them.
+// Chunks that aren't merged are returned as they are. The keys of the chunks
+// that are written are added to referenced, and runs whose merged key would
+// collide with a referenced chunk are left alone. Anything else at the merged
+// key, such as a chunk written by a compaction that stopped before replacing
+// the manifests, is overwritten.
+func (b *Bucket) compactChunks(ctx context.Context, chunks []LogChunkInfo, targetBytes int, referenced map[string]bool) ([]LogChunkInfo, error) {
+	compacted := []LogChunkInfo{}
+	var run []LogChunkInfo
+	var runData bytes.Buffer
+
+	flush := func() error {
+		defer func() {
+			run = nil
+			runData.Reset()
+		}()
+		if len(run) < 2 {
+			compacted = append(compacted, run...)
+			return nil
+		}
+
+		data, encoding, err := encodeChunk(b.encoding, runData.Bytes())
+		if err != nil {
+			return errors.Wrap(err, "encoding merged chunk")
+		}
+		merged := mergedChunkInfo(run)
+		merged.Encoding = encoding
+		if referenced[merged.key()] {
+			compacted = append(compacted, run...)
+			return nil
+		}
+		if err := b.putConfirmed(ctx, merged.key(), data); err != nil {
+			return err
+		}
+		referenced[merged.key()] = true
+		compacted = append(compacted, merged)
+
+		return nil
+	}
+
+	for _, chunk := range chunks {
+		data, err := b.readChunk(ctx, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if len(run) > 0 {
+			last := run[len(run)-1]
+			if chunk.Start.Before(last.End) || runData.Len()+len(data) > targetBytes {
+				if err = flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		run = append(run, chunk)
+		runData.Write(data)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return compacted, nil
+}
+
+// mergedChunkInfo returns the chunk that holds the lines of all of the chunks,
+// which must be sorted by start time.
+func mergedChunkInfo(chunks []LogChunkInfo) LogChunkInfo {
+	merged := LogChunkInfo{
+		BuildID: chunks[0].BuildID,
+		TestID:  chunks[0].TestID,
+		Start:   chunks[0].Start,
+		End:     chunks[0].End,
+	}
+	for _, chunk := range chunks {
+		merged.NumLines += chunk.NumLines
+		if chunk.End.After(merged.End) {
+			merged.End = chunk.End
+		}
+	}
+
+	return merged
+}
+
+// readChunk returns the chunk's decoded contents.
+func (b *Bucket) readChunk(ctx context.Context, chunk LogChunkInfo) ([]byte, error) {
+	reader, err := getChunk(ctx, b, chunk)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching chunk '%s'", chunk.key())
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	return data, errors.Wrapf(err, "reading chunk '%s'", chunk.key())
+}
+
+// putConfirmed puts the data at the key and reads it back to make sure it was
+// written in full.
+func (b *Bucket) putConfirmed(ctx context.Context, key string, data []byte) error {
+	if err := b.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(err, "putting '%s'", key)
+	}
+
+	reader, err := b.Get(ctx, key)
+	if err != nil {
+		return errors.Wrapf(err, "fetching '%s'", key)
+	}
+	defer reader.Close()
+
+	written, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrapf(err, "reading '%s'", key)
+	}
+	if !bytes.Equal(data, written) {
+		return errors.Errorf("'%s' was not written in full", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCompactBuild(t *testing.T) {
+	ctx := context.Background()
+	buildID := bson.NewObjectId().Hex()
+	testID := bson.NewObjectId().Hex()
+	start := time.Date(2022, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+	readAll := func(t *testing.T, storage Bucket) []string {
+		lines, err := storage.GetAllLogLines(ctx, buildID, NewTimeRange(TimeRangeMin, TimeRangeMax))
+		require.NoError(t, err)
+		data := []string{}
+		for line := range lines {
+			data = append(data, line.Data)
+		}
+		return data
+	}
+
+	setup := func(t *testing.T) Bucket {
+		storage := makeTestStorage(t, "")
+		for i := 0; i < 6; i++ {
+			at := start.Add(time.Duration(i) * time.Second)
+			require.NoError(t, storage.InsertLogChunks(ctx, buildID, testID, []model.LogChunk{{
+				{Time: at, Msg: "test line"},
+				{Time: at.Add(time.Millisecond), Msg: "test line"},
+			}}))
+		}
+		// The second global chunk overlaps the first, so they can't be merged.
+		require.NoError(t, storage.InsertLogChunks(ctx, buildID, "", []model.LogChunk{
+			{{Time: start, Msg: "global 0"}, {Time: start.Add(2 * time.Second), Msg: "global 2"}},
+			{{Time: start.Add(time.Second), Msg: "global 1"}},
+		}))
+		return storage
+	}
+
+	t.Run("MergesAdjacentChunks", func(t *testing.T) {
+		storage := setup(t)
+		defer cleanTestStorage(t)
+		expected := readAll(t, storage)
+
+		stats, err := storage.CompactBuild(ctx, buildID, 1024)
+		require.NoError(t, err)
+		assert.Equal(t, CompactionStats{Merged: 6, Written: 1}, stats)
+
+		listed, err := storage.listChunks(ctx, buildID)
+		require.NoError(t, err)
+		assert.Len(t, listed, 9, "the merged chunks aren't removed yet")
+		chunks, ok, err := storage.readManifests(ctx, buildID)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Len(t, chunks, 3)
+		build, _, err := storage.readManifest(ctx, buildID, "")
+		require.NoError(t, err)
+		assert.Len(t, build.Retired, 6)
+		for _, chunk := range chunks {
+			if chunk.TestID == testID {
+				assert.Equal(t, 12, chunk.NumLines)
+				assert.Equal(t, start, chunk.Start)
+				assert.Equal(t, start.Add(5*time.Second+time.Millisecond), chunk.End)
+			}
+		}
+
+		assert.Equal(t, expected, readAll(t, storage))
+		lines, err := storage.GetTestLogLines(ctx, buildID, testID, NewTimeRange(TimeRangeMin, TimeRangeMax))
+		require.NoError(t, err)
+		count := 0
+		for range lines {
+			count++
+		}
+		assert.Equal(t, 15, count)
+	})
+
+	t.Run("LimitsChunkSize", func(t *testing.T) {
+		storage := setup(t)
+		defer cleanTestStorage(t)
+		expected := readAll(t, storage)
+
+		chunk := model.LogChunk{{Time: start, Msg: "test line"}, {Time: start, Msg: "test line"}}
+		chunkBytes := len(makeLogLineString(chunk[0])) + len(makeLogLineString(chunk[1]))
+		stats, err := storage.CompactBuild(ctx, buildID, 2*chunkBytes)
+		require.NoError(t, err)
+		assert.Equal(t, CompactionStats{Merged: 6, Written: 3}, stats)
+		assert.Equal(t, expected, readAll(t, storage))
+	})
+
+	t.Run("RepeatedCompactionIsANoOp", func(t *testing.T) {
+		storage := setup(t)
+		defer cleanTestStorage(t)
+
+		_, err := storage.CompactBuild(ctx, buildID, 1024)
+		require.NoError(t, err)
+		stats, err := storage.CompactBuild(ctx, buildID, 1024)
+		require.NoError(t, err)
+		assert.Zero(t, stats)
+	})
+
+	t.Run("OverwritesChunksFromInterruptedCompaction", func(t *testing.T) {
+		storage := setup(t)
+		defer cleanTestStorage(t)
+		expected := readAll(t, storage)
+
+		// A partly written merged chunk from a compaction that stopped
+		// before replacing the manifests.
+		merged := LogChunkInfo{BuildID: buildID, TestID: testID, NumLines: 12, Start: start, End: start.Add(5*time.Second + time.Millisecond)}
+		require.NoError(t, storage.Put(ctx, merged.key(), bytes.NewReader([]byte(makeLogLineString(model.LogLine{Time: start, Msg: "test line"})))))
+
+		stats, err := storage.CompactBuild(ctx, buildID, 1024)
+		require.NoError(t, err)
+		assert.Equal(t, CompactionStats{Merged: 6, Written: 1}, stats)
+		assert.Equal(t, expected, readAll(t, storage))
+	})
+
+	t.Run("KeepsChunksMissingFromManifests", func(t *testing.T) {
+		storage := setup(t)
+		defer cleanTestStorage(t)
+
+		unlisted := LogChunkInfo{BuildID: buildID, TestID: testID, NumLines: 1, Start: start.Add(time.Minute), End: start.Add(time.Minute)}
+		require.NoError(t, storage.Put(ctx, unlisted.key(), bytes.NewReader([]byte(makeLogLineString(model.LogLine{Time: unlisted.Start, Msg: "unlisted"})))))
+
+		_, err := storage.CompactBuild(ctx, buildID, 1024)
+		require.NoError(t, err)
+		_, _, err = storage.RemoveRetiredChunks(ctx, buildID, time.Now())
+		require.NoError(t, err)
+		_, err = storage.readObject(ctx, unlisted.key())
+		assert.NoError(t, err, "only chunks that were merged are removed")
+	})
+
+	t.Run("RemovesRetiredChunks", func(t *testing.T) {
+		storage := setup(t)
+		defer cleanTestStorage(t)
+		expected := readAll(t, storage)
+		before, err := storage.getAllChunks(ctx, buildID)
+		require.NoError(t, err)
+		sortByStartTime(before)
+
+		_, err = storage.CompactBuild(ctx, buildID, 1024)
+		require.NoError(t, err)
+		removed, remaining, err := storage.RemoveRetiredChunks(ctx, buildID, time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		assert.Zero(t, removed)
+		assert.Equal(t, 6, remaining)
+
+		// Readers that read the manifests before the compaction can still
+		// fetch the chunks.
+		lines := NewBatchedLogIterator(storage, before, 4, NewTimeRange(TimeRangeMin, TimeRangeMax)).Channel(ctx)
+		count := 0
+		for range lines {
+			count++
+		}
+		assert.Equal(t, 15, count)
+
+		removed, remaining, err = storage.RemoveRetiredChunks(ctx, buildID, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 6, removed)
+		assert.Zero(t, remaining)
+		listed, err := storage.listChunks(ctx, buildID)
+		require.NoError(t, err)
+		assert.Len(t, listed, 3)
+		assert.Equal(t, expected, readAll(t, storage))
+
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+		assert.Equal(t, expected, readAll(t, storage))
+	})
+
+	t.Run("KeepsRetiredChunksOutOfRewrittenManifests", func(t *testing.T) {
+		storage := setup(t)
+		defer cleanTestStorage(t)
+		expected := readAll(t, storage)
+
+		_, err := storage.CompactBuild(ctx, buildID, 1024)
+		require.NoError(t, err)
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+		assert.Equal(t, expected, readAll(t, storage))
+	})
+}
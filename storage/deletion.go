@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
+)
+
+// DeletionStats describes the objects removed from the bucket.
+type DeletionStats struct {
+	Objects int
+}
+
+// DeleteBuild removes every object stored under the build's prefix. The
+// build's chunk manifest and append manifests are removed first, so that
+// readers fall back to listing the chunks that remain, then the tests'
+// manifests, the log chunks, then the test metadata, and the build's metadata
+// last, so that a deletion that fails partway leaves the build discoverable
+// and can be retried. Objects that are already gone are not
+// considered an error. The returned stats only count the objects removed by
+// this call.
+func (b *Bucket) DeleteBuild(ctx context.Context, buildID string) (DeletionStats, error) {
+	stats := DeletionStats{}
+
+	iterator, err := b.List(ctx, buildPrefix(buildID))
+	if err != nil {
+		return stats, errors.Wrapf(err, "listing objects for build '%s'", buildID)
+	}
+
+	buildMetadataKey := metadataKeyForBuildId(buildID)
+	buildManifestKey := manifestKeyForBuildId(buildID)
+	var buildManifestKeys, testManifestKeys, chunkKeys, testMetadataKeys, buildMetadataKeys []string
+	for iterator.Next(ctx) {
+		key := iterator.Item().Name()
+		switch {
+		case key == buildManifestKey, isAppendManifestKey(buildID, key):
+			buildManifestKeys = append(buildManifestKeys, key)
+		case strings.HasSuffix(key, "/"+manifestFilename):
+			testManifestKeys = append(testManifestKeys, key)
+		case key == buildMetadataKey:
+			buildMetadataKeys = append(buildMetadataKeys, key)
+		case strings.HasSuffix(key, metadataFilename):
+			testMetadataKeys = append(testMetadataKeys, key)
+		default:
+			chunkKeys = append(chunkKeys, key)
+		}
+	}
+	if err = iterator.Err(); err != nil {
+		return stats, errors.Wrapf(err, "iterating objects for build '%s'", buildID)
+	}
+
+	for _, keys := range [][]string{buildManifestKeys, testManifestKeys, chunkKeys, testMetadataKeys, buildMetadataKeys} {
+		if len(keys) == 0 {
+			continue
+		}
+		if err = b.removeKeys(ctx, keys); err != nil {
+			return stats, errors.Wrapf(err, "removing objects for build '%s'", buildID)
+		}
+		stats.Objects += len(keys)
+	}
+
+	return stats, nil
+}
+
+// removeKeys removes the keys from the bucket, ignoring keys that don't exist.
+func (b *Bucket) removeKeys(ctx context.Context, keys []string) error {
+	if err := b.RemoveMany(ctx, keys...); err == nil {
+		return nil
+	}
+
+	// The batch removal doesn't report which keys failed, so retry them one
+	// at a time to tell missing keys apart from real failures.
+	for _, key := range keys {
+		if err := b.Remove(ctx, key); err != nil && !pail.IsKeyNotFoundError(errors.Cause(err)) {
+			return errors.Wrapf(err, "removing '%s'", key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteBuild(t *testing.T) {
+	const buildID = "5a75f537726934e4b62833ab6d5dca41"
+
+	countObjects := func(t *testing.T, dir string) int {
+		var objects int
+		require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			require.NoError(t, err)
+			if !info.IsDir() {
+				objects++
+			}
+			return nil
+		}))
+		return objects
+	}
+
+	t.Run("RemovesAllObjects", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+		expectedObjects := countObjects(t, filepath.Join(tempDir, "builds", buildID))
+
+		stats, err := storage.DeleteBuild(context.Background(), buildID)
+		require.NoError(t, err)
+		assert.Equal(t, expectedObjects, stats.Objects)
+
+		objects := countObjects(t, filepath.Join(tempDir, "builds", buildID))
+		assert.Zero(t, objects)
+		build, err := storage.FindBuildByID(context.Background(), buildID)
+		assert.NoError(t, err)
+		assert.Nil(t, build)
+	})
+
+	t.Run("RetryAfterPartialDeletion", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+		expectedObjects := countObjects(t, filepath.Join(tempDir, "builds", buildID))
+
+		chunks, err := storage.getAllChunks(context.Background(), buildID)
+		require.NoError(t, err)
+		require.NotEmpty(t, chunks)
+		require.NoError(t, storage.Remove(context.Background(), chunks[0].key()))
+
+		stats, err := storage.DeleteBuild(context.Background(), buildID)
+		require.NoError(t, err)
+		assert.Equal(t, expectedObjects-1, stats.Objects)
+
+		stats, err = storage.DeleteBuild(context.Background(), buildID)
+		require.NoError(t, err)
+		assert.Zero(t, stats.Objects)
+	})
+
+	t.Run("NonexistentBuild", func(t *testing.T) {
+		storage := makeTestStorage(t, "")
+		defer cleanTestStorage(t)
+
+		stats, err := storage.DeleteBuild(context.Background(), "missing")
+		require.NoError(t, err)
+		assert.Zero(t, stats.Objects)
+	})
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// WriteJournal records log appends from before they're written to the
+// database until they're confirmed in the bucket, so that appends that don't
+// reach the bucket can be replayed.
+type WriteJournal interface {
+	Record(ctx context.Context, write *model.PendingWrite) error
+	SetSeqRange(ctx context.Context, write *model.PendingWrite, first, last int) error
+	Complete(ctx context.Context, write *model.PendingWrite) error
+}
+
+// dualStore is a LogStore that keeps every build in the database and
+// additionally writes builds marked as S3 to the bucket.
+type dualStore struct {
+	db      LogStore
+	bucket  LogStore
+	journal WriteJournal
+}
+
+// NewDualStore returns a LogStore that writes every build to db and also
+// writes builds with S3 set to bucket. Builds and tests are read from db
+// while it has them, since the bucket doesn't keep the sequence numbers of
+// logs that are still being appended to, and from the bucket once their
+// database data is cleaned up. The logs of builds with S3 set are read from
+// the bucket. Searching tests and finding old builds only use db. Log appends to builds with S3 set are recorded in journal until they're
+// written to the bucket.
+func NewDualStore(db, bucket LogStore, journal WriteJournal) LogStore {
+	return &dualStore{db: db, bucket: bucket, journal: journal}
+}
+
+// readStore returns the store that the build's logs are read from.
+func (s *dualStore) readStore(build *model.Build) LogStore {
+	if build.S3 {
+		return s.bucket
+	}
+
+	return s.db
+}
+
+func (s *dualStore) InsertBuild(ctx context.Context, build model.Build) error {
+	if err := s.db.InsertBuild(ctx, build); err != nil {
+		return err
+	}
+	if build.S3 {
+		return s.bucket.InsertBuild(ctx, build)
+	}
+
+	return nil
+}
+
+func (s *dualStore) FindBuildByID(ctx context.Context, id string) (*model.Build, error) {
+	build, err := s.db.FindBuildByID(ctx, id)
+	if err != nil || build != nil {
+		return build, err
+	}
+
+	return s.bucket.FindBuildByID(ctx, id)
+}
+
+func (s *dualStore) FindBuildByBuilder(ctx context.Context, builder string, buildNum int) (*model.Build, error) {
+	return s.db.FindBuildByBuilder(ctx, builder, buildNum)
+}
+
+func (s *dualStore) FinishBuild(ctx context.Context, build *model.Build, ended time.Time, failed bool, phases []string) error {
+	if err := s.db.FinishBuild(ctx, build, ended, failed, phases); err != nil {
+		return err
+	}
+	if build.S3 {
+		return s.bucket.FinishBuild(ctx, build, ended, failed, phases)
+	}
+
+	return nil
+}
+
+func (s *dualStore) SetBuildHold(ctx context.Context, build *model.Build, hold *model.BuildHold) error {
+	if err := s.db.SetBuildHold(ctx, build, hold); err != nil {
+		return err
+	}
+	if build.S3 {
+		return s.bucket.SetBuildHold(ctx, build, hold)
+	}
+
+	return nil
+}
+
+func (s *dualStore) InsertTest(ctx context.Context, build *model.Build, test model.Test) error {
+	if err := s.db.InsertTest(ctx, build, test); err != nil {
+		return err
+	}
+	if build.S3 {
+		return s.bucket.InsertTest(ctx, build, test)
+	}
+
+	return nil
+}
+
+func (s *dualStore) FindTestByID(ctx context.Context, build *model.Build, testID string) (*model.Test, error) {
+	test, err := s.db.FindTestByID(ctx, build, testID)
+	if err != nil || test != nil || !build.S3 {
+		return test, err
+	}
+
+	return s.bucket.FindTestByID(ctx, build, testID)
+}
+
+func (s *dualStore) FindTestsForBuild(ctx context.Context, build *model.Build) ([]model.Test, error) {
+	tests, err := s.db.FindTestsForBuild(ctx, build)
+	if err != nil || len(tests) > 0 || !build.S3 {
+		return tests, err
+	}
+
+	return s.bucket.FindTestsForBuild(ctx, build)
+}
+
+func (s *dualStore) FindTests(ctx context.Context, query model.TestQuery) ([]model.Test, error) {
+	return s.db.FindTests(ctx, query)
+}
+
+func (s *dualStore) EndTest(ctx context.Context, build *model.Build, test *model.Test, ended time.Time, failed bool) error {
+	if err := s.db.EndTest(ctx, build, test, ended, failed); err != nil {
+		return err
+	}
+	if build.S3 {
+		return s.bucket.EndTest(ctx, build, test, ended, failed)
+	}
+
+	return nil
+}
+
+// InsertLogChunks journals a batch before writing it to the database and
+// then to the bucket, and completes the journal entry once the bucket has
+// the batch, so if the bucket write fails, or the process stops before it,
+// the append is replayed to the bucket later. It writes the batch to the
+// bucket even if the database already has it, since a retry may follow an
+// append that only reached the database.
+func (s *dualStore) InsertLogChunks(ctx context.Context, build *model.Build, test *model.Test, batchID string, chunks []model.LogChunk) (bool, error) {
+	if !build.S3 {
+		return s.db.InsertLogChunks(ctx, build, test, batchID, chunks)
+	}
+
+	// The build or test may have been read from the bucket, which doesn't
+	// have sequence numbers, so the journal takes them from the database.
+	seq, err := s.currentSeq(ctx, build, test)
+	if err != nil {
+		return false, errors.Wrap(err, "finding sequence number to journal bucket write")
+	}
+	write := pendingWrite(build, test, batchID, seq)
+	if err = s.journal.Record(ctx, write); err != nil {
+		return false, errors.Wrap(err, "journaling bucket write")
+	}
+	applied, err := s.db.InsertLogChunks(ctx, build, test, batchID, chunks)
+	if err != nil {
+		s.completeWrite(ctx, build, write)
+		return false, err
+	}
+
+	if applied {
+		lastSeq := build.Seq
+		if test != nil {
+			lastSeq = test.Seq
+		}
+		// If the range can't be recorded, the journal still covers the
+		// append with every sequence number it could have.
+		grip.Warning(message.WrapError(s.journal.SetSeqRange(ctx, write, lastSeq-len(chunks)+1, lastSeq), message.Fields{
+			"message":       "recording sequence range of journaled bucket write",
+			"build":         build.Id,
+			"pending_write": write.Id.Hex(),
+		}))
+	}
+	bucketApplied, err := s.bucket.InsertLogChunks(ctx, build, test, batchID, chunks)
+	if err != nil {
+		return false, errors.Wrapf(err, "writing logs to bucket, replaying them later as write '%s'", write.Id.Hex())
+	}
+	s.completeWrite(ctx, build, write)
+
+	return applied || bucketApplied, nil
+}
+
+// currentSeq returns the sequence number the database has for the build's
+// global log, if test is nil, or for the test's log.
+func (s *dualStore) currentSeq(ctx context.Context, build *model.Build, test *model.Test) (int, error) {
+	if test == nil {
+		stored, err := s.db.FindBuildByID(ctx, build.Id)
+		if err != nil {
+			return 0, err
+		}
+		if stored == nil {
+			return 0, errors.Errorf("build '%s' not found in the database", build.Id)
+		}
+		return stored.Seq, nil
+	}
+
+	stored, err := s.db.FindTestByID(ctx, build, test.Id.Hex())
+	if err != nil {
+		return 0, err
+	}
+	if stored == nil {
+		return 0, errors.Errorf("test '%s' not found in the database", test.Id.Hex())
+	}
+
+	return stored.Seq, nil
+}
+
+// completeWrite removes the write from the journal. If that fails the write
+// is replayed, which rewrites the same chunks.
+func (s *dualStore) completeWrite(ctx context.Context, build *model.Build, write *model.PendingWrite) {
+	grip.Warning(message.WrapError(s.journal.Complete(ctx, write), message.Fields{
+		"message":       "completing journaled bucket write",
+		"build":         build.Id,
+		"pending_write": write.Id.Hex(),
+	}))
+}
+
+// pendingWrite returns the journal entry for an append to the build's global
+// log, if test is nil, or to the test's log, before the append's sequence
+// numbers are known. The append's chunks come after seq, the sequence number
+// the build or test has now.
+func pendingWrite(build *model.Build, test *model.Test, batchID string, seq int) *model.PendingWrite {
+	write := &model.PendingWrite{
+		Id:       bson.NewObjectId(),
+		BuildId:  build.Id,
+		BatchId:  batchID,
+		FirstSeq: seq + 1,
+		LastSeq:  seq,
+		Created:  time.Now(),
+	}
+	if test != nil {
+		testID := test.Id
+		write.TestId = &testID
+	}
+
+	return write
+}
+
+func (s *dualStore) GetTestLogLines(ctx context.Context, build *model.Build, test *model.Test, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error) {
+	return s.readStore(build).GetTestLogLines(ctx, build, test, timeRange, reverse)
+}
+
+func (s *dualStore) GetTestLogLinesFrom(ctx context.Context, build *model.Build, test *model.Test, timeRange TimeRange, cursor LogCursor) (chan *model.LogLineItem, error) {
+	return s.readStore(build).GetTestLogLinesFrom(ctx, build, test, timeRange, cursor)
+}
+
+func (s *dualStore) GetAllLogLines(ctx context.Context, build *model.Build, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error) {
+	return s.readStore(build).GetAllLogLines(ctx, build, timeRange, reverse)
+}
+
+func (s *dualStore) StreamingGetOldBuilds(ctx context.Context, policies model.RetentionPolicies) (<-chan model.Build, <-chan error) {
+	return s.db.StreamingGetOldBuilds(ctx, policies)
+}
@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDualStore(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryStore()
+	bucket := NewMemoryStore()
+	store := NewDualStore(db, bucket, newMemoryJournal())
+	now := time.Now()
+
+	for _, s3 := range []bool{false, true} {
+		build := model.Build{Id: bson.NewObjectId().Hex(), Started: now, S3: s3}
+		require.NoError(t, store.InsertBuild(ctx, build))
+		test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: now}
+		require.NoError(t, store.InsertTest(ctx, &build, test))
+		insertLogChunks(t, store, &build, &test, []model.LogChunk{{{Time: now, Msg: "line"}}})
+		require.NoError(t, store.FinishBuild(ctx, &build, now, false, nil))
+
+		bucketBuild, err := bucket.FindBuildByID(ctx, build.Id)
+		require.NoError(t, err)
+		if !s3 {
+			assert.Nil(t, bucketBuild, "builds are only written to the bucket if they're marked as S3")
+			continue
+		}
+		require.NotNil(t, bucketBuild)
+		assert.True(t, bucketBuild.Finished())
+		lines, err := bucket.GetTestLogLines(ctx, bucketBuild, &test, NewTimeRange(TimeRangeMin, TimeRangeMax), false)
+		assert.Equal(t, []string{"line"}, readLines(t, lines, err))
+	}
+
+	t.Run("ReadsBucketOnlyBuilds", func(t *testing.T) {
+		build := model.Build{Id: "bucket-only", Started: now, S3: true}
+		require.NoError(t, bucket.InsertBuild(ctx, build))
+		test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: now}
+		require.NoError(t, bucket.InsertTest(ctx, &build, test))
+
+		found, err := store.FindBuildByID(ctx, build.Id)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		tests, err := store.FindTestsForBuild(ctx, found)
+		require.NoError(t, err)
+		require.Len(t, tests, 1)
+		assert.Equal(t, test.Id, tests[0].Id)
+	})
+}
+
+func TestDualStoreReadsMetadataFromDatabase(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := NewBucket(BucketOpts{Location: PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	db := NewMemoryStore()
+	store := NewDualStore(db, NewBucketStore(bucket), newMemoryJournal())
+
+	build := model.Build{Id: bson.NewObjectId().Hex(), Started: time.Now().UTC(), S3: true}
+	require.NoError(t, store.InsertBuild(ctx, build))
+	test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Name: "test", Started: build.Started}
+	require.NoError(t, store.InsertTest(ctx, &build, test))
+	insertLogChunks(t, store, &build, &test, []model.LogChunk{{{Time: build.Started, Msg: "line"}}})
+
+	found, err := store.FindTestByID(ctx, &build, test.Id.Hex())
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, 1, found.Seq, "the sequence numbers of unfinished tests come from the database")
+	tests, err := store.FindTestsForBuild(ctx, &build)
+	require.NoError(t, err)
+	require.Len(t, tests, 1)
+	assert.Equal(t, 1, tests[0].Seq)
+
+	require.NoError(t, store.EndTest(ctx, &build, found, time.Now(), false))
+	// Once the database data is cleaned up, the bucket's metadata is read.
+	store = NewDualStore(NewMemoryStore(), NewBucketStore(bucket), newMemoryJournal())
+	bucketBuild, err := store.FindBuildByID(ctx, build.Id)
+	require.NoError(t, err)
+	require.NotNil(t, bucketBuild)
+	assert.True(t, build.Started.Equal(bucketBuild.Started))
+	tests, err = store.FindTestsForBuild(ctx, bucketBuild)
+	require.NoError(t, err)
+	require.Len(t, tests, 1)
+	assert.Equal(t, "test", tests[0].Name)
+	assert.True(t, test.Started.Equal(tests[0].Started))
+	assert.Equal(t, 1, tests[0].Seq, "ending a test records its sequence number in the bucket")
+}
+
+func TestDualStoreRetriesBatchInBucket(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryStore()
+	bucket := NewMemoryStore()
+	store := NewDualStore(db, bucket, newMemoryJournal())
+
+	build := model.Build{Id: bson.NewObjectId().Hex(), Started: time.Now(), S3: true}
+	require.NoError(t, store.InsertBuild(ctx, build))
+	chunks := []model.LogChunk{{{Time: build.Started, Msg: "line"}}}
+
+	// The first attempt only reached the database.
+	applied, err := db.InsertLogChunks(ctx, &build, nil, "batch0", chunks)
+	require.NoError(t, err)
+	require.True(t, applied)
+
+	applied, err = store.InsertLogChunks(ctx, &build, nil, "batch0", chunks)
+	require.NoError(t, err)
+	assert.True(t, applied)
+	lines, err := bucket.GetAllLogLines(ctx, &build, NewTimeRange(TimeRangeMin, TimeRangeMax), false)
+	assert.Equal(t, []string{"line"}, readLines(t, lines, err))
+
+	applied, err = store.InsertLogChunks(ctx, &build, nil, "batch0", chunks)
+	require.NoError(t, err)
+	assert.False(t, applied)
+}
+
+func TestDualStoreJournalsBucketWrites(t *testing.T) {
+	ctx := context.Background()
+	db := &failingStore{LogStore: NewMemoryStore()}
+	bucket := &failingStore{LogStore: NewMemoryStore()}
+	journal := newMemoryJournal()
+	store := NewDualStore(db, bucket, journal)
+
+	build := model.Build{Id: bson.NewObjectId().Hex(), Started: time.Now(), S3: true}
+	require.NoError(t, store.InsertBuild(ctx, build))
+	test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: build.Started}
+	require.NoError(t, store.InsertTest(ctx, &build, test))
+	chunks := []model.LogChunk{{{Time: build.Started, Msg: "line"}}}
+
+	insertLogChunks(t, store, &build, &test, chunks)
+	assert.Empty(t, journal.pending, "writes that reach the bucket are completed")
+
+	bucket.err = errors.New("bucket unavailable")
+	_, err := store.InsertLogChunks(ctx, &build, &test, "", append(chunks, chunks...))
+	assert.Error(t, err, "an append that doesn't reach the bucket fails")
+	require.Len(t, journal.pending, 1, "a failed bucket write is replayed")
+	for _, write := range journal.pending {
+		assert.Equal(t, build.Id, write.BuildId)
+		require.NotNil(t, write.TestId)
+		assert.Equal(t, test.Id, *write.TestId)
+		assert.Equal(t, 2, write.FirstSeq)
+		assert.Equal(t, 3, write.LastSeq)
+	}
+
+	t.Run("RetriedBatchFailsInBucket", func(t *testing.T) {
+		journal.pending = map[bson.ObjectId]model.PendingWrite{}
+		bucket.err = errors.New("bucket unavailable")
+		_, err := store.InsertLogChunks(ctx, &build, &test, "batch0", chunks)
+		assert.Error(t, err)
+		_, err = store.InsertLogChunks(ctx, &build, &test, "batch0", chunks)
+		assert.Error(t, err)
+		assert.Len(t, journal.pending, 2, "a batch the database already has is replayed until it reaches the bucket")
+		for _, write := range journal.pending {
+			assert.Equal(t, "batch0", write.BatchId)
+		}
+
+		bucket.err = nil
+		applied, err := store.InsertLogChunks(ctx, &build, &test, "batch0", chunks)
+		require.NoError(t, err)
+		assert.True(t, applied, "the batch was new to the bucket")
+		assert.Len(t, journal.pending, 2)
+	})
+
+	t.Run("SequenceFromDatabase", func(t *testing.T) {
+		journal.pending = map[bson.ObjectId]model.PendingWrite{}
+		bucket.err = errors.New("bucket unavailable")
+		defer func() { bucket.err = nil }()
+
+		stored, err := db.FindTestByID(ctx, &build, test.Id.Hex())
+		require.NoError(t, err)
+		require.NotNil(t, stored)
+		// Tests read from the bucket don't have sequence numbers.
+		bucketTest := test
+		bucketTest.Seq = 0
+		_, err = store.InsertLogChunks(ctx, &build, &bucketTest, "", chunks)
+		assert.Error(t, err)
+		require.Len(t, journal.pending, 1)
+		for _, write := range journal.pending {
+			assert.Equal(t, stored.Seq+1, write.FirstSeq)
+			assert.Equal(t, stored.Seq+1, write.LastSeq)
+		}
+	})
+
+	t.Run("JournaledBeforeDatabase", func(t *testing.T) {
+		journal.pending = map[bson.ObjectId]model.PendingWrite{}
+		bucket.err = nil
+		stored, err := db.FindTestByID(ctx, &build, test.Id.Hex())
+		require.NoError(t, err)
+		require.NotNil(t, stored)
+		db.onInsert = func() {
+			require.Len(t, journal.pending, 1)
+			for _, write := range journal.pending {
+				assert.False(t, write.Sequenced())
+				assert.Equal(t, stored.Seq+1, write.FirstSeq)
+			}
+		}
+		defer func() { db.onInsert = nil }()
+
+		insertLogChunks(t, store, &build, &test, chunks)
+		assert.Empty(t, journal.pending)
+	})
+
+	t.Run("DatabaseWriteFails", func(t *testing.T) {
+		db.err = errors.New("database unavailable")
+		defer func() { db.err = nil }()
+
+		_, err := store.InsertLogChunks(ctx, &build, &test, "", chunks)
+		assert.Error(t, err)
+		assert.Empty(t, journal.pending, "an append that didn't reach the database isn't replayed")
+	})
+
+	t.Run("JournalFails", func(t *testing.T) {
+		journal.err = errors.New("journal unavailable")
+		defer func() { journal.err = nil }()
+
+		seq := test.Seq
+		_, err := store.InsertLogChunks(ctx, &build, &test, "", chunks)
+		assert.Error(t, err, "an append that can't be journaled fails")
+		assert.Equal(t, seq, test.Seq, "an append that can't be journaled isn't written to the database")
+	})
+}
+
+// failingStore is a LogStore whose log appends fail while err is set and call
+// onInsert, if it's set, before they're written.
+type failingStore struct {
+	LogStore
+	err      error
+	onInsert func()
+}
+
+func (s *failingStore) InsertLogChunks(ctx context.Context, build *model.Build, test *model.Test, batchID string, chunks []model.LogChunk) (bool, error) {
+	if s.onInsert != nil {
+		s.onInsert()
+	}
+	if s.err != nil {
+		return false, s.err
+	}
+
+	return s.LogStore.InsertLogChunks(ctx, build, test, batchID, chunks)
+}
+
+// memoryJournal is a WriteJournal that keeps pending writes in memory.
+type memoryJournal struct {
+	pending map[bson.ObjectId]model.PendingWrite
+	err     error
+}
+
+func newMemoryJournal() *memoryJournal {
+	return &memoryJournal{pending: map[bson.ObjectId]model.PendingWrite{}}
+}
+
+func (j *memoryJournal) Record(_ context.Context, write *model.PendingWrite) error {
+	if j.err != nil {
+		return j.err
+	}
+	j.pending[write.Id] = *write
+
+	return nil
+}
+
+func (j *memoryJournal) SetSeqRange(_ context.Context, write *model.PendingWrite, first, last int) error {
+	write.FirstSeq = first
+	write.LastSeq = last
+	j.pending[write.Id] = *write
+
+	return nil
+}
+
+func (j *memoryJournal) Complete(_ context.Context, write *model.PendingWrite) error {
+	delete(j.pending, write.Id)
+
+	return nil
+}
+
+func TestBucketStoreMarksBuildsAsS3(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := NewBucket(BucketOpts{Location: PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	store := NewBucketStore(bucket)
+
+	build := model.Build{Builder: "builder", BuildNum: 1}
+	build.Id, err = model.NewBuildId(build.Builder, build.BuildNum)
+	require.NoError(t, err)
+	require.NoError(t, store.InsertBuild(ctx, build))
+
+	found, err := store.FindBuildByBuilder(ctx, build.Builder, build.BuildNum)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, build.Id, found.Id)
+	assert.True(t, found.S3)
+
+	test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id}
+	require.NoError(t, store.InsertTest(ctx, found, test))
+	lines, err := store.GetTestLogLines(ctx, found, &test, NewTimeRange(TimeRangeMin, TimeRangeMax), false)
+	assert.Empty(t, readLines(t, lines, err), "a test without logs has no lines")
+}
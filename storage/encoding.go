@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// ChunkEncoding is the compression applied to the contents of a log chunk. It
+// is recorded in the extension of the chunk's key, so each chunk can be read
+// regardless of the encoding the bucket currently writes.
+type ChunkEncoding string
+
+const (
+	// EncodingNone stores the lines as they are. Chunks written before
+	// encodings were introduced have no extension and use it.
+	EncodingNone ChunkEncoding = ""
+	EncodingGzip ChunkEncoding = "gzip"
+	EncodingZstd ChunkEncoding = "zstd"
+)
+
+var (
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func init() {
+	var err error
+	if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+		panic(errors.Wrap(err, "creating zstd encoder"))
+	}
+	if zstdDecoder, err = zstd.NewReader(nil); err != nil {
+		panic(errors.Wrap(err, "creating zstd decoder"))
+	}
+}
+
+// DefaultChunkEncoding returns the encoding of new chunks in a bucket at the
+// location when none is chosen. S3 buckets already compress every object they
+// upload, so their chunks aren't compressed again.
+func DefaultChunkEncoding(location PailType) ChunkEncoding {
+	if location == PailS3 {
+		return EncodingNone
+	}
+
+	return EncodingGzip
+}
+
+// ParseChunkEncoding returns the encoding with the given name, where "none"
+// or the empty string means no encoding.
+func ParseChunkEncoding(name string) (ChunkEncoding, error) {
+	switch ChunkEncoding(name) {
+	case "none", EncodingNone:
+		return EncodingNone, nil
+	case EncodingGzip, EncodingZstd:
+		return ChunkEncoding(name), nil
+	default:
+		return EncodingNone, errors.Errorf("unknown chunk encoding '%s'", name)
+	}
+}
+
+func (e ChunkEncoding) extension() string {
+	switch e {
+	case EncodingGzip:
+		return ".gz"
+	case EncodingZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// splitEncoding splits the encoding's extension off of the chunk key name.
+func splitEncoding(keyName string) (string, ChunkEncoding, error) {
+	dot := strings.LastIndex(keyName, ".")
+	if dot < 0 {
+		return keyName, EncodingNone, nil
+	}
+
+	for _, encoding := range []ChunkEncoding{EncodingGzip, EncodingZstd} {
+		if keyName[dot:] == encoding.extension() {
+			return keyName[:dot], encoding, nil
+		}
+	}
+
+	return "", EncodingNone, errors.Errorf("unknown chunk extension '%s'", keyName[dot:])
+}
+
+// encodeChunk returns the data encoded with the encoding, unless that doesn't
+// make it any smaller, in which case the data is returned unencoded along with
+// EncodingNone.
+func encodeChunk(encoding ChunkEncoding, data []byte) ([]byte, ChunkEncoding, error) {
+	var encoded []byte
+	switch encoding {
+	case EncodingNone:
+		return data, EncodingNone, nil
+	case EncodingGzip:
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, EncodingNone, errors.Wrap(err, "compressing chunk")
+		}
+		if err := writer.Close(); err != nil {
+			return nil, EncodingNone, errors.Wrap(err, "compressing chunk")
+		}
+		encoded = buffer.Bytes()
+	case EncodingZstd:
+		encoded = zstdEncoder.EncodeAll(data, nil)
+	default:
+		return nil, EncodingNone, errors.Errorf("unknown chunk encoding '%s'", encoding)
+	}
+
+	if len(encoded) >= len(data) {
+		return data, EncodingNone, nil
+	}
+
+	return encoded, encoding, nil
+}
+
+// getChunk returns a reader of the chunk's lines, decoding them if needed.
+func getChunk(ctx context.Context, bucket pail.Bucket, chunk LogChunkInfo) (io.ReadCloser, error) {
+	reader, err := bucket.Get(ctx, chunk.key())
+	if err != nil {
+		return nil, err
+	}
+
+	switch chunk.Encoding {
+	case EncodingNone:
+		return reader, nil
+	case EncodingGzip:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			_ = reader.Close()
+			return nil, errors.Wrapf(err, "decompressing chunk '%s'", chunk.key())
+		}
+		return &decodingReader{Reader: gzipReader, closers: []io.Closer{gzipReader, reader}}, nil
+	case EncodingZstd:
+		defer reader.Close()
+		encoded, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading chunk '%s'", chunk.key())
+		}
+		decoded, err := zstdDecoder.DecodeAll(encoded, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decompressing chunk '%s'", chunk.key())
+		}
+		return ioutil.NopCloser(bytes.NewReader(decoded)), nil
+	default:
+		_ = reader.Close()
+		return nil, errors.Errorf("unknown encoding '%s' for chunk '%s'", chunk.Encoding, chunk.key())
+	}
+}
+
+// decodingReader reads decoded data and closes both the decoder and the
+// underlying reader.
+type decodingReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *decodingReader) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseChunkEncoding(t *testing.T) {
+	for name, expected := range map[string]ChunkEncoding{
+		"":     EncodingNone,
+		"none": EncodingNone,
+		"gzip": EncodingGzip,
+		"zstd": EncodingZstd,
+	} {
+		encoding, err := ParseChunkEncoding(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, encoding)
+	}
+
+	_, err := ParseChunkEncoding("lz4")
+	assert.Error(t, err)
+}
+
+func TestDefaultChunkEncoding(t *testing.T) {
+	assert.Equal(t, EncodingNone, DefaultChunkEncoding(PailS3), "S3 already compresses its objects")
+	assert.Equal(t, EncodingGzip, DefaultChunkEncoding(PailLocal))
+}
+
+func TestChunkKeyEncoding(t *testing.T) {
+	start := time.Unix(0, 1000).UTC()
+	for _, encoding := range []ChunkEncoding{EncodingNone, EncodingGzip, EncodingZstd} {
+		info := LogChunkInfo{BuildID: "b0", TestID: "t0", NumLines: 3, Start: start, End: start.Add(time.Second), Encoding: encoding}
+		parsed := LogChunkInfo{}
+		require.NoError(t, parsed.fromKey(info.key()))
+		assert.Equal(t, info, parsed)
+	}
+
+	info := LogChunkInfo{BuildID: "b0", TestID: "t0", NumLines: 3, Start: start, End: start.Add(time.Second), Encoding: EncodingGzip}
+	assert.Equal(t, "/builds/b0/tests/t0/1000_1000001000_3.gz", info.key())
+	assert.Error(t, (&LogChunkInfo{}).fromKey("/builds/b0/1000_1000001000_3.lz4"))
+}
+
+func TestEncodeChunk(t *testing.T) {
+	data := []byte(strings.Repeat(makeLogLineString(model.LogLine{Time: time.Now(), Msg: "a repetitive log line"}), 1000))
+
+	for _, encoding := range []ChunkEncoding{EncodingGzip, EncodingZstd} {
+		t.Run(string(encoding), func(t *testing.T) {
+			encoded, used, err := encodeChunk(encoding, data)
+			require.NoError(t, err)
+			assert.Equal(t, encoding, used)
+			ratio := float64(len(encoded)) / float64(len(data))
+			t.Logf("%s compresses %d bytes to %d, a ratio of %.3f", encoding, len(data), len(encoded), ratio)
+			assert.Less(t, ratio, 0.1)
+
+			encoded, used, err = encodeChunk(encoding, []byte("x"))
+			require.NoError(t, err)
+			assert.Equal(t, EncodingNone, used, "chunks that don't get smaller are stored unencoded")
+			assert.Equal(t, []byte("x"), encoded)
+		})
+	}
+}
+
+func TestEncodedChunks(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2022, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, encoding := range []ChunkEncoding{EncodingNone, EncodingGzip, EncodingZstd} {
+		t.Run(fmt.Sprintf("Encoding=%q", encoding), func(t *testing.T) {
+			storage := makeTestStorage(t, "")
+			defer cleanTestStorage(t)
+			storage.encoding = encoding
+
+			buildID := bson.NewObjectId().Hex()
+			testID := bson.NewObjectId().Hex()
+			chunk := model.LogChunk{}
+			for i := 0; i < 100; i++ {
+				chunk = append(chunk, model.LogLine{Time: start.Add(time.Duration(i) * time.Millisecond), Msg: fmt.Sprintf("test line %d", i)})
+			}
+			require.NoError(t, storage.InsertLogChunks(ctx, buildID, testID, []model.LogChunk{chunk}))
+			require.NoError(t, storage.InsertLogChunks(ctx, buildID, "", []model.LogChunk{{{Time: start.Add(50 * time.Millisecond), Msg: "global"}}}))
+
+			chunks, err := storage.listChunks(ctx, buildID)
+			require.NoError(t, err)
+			for _, chunk := range chunks {
+				if chunk.TestID == testID {
+					assert.Equal(t, encoding, chunk.Encoding)
+				} else {
+					assert.Equal(t, EncodingNone, chunk.Encoding, "a single short line doesn't get smaller")
+				}
+			}
+
+			lines, err := storage.GetTestLogLines(ctx, buildID, testID, NewTimeRange(TimeRangeMin, TimeRangeMax))
+			require.NoError(t, err)
+			forward := []string{}
+			for line := range lines {
+				forward = append(forward, line.Data)
+			}
+			require.Len(t, forward, 101)
+			assert.Equal(t, "test line 0", forward[0])
+
+			lines, err = storage.GetAllLogLinesReverse(ctx, buildID, NewTimeRange(TimeRangeMin, TimeRangeMax))
+			require.NoError(t, err)
+			reverse := []string{}
+			for line := range lines {
+				reverse = append(reverse, line.Data)
+			}
+			require.Len(t, reverse, 101)
+			assert.Equal(t, "test line 99", reverse[0])
+
+			_, err = storage.CompactBuild(ctx, buildID, 1024*1024)
+			require.NoError(t, err)
+			counts, err := storage.CountLogLines(ctx, buildID)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]int{"": 1, testID: 100}, counts)
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/evergreen-ci/logkeeper/model"
 	"github.com/evergreen-ci/pail"
 	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
 	"github.com/mongodb/grip/recovery"
 	"github.com/pkg/errors"
 )
@@ -91,7 +92,7 @@ func (i *serializedIterator) Next(ctx context.Context) bool {
 			}
 
 			var err error
-			i.currentReadCloser, err = i.bucket.Get(ctx, i.chunks[i.keyIndex].key())
+			i.currentReadCloser, err = getChunk(ctx, i.bucket, i.chunks[i.keyIndex])
 			if err != nil {
 				i.catcher.Wrap(err, "downloading log artifact")
 				return false
@@ -134,6 +135,7 @@ func (i *serializedIterator) Next(ctx context.Context) bool {
 			i.catcher.Wrap(err, "parsing timestamp")
 			return false
 		}
+		item.TestId = i.chunks[i.keyIndex].testObjectID()
 		i.lineCount++
 
 		if item.Timestamp.After(i.timeRange.EndAt) && !i.reverse {
@@ -279,7 +281,7 @@ func (i *batchedIterator) getNextBatch(ctx context.Context) error {
 					return
 				}
 
-				r, err := i.bucket.Get(ctx, chunk.key())
+				r, err := getChunk(ctx, i.bucket, chunk)
 				if err != nil {
 					catcher.Add(err)
 					return
@@ -353,6 +355,7 @@ func (i *batchedIterator) Next(ctx context.Context) bool {
 			i.catcher.Wrap(err, "parsing timestamp")
 			return false
 		}
+		item.TestId = i.chunks[i.keyIndex].testObjectID()
 		i.lineCount++
 
 		if item.Timestamp.After(i.timeRange.EndAt) && !i.reverse {
@@ -533,17 +536,35 @@ func reverseChunks(chunks []LogChunkInfo) {
 	}
 }
 
-func channelFromIterator(context context.Context, iterator LogIterator) chan *model.LogLineItem {
+// channelFromIterator returns a channel with the iterator's lines. An error
+// that stops the iteration is logged and reported to the context's stream
+// status before the channel is closed. The iterator is closed once it's
+// exhausted or the context is done.
+func channelFromIterator(ctx context.Context, iterator LogIterator) chan *model.LogLineItem {
 	logsChan := make(chan *model.LogLineItem)
 
 	go func() {
 		defer recovery.LogStackTraceAndContinue("Channel from Iterator")
 		defer close(logsChan)
-		// Iterators will aggregate all errors into a catcher that can be when Next returns false.
-		defer grip.Errorf("Error iterating over logs: %v", iterator.Err())
-		for iterator.Next(context) {
+		// Iterators aggregate their errors into a catcher that can be
+		// checked once Next returns false. Errors after the context is
+		// done are from the reader going away, so nobody is told.
+		defer func() {
+			if err := iterator.Err(); err != nil && ctx.Err() == nil {
+				grip.Error(message.WrapError(err, "iterating over logs"))
+				model.ReportStreamError(ctx, err)
+			}
+		}()
+		defer func() {
+			grip.Warning(message.WrapError(iterator.Close(), "closing log iterator"))
+		}()
+		for iterator.Next(ctx) {
 			item := iterator.Item()
-			logsChan <- &item
+			select {
+			case logsChan <- &item:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -0,0 +1,621 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/pail"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	manifestFilename = "manifest.json"
+	// appendManifestsDirectory holds, under a build's prefix, a manifest
+	// for each append to the build.
+	appendManifestsDirectory = "manifests/"
+
+	// maxCachedAppendManifests is the most append manifests that a bucket
+	// keeps parsed in memory.
+	maxCachedAppendManifests = 100000
+)
+
+// chunkManifest lists the log chunks of a build's global logs, or of one of
+// its tests, so that readers don't have to list every key under the build's
+// prefix. A build's manifest also names the tests that have a manifest of
+// their own. The chunks of any other test are in the build's manifest, as
+// they are in manifests written before tests had their own.
+//
+// Appends don't update these manifests, since appends from different
+// processes would overwrite each other's updates. Instead, each append writes
+// a manifest of its own chunks under the build's append manifests directory,
+// which is never changed afterwards. Rewriting the build's manifests, as
+// compaction does, folds the append manifests into them and removes them.
+type chunkManifest struct {
+	BuildID string          `json:"build_id"`
+	TestID  string          `json:"test_id,omitempty"`
+	Chunks  []manifestChunk `json:"chunks"`
+	Tests   []string        `json:"tests,omitempty"`
+	// Retired lists the chunks that compaction replaced. Only a build's
+	// manifest has retired chunks.
+	Retired []retiredChunk `json:"retired,omitempty"`
+}
+
+// retiredChunk is a chunk that compaction merged into a larger one. It stays
+// in the bucket until readers that read the manifests from before the
+// compaction are done with it.
+type retiredChunk struct {
+	Key     string `json:"key"`
+	Retired int64  `json:"retired"`
+}
+
+type manifestChunk struct {
+	TestID   string `json:"test_id,omitempty"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	NumLines int    `json:"num_lines"`
+	Encoding string `json:"encoding,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+}
+
+func newChunkManifest(buildID, testID string, chunks []LogChunkInfo) chunkManifest {
+	manifest := chunkManifest{BuildID: buildID, TestID: testID, Chunks: make([]manifestChunk, 0, len(chunks))}
+	manifest.addChunks(chunks)
+
+	return manifest
+}
+
+// addChunks adds the chunks that the manifest doesn't already list.
+func (m *chunkManifest) addChunks(chunks []LogChunkInfo) {
+	listed := map[string]bool{}
+	for _, chunk := range m.chunkInfos() {
+		listed[chunk.key()] = true
+	}
+	for _, chunk := range chunks {
+		if listed[chunk.key()] {
+			continue
+		}
+		listed[chunk.key()] = true
+		m.Chunks = append(m.Chunks, manifestChunk{
+			TestID:   chunk.TestID,
+			Start:    chunk.Start.UnixNano(),
+			End:      chunk.End.UnixNano(),
+			NumLines: chunk.NumLines,
+			Encoding: string(chunk.Encoding),
+			Tag:      chunk.Tag,
+		})
+	}
+}
+
+// takeTestChunks removes the test's chunks from the manifest and returns them.
+func (m *chunkManifest) takeTestChunks(testID string) []LogChunkInfo {
+	taken := []LogChunkInfo{}
+	kept := []manifestChunk{}
+	for i, chunk := range m.Chunks {
+		if chunk.TestID == testID {
+			taken = append(taken, m.chunkInfo(i))
+			continue
+		}
+		kept = append(kept, chunk)
+	}
+	m.Chunks = kept
+
+	return taken
+}
+
+func (m *chunkManifest) hasTest(testID string) bool {
+	for _, id := range m.Tests {
+		if id == testID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *chunkManifest) chunkInfo(i int) LogChunkInfo {
+	chunk := m.Chunks[i]
+	return LogChunkInfo{
+		BuildID:  m.BuildID,
+		TestID:   chunk.TestID,
+		NumLines: chunk.NumLines,
+		Start:    time.Unix(0, chunk.Start).UTC(),
+		End:      time.Unix(0, chunk.End).UTC(),
+		Encoding: ChunkEncoding(chunk.Encoding),
+		Tag:      chunk.Tag,
+	}
+}
+
+func (m *chunkManifest) chunkInfos() []LogChunkInfo {
+	chunks := make([]LogChunkInfo, 0, len(m.Chunks))
+	for i := range m.Chunks {
+		chunks = append(chunks, m.chunkInfo(i))
+	}
+
+	return chunks
+}
+
+func (m *chunkManifest) key() string {
+	return manifestKey(m.BuildID, m.TestID)
+}
+
+func appendManifestsPrefix(buildID string) string {
+	return fmt.Sprintf("%s%s", buildPrefix(buildID), appendManifestsDirectory)
+}
+
+// isAppendManifestKey returns true if the key is one of the build's append
+// manifests.
+func isAppendManifestKey(buildID, key string) bool {
+	return strings.HasPrefix(key, appendManifestsPrefix(buildID))
+}
+
+func manifestKeyForBuildId(id string) string {
+	return fmt.Sprintf("%s%s", buildPrefix(id), manifestFilename)
+}
+
+func manifestKeyForTest(buildID, testID string) string {
+	return fmt.Sprintf("%s%s", testPrefix(buildID, testID), manifestFilename)
+}
+
+// manifestKey returns the key of the manifest of the build's global logs, if
+// testID is empty, or of the test's logs.
+func manifestKey(buildID, testID string) string {
+	if testID == "" {
+		return manifestKeyForBuildId(buildID)
+	}
+
+	return manifestKeyForTest(buildID, testID)
+}
+
+// WriteManifest records the build's log chunks, as listed under the build's
+// prefix, in the manifests of its global logs and its tests, replacing
+// whatever the manifests recorded before, and removes the append manifests
+// whose chunks the listing includes. Chunks that compaction retired aren't
+// recorded.
+func (b *Bucket) WriteManifest(ctx context.Context, buildID string) error {
+	unlock := b.manifestLocks.lock(buildID)
+	defer unlock()
+
+	// Append manifests are only written after their chunks, so the listing
+	// includes the chunks of those that exist before it.
+	appended, _, err := b.readAppendManifests(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	build, _, err := b.readManifest(ctx, buildID, "")
+	if err != nil {
+		return err
+	}
+	retired := map[string]bool{}
+	for _, chunk := range build.Retired {
+		retired[chunk.Key] = true
+	}
+
+	listed, err := b.listChunks(ctx, buildID)
+	if err != nil {
+		return errors.Wrapf(err, "listing chunks for build '%s'", buildID)
+	}
+	chunks := make([]LogChunkInfo, 0, len(listed))
+	for _, chunk := range listed {
+		if !retired[chunk.key()] {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	if err = b.putManifests(ctx, buildID, chunks, build.Retired); err != nil {
+		return err
+	}
+
+	return b.removeAppendManifests(ctx, buildID, appended)
+}
+
+// putManifests replaces the build's manifests with ones recording the chunks,
+// giving each test with chunks its own manifest, and the retired chunks. The
+// build's manifest is put last, so that the tests it names have manifests.
+func (b *Bucket) putManifests(ctx context.Context, buildID string, chunks []LogChunkInfo, retired []retiredChunk) error {
+	byTest := map[string][]LogChunkInfo{}
+	for _, chunk := range chunks {
+		byTest[chunk.TestID] = append(byTest[chunk.TestID], chunk)
+	}
+
+	build := newChunkManifest(buildID, "", byTest[""])
+	build.Retired = retired
+	for testID, testChunks := range byTest {
+		if testID == "" {
+			continue
+		}
+		if err := b.putManifest(ctx, newChunkManifest(buildID, testID, testChunks)); err != nil {
+			return err
+		}
+		build.Tests = append(build.Tests, testID)
+	}
+	sort.Strings(build.Tests)
+
+	return b.putManifest(ctx, build)
+}
+
+// addToManifest records the chunks, which were just written to the build,
+// in an append manifest of their own. A build without a manifest first gets
+// one that records its listed chunks, so that readers of the manifests don't
+// miss chunks that were written before the build had one.
+func (b *Bucket) addToManifest(ctx context.Context, buildID string, chunks []LogChunkInfo) error {
+	if err := b.ensureManifest(ctx, buildID); err != nil {
+		return err
+	}
+
+	manifest := newChunkManifest(buildID, "", chunks)
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "marshaling append manifest")
+	}
+	key := fmt.Sprintf("%s%s.json", appendManifestsPrefix(buildID), bson.NewObjectId().Hex())
+
+	return errors.Wrapf(b.Put(ctx, key, bytes.NewReader(manifestJSON)), "putting append manifest '%s'", key)
+}
+
+// ensureManifest gives the build a manifest of its listed chunks if it
+// doesn't have one. Builds that are known to have a manifest aren't checked
+// again, since a build's manifest is only removed with the build.
+func (b *Bucket) ensureManifest(ctx context.Context, buildID string) error {
+	if b.manifestCache.hasManifest(buildID) {
+		return nil
+	}
+
+	unlock := b.manifestLocks.lock(buildID)
+	defer unlock()
+
+	_, ok, err := b.readManifest(ctx, buildID, "")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		listed, err := b.listChunks(ctx, buildID)
+		if err != nil {
+			return errors.Wrapf(err, "listing chunks for build '%s'", buildID)
+		}
+		if err = b.putManifests(ctx, buildID, listed, nil); err != nil {
+			return err
+		}
+	}
+	b.manifestCache.setHasManifest(buildID)
+
+	return nil
+}
+
+// putManifest replaces the manifest.
+func (b *Bucket) putManifest(ctx context.Context, manifest chunkManifest) error {
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "marshaling manifest")
+	}
+
+	return errors.Wrapf(b.Put(ctx, manifest.key(), bytes.NewReader(manifestJSON)), "putting manifest '%s'", manifest.key())
+}
+
+// readManifest returns the manifest of the build's global logs, if testID is
+// empty, or of the test's logs. It returns false if there's no such manifest.
+func (b *Bucket) readManifest(ctx context.Context, buildID, testID string) (chunkManifest, bool, error) {
+	key := manifestKey(buildID, testID)
+	reader, err := b.Get(ctx, key)
+	if pail.IsKeyNotFoundError(errors.Cause(err)) {
+		return chunkManifest{}, false, nil
+	}
+	if err != nil {
+		return chunkManifest{}, false, errors.Wrapf(err, "fetching manifest '%s'", key)
+	}
+	defer reader.Close()
+
+	manifest := chunkManifest{}
+	if err = json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return chunkManifest{}, false, errors.Wrapf(err, "parsing manifest '%s'", key)
+	}
+	manifest.BuildID = buildID
+	manifest.TestID = testID
+
+	return manifest, true, nil
+}
+
+// buildManifests is what a build's manifests record.
+type buildManifests struct {
+	// build is the manifest of the build's global logs.
+	build chunkManifest
+	// ok is true if the build has a manifest or append manifests.
+	ok bool
+	// chunks are the chunks that the build's manifest, the manifests of
+	// the tests it names, and its append manifests record, without the
+	// chunks that compaction retired.
+	chunks []LogChunkInfo
+	// appended are the keys of the append manifests that were read.
+	appended []string
+}
+
+// readBuildManifests reads the build's manifests and its append manifests.
+// The append manifests are read first: rewriting the build's manifests
+// removes the append manifests only after the build's manifest is replaced, so
+// the build's manifest that's read afterwards records the chunks of any append
+// manifest that's gone by then.
+func (b *Bucket) readBuildManifests(ctx context.Context, buildID string) (buildManifests, error) {
+	appended, appendedChunks, err := b.readAppendManifests(ctx, buildID)
+	if err != nil {
+		return buildManifests{}, err
+	}
+	build, ok, err := b.readManifest(ctx, buildID, "")
+	if err != nil {
+		return buildManifests{}, err
+	}
+	manifests := buildManifests{build: build, ok: ok || len(appended) > 0, appended: appended}
+	if !manifests.ok {
+		return manifests, nil
+	}
+
+	chunks := build.chunkInfos()
+	for _, testID := range build.Tests {
+		test, ok, err := b.readManifest(ctx, buildID, testID)
+		if err != nil {
+			return buildManifests{}, err
+		}
+		if !ok {
+			return buildManifests{}, errors.Errorf("manifest for build '%s' names test '%s', which has no manifest", buildID, testID)
+		}
+		chunks = append(chunks, test.chunkInfos()...)
+	}
+
+	// An append manifest's chunks may already be in the build's manifests,
+	// or may have been merged by compaction since it was read.
+	skip := map[string]bool{}
+	for _, chunk := range build.Retired {
+		skip[chunk.Key] = true
+	}
+	for _, chunk := range chunks {
+		skip[chunk.key()] = true
+	}
+	for _, chunk := range appendedChunks {
+		if skip[chunk.key()] {
+			continue
+		}
+		skip[chunk.key()] = true
+		chunks = append(chunks, chunk)
+	}
+	manifests.chunks = chunks
+
+	return manifests, nil
+}
+
+// readManifests returns the chunks recorded in the build's manifests, as
+// readBuildManifests does. It returns false if the build doesn't have a
+// manifest or append manifests.
+func (b *Bucket) readManifests(ctx context.Context, buildID string) ([]LogChunkInfo, bool, error) {
+	manifests, err := b.readBuildManifests(ctx, buildID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return manifests.chunks, manifests.ok, nil
+}
+
+// readAppendManifests returns the keys of the build's append manifests, in
+// the order they were written, and the chunks they record. Append manifests
+// never change, so the ones that were read before are taken from the cache.
+func (b *Bucket) readAppendManifests(ctx context.Context, buildID string) ([]string, []LogChunkInfo, error) {
+	prefix := appendManifestsPrefix(buildID)
+	iterator, err := b.List(ctx, prefix)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "listing append manifests for build '%s'", buildID)
+	}
+	listed := []string{}
+	for iterator.Next(ctx) {
+		listed = append(listed, iterator.Item().Name())
+	}
+	if err = iterator.Err(); err != nil {
+		return nil, nil, errors.Wrapf(err, "iterating append manifests for build '%s'", buildID)
+	}
+	sort.Strings(listed)
+
+	keys := make([]string, 0, len(listed))
+	chunks := []LogChunkInfo{}
+	for _, key := range listed {
+		manifestChunks, ok := b.manifestCache.get(key)
+		if !ok {
+			manifest := chunkManifest{}
+			err := b.readJSON(ctx, key, &manifest)
+			if pail.IsKeyNotFoundError(errors.Cause(err)) {
+				// It was folded into the build's manifests since
+				// it was listed.
+				continue
+			}
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "reading append manifest for build '%s'", buildID)
+			}
+			manifest.BuildID = buildID
+			manifestChunks = manifest.chunkInfos()
+			b.manifestCache.add(key, manifestChunks)
+		}
+		keys = append(keys, key)
+		chunks = append(chunks, manifestChunks...)
+	}
+
+	return keys, chunks, nil
+}
+
+// removeAppendManifests removes the build's append manifests with the keys,
+// once their chunks are recorded in the build's manifests.
+func (b *Bucket) removeAppendManifests(ctx context.Context, buildID string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := b.removeKeys(ctx, keys); err != nil {
+		return errors.Wrapf(err, "removing append manifests for build '%s'", buildID)
+	}
+	b.manifestCache.remove(keys)
+
+	return nil
+}
+
+// getAllChunks returns the build's log chunks from its manifests, falling
+// back to listing the build's keys if it doesn't have any.
+func (b *Bucket) getAllChunks(ctx context.Context, buildID string) ([]LogChunkInfo, error) {
+	chunks, ok, err := b.readManifests(ctx, buildID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading manifests for build '%s'", buildID)
+	}
+	if ok {
+		return chunks, nil
+	}
+
+	return b.listChunks(ctx, buildID)
+}
+
+// manifestCache keeps the chunks of the append manifests that were read,
+// since append manifests never change, and the builds that are known to have a
+// manifest.
+type manifestCache struct {
+	mu        sync.Mutex
+	appended  map[string][]LogChunkInfo
+	manifests map[string]bool
+}
+
+func newManifestCache() *manifestCache {
+	return &manifestCache{appended: map[string][]LogChunkInfo{}, manifests: map[string]bool{}}
+}
+
+func (c *manifestCache) get(key string) ([]LogChunkInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	chunks, ok := c.appended[key]
+	return chunks, ok
+}
+
+func (c *manifestCache) add(key string, chunks []LogChunkInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.appended) >= maxCachedAppendManifests {
+		c.appended = map[string][]LogChunkInfo{}
+	}
+	c.appended[key] = chunks
+}
+
+func (c *manifestCache) remove(keys []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		delete(c.appended, key)
+	}
+}
+
+func (c *manifestCache) hasManifest(buildID string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.manifests[buildID]
+}
+
+func (c *manifestCache) setHasManifest(buildID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.manifests) >= maxCachedAppendManifests {
+		c.manifests = map[string]bool{}
+	}
+	c.manifests[buildID] = true
+}
+
+// manifestLocks serializes the updates to each build's manifests within the
+// process.
+type manifestLocks struct {
+	mu    sync.Mutex
+	locks map[string]*manifestLock
+}
+
+type manifestLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func newManifestLocks() *manifestLocks {
+	return &manifestLocks{locks: map[string]*manifestLock{}}
+}
+
+// lock locks the build's manifests and returns the function that unlocks
+// them.
+func (l *manifestLocks) lock(buildID string) func() {
+	if l == nil {
+		return func() {}
+	}
+
+	l.mu.Lock()
+	lock, ok := l.locks[buildID]
+	if !ok {
+		lock = &manifestLock{}
+		l.locks[buildID] = lock
+	}
+	lock.waiters++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(l.locks, buildID)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// listChunks returns the build's log chunks by listing the keys under the
+// build's prefix.
+func (b *Bucket) listChunks(ctx context.Context, buildID string) ([]LogChunkInfo, error) {
+	iterator, err := b.List(ctx, buildPrefix(buildID))
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := []LogChunkInfo{}
+	for iterator.Next(ctx) {
+		if !isChunkKey(iterator.Item().Name()) {
+			continue
+		}
+		var info LogChunkInfo
+		if err := info.fromKey(iterator.Item().Name()); err != nil {
+			return nil, errors.Wrap(err, "getting log chunk info from key name")
+		}
+		chunks = append(chunks, info)
+	}
+	if err = iterator.Err(); err != nil {
+		return nil, errors.Wrapf(err, "iterating keys for build '%s'", buildID)
+	}
+
+	return chunks, nil
+}
+
+// isChunkKey returns true if the key under a build's prefix holds log lines
+// rather than metadata, a manifest, or a batch record.
+func isChunkKey(key string) bool {
+	return !strings.HasSuffix(key, metadataFilename) && !strings.HasSuffix(key, manifestFilename) && !strings.Contains(key, "/"+batchesDirectory) && !strings.Contains(key, "/"+appendManifestsDirectory)
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestChunkManifest(t *testing.T) {
+	const (
+		buildID = "5a75f537726934e4b62833ab6d5dca41"
+		testID  = "62dba0159041307f697e6ccc"
+	)
+	ctx := context.Background()
+
+	t.Run("MatchesListing", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+
+		listed, err := storage.listChunks(ctx, buildID)
+		require.NoError(t, err)
+		require.NotEmpty(t, listed)
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+
+		chunks, ok, err := storage.readManifests(ctx, buildID)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.ElementsMatch(t, listed, chunks)
+		build, ok, err := storage.readManifest(ctx, buildID, "")
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, []string{testID}, build.Tests)
+		assert.Len(t, build.Chunks, 1, "the build's manifest only lists its global chunks")
+
+		listed, err = storage.listChunks(ctx, buildID)
+		require.NoError(t, err)
+		assert.Len(t, listed, len(chunks), "manifests aren't listed as chunks")
+	})
+
+	t.Run("UpdatedOnAppend", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+
+		require.NoError(t, storage.InsertLogChunks(ctx, buildID, "", []model.LogChunk{{{Time: time.Now(), Msg: "global"}}}))
+		build, ok, err := storage.readManifest(ctx, buildID, "")
+		require.NoError(t, err)
+		require.True(t, ok, "a build without a manifest gets one from its listed chunks")
+		assert.Len(t, build.Chunks, 2)
+		assert.Equal(t, []string{testID}, build.Tests)
+
+		require.NoError(t, storage.InsertLogChunks(ctx, buildID, testID, []model.LogChunk{{{Time: time.Now(), Msg: "test"}}}))
+		after, _, err := storage.readManifest(ctx, buildID, "")
+		require.NoError(t, err)
+		assert.Equal(t, build, after, "appends don't rewrite the build's manifest")
+		appended, appendedChunks, err := storage.readAppendManifests(ctx, buildID)
+		require.NoError(t, err)
+		assert.Len(t, appended, 2, "each append writes a manifest of its own")
+		assert.Len(t, appendedChunks, 2)
+
+		counts, err := storage.CountLogLines(ctx, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"": 5, testID: 12}, counts)
+
+		// A chunk that's put without an append isn't in the manifest.
+		require.NoError(t, storage.Put(ctx, buildPrefix(buildID)+"1658560532739000000_1658560532739000000_1", bytes.NewReader([]byte(makeLogLineString(model.LogLine{Time: time.Unix(0, 1658560532739000000), Msg: "unlisted"})))))
+		unlisted, err := storage.CountLogLines(ctx, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, counts, unlisted)
+
+		// Rewriting the manifests folds the append manifests into them.
+		require.NoError(t, storage.removeKeys(ctx, []string{buildPrefix(buildID) + "1658560532739000000_1658560532739000000_1"}))
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+		appended, _, err = storage.readAppendManifests(ctx, buildID)
+		require.NoError(t, err)
+		assert.Empty(t, appended)
+		folded, err := storage.CountLogLines(ctx, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, counts, folded)
+	})
+
+	t.Run("ConcurrentBuckets", func(t *testing.T) {
+		storage := makeTestStorage(t, "")
+		defer cleanTestStorage(t)
+
+		// Each append goes through its own bucket, as appends from
+		// different processes do.
+		const appends = 10
+		start := time.Now()
+		errs := make(chan error, appends)
+		for i := 0; i < appends; i++ {
+			go func(i int) {
+				bucket, err := NewBucket(BucketOpts{Location: PailLocal, Path: tempDir})
+				if err != nil {
+					errs <- err
+					return
+				}
+				logID := ""
+				if i%2 == 1 {
+					logID = testID
+				}
+				errs <- bucket.InsertLogChunks(ctx, buildID, logID, []model.LogChunk{{{Time: start.Add(time.Duration(i) * time.Second), Msg: "line"}}})
+			}(i)
+		}
+		for i := 0; i < appends; i++ {
+			require.NoError(t, <-errs)
+		}
+
+		counts, err := storage.CountLogLines(ctx, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"": appends / 2, testID: appends / 2}, counts)
+	})
+
+	t.Run("ConcurrentAppends", func(t *testing.T) {
+		storage := makeTestStorage(t, "")
+		defer cleanTestStorage(t)
+
+		const appends = 20
+		start := time.Now()
+		errs := make(chan error, appends)
+		for i := 0; i < appends; i++ {
+			go func(i int) {
+				logID := ""
+				if i%2 == 1 {
+					logID = bson.NewObjectId().Hex()
+				}
+				errs <- storage.InsertLogChunks(ctx, buildID, logID, []model.LogChunk{{{Time: start.Add(time.Duration(i) * time.Second), Msg: "line"}}})
+			}(i)
+		}
+		for i := 0; i < appends; i++ {
+			require.NoError(t, <-errs)
+		}
+
+		chunks, ok, err := storage.readManifests(ctx, buildID)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Len(t, chunks, appends)
+	})
+
+	t.Run("FallsBackToListing", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+
+		counts, err := storage.CountLogLines(ctx, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"": 4, testID: 11}, counts)
+	})
+
+	t.Run("ReadErrors", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+
+		require.NoError(t, storage.Put(ctx, manifestKeyForTest(buildID, testID), bytes.NewReader([]byte("not json"))))
+		_, err := storage.CountLogLines(ctx, buildID)
+		assert.Error(t, err, "an unreadable test manifest isn't replaced by listing")
+
+		require.NoError(t, storage.removeKeys(ctx, []string{manifestKeyForTest(buildID, testID)}))
+		_, err = storage.CountLogLines(ctx, buildID)
+		assert.Error(t, err, "a test named by the build's manifest must have a manifest")
+
+		require.NoError(t, storage.Put(ctx, manifestKeyForBuildId(buildID), bytes.NewReader([]byte("not json"))))
+		_, err = storage.CountLogLines(ctx, buildID)
+		assert.Error(t, err, "an unreadable build manifest isn't replaced by listing")
+	})
+
+	t.Run("DeletedWithBuild", func(t *testing.T) {
+		storage := makeTestStorage(t, "../testdata/simple")
+		defer cleanTestStorage(t)
+
+		require.NoError(t, storage.WriteManifest(ctx, buildID))
+		_, err := storage.DeleteBuild(ctx, buildID)
+		require.NoError(t, err)
+
+		_, ok, err := storage.readManifest(ctx, buildID, "")
+		require.NoError(t, err)
+		assert.False(t, ok)
+		_, ok, err = storage.readManifest(ctx, buildID, testID)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("AppendRacingFinish", func(t *testing.T) {
+		storage := makeTestStorage(t, "")
+		defer cleanTestStorage(t)
+		store := NewBucketStore(storage)
+
+		now := time.Now()
+		build := model.Build{Id: bson.NewObjectId().Hex(), Started: now}
+		require.NoError(t, store.InsertBuild(ctx, build))
+		insertLogChunks(t, store, &build, nil, []model.LogChunk{{{Time: now, Msg: "line"}}})
+		require.NoError(t, store.FinishBuild(ctx, &build, now, false, nil))
+		insertLogChunks(t, store, &build, nil, []model.LogChunk{{{Time: now.Add(time.Second), Msg: "late"}}})
+
+		chunks, ok, err := storage.readManifests(ctx, build.Id)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Len(t, chunks, 2, "a chunk appended after the build finished is in the manifest")
+	})
+}
@@ -0,0 +1,534 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memoryStore is a LogStore that keeps everything in memory. It follows the
+// database's semantics for sequence numbers and for selecting the logs in a
+// window, so that it can stand in for the database in tests.
+type memoryStore struct {
+	mu     sync.RWMutex
+	builds map[string]model.Build
+	tests  map[bson.ObjectId]model.Test
+	// logs holds each build's logs in the order they were inserted.
+	logs map[string][]model.Log
+	// batches holds the most recently applied batch IDs of each build's
+	// global log and of each test's log, keyed by the build or test ID.
+	batches map[string][]string
+}
+
+// NewMemoryStore returns an empty LogStore that keeps everything in memory,
+// for tests and local development.
+func NewMemoryStore() LogStore {
+	return &memoryStore{
+		builds:  map[string]model.Build{},
+		tests:   map[bson.ObjectId]model.Test{},
+		logs:    map[string][]model.Log{},
+		batches: map[string][]string{},
+	}
+}
+
+func (s *memoryStore) InsertBuild(_ context.Context, build model.Build) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.builds[build.Id]; ok {
+		return errors.Errorf("build '%s' already exists", build.Id)
+	}
+	s.builds[build.Id] = build
+
+	return nil
+}
+
+func (s *memoryStore) FindBuildByID(_ context.Context, id string) (*model.Build, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	build, ok := s.builds[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return &build, nil
+}
+
+func (s *memoryStore) FindBuildByBuilder(_ context.Context, builder string, buildNum int) (*model.Build, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, build := range s.builds {
+		if build.Builder == builder && build.BuildNum == buildNum {
+			return &build, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *memoryStore) FinishBuild(_ context.Context, build *model.Build, ended time.Time, failed bool, phases []string) error {
+	return s.updateBuild(build, func(stored *model.Build) {
+		stored.Ended = &ended
+		stored.Failed = failed
+		if phases != nil {
+			stored.Phases = phases
+		}
+	})
+}
+
+func (s *memoryStore) SetBuildHold(_ context.Context, build *model.Build, hold *model.BuildHold) error {
+	return s.updateBuild(build, func(stored *model.Build) {
+		stored.Hold = hold
+	})
+}
+
+// updateBuild applies the update to the stored build and copies the result to
+// the given build.
+func (s *memoryStore) updateBuild(build *model.Build, update func(*model.Build)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.builds[build.Id]
+	if !ok {
+		return errors.Errorf("build '%s' not found", build.Id)
+	}
+	update(&stored)
+	s.builds[build.Id] = stored
+	*build = stored
+
+	return nil
+}
+
+func (s *memoryStore) InsertTest(_ context.Context, _ *model.Build, test model.Test) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tests[test.Id]; ok {
+		return errors.Errorf("test '%s' already exists", test.Id.Hex())
+	}
+	s.tests[test.Id] = test
+
+	return nil
+}
+
+func (s *memoryStore) FindTestByID(_ context.Context, build *model.Build, testID string) (*model.Test, error) {
+	if !bson.IsObjectIdHex(testID) {
+		return nil, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	test, ok := s.tests[bson.ObjectIdHex(testID)]
+	if !ok || test.BuildId != build.Id {
+		return nil, nil
+	}
+
+	return &test, nil
+}
+
+func (s *memoryStore) FindTestsForBuild(_ context.Context, build *model.Build) ([]model.Test, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tests := []model.Test{}
+	for _, test := range s.tests {
+		if test.BuildId == build.Id {
+			tests = append(tests, test)
+		}
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].Started.Before(tests[j].Started) })
+
+	return tests, nil
+}
+
+func (s *memoryStore) FindTests(_ context.Context, query model.TestQuery) ([]model.Test, error) {
+	if query.After != "" && !bson.IsObjectIdHex(query.After) {
+		return nil, errors.Errorf("invalid test ID '%s'", query.After)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tests := []model.Test{}
+	for _, test := range s.tests {
+		if query.Builder != "" && test.Builder != query.Builder {
+			continue
+		}
+		if query.Name != "" && test.Name != query.Name {
+			continue
+		}
+		if query.Failed != nil && test.Failed != *query.Failed {
+			continue
+		}
+		if query.Since != nil && test.Started.Before(*query.Since) {
+			continue
+		}
+		if query.After != "" && test.Id >= bson.ObjectIdHex(query.After) {
+			continue
+		}
+		tests = append(tests, test)
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].Id > tests[j].Id })
+	if query.Limit > 0 && len(tests) > query.Limit {
+		tests = tests[:query.Limit]
+	}
+
+	return tests, nil
+}
+
+func (s *memoryStore) EndTest(_ context.Context, _ *model.Build, test *model.Test, ended time.Time, failed bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.tests[test.Id]
+	if !ok {
+		return errors.Errorf("test '%s' not found", test.Id.Hex())
+	}
+	stored.Ended = &ended
+	stored.Failed = failed
+	s.tests[test.Id] = stored
+	*test = stored
+
+	return nil
+}
+
+func (s *memoryStore) InsertLogChunks(_ context.Context, build *model.Build, test *model.Test, batchID string, chunks []model.LogChunk) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logID := build.Id
+	if test != nil {
+		logID = test.Id.Hex()
+	}
+	if batchID != "" {
+		for _, applied := range s.batches[logID] {
+			if applied == batchID {
+				return false, nil
+			}
+		}
+	}
+
+	var (
+		testID *bson.ObjectId
+		seq    int
+	)
+	if test == nil {
+		stored, ok := s.builds[build.Id]
+		if !ok {
+			return false, errors.Errorf("build '%s' not found", build.Id)
+		}
+		stored.Seq += len(chunks)
+		s.builds[build.Id] = stored
+		*build = stored
+		seq = stored.Seq
+	} else {
+		stored, ok := s.tests[test.Id]
+		if !ok {
+			return false, errors.Errorf("test '%s' not found", test.Id.Hex())
+		}
+		stored.Seq += len(chunks)
+		s.tests[test.Id] = stored
+		*test = stored
+		seq = stored.Seq
+		id := test.Id
+		testID = &id
+	}
+
+	for i, chunk := range chunks {
+		if len(chunk) == 0 {
+			continue
+		}
+		started := chunk[0].Time
+		s.logs[build.Id] = append(s.logs[build.Id], model.Log{
+			BuildId: build.Id,
+			TestId:  testID,
+			Seq:     seq - len(chunks) + i + 1,
+			Started: &started,
+			Lines:   append([]model.LogLine{}, chunk...),
+			BatchId: batchID,
+		})
+	}
+
+	if batchID != "" {
+		batches := append(s.batches[logID], batchID)
+		if len(batches) > model.MaxRememberedBatches {
+			batches = batches[len(batches)-model.MaxRememberedBatches:]
+		}
+		s.batches[logID] = batches
+	}
+
+	return true, nil
+}
+
+// GetTestLogLines selects logs the same way as model.MergedTestLogs, including
+// the sequence number bounds on the global logs, so the two return the same
+// lines.
+func (s *memoryStore) GetTestLogLines(_ context.Context, build *model.Build, test *model.Test, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error) {
+	return s.testLogLines(build, test, timeRange, timeRange, reverse), nil
+}
+
+// GetTestLogLinesFrom selects logs the same way as model.MergedTestLogsFrom.
+func (s *memoryStore) GetTestLogLinesFrom(_ context.Context, build *model.Build, test *model.Test, timeRange TimeRange, cursor LogCursor) (chan *model.LogLineItem, error) {
+	return s.testLogLines(build, test, timeRange.from(cursor.Test), timeRange.from(cursor.Global), false), nil
+}
+
+// testLogLines returns the test's lines within testRange merged with the
+// concurrent global lines within globalRange.
+func (s *memoryStore) testLogLines(build *model.Build, test *model.Test, testRange, globalRange TimeRange, reverse bool) chan *model.LogLineItem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	minTime, maxTime := testRange.bounds()
+
+	testLogs := s.findLogs(build.Id, func(log model.Log) bool { return log.TestId != nil && *log.TestId == test.Id })
+	if minTime != nil {
+		if firstSeq := seqBefore(testLogs, *minTime); firstSeq != nil {
+			testLogs = seqRange(testLogs, *firstSeq, nil)
+		}
+	}
+	globalMinTime, globalMaxTime := globalRange.bounds()
+
+	return linesChannel(mergeLines(windowLines(testLogs, minTime, maxTime), s.globalLinesDuringTest(test, globalMinTime, globalMaxTime), reverse))
+}
+
+// globalLinesDuringTest returns the global lines written during the test's
+// execution window, further limited to those between minTime and maxTime if
+// they're not nil, following model.findGlobalLogsDuringTest. The caller must
+// hold the lock.
+func (s *memoryStore) globalLinesDuringTest(test *model.Test, minTime, maxTime *time.Time) []*model.LogLineItem {
+	testMinTime, testMaxTime := s.executionWindow(test)
+	if minTime == nil || minTime.Before(testMinTime) {
+		minTime = &testMinTime
+	}
+	if maxTime == nil || (testMaxTime != nil && testMaxTime.Before(*maxTime)) {
+		maxTime = testMaxTime
+	}
+
+	globalLogs := s.findLogs(test.BuildId, func(log model.Log) bool { return log.TestId == nil })
+	first := test.Seq
+	if firstSeq := seqBefore(globalLogs, *minTime); firstSeq != nil {
+		first = *firstSeq
+	}
+	var last *int
+	if maxTime != nil {
+		last = seqBefore(globalLogs, *maxTime)
+	}
+
+	return windowLines(seqRange(globalLogs, first, last), minTime, maxTime)
+}
+
+// executionWindow returns the extents of the test, following
+// model.Test.GetExecutionWindow. The caller must hold the lock.
+func (s *memoryStore) executionWindow(test *model.Test) (time.Time, *time.Time) {
+	if test.Ended != nil {
+		return test.Started, test.Ended
+	}
+
+	var next *model.Test
+	for _, other := range s.tests {
+		if other.BuildId != test.BuildId || !other.Started.After(test.Started) {
+			continue
+		}
+		if next == nil || other.Started.Before(next.Started) {
+			other := other
+			next = &other
+		}
+	}
+	if next == nil {
+		return test.Started, nil
+	}
+
+	return test.Started, &next.Started
+}
+
+// GetAllLogLines selects logs the same way as model.AllLogs.
+func (s *memoryStore) GetAllLogLines(_ context.Context, build *model.Build, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	minTime, maxTime := timeRange.bounds()
+
+	globalLogs := s.findLogs(build.Id, func(log model.Log) bool { return log.TestId == nil })
+	if minTime != nil {
+		if firstSeq := seqBefore(globalLogs, *minTime); firstSeq != nil {
+			globalLogs = seqRange(globalLogs, *firstSeq, nil)
+		}
+	}
+	testLogs := s.findLogs(build.Id, func(log model.Log) bool { return log.TestId != nil })
+	sort.SliceStable(testLogs, func(i, j int) bool { return startedBefore(testLogs[i], testLogs[j]) })
+
+	return linesChannel(mergeLines(windowLines(testLogs, minTime, maxTime), windowLines(globalLogs, minTime, maxTime), reverse)), nil
+}
+
+func (s *memoryStore) StreamingGetOldBuilds(ctx context.Context, policies model.RetentionPolicies) (<-chan model.Build, <-chan error) {
+	now := time.Now()
+	s.mu.RLock()
+	expired := []model.Build{}
+	for _, build := range s.builds {
+		if policies.Expired(&build, now) {
+			expired = append(expired, build)
+		}
+	}
+	s.mu.RUnlock()
+
+	out := make(chan model.Build)
+	errOut := make(chan error)
+	go func() {
+		defer close(errOut)
+		defer close(out)
+
+		for _, build := range expired {
+			select {
+			case out <- build:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, errOut
+}
+
+// findLogs returns the build's logs for which matches returns true, in
+// sequence order. The caller must hold the lock.
+func (s *memoryStore) findLogs(buildID string, matches func(model.Log) bool) []model.Log {
+	logs := []model.Log{}
+	for _, log := range s.logs[buildID] {
+		if matches(log) {
+			logs = append(logs, log)
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].Seq < logs[j].Seq })
+
+	return logs
+}
+
+// seqBefore returns the sequence number of the last of the logs that started
+// before the given time, or nil if there is no such log, like
+// model.findSeqBefore. The logs must be in sequence order.
+func seqBefore(logs []model.Log, before time.Time) *int {
+	var seq *int
+	for _, log := range logs {
+		if log.Started != nil && log.Started.Before(before) {
+			logSeq := log.Seq
+			seq = &logSeq
+		}
+	}
+
+	return seq
+}
+
+// seqRange returns the logs with sequence numbers from first to last,
+// inclusive. A nil last leaves the range open-ended.
+func seqRange(logs []model.Log, first int, last *int) []model.Log {
+	inRange := []model.Log{}
+	for _, log := range logs {
+		if log.Seq < first || (last != nil && log.Seq > *last) {
+			continue
+		}
+		inRange = append(inRange, log)
+	}
+
+	return inRange
+}
+
+// startedBefore orders logs by their start time. Logs without a start time
+// sort first, as they do in the database.
+func startedBefore(a, b model.Log) bool {
+	if a.Started == nil || b.Started == nil {
+		return a.Started == nil && b.Started != nil
+	}
+
+	return a.Started.Before(*b.Started)
+}
+
+// windowLines returns the lines of the logs that are between minTime and
+// maxTime, where a nil bound leaves that side of the window open. Logs that
+// started after the window are skipped without looking at their lines, as in
+// the database.
+func windowLines(logs []model.Log, minTime, maxTime *time.Time) []*model.LogLineItem {
+	items := []*model.LogLineItem{}
+	for _, log := range logs {
+		if maxTime != nil && log.Started != nil && log.Started.After(*maxTime) {
+			continue
+		}
+		for _, line := range log.Lines {
+			if minTime != nil && line.Time.Before(*minTime) {
+				continue
+			}
+			if maxTime != nil && line.Time.After(*maxTime) {
+				continue
+			}
+			items = append(items, &model.LogLineItem{
+				Timestamp: line.Time,
+				Data:      line.Msg,
+				TestId:    log.TestId,
+			})
+		}
+	}
+
+	return items
+}
+
+// mergeLines merges the test and global lines by timestamp, preferring global
+// lines when the timestamps are equal. If reverse is true the merged lines are
+// returned newest first.
+func mergeLines(testLines, globalLines []*model.LogLineItem, reverse bool) []*model.LogLineItem {
+	if reverse {
+		reverseLines(testLines)
+		reverseLines(globalLines)
+	}
+
+	merged := make([]*model.LogLineItem, 0, len(testLines)+len(globalLines))
+	for len(testLines) > 0 || len(globalLines) > 0 {
+		var testFirst bool
+		switch {
+		case len(globalLines) == 0:
+			testFirst = true
+		case len(testLines) == 0:
+			testFirst = false
+		case reverse:
+			testFirst = testLines[0].Timestamp.After(globalLines[0].Timestamp)
+		default:
+			testFirst = testLines[0].Timestamp.Before(globalLines[0].Timestamp)
+		}
+
+		if testFirst {
+			merged = append(merged, testLines[0])
+			testLines = testLines[1:]
+		} else {
+			merged = append(merged, globalLines[0])
+			globalLines = globalLines[1:]
+		}
+	}
+	for i, line := range merged {
+		line.LineNum = i
+	}
+
+	return merged
+}
+
+func reverseLines(lines []*model.LogLineItem) {
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+}
+
+// linesChannel returns a closed channel buffering the lines.
+func linesChannel(lines []*model.LogLineItem) chan *model.LogLineItem {
+	out := make(chan *model.LogLineItem, len(lines))
+	for _, line := range lines {
+		out <- line
+	}
+	close(out)
+
+	return out
+}
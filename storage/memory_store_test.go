@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func readLines(t *testing.T, lines chan *model.LogLineItem, err error) []string {
+	require.NoError(t, err)
+	data := []string{}
+	for line := range lines {
+		data = append(data, line.Data)
+	}
+	return data
+}
+
+// insertLogChunks inserts the chunks without a batch ID.
+func insertLogChunks(t *testing.T, store LogStore, build *model.Build, test *model.Test, chunks []model.LogChunk) {
+	applied, err := store.InsertLogChunks(context.Background(), build, test, "", chunks)
+	require.NoError(t, err)
+	require.True(t, applied)
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	now := time.Now()
+
+	build := model.Build{Id: "b0", Builder: "builder", BuildNum: 1, Started: now}
+	require.NoError(t, store.InsertBuild(ctx, build))
+	assert.Error(t, store.InsertBuild(ctx, build))
+	found, err := store.FindBuildByBuilder(ctx, "builder", 1)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, build.Id, found.Id)
+
+	test0 := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Builder: build.Builder, Name: "test0", Started: now}
+	require.NoError(t, store.InsertTest(ctx, &build, test0))
+	test1 := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Builder: build.Builder, Name: "test1", Started: now.Add(10 * time.Second)}
+	require.NoError(t, store.InsertTest(ctx, &build, test1))
+
+	insertLogChunks(t, store, &build, nil, []model.LogChunk{
+		{{Time: now.Add(time.Second), Msg: "global 0"}},
+		{{Time: now.Add(12 * time.Second), Msg: "global 1"}},
+	})
+	assert.Equal(t, 2, build.Seq)
+	insertLogChunks(t, store, &build, &test0, []model.LogChunk{{
+		{Time: now, Msg: "test0 line 0"},
+		{Time: now.Add(2 * time.Second), Msg: "test0 line 1"},
+	}})
+	assert.Equal(t, 1, test0.Seq)
+	insertLogChunks(t, store, &build, &test1, []model.LogChunk{{{Time: now.Add(11 * time.Second), Msg: "test1 line 0"}}})
+	require.NoError(t, store.EndTest(ctx, &build, &test0, now.Add(5*time.Second), false))
+	assert.NotNil(t, test0.Ended)
+
+	allTime := NewTimeRange(TimeRangeMin, TimeRangeMax)
+	t.Run("TestLogs", func(t *testing.T) {
+		lines, err := store.GetTestLogLines(ctx, &build, &test0, allTime, false)
+		assert.Equal(t, []string{"test0 line 0", "global 0", "test0 line 1"}, readLines(t, lines, err))
+
+		lines, err = store.GetTestLogLines(ctx, &build, &test0, allTime, true)
+		assert.Equal(t, []string{"test0 line 1", "global 0", "test0 line 0"}, readLines(t, lines, err))
+
+		lines, err = store.GetTestLogLines(ctx, &build, &test0, NewTimeRange(now.Add(time.Second), TimeRangeMax), false)
+		assert.Equal(t, []string{"global 0", "test0 line 1"}, readLines(t, lines, err))
+	})
+
+	t.Run("TestLogsFromCursor", func(t *testing.T) {
+		lines, err := store.GetTestLogLinesFrom(ctx, &build, &test0, allTime, LogCursor{Test: now.Add(2 * time.Second), Global: now})
+		assert.Equal(t, []string{"global 0", "test0 line 1"}, readLines(t, lines, err))
+
+		lines, err = store.GetTestLogLinesFrom(ctx, &build, &test0, allTime, LogCursor{Test: now, Global: now.Add(2 * time.Second)})
+		assert.Equal(t, []string{"test0 line 0", "test0 line 1"}, readLines(t, lines, err))
+	})
+
+	t.Run("ExecutionWindow", func(t *testing.T) {
+		build := model.Build{Id: "b1", Started: now}
+		require.NoError(t, store.InsertBuild(ctx, build))
+		first := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: now}
+		require.NoError(t, store.InsertTest(ctx, &build, first))
+		insertLogChunks(t, store, &build, nil, []model.LogChunk{
+			{{Time: now.Add(time.Second), Msg: "during first"}},
+			{{Time: now.Add(3 * time.Second), Msg: "during second"}},
+		})
+
+		lines, err := store.GetTestLogLines(ctx, &build, &first, allTime, false)
+		assert.Equal(t, []string{"during first", "during second"}, readLines(t, lines, err), "an unfinished test runs until the next test starts")
+
+		second := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: now.Add(2 * time.Second)}
+		require.NoError(t, store.InsertTest(ctx, &build, second))
+		lines, err = store.GetTestLogLines(ctx, &build, &first, allTime, false)
+		assert.Equal(t, []string{"during first"}, readLines(t, lines, err))
+		lines, err = store.GetTestLogLines(ctx, &build, &second, allTime, false)
+		assert.Equal(t, []string{"during second"}, readLines(t, lines, err))
+	})
+
+	t.Run("Sequence", func(t *testing.T) {
+		build := model.Build{Id: "b2", Started: now}
+		require.NoError(t, store.InsertBuild(ctx, build))
+		test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: now}
+		require.NoError(t, store.InsertTest(ctx, &build, test))
+		insertLogChunks(t, store, &build, &test, []model.LogChunk{
+			{{Time: now, Msg: "line 0"}},
+			{{Time: now.Add(time.Second), Msg: "line 1"}},
+		})
+		insertLogChunks(t, store, &build, nil, []model.LogChunk{{{Time: now.Add(time.Second), Msg: "global 0"}}})
+
+		// As in the database, global logs that started after the test
+		// are only included from the test's own sequence number on.
+		lines, err := store.GetTestLogLines(ctx, &build, &test, allTime, false)
+		assert.Equal(t, []string{"line 0", "line 1"}, readLines(t, lines, err))
+	})
+
+	t.Run("Batches", func(t *testing.T) {
+		build := model.Build{Id: "batches", Started: now}
+		require.NoError(t, store.InsertBuild(ctx, build))
+		test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: now}
+		require.NoError(t, store.InsertTest(ctx, &build, test))
+		chunks := []model.LogChunk{{{Time: now, Msg: "line"}}}
+
+		for _, logTest := range []*model.Test{&test, nil} {
+			applied, err := store.InsertLogChunks(ctx, &build, logTest, "batch0", chunks)
+			require.NoError(t, err)
+			assert.True(t, applied)
+			applied, err = store.InsertLogChunks(ctx, &build, logTest, "batch0", chunks)
+			require.NoError(t, err)
+			assert.False(t, applied, "retried batches aren't written again")
+		}
+		assert.Equal(t, 1, test.Seq)
+		assert.Equal(t, 1, build.Seq)
+
+		lines, err := store.GetAllLogLines(ctx, &build, NewTimeRange(TimeRangeMin, TimeRangeMax), false)
+		assert.Equal(t, []string{"line", "line"}, readLines(t, lines, err))
+	})
+
+	t.Run("AllLogs", func(t *testing.T) {
+		lines, err := store.GetAllLogLines(ctx, &build, allTime, false)
+		assert.Equal(t, []string{"test0 line 0", "global 0", "test0 line 1", "test1 line 0", "global 1"}, readLines(t, lines, err))
+
+		lines, err = store.GetAllLogLines(ctx, &build, NewTimeRange(TimeRangeMin, now.Add(time.Second)), true)
+		assert.Equal(t, []string{"global 0", "test0 line 0"}, readLines(t, lines, err))
+	})
+
+	t.Run("FindTests", func(t *testing.T) {
+		tests, err := store.FindTestsForBuild(ctx, &build)
+		require.NoError(t, err)
+		require.Len(t, tests, 2)
+		assert.Equal(t, test0.Id, tests[0].Id)
+
+		tests, err = store.FindTests(ctx, model.TestQuery{Builder: "builder", Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, tests, 1)
+		assert.Equal(t, test1.Id, tests[0].Id)
+
+		tests, err = store.FindTests(ctx, model.TestQuery{Builder: "builder", After: test1.Id.Hex()})
+		require.NoError(t, err)
+		require.Len(t, tests, 1)
+		assert.Equal(t, test0.Id, tests[0].Id)
+
+		test, err := store.FindTestByID(ctx, &model.Build{Id: "b1"}, test0.Id.Hex())
+		require.NoError(t, err)
+		assert.Nil(t, test, "tests are only found in their own build")
+	})
+
+	t.Run("OldBuilds", func(t *testing.T) {
+		old := model.Build{Id: "old", Started: now.Add(-2 * model.DeletePassedTestCutoff), Info: model.BuildInfo{TaskID: "t0"}}
+		require.NoError(t, store.InsertBuild(ctx, old))
+
+		builds, errs := store.StreamingGetOldBuilds(ctx, model.DefaultRetentionPolicies())
+		expired := []string{}
+		for build := range builds {
+			expired = append(expired, build.Id)
+		}
+		assert.NoError(t, <-errs)
+		assert.Equal(t, []string{old.Id}, expired)
+	})
+}
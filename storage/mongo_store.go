@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoStore is a LogStore backed by the database through the model package.
+type mongoStore struct{}
+
+// NewMongoStore returns a LogStore that keeps everything in the database.
+func NewMongoStore() LogStore {
+	return &mongoStore{}
+}
+
+func (s *mongoStore) InsertBuild(_ context.Context, build model.Build) error {
+	return errors.Wrapf(build.Insert(), "inserting build '%s'", build.Id)
+}
+
+func (s *mongoStore) FindBuildByID(_ context.Context, id string) (*model.Build, error) {
+	build, err := model.FindBuildById(id)
+	return build, errors.Wrapf(err, "finding build '%s'", id)
+}
+
+func (s *mongoStore) FindBuildByBuilder(_ context.Context, builder string, buildNum int) (*model.Build, error) {
+	build, err := model.FindBuildByBuilder(builder, buildNum)
+	return build, errors.Wrapf(err, "finding build %d of builder '%s'", buildNum, builder)
+}
+
+func (s *mongoStore) FinishBuild(_ context.Context, build *model.Build, ended time.Time, failed bool, phases []string) error {
+	return build.Finish(ended, failed, phases)
+}
+
+func (s *mongoStore) SetBuildHold(_ context.Context, build *model.Build, hold *model.BuildHold) error {
+	if hold == nil {
+		return build.Unpin()
+	}
+
+	return build.Pin(*hold)
+}
+
+func (s *mongoStore) InsertTest(_ context.Context, _ *model.Build, test model.Test) error {
+	return errors.Wrapf(test.Insert(), "inserting test '%s'", test.Id.Hex())
+}
+
+func (s *mongoStore) FindTestByID(_ context.Context, build *model.Build, testID string) (*model.Test, error) {
+	test, err := model.FindTestByID(testID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding test '%s'", testID)
+	}
+	if test == nil || test.BuildId != build.Id {
+		return nil, nil
+	}
+
+	return test, nil
+}
+
+func (s *mongoStore) FindTestsForBuild(_ context.Context, build *model.Build) ([]model.Test, error) {
+	tests, err := model.FindTestsForBuild(build.Id)
+	return tests, errors.Wrapf(err, "finding tests for build '%s'", build.Id)
+}
+
+func (s *mongoStore) FindTests(_ context.Context, query model.TestQuery) ([]model.Test, error) {
+	return model.FindTests(query)
+}
+
+func (s *mongoStore) EndTest(_ context.Context, _ *model.Build, test *model.Test, ended time.Time, failed bool) error {
+	return test.End(ended, failed)
+}
+
+func (s *mongoStore) InsertLogChunks(_ context.Context, build *model.Build, test *model.Test, batchID string, chunks []model.LogChunk) (bool, error) {
+	if test == nil {
+		return insertLogBatch(build, &build.Seq, build.Id, nil, batchID, chunks)
+	}
+
+	return insertLogBatch(test, &test.Seq, build.Id, &test.Id, batchID, chunks)
+}
+
+// sequencedLog is a build's global log or a test's log, whose chunks are
+// numbered by the sequence number of the build or test.
+type sequencedLog interface {
+	IncrementSequence(count int) error
+	IncrementSequenceForBatch(count int, batchID string) (bool, error)
+	ForgetBatch(batchID string) error
+}
+
+// insertLogBatch increments the log's sequence number, which seq points to,
+// and inserts the chunks. A batch with an ID is recorded in the same update as
+// the increment, so that a retried batch doesn't take up more sequence
+// numbers, and it's forgotten again if the chunks can't be inserted.
+func insertLogBatch(log sequencedLog, seq *int, buildID string, testID *bson.ObjectId, batchID string, chunks []model.LogChunk) (bool, error) {
+	if batchID == "" {
+		if err := log.IncrementSequence(len(chunks)); err != nil {
+			return false, err
+		}
+		return true, model.InsertLogChunks(buildID, testID, *seq, chunks)
+	}
+
+	applied, err := log.IncrementSequenceForBatch(len(chunks), batchID)
+	if err != nil || !applied {
+		return false, err
+	}
+	if err = model.InsertLogBatch(buildID, testID, batchID, *seq, chunks); err != nil {
+		catcher := grip.NewBasicCatcher()
+		catcher.Add(err)
+		catcher.Add(log.ForgetBatch(batchID))
+		return false, catcher.Resolve()
+	}
+
+	return true, nil
+}
+
+func (s *mongoStore) GetTestLogLines(ctx context.Context, _ *model.Build, test *model.Test, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error) {
+	minTime, maxTime := timeRange.bounds()
+	if reverse {
+		return model.MergedTestLogsReverse(ctx, test, minTime, maxTime)
+	}
+
+	return model.MergedTestLogs(ctx, test, minTime, maxTime)
+}
+
+func (s *mongoStore) GetTestLogLinesFrom(ctx context.Context, _ *model.Build, test *model.Test, timeRange TimeRange, cursor LogCursor) (chan *model.LogLineItem, error) {
+	testMinTime, maxTime := timeRange.from(cursor.Test).bounds()
+	globalMinTime, _ := timeRange.from(cursor.Global).bounds()
+
+	return model.MergedTestLogsFrom(ctx, test, testMinTime, globalMinTime, maxTime)
+}
+
+func (s *mongoStore) GetAllLogLines(ctx context.Context, build *model.Build, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error) {
+	minTime, maxTime := timeRange.bounds()
+	if reverse {
+		return model.AllLogsReverse(ctx, build.Id, minTime, maxTime)
+	}
+
+	return model.AllLogs(ctx, build.Id, minTime, maxTime)
+}
+
+func (s *mongoStore) StreamingGetOldBuilds(ctx context.Context, policies model.RetentionPolicies) (<-chan model.Build, <-chan error) {
+	return model.StreamingGetOldBuilds(ctx, policies)
+}
+
+// mongoJournal is a WriteJournal backed by the pending writes collection.
+type mongoJournal struct{}
+
+// NewMongoJournal returns a WriteJournal that records pending bucket writes in
+// the database, where the replay jobs find them.
+func NewMongoJournal() WriteJournal {
+	return &mongoJournal{}
+}
+
+func (j *mongoJournal) Record(_ context.Context, write *model.PendingWrite) error {
+	return write.Insert()
+}
+
+func (j *mongoJournal) SetSeqRange(_ context.Context, write *model.PendingWrite, first, last int) error {
+	return write.SetSeqRange(first, last)
+}
+
+func (j *mongoJournal) Complete(_ context.Context, write *model.PendingWrite) error {
+	return write.Remove()
+}
@@ -5,6 +5,9 @@ import (
 	"context"
 
 	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/pail"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
 	"github.com/pkg/errors"
 )
 
@@ -28,8 +31,45 @@ func (b *Bucket) UploadTestMetadata(ctx context.Context, test model.Test) error
 	return errors.Wrapf(b.Put(ctx, metadata.key(), bytes.NewReader(json)), "putting metadata for test '%s'", test.Id)
 }
 
+// InsertLogBatch writes the chunks like InsertLogChunks and then records the
+// batch ID, unless the batch was already recorded, in which case nothing is
+// written and it returns false. The chunks' keys are tagged with the batch ID,
+// so a batch whose chunks were written but not recorded, or that is retried
+// while it's being written, writes the same keys again, and the copies
+// overwrite each other. An empty batch ID always writes the chunks.
+func (b *Bucket) InsertLogBatch(ctx context.Context, buildID string, testID string, batchID string, chunks []model.LogChunk) (bool, error) {
+	if batchID == "" {
+		return true, b.InsertLogChunks(ctx, buildID, testID, chunks)
+	}
+
+	key := batchKey(buildID, testID, batchID)
+	reader, err := b.Get(ctx, key)
+	if err == nil {
+		return false, errors.Wrapf(reader.Close(), "closing batch '%s'", batchID)
+	}
+	if !pail.IsKeyNotFoundError(errors.Cause(err)) {
+		return false, errors.Wrapf(err, "checking for batch '%s'", batchID)
+	}
+
+	if err = b.insertLogChunks(ctx, buildID, testID, batchID, chunks); err != nil {
+		return false, err
+	}
+
+	return true, errors.Wrapf(b.Put(ctx, key, bytes.NewReader(nil)), "recording batch '%s'", batchID)
+}
+
+// InsertLogChunks writes each chunk to the bucket with the bucket's encoding
+// and then records them in an append manifest.
 func (b *Bucket) InsertLogChunks(ctx context.Context, buildID string, testID string, chunks []model.LogChunk) error {
-	for _, chunk := range chunks {
+	return b.insertLogChunks(ctx, buildID, testID, "", chunks)
+}
+
+// insertLogChunks is InsertLogChunks for the chunks of the batch with the
+// given ID, whose keys are tagged with it.
+func (b *Bucket) insertLogChunks(ctx context.Context, buildID string, testID string, batchID string, chunks []model.LogChunk) error {
+	var rawBytes, storedBytes int
+	written := make([]LogChunkInfo, 0, len(chunks))
+	for i, chunk := range chunks {
 		if len(chunk) == 0 {
 			continue
 		}
@@ -39,15 +79,39 @@ func (b *Bucket) InsertLogChunks(ctx context.Context, buildID string, testID str
 		if err != nil {
 			return errors.Wrap(err, "parsing log chunks")
 		}
+		logChunkInfo.Tag = batchChunkTag(batchID, i)
 		var buffer bytes.Buffer
 		for _, line := range chunk {
 			buffer.WriteString(makeLogLineString(line))
 		}
 
-		if err := b.Put(ctx, logChunkInfo.key(), &buffer); err != nil {
+		data, encoding, err := encodeChunk(b.encoding, buffer.Bytes())
+		if err != nil {
+			return errors.Wrap(err, "encoding log chunk")
+		}
+		logChunkInfo.Encoding = encoding
+		rawBytes += buffer.Len()
+		storedBytes += len(data)
+
+		if err := b.Put(ctx, logChunkInfo.key(), bytes.NewReader(data)); err != nil {
 			return errors.Wrap(err, "uploading log entry to bucket")
 		}
+		written = append(written, logChunkInfo)
+	}
+	if len(written) > 0 {
+		if err := b.addToManifest(ctx, buildID, written); err != nil {
+			return errors.Wrap(err, "adding log chunks to manifest")
+		}
 	}
 
+	grip.DebugWhen(rawBytes > 0, message.Fields{
+		"message":      "uploaded log chunks",
+		"build_id":     buildID,
+		"test_id":      testID,
+		"encoding":     b.encoding,
+		"raw_bytes":    rawBytes,
+		"stored_bytes": storedBytes,
+	})
+
 	return nil
 }
@@ -168,7 +168,7 @@ func TestInsertLogChunks(t *testing.T) {
 
 		verifyDataStorage(t, storage, fmt.Sprintf("/builds/%s/", buildID), expectedChunks)
 
-		logsChannel, err := storage.GetAllLogLines(context.Background(), buildID)
+		logsChannel, err := storage.GetAllLogLines(context.Background(), buildID, NewTimeRange(TimeRangeMin, TimeRangeMax))
 		require.NoError(t, err)
 
 		result := []model.LogLineItem{}
@@ -191,7 +191,7 @@ func TestInsertLogChunks(t *testing.T) {
 
 		verifyDataStorage(t, storage, fmt.Sprintf("/builds/%s/tests/%s/", buildID, testID), expectedChunks)
 
-		logsChannel, err := storage.GetTestLogLines(context.Background(), buildID, testID)
+		logsChannel, err := storage.GetTestLogLines(context.Background(), buildID, testID, NewTimeRange(TimeRangeMin, TimeRangeMax))
 		require.NoError(t, err)
 
 		result := []model.LogLineItem{}
@@ -200,6 +200,64 @@ func TestInsertLogChunks(t *testing.T) {
 			result = append(result, *item)
 		}
 
-		assert.Equal(t, expected, result)
+		testObjectID := bson.ObjectIdHex(testID)
+		expectedTestLines := make([]model.LogLineItem, len(expected))
+		for i, item := range expected {
+			item.TestId = &testObjectID
+			expectedTestLines[i] = item
+		}
+		assert.Equal(t, expectedTestLines, result)
+	})
+}
+
+func TestInsertLogBatch(t *testing.T) {
+	ctx := context.Background()
+	buildID := "5a75f537726934e4b62833ab6d5dca41"
+	testID := "62dba0159041307f697e6ccc"
+
+	storage := makeTestStorage(t, "")
+	defer cleanTestStorage(t)
+
+	for _, id := range []string{testID, ""} {
+		applied, err := storage.InsertLogBatch(ctx, buildID, id, "batch0", []model.LogChunk{{{Time: time.Now(), Msg: "line"}}})
+		require.NoError(t, err)
+		assert.True(t, applied)
+
+		// A retry may carry lines with different timestamps, which would
+		// otherwise be written under a different key.
+		applied, err = storage.InsertLogBatch(ctx, buildID, id, "batch0", []model.LogChunk{{{Time: time.Now().Add(time.Second), Msg: "line"}}})
+		require.NoError(t, err)
+		assert.False(t, applied)
+
+		applied, err = storage.InsertLogBatch(ctx, buildID, id, "", []model.LogChunk{{{Time: time.Now().Add(2 * time.Second), Msg: "line"}}})
+		require.NoError(t, err)
+		assert.True(t, applied, "batches without an ID are always written")
+	}
+
+	counts, err := storage.CountLogLines(ctx, buildID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"": 2, testID: 2}, counts)
+
+	stats, err := storage.DeleteBuild(ctx, buildID)
+	require.NoError(t, err)
+	assert.Equal(t, 12, stats.Objects, "the batch records and manifests are removed with the build")
+
+	t.Run("ConcurrentRetries", func(t *testing.T) {
+		now := time.Now()
+		chunks := []model.LogChunk{{{Time: now, Msg: "line 0"}}, {{Time: now, Msg: "line 1"}}}
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				_, err := storage.InsertLogBatch(ctx, buildID, testID, "batch1", chunks)
+				errs <- err
+			}()
+		}
+		for i := 0; i < 2; i++ {
+			require.NoError(t, <-errs)
+		}
+
+		counts, err := storage.CountLogLines(ctx, buildID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{testID: 2}, counts, "retries that both write the batch write the same keys")
 	})
 }
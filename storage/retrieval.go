@@ -9,28 +9,26 @@ import (
 	"time"
 
 	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/pail"
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/recovery"
 	"github.com/pkg/errors"
 )
 
-func (b *Bucket) getAllChunks(context context.Context, buildId string) ([]LogChunkInfo, error) {
-	iterator, listErr := b.List(context, buildPrefix(buildId))
-	buildChunks := []LogChunkInfo{}
-	if listErr != nil {
-		return nil, listErr
+// CountLogLines returns the number of log lines stored for the build, keyed
+// by test ID. Global log lines are counted under the empty string.
+func (b *Bucket) CountLogLines(ctx context.Context, buildID string) (map[string]int, error) {
+	chunks, err := b.getAllChunks(ctx, buildID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting chunks for build '%s'", buildID)
 	}
-	for iterator.Next(context) {
-		if strings.HasSuffix(iterator.Item().Name(), metadataFilename) {
-			continue
-		}
-		var info LogChunkInfo
-		if err := info.fromKey(iterator.Item().Name()); err != nil {
-			return nil, errors.Wrap(err, "getting log chunk info from key name")
-		}
-		buildChunks = append(buildChunks, info)
+
+	counts := map[string]int{}
+	for _, chunk := range chunks {
+		counts[chunk.TestID] += chunk.NumLines
 	}
-	return buildChunks, nil
+
+	return counts, nil
 }
 
 func (storage *Bucket) getBuildAndTestChunks(context context.Context, buildId string) ([]LogChunkInfo, []LogChunkInfo, error) {
@@ -71,7 +69,29 @@ func sortByStartTime(chunks []LogChunkInfo) {
 	})
 }
 
-func (storage *Bucket) GetAllLogLines(context context.Context, buildId string) (chan *model.LogLineItem, error) {
+// GetAllLogLines returns a channel with all build and test logs for the build
+// within the time range, merged together by timestamp.
+func (storage *Bucket) GetAllLogLines(context context.Context, buildId string, timeRange TimeRange) (chan *model.LogLineItem, error) {
+	iterator, err := storage.allLogsIterator(context, buildId, timeRange)
+	if err != nil {
+		return nil, err
+	}
+
+	return iterator.Channel(context), nil
+}
+
+// GetAllLogLinesReverse is the same as GetAllLogLines, except that the lines
+// are returned newest first.
+func (storage *Bucket) GetAllLogLinesReverse(context context.Context, buildId string, timeRange TimeRange) (chan *model.LogLineItem, error) {
+	iterator, err := storage.allLogsIterator(context, buildId, timeRange)
+	if err != nil {
+		return nil, err
+	}
+
+	return iterator.Reverse().Channel(context), nil
+}
+
+func (storage *Bucket) allLogsIterator(context context.Context, buildId string, timeRange TimeRange) (LogIterator, error) {
 	buildChunks, testChunks, err := storage.getBuildAndTestChunks(context, buildId)
 	if err != nil {
 		return nil, err
@@ -80,13 +100,11 @@ func (storage *Bucket) GetAllLogLines(context context.Context, buildId string) (
 	sortByStartTime(buildChunks)
 	sortByStartTime(testChunks)
 
-	timeRange := NewTimeRange(TimeRangeMin, TimeRangeMax)
-
 	buildChunkIterator := NewBatchedLogIterator(storage, buildChunks, 4, timeRange)
 	testChunkIterator := NewBatchedLogIterator(storage, testChunks, 4, timeRange)
 
 	// Merge test and build logs
-	return NewMergingIterator(testChunkIterator, buildChunkIterator).Channel(context), nil
+	return NewMergingIterator(testChunkIterator, buildChunkIterator), nil
 }
 
 func testChunksWithId(chunks []LogChunkInfo, testID string) []LogChunkInfo {
@@ -111,7 +129,41 @@ func getFirstTestChunkAfter(allTestChunks []LogChunkInfo, target time.Time) time
 	return TimeRangeMax
 }
 
-func (storage *Bucket) GetTestLogLines(context context.Context, buildId string, testId string) (chan *model.LogLineItem, error) {
+// GetTestLogLines returns a channel with the test's logs merged with the
+// concurrent global logs, limited to those within the time range.
+func (storage *Bucket) GetTestLogLines(context context.Context, buildId string, testId string, timeRange TimeRange) (chan *model.LogLineItem, error) {
+	iterator, err := storage.testLogsIterator(context, buildId, testId, timeRange, timeRange)
+	if err != nil {
+		return nil, err
+	}
+
+	return iterator.Channel(context), nil
+}
+
+// GetTestLogLinesReverse is the same as GetTestLogLines, except that the lines
+// are returned newest first.
+func (storage *Bucket) GetTestLogLinesReverse(context context.Context, buildId string, testId string, timeRange TimeRange) (chan *model.LogLineItem, error) {
+	iterator, err := storage.testLogsIterator(context, buildId, testId, timeRange, timeRange)
+	if err != nil {
+		return nil, err
+	}
+
+	return iterator.Reverse().Channel(context), nil
+}
+
+// GetTestLogLinesFrom is the same as GetTestLogLines, except that the test's
+// logs are limited to those within testRange and the global logs to those
+// within globalRange.
+func (storage *Bucket) GetTestLogLinesFrom(context context.Context, buildId string, testId string, testRange, globalRange TimeRange) (chan *model.LogLineItem, error) {
+	iterator, err := storage.testLogsIterator(context, buildId, testId, testRange, globalRange)
+	if err != nil {
+		return nil, err
+	}
+
+	return iterator.Channel(context), nil
+}
+
+func (storage *Bucket) testLogsIterator(context context.Context, buildId string, testId string, testRange, globalRange TimeRange) (LogIterator, error) {
 	buildChunks, allTestChunks, err := storage.getBuildAndTestChunks(context, buildId)
 	if err != nil {
 		return nil, err
@@ -120,6 +172,11 @@ func (storage *Bucket) GetTestLogLines(context context.Context, buildId string,
 	sortByStartTime(allTestChunks)
 
 	testChunks := testChunksWithId(allTestChunks, testId)
+	if len(testChunks) == 0 {
+		// The test's window is derived from its chunks, so a test without
+		// any logs has no global logs either.
+		return NewBatchedLogIterator(storage, testChunks, 4, testRange), nil
+	}
 
 	sortByStartTime(testChunks)
 
@@ -129,24 +186,37 @@ func (storage *Bucket) GetTestLogLines(context context.Context, buildId string,
 	lastTestChunkEnd := getLatestTime(testChunks)
 	logEndTime := getFirstTestChunkAfter(allTestChunks, lastTestChunkEnd)
 
-	testTimeRange := NewTimeRange(testChunks[0].Start, logEndTime)
+	executionRange := NewTimeRange(testChunks[0].Start, logEndTime)
+	within := func(timeRange TimeRange) TimeRange {
+		clamped := executionRange.from(timeRange.StartAt)
+		if timeRange.EndAt.Before(clamped.EndAt) {
+			clamped.EndAt = timeRange.EndAt
+		}
+		return clamped
+	}
 
-	testChunkIterator := NewBatchedLogIterator(storage, testChunks, 4, testTimeRange)
+	testChunkIterator := NewBatchedLogIterator(storage, testChunks, 4, within(testRange))
 
 	sortByStartTime(buildChunks)
-	// Before fetching, this batchedlogiterator will filter out buildChunks that don't intersect with testTimeRange
-	buildChunkIterator := NewBatchedLogIterator(storage, buildChunks, 4, testTimeRange)
+	// Before fetching, this batchedlogiterator will filter out buildChunks that don't intersect with the test's time range
+	buildChunkIterator := NewBatchedLogIterator(storage, buildChunks, 4, within(globalRange))
 
 	// Merge everything together
-	return NewMergingIterator(testChunkIterator, buildChunkIterator).Channel(context), nil
+	return NewMergingIterator(testChunkIterator, buildChunkIterator), nil
 }
 
+// FindBuildByID returns the build with the given ID, or nil if the bucket
+// doesn't have it.
 func (b *Bucket) FindBuildByID(ctx context.Context, id string) (*model.Build, error) {
 	key := metadataKeyForBuildId(id)
 	reader, err := b.Get(ctx, key)
+	if pail.IsKeyNotFoundError(errors.Cause(err)) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "fetching build metadata for build '%s'", id)
 	}
+	defer reader.Close()
 
 	metadata := buildMetadata{}
 	decoder := json.NewDecoder(reader)
@@ -160,12 +230,18 @@ func (b *Bucket) FindBuildByID(ctx context.Context, id string) (*model.Build, er
 	return &build, nil
 }
 
+// FindTestByID returns the test with the given ID, or nil if the bucket
+// doesn't have it.
 func (b *Bucket) FindTestByID(ctx context.Context, buildId string, testId string) (*model.Test, error) {
 	key := metadataKeyForTest(buildId, testId)
 	reader, err := b.Get(ctx, key)
+	if pail.IsKeyNotFoundError(errors.Cause(err)) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "fetching test metadata for build: '%s' and test: '%s'", buildId, testId)
 	}
+	defer reader.Close()
 
 	metadata := testMetadata{}
 	decoder := json.NewDecoder(reader)
@@ -209,6 +285,8 @@ func (b *Bucket) FindTestsForBuild(ctx context.Context, buildId string) ([]model
 			test, err := b.FindTestByID(ctx, buildId, closureTestId)
 			if err != nil {
 				catcher.Wrapf(err, "fetching test ID '%s' under build ID '%s'", closureTestId, buildId)
+			} else if test == nil {
+				catcher.Errorf("test ID '%s' under build ID '%s' was removed while fetching it", closureTestId, buildId)
 			} else {
 				testResults[closureIndex] = *test
 			}
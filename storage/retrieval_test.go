@@ -2,9 +2,12 @@ package storage
 
 import (
 	"context"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/mgo.v2/bson"
@@ -13,7 +16,7 @@ import (
 func TestGetTestLogLines(t *testing.T) {
 	storage := makeTestStorage(t, "../testdata/simple")
 	defer cleanTestStorage(t)
-	channel, err := storage.GetTestLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc")
+	channel, err := storage.GetTestLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc", NewTimeRange(TimeRangeMin, TimeRangeMax))
 	require.NoError(t, err)
 
 	// We should have the one additional intersecting line from the global logs and an additional one after
@@ -28,10 +31,37 @@ func TestGetTestLogLines(t *testing.T) {
 	assert.Equal(t, "I am a global log within the test start/stop ranges.", lines[2])
 }
 
+func TestGetTestLogLinesStopsWithContext(t *testing.T) {
+	storage := makeTestStorage(t, "../testdata/simple")
+	defer cleanTestStorage(t)
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	channel, err := storage.GetTestLogLines(ctx, "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc", NewTimeRange(TimeRangeMin, TimeRangeMax))
+	require.NoError(t, err)
+	<-channel
+	cancel()
+
+	assert.NoError(t, testutil.WaitForGoroutines(baseline, 5*time.Second))
+}
+
+func TestCountLogLines(t *testing.T) {
+	storage := makeTestStorage(t, "../testdata/simple")
+	defer cleanTestStorage(t)
+
+	counts, err := storage.CountLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"": 4, "62dba0159041307f697e6ccc": 11}, counts)
+
+	counts, err = storage.CountLogLines(context.Background(), "nonexistent")
+	require.NoError(t, err)
+	assert.Empty(t, counts)
+}
+
 func TestGetTestLogLinesInBetween(t *testing.T) {
 	storage := makeTestStorage(t, "../testdata/between")
 	defer cleanTestStorage(t)
-	channel, err := storage.GetTestLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc")
+	channel, err := storage.GetTestLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc", NewTimeRange(TimeRangeMin, TimeRangeMax))
 	require.NoError(t, err)
 
 	const expectedCount = 4
@@ -42,19 +72,39 @@ func TestGetTestLogLinesInBetween(t *testing.T) {
 		"Log501",
 		"Log502",
 	}
+	expectedGlobal := []bool{false, false, true, true}
 	lines := []string{}
+	global := []bool{}
 	for item := range channel {
 		lines = append(lines, item.Data)
+		global = append(global, item.Global())
+		if !item.Global() {
+			assert.Equal(t, "62dba0159041307f697e6ccc", item.TestId.Hex())
+		}
 	}
 
 	assert.Equal(t, expectedCount, len(lines))
 	assert.Equal(t, expectedLines, lines)
+	assert.Equal(t, expectedGlobal, global)
+}
+
+func TestGetTestLogLinesReverse(t *testing.T) {
+	storage := makeTestStorage(t, "../testdata/between")
+	defer cleanTestStorage(t)
+	channel, err := storage.GetTestLogLinesReverse(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc", NewTimeRange(TimeRangeMin, TimeRangeMax))
+	require.NoError(t, err)
+
+	lines := []string{}
+	for item := range channel {
+		lines = append(lines, item.Data)
+	}
+	assert.Equal(t, []string{"Log502", "Log501", "Test Log402", "Test Log401"}, lines)
 }
 
 func TestGetTestLogLinesOverlapping(t *testing.T) {
 	storage := makeTestStorage(t, "../testdata/overlapping")
 	defer cleanTestStorage(t)
-	channel, err := storage.GetTestLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc")
+	channel, err := storage.GetTestLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc", NewTimeRange(TimeRangeMin, TimeRangeMax))
 	require.NoError(t, err)
 
 	// We should have all global logs that overlap our test and all logs after, since there is
@@ -106,10 +156,54 @@ func TestGetTestLogLinesOverlapping(t *testing.T) {
 	assert.Equal(t, expectedLines, lines)
 }
 
+func TestGetTestLogLinesFrom(t *testing.T) {
+	storage := makeTestStorage(t, "../testdata/overlapping")
+	defer cleanTestStorage(t)
+	const buildID, testID = "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc"
+	allTime := NewTimeRange(TimeRangeMin, TimeRangeMax)
+	channel, err := storage.GetTestLogLines(context.Background(), buildID, testID, allTime)
+	require.NoError(t, err)
+	all := []model.LogLineItem{}
+	for item := range channel {
+		all = append(all, *item)
+	}
+
+	var testFrom, globalFrom time.Time
+	for _, item := range all {
+		switch item.Data {
+		case "Test Log760":
+			testFrom = item.Timestamp
+		case "Log540":
+			globalFrom = item.Timestamp
+		}
+	}
+	require.False(t, testFrom.IsZero())
+	require.False(t, globalFrom.IsZero())
+	expectedLines := []string{}
+	for _, item := range all {
+		from := testFrom
+		if item.Global() {
+			from = globalFrom
+		}
+		if !item.Timestamp.Before(from) {
+			expectedLines = append(expectedLines, item.Data)
+		}
+	}
+
+	channel, err = storage.GetTestLogLinesFrom(context.Background(), buildID, testID, allTime.from(testFrom), allTime.from(globalFrom))
+	require.NoError(t, err)
+	lines := []string{}
+	for item := range channel {
+		lines = append(lines, item.Data)
+	}
+	assert.Equal(t, expectedLines, lines)
+	assert.Equal(t, []string{"Log540", "Log560", "Log580", "Test Log760", "Test Log800"}, lines[:5])
+}
+
 func TestGetAllLogLinesOverlapping(t *testing.T) {
 	storage := makeTestStorage(t, "../testdata/overlapping")
 	defer cleanTestStorage(t)
-	channel, err := storage.GetAllLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41")
+	channel, err := storage.GetAllLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", NewTimeRange(TimeRangeMin, TimeRangeMax))
 	require.NoError(t, err)
 
 	const expectedCount = 40
@@ -163,6 +257,35 @@ func TestGetAllLogLinesOverlapping(t *testing.T) {
 	assert.Equal(t, expectedLines, lines)
 }
 
+func TestGetLogLinesInTimeRange(t *testing.T) {
+	storage := makeTestStorage(t, "../testdata/overlapping")
+	defer cleanTestStorage(t)
+
+	timeRange := NewTimeRange(time.Unix(1000000000, 580*int64(time.Millisecond)), time.Unix(1000000000, 610*int64(time.Millisecond)))
+
+	t.Run("AllLogs", func(t *testing.T) {
+		channel, err := storage.GetAllLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", timeRange)
+		require.NoError(t, err)
+
+		lines := []string{}
+		for item := range channel {
+			lines = append(lines, item.Data)
+		}
+		assert.Equal(t, []string{"Log580", "Test Log600", "Test Log601"}, lines)
+	})
+
+	t.Run("TestLogs", func(t *testing.T) {
+		channel, err := storage.GetTestLogLines(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc", timeRange)
+		require.NoError(t, err)
+
+		lines := []string{}
+		for item := range channel {
+			lines = append(lines, item.Data)
+		}
+		assert.Equal(t, []string{"Log580", "Test Log600", "Test Log601"}, lines)
+	})
+}
+
 func TestFindBuildById(t *testing.T) {
 	storage := makeTestStorage(t, "../testdata/simple")
 	defer cleanTestStorage(t)
@@ -178,6 +301,10 @@ func TestFindBuildById(t *testing.T) {
 	buildResponse, err := storage.FindBuildByID(context.Background(), "5a75f537726934e4b62833ab6d5dca41")
 	require.NoError(t, err)
 	assert.Equal(t, &expected, buildResponse)
+
+	buildResponse, err = storage.FindBuildByID(context.Background(), "nonexistent")
+	require.NoError(t, err)
+	assert.Nil(t, buildResponse)
 }
 
 func TestFindTestById(t *testing.T) {
@@ -197,6 +324,10 @@ func TestFindTestById(t *testing.T) {
 	testResponse, err := storage.FindTestByID(context.Background(), "5a75f537726934e4b62833ab6d5dca41", "62dba0159041307f697e6ccc")
 	require.NoError(t, err)
 	assert.Equal(t, &expected, testResponse)
+
+	testResponse, err = storage.FindTestByID(context.Background(), "5a75f537726934e4b62833ab6d5dca41", bson.NewObjectId().Hex())
+	require.NoError(t, err)
+	assert.Nil(t, testResponse)
 }
 
 func TestFindTestsForBuild(t *testing.T) {
@@ -16,6 +16,12 @@ const (
 
 type Bucket struct {
 	pail.Bucket
+	// encoding is the encoding of the log chunks written to the bucket.
+	encoding ChunkEncoding
+	// manifestLocks serializes updates to the manifests of each build.
+	manifestLocks *manifestLocks
+	// manifestCache keeps the append manifests that were read.
+	manifestCache *manifestCache
 }
 
 type PailType int
@@ -28,6 +34,9 @@ const (
 type BucketOpts struct {
 	Location PailType
 	Path     string
+	// Encoding is the encoding of the log chunks written to the bucket.
+	// Chunks are read with whichever encoding they were written with.
+	Encoding ChunkEncoding
 }
 
 func NewBucket(opts BucketOpts) (Bucket, error) {
@@ -35,7 +44,7 @@ func NewBucket(opts BucketOpts) (Bucket, error) {
 	if err != nil {
 		return Bucket{}, errors.Wrap(err, "making bucket")
 	}
-	return Bucket{bucket}, nil
+	return Bucket{Bucket: bucket, encoding: opts.Encoding, manifestLocks: newManifestLocks(), manifestCache: newManifestCache()}, nil
 }
 
 func (opts *BucketOpts) getBucket() (pail.Bucket, error) {
@@ -55,7 +64,7 @@ func (opts *BucketOpts) getBucket() (pail.Bucket, error) {
 			return nil, errors.Wrapf(err, "creating local bucket at '%s'", opts.Path)
 		}
 
-		return Bucket{localBucket}, nil
+		return localBucket, nil
 	case PailS3:
 		s3Options, err := opts.getS3Options()
 		if err != nil {
@@ -66,7 +75,7 @@ func (opts *BucketOpts) getBucket() (pail.Bucket, error) {
 			return nil, errors.Wrap(err, "creating S3 bucket")
 		}
 
-		return Bucket{s3Bucket}, nil
+		return s3Bucket, nil
 	default:
 		return nil, errors.Errorf("unknown location '%d'", opts.Location)
 	}
@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -13,9 +16,21 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
-const metadataFilename = "metadata.json"
+const (
+	metadataFilename = "metadata.json"
+	batchesDirectory = "batches/"
+
+	// chunkTagBytes is the number of bytes of the digest that a chunk's tag
+	// is made of.
+	chunkTagBytes = 8
+)
+
+var chunkTagPattern = regexp.MustCompile(fmt.Sprintf("^[0-9a-f]{%d}$", 2*chunkTagBytes))
 
 func parseLogLineString(data string) (model.LogLineItem, error) {
+	if len(data) < 23 {
+		return model.LogLineItem{}, errors.Errorf("log line of %d bytes is too short to have a timestamp", len(data))
+	}
 	ts, err := strconv.ParseInt(strings.TrimSpace(data[3:23]), 10, 64)
 	if err != nil {
 		return model.LogLineItem{}, errors.Wrap(err, "parsing log line timestamp")
@@ -40,6 +55,12 @@ type LogChunkInfo struct {
 	NumLines int
 	Start    time.Time
 	End      time.Time
+	Encoding ChunkEncoding
+	// Tag tells apart the chunks of different batches that have the same
+	// times and number of lines, and is the same for the chunks of a
+	// retried batch, so that retries overwrite each other. It's empty for
+	// chunks appended without a batch ID and for merged chunks.
+	Tag string
 }
 
 func (info *LogChunkInfo) key() string {
@@ -49,22 +70,47 @@ func (info *LogChunkInfo) key() string {
 	} else {
 		prefix = buildPrefix(info.BuildID)
 	}
-	return fmt.Sprintf("%s%d_%d_%d", prefix, info.Start.UnixNano(), info.End.UnixNano(), info.NumLines)
+	name := fmt.Sprintf("%d_%d_%d", info.Start.UnixNano(), info.End.UnixNano(), info.NumLines)
+	if info.Tag != "" {
+		name += "_" + info.Tag
+	}
+	return fmt.Sprintf("%s%s%s", prefix, name, info.Encoding.extension())
 }
 
 func (info *LogChunkInfo) fromKey(path string) error {
 	var keyName string
 	keyParts := strings.Split(path, "/")
 	if strings.Contains(path, "/tests/") {
+		if len(keyParts) != 6 {
+			return errors.Errorf("test chunk key '%s' should have 6 parts", path)
+		}
 		info.BuildID = keyParts[2]
 		info.TestID = keyParts[4]
 		keyName = keyParts[5]
 	} else {
+		if len(keyParts) != 4 {
+			return errors.Errorf("chunk key '%s' should have 4 parts", path)
+		}
 		info.BuildID = keyParts[2]
 		keyName = keyParts[3]
 	}
 
+	keyName, encoding, err := splitEncoding(keyName)
+	if err != nil {
+		return errors.Wrap(err, "parsing encoding")
+	}
+	info.Encoding = encoding
+
 	nameParts := strings.Split(keyName, "_")
+	if len(nameParts) != 3 && len(nameParts) != 4 {
+		return errors.Errorf("chunk name '%s' should be the start, end, and number of lines, optionally followed by a tag", keyName)
+	}
+	if len(nameParts) == 4 {
+		if !chunkTagPattern.MatchString(nameParts[3]) {
+			return errors.Errorf("chunk name '%s' has an invalid tag", keyName)
+		}
+		info.Tag = nameParts[3]
+	}
 	startNanos, err := strconv.ParseInt(nameParts[0], 10, 64)
 	if err != nil {
 		return errors.Wrap(err, "parsing start time")
@@ -86,6 +132,26 @@ func (info *LogChunkInfo) fromKey(path string) error {
 	return nil
 }
 
+// testObjectID returns the ID of the test the chunk belongs to, or nil if the
+// chunk is part of the global logs.
+func (info *LogChunkInfo) testObjectID() *bson.ObjectId {
+	if !bson.IsObjectIdHex(info.TestID) {
+		return nil
+	}
+	id := bson.ObjectIdHex(info.TestID)
+	return &id
+}
+
+// batchChunkTag returns the tag of the chunk at the given index of a batch
+// appended with the batch ID, or an empty tag if the batch ID is empty.
+func batchChunkTag(batchID string, index int) string {
+	if batchID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", batchID, index)))
+	return hex.EncodeToString(sum[:chunkTagBytes])
+}
+
 func (info *LogChunkInfo) fromLogChunk(buildID string, testID string, logChunk model.LogChunk) error {
 	if len(logChunk) == 0 {
 		return errors.New("log chunk must contain at least one line")
@@ -103,8 +169,10 @@ func (info *LogChunkInfo) fromLogChunk(buildID string, testID string, logChunk m
 	info.BuildID = buildID
 	info.TestID = testID
 	info.NumLines = len(logChunk)
-	info.Start = minTime
-	info.End = maxTime
+	// Lines are stored with millisecond precision, so the key's times are
+	// too, which lets a chunk replayed from the database get the same key.
+	info.Start = minTime.Truncate(time.Millisecond)
+	info.End = maxTime.Truncate(time.Millisecond)
 	return nil
 }
 
@@ -116,6 +184,17 @@ func testIdFromKey(path string) (string, error) {
 	return "", errors.Errorf("programmatic error: unexpected test ID prefix in path '%s'", path)
 }
 
+// batchKey returns the key that records that the batch was applied to the
+// test's logs, or to the build's global logs if the test ID is empty.
+func batchKey(buildID, testID, batchID string) string {
+	prefix := buildPrefix(buildID)
+	if testID != "" {
+		prefix = testPrefix(buildID, testID)
+	}
+
+	return fmt.Sprintf("%s%s%s", prefix, batchesDirectory, batchID)
+}
+
 func buildPrefix(buildID string) string {
 	return fmt.Sprintf("/builds/%s/", buildID)
 }
@@ -128,11 +207,21 @@ func testPrefix(buildID, testID string) string {
 	return fmt.Sprintf("%s%s/", buildTestsPrefix(buildID), testID)
 }
 
+// buildMetadata is the build as it's stored in the bucket. Seq is only
+// brought up to date when the rest of the metadata changes, so it's exact
+// once the build is finished.
 type buildMetadata struct {
-	ID       string `json:"id"`
-	Builder  string `json:"builder"`
-	BuildNum int    `json:"buildnum"`
-	TaskID   string `json:"task_id"`
+	ID       string           `json:"id"`
+	Builder  string           `json:"builder"`
+	BuildNum int              `json:"buildnum"`
+	Name     string           `json:"name,omitempty"`
+	TaskID   string           `json:"task_id"`
+	Started  *time.Time       `json:"started,omitempty"`
+	Ended    *time.Time       `json:"ended,omitempty"`
+	Failed   bool             `json:"failed,omitempty"`
+	Phases   []string         `json:"phases,omitempty"`
+	Seq      int              `json:"seq,omitempty"`
+	Hold     *model.BuildHold `json:"hold,omitempty"`
 }
 
 func newBuildMetadata(b model.Build) buildMetadata {
@@ -140,19 +229,37 @@ func newBuildMetadata(b model.Build) buildMetadata {
 		ID:       b.Id,
 		Builder:  b.Builder,
 		BuildNum: b.BuildNum,
+		Name:     b.Name,
 		TaskID:   b.Info.TaskID,
+		Started:  optionalTime(b.Started),
+		Ended:    b.Ended,
+		Failed:   b.Failed,
+		Phases:   b.Phases,
+		Seq:      b.Seq,
+		Hold:     b.Hold,
 	}
 }
 
 func (m *buildMetadata) toBuild() model.Build {
-	return model.Build{
+	build := model.Build{
 		Id:       m.ID,
 		Builder:  m.Builder,
 		BuildNum: m.BuildNum,
+		Name:     m.Name,
 		Info: model.BuildInfo{
 			TaskID: m.TaskID,
 		},
+		Ended:  m.Ended,
+		Failed: m.Failed,
+		Phases: m.Phases,
+		Seq:    m.Seq,
+		Hold:   m.Hold,
 	}
+	if m.Started != nil {
+		build.Started = *m.Started
+	}
+
+	return build
 }
 
 func (m *buildMetadata) key() string {
@@ -172,37 +279,70 @@ func (m *buildMetadata) toJSON() ([]byte, error) {
 	return metadataJSON, nil
 }
 
+// testMetadata is the test as it's stored in the bucket. Like the build's,
+// Seq is exact once the test has ended.
 type testMetadata struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	BuildID string `json:"build_id"`
-	TaskID  string `json:"task_id"`
-	Phase   string `json:"phase"`
-	Command string `json:"command"`
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	BuildID   string     `json:"build_id"`
+	BuildName string     `json:"build_name,omitempty"`
+	Builder   string     `json:"builder,omitempty"`
+	TaskID    string     `json:"task_id"`
+	Phase     string     `json:"phase"`
+	Command   string     `json:"command"`
+	Started   *time.Time `json:"started,omitempty"`
+	Ended     *time.Time `json:"ended,omitempty"`
+	Failed    bool       `json:"failed,omitempty"`
+	Seq       int        `json:"seq,omitempty"`
 }
 
 func newTestMetadata(t model.Test) testMetadata {
 	return testMetadata{
-		ID:      t.Id.Hex(),
-		BuildID: t.BuildId,
-		Name:    t.Name,
-		TaskID:  t.Info.TaskID,
-		Phase:   t.Phase,
-		Command: t.Command,
+		ID:        t.Id.Hex(),
+		BuildID:   t.BuildId,
+		BuildName: t.BuildName,
+		Builder:   t.Builder,
+		Name:      t.Name,
+		TaskID:    t.Info.TaskID,
+		Phase:     t.Phase,
+		Command:   t.Command,
+		Started:   optionalTime(t.Started),
+		Ended:     t.Ended,
+		Failed:    t.Failed,
+		Seq:       t.Seq,
 	}
 }
 
 func (m *testMetadata) toTest() model.Test {
-	return model.Test{
-		Id:      bson.ObjectIdHex(m.ID),
-		BuildId: m.BuildID,
-		Name:    m.Name,
+	test := model.Test{
+		Id:        bson.ObjectIdHex(m.ID),
+		BuildId:   m.BuildID,
+		BuildName: m.BuildName,
+		Builder:   m.Builder,
+		Name:      m.Name,
 		Info: model.TestInfo{
 			TaskID: m.TaskID,
 		},
 		Phase:   m.Phase,
 		Command: m.Command,
+		Ended:   m.Ended,
+		Failed:  m.Failed,
+		Seq:     m.Seq,
+	}
+	if m.Started != nil {
+		test.Started = *m.Started
+	}
+
+	return test
+}
+
+// optionalTime returns a pointer to t, or nil if t is the zero time, so that
+// metadata written without a time leaves it out.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
+	return &t
 }
 
 func (m *testMetadata) key() string {
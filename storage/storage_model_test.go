@@ -4,7 +4,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/evergreen-ci/logkeeper/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestLogChunkInfoKey(t *testing.T) {
@@ -37,6 +40,47 @@ func TestLogChunkInfoKey(t *testing.T) {
 		assert.Equal(t, info, newInfo)
 	})
 
+	t.Run("WithTag", func(t *testing.T) {
+		info := LogChunkInfo{
+			BuildID:  "b0",
+			NumLines: 1,
+			Start:    time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC),
+			End:      time.Date(2009, time.November, 10, 23, 1, 0, 0, time.UTC),
+			Tag:      batchChunkTag("batch0", 0),
+		}
+		key := info.key()
+		assert.Equal(t, "/builds/b0/1257894000000000000_1257894060000000000_1_"+info.Tag, key)
+		newInfo := LogChunkInfo{}
+		assert.NoError(t, newInfo.fromKey(key))
+		assert.Equal(t, info, newInfo)
+		assert.NotEqual(t, info.Tag, batchChunkTag("batch0", 1))
+		assert.NotEqual(t, info.Tag, batchChunkTag("batch1", 0))
+		assert.Empty(t, batchChunkTag("", 0))
+	})
+
+	t.Run("FromLogChunk", func(t *testing.T) {
+		start := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+		info := LogChunkInfo{}
+		require.NoError(t, info.fromLogChunk("b0", "", model.LogChunk{
+			{Time: start.Add(time.Second + 1500*time.Microsecond), Msg: "line 1"},
+			{Time: start.Add(500 * time.Microsecond), Msg: "line 0"},
+		}))
+		assert.Equal(t, "/builds/b0/1257894000000000000_1257894001001000000_2", info.key(), "the key has the lines' stored millisecond precision")
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		for _, key := range []string{
+			"/builds/b0/tests/t0",
+			"/builds/b0/tests/t0/extra/1_2_1",
+			"/builds/b0/nested/1_2_1",
+			"/builds/b0/1_2",
+			"/builds/b0/1_2_3_4",
+			"/builds/b0/1_2_3_4_5",
+			"/builds/b0/start_2_1",
+		} {
+			assert.Error(t, (&LogChunkInfo{}).fromKey(key), key)
+		}
+	})
 }
 
 func TestBuildMetadataKey(t *testing.T) {
@@ -86,3 +130,88 @@ func TestTestMetadataJSON(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, `{"id":"test0","name":"name","build_id":"build0","task_id":"t0","phase":"phase0","command":"command0"}`, string(json))
 }
+
+func TestEndedTestMetadataJSON(t *testing.T) {
+	ended := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	metadata := newTestMetadata(model.Test{
+		Id:      bson.ObjectIdHex("62dba0159041307f697e6ccc"),
+		BuildId: "build0",
+		Ended:   &ended,
+		Failed:  true,
+	})
+	json, err := metadata.toJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"62dba0159041307f697e6ccc","name":"","build_id":"build0","task_id":"","phase":"","command":"","ended":"2009-11-10T23:00:00Z","failed":true}`, string(json))
+
+	test := metadata.toTest()
+	require.NotNil(t, test.Ended)
+	assert.True(t, ended.Equal(*test.Ended))
+	assert.True(t, test.Failed)
+}
+
+func TestFinishedBuildMetadataJSON(t *testing.T) {
+	ended := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	metadata := newBuildMetadata(model.Build{
+		Id:       "b0",
+		Builder:  "builder0",
+		BuildNum: 1,
+		Ended:    &ended,
+		Failed:   true,
+		Phases:   []string{"phase0"},
+	})
+	json, err := metadata.toJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"b0","builder":"builder0","buildnum":1,"task_id":"","ended":"2009-11-10T23:00:00Z","failed":true,"phases":["phase0"]}`, string(json))
+
+	build := metadata.toBuild()
+	require.NotNil(t, build.Ended)
+	assert.True(t, ended.Equal(*build.Ended))
+	assert.True(t, build.Failed)
+	assert.Equal(t, []string{"phase0"}, build.Phases)
+}
+
+func TestHeldBuildMetadataJSON(t *testing.T) {
+	created := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	expires := created.Add(time.Hour)
+	metadata := newBuildMetadata(model.Build{
+		Id:   "b0",
+		Hold: &model.BuildHold{Reason: "investigating", Created: created, Expires: &expires},
+	})
+	json, err := metadata.toJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"b0","builder":"","buildnum":0,"task_id":"","hold":{"reason":"investigating","created":"2009-11-10T23:00:00Z","expires":"2009-11-11T00:00:00Z"}}`, string(json))
+
+	build := metadata.toBuild()
+	require.NotNil(t, build.Hold)
+	assert.Equal(t, "investigating", build.Hold.Reason)
+	require.NotNil(t, build.Hold.Expires)
+	assert.True(t, expires.Equal(*build.Hold.Expires))
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	started := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	build := model.Build{
+		Id:       "b0",
+		Builder:  "builder0",
+		BuildNum: 1,
+		Name:     "builder0 #1",
+		Started:  started,
+		Info:     model.BuildInfo{TaskID: "t0"},
+		Seq:      3,
+	}
+	buildMetadata := newBuildMetadata(build)
+	assert.Equal(t, build, buildMetadata.toBuild())
+
+	test := model.Test{
+		Id:        bson.ObjectIdHex("62dba0159041307f697e6ccc"),
+		BuildId:   "b0",
+		BuildName: "builder0 #1",
+		Builder:   "builder0",
+		Name:      "test0",
+		Started:   started.Add(time.Second),
+		Info:      model.TestInfo{TaskID: "t0"},
+		Seq:       2,
+	}
+	testMetadata := newTestMetadata(test)
+	assert.Equal(t, test, testMetadata.toTest())
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+)
+
+// LogStore stores builds, their tests, and their logs. Operations on an
+// existing build or test take the record returned by the store, which they
+// update in place to reflect the change.
+type LogStore interface {
+	// InsertBuild stores a new build.
+	InsertBuild(ctx context.Context, build model.Build) error
+	// FindBuildByID returns the build with the given ID, or nil if the
+	// store doesn't have it.
+	FindBuildByID(ctx context.Context, id string) (*model.Build, error)
+	// FindBuildByBuilder returns the build with the given builder and build
+	// number, or nil if the store doesn't have it.
+	FindBuildByBuilder(ctx context.Context, builder string, buildNum int) (*model.Build, error)
+	// FinishBuild marks the build as finished at the given time with the
+	// given outcome. The build's phases are only replaced if phases is not
+	// nil.
+	FinishBuild(ctx context.Context, build *model.Build, ended time.Time, failed bool, phases []string) error
+	// SetBuildHold places the hold on the build, replacing any existing
+	// hold, or removes the build's hold if hold is nil.
+	SetBuildHold(ctx context.Context, build *model.Build, hold *model.BuildHold) error
+
+	// InsertTest stores a new test in the build.
+	InsertTest(ctx context.Context, build *model.Build, test model.Test) error
+	// FindTestByID returns the build's test with the given ID, or nil if
+	// the store doesn't have it.
+	FindTestByID(ctx context.Context, build *model.Build, testID string) (*model.Test, error)
+	// FindTestsForBuild returns all the tests in the build.
+	FindTestsForBuild(ctx context.Context, build *model.Build) ([]model.Test, error)
+	// FindTests returns the tests matching the query across builds, most
+	// recent first.
+	FindTests(ctx context.Context, query model.TestQuery) ([]model.Test, error)
+	// EndTest marks the test as ended at the given time with the given
+	// outcome.
+	EndTest(ctx context.Context, build *model.Build, test *model.Test, ended time.Time, failed bool) error
+
+	// InsertLogChunks appends the chunks to the test's log, or to the
+	// build's global log if test is nil, and returns true. If the batch ID
+	// isn't empty and a batch with the same ID was recently appended to the
+	// same log, nothing is written and it returns false, so that clients
+	// can safely retry appends.
+	InsertLogChunks(ctx context.Context, build *model.Build, test *model.Test, batchID string, chunks []model.LogChunk) (bool, error)
+	// GetTestLogLines returns a channel with the test's log lines merged
+	// with the concurrent global log lines, limited to those within the
+	// time range. If reverse is true the lines are returned newest first.
+	GetTestLogLines(ctx context.Context, build *model.Build, test *model.Test, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error)
+	// GetTestLogLinesFrom is the same as GetTestLogLines in chronological
+	// order, except that the test's lines are further limited to those not
+	// before the cursor's Test time and the global lines to those not
+	// before its Global time.
+	GetTestLogLinesFrom(ctx context.Context, build *model.Build, test *model.Test, timeRange TimeRange, cursor LogCursor) (chan *model.LogLineItem, error)
+	// GetAllLogLines returns a channel with all the build's test and global
+	// log lines merged together by timestamp, limited to those within the
+	// time range. If reverse is true the lines are returned newest first.
+	GetAllLogLines(ctx context.Context, build *model.Build, timeRange TimeRange, reverse bool) (chan *model.LogLineItem, error)
+
+	// StreamingGetOldBuilds returns a channel containing the builds that
+	// the retention policies allow to be deleted and a channel for any
+	// error encountered. The channels are closed once all the builds have
+	// been returned or an error is encountered.
+	StreamingGetOldBuilds(ctx context.Context, policies model.RetentionPolicies) (<-chan model.Build, <-chan error)
+}
+
+// LogCursor is a position in a test's log lines, which are merged from the
+// test's log and its build's global log, given as the time that reading
+// resumes from in each of the two logs.
+type LogCursor struct {
+	Test   time.Time
+	Global time.Time
+}
+
+// unsupportedBuildStream returns channels for StreamingGetOldBuilds that only
+// carry the given error.
+func unsupportedBuildStream(ctx context.Context, err error) (<-chan model.Build, <-chan error) {
+	out := make(chan model.Build)
+	errOut := make(chan error)
+	go func() {
+		defer close(errOut)
+		defer close(out)
+
+		select {
+		case errOut <- err:
+		case <-ctx.Done():
+		}
+	}()
+
+	return out, errOut
+}
@@ -33,3 +33,29 @@ func (t TimeRange) Intersects(other TimeRange) bool {
 	}
 	return true
 }
+
+// bounds returns the time range as the optional bounds used by the model
+// package, where nil leaves that side of the range open.
+func (t TimeRange) bounds() (*time.Time, *time.Time) {
+	var start, end *time.Time
+	if t.StartAt.After(TimeRangeMin) {
+		startAt := t.StartAt
+		start = &startAt
+	}
+	if t.EndAt.Before(TimeRangeMax) {
+		endAt := t.EndAt
+		end = &endAt
+	}
+
+	return start, end
+}
+
+// from returns the time range with its start moved up to the given time if the
+// range starts before it.
+func (t TimeRange) from(start time.Time) TimeRange {
+	if start.After(t.StartAt) {
+		t.StartAt = start
+	}
+
+	return t
+}
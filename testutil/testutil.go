@@ -1,6 +1,7 @@
 package testutil
 
 import (
+	"runtime"
 	"time"
 
 	"github.com/evergreen-ci/logkeeper/db"
@@ -47,3 +48,21 @@ func ClearCollections(collections ...string) error {
 	}
 	return nil
 }
+
+// WaitForGoroutines waits up to the timeout for the number of goroutines to
+// drop to at most n, returning an error with the stacks of the remaining
+// goroutines if it doesn't. Tests use it to check that goroutines started by
+// the code under test have stopped.
+func WaitForGoroutines(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			stacks := make([]byte, 1<<20)
+			stacks = stacks[:runtime.Stack(stacks, true)]
+			return errors.Errorf("%d goroutines are running, expected at most %d:\n%s", runtime.NumGoroutine(), n, stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
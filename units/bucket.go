@@ -0,0 +1,35 @@
+package units
+
+import (
+	"sync"
+
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/pkg/errors"
+)
+
+var (
+	jobBucket     *storage.Bucket
+	jobBucketLock sync.RWMutex
+)
+
+// SetBucket sets the bucket that the jobs read and write build data in. The
+// cleanup jobs remove build data from it in addition to the database, and the
+// migration jobs copy build data to it from the database.
+func SetBucket(b *storage.Bucket) error {
+	if b == nil {
+		return errors.New("cannot set a nil bucket")
+	}
+
+	jobBucketLock.Lock()
+	defer jobBucketLock.Unlock()
+
+	jobBucket = b
+	return nil
+}
+
+func getBucket() *storage.Bucket {
+	jobBucketLock.RLock()
+	defer jobBucketLock.RUnlock()
+
+	return jobBucket
+}
@@ -3,11 +3,10 @@ package units
 import (
 	"context"
 	"fmt"
-	"net/http"
-	"os"
+	"time"
 
 	"github.com/evergreen-ci/logkeeper/model"
-	"github.com/evergreen-ci/utility"
+	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/mongodb/amboy"
 	"github.com/mongodb/amboy/dependency"
 	"github.com/mongodb/amboy/job"
@@ -19,12 +18,6 @@ import (
 
 const (
 	cleanupJobsName = "cleanup-old-log-data-job"
-	urlBase         = "https://evergreen.mongodb.com/rest/v2/tasks"
-)
-
-var (
-	apiUser = os.Getenv("EVG_API_USER")
-	apiKey  = os.Getenv("EVG_API_KEY")
 )
 
 func init() {
@@ -59,74 +52,78 @@ func makeCleanupOldLogDataJob() *cleanupOldLogDataJob {
 	return j
 }
 
-// If the evergreen task is marked complete, delete the test and corresponding log objects
+// Run deletes the build's data if the retention policies allow it. Builds
+// that look like they passed are first checked against the task status
+// provider, and marked failed, so that the failed retention applies, if their
+// task didn't succeed.
 func (j *cleanupOldLogDataJob) Run(ctx context.Context) {
 	defer j.MarkComplete()
 
-	if apiUser == "" {
-		j.AddError(errors.New("cannot run job without a user defined"))
-		return
-	}
-
-	client := utility.GetDefaultHTTPRetryableClient()
-	defer utility.PutHTTPClient(client)
-	url := fmt.Sprintf("%s/%s", urlBase, j.TaskID)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	build, err := model.FindBuildById(j.BuildID)
 	if err != nil {
-		j.AddError(err)
+		j.AddError(errors.Wrapf(err, "finding build '%s'", j.BuildID))
 		return
 	}
-
-	req = req.WithContext(ctx)
-	req.Header.Add("Api-User", apiUser)
-	req.Header.Add("Api-Key", apiKey)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		j.AddError(err)
+	if build == nil {
 		return
 	}
-	defer resp.Body.Close()
-
-	taskInfo := struct {
-		Status string `json:"status"`
-	}{}
-
-	if resp.StatusCode == 200 {
-		if err = utility.ReadJSON(resp.Body, &taskInfo); err != nil {
-			j.AddError(errors.Wrapf(err, "problem reading response from server for [task='%s' build='%s']", j.TaskID, j.BuildID))
-			return
-		}
-	} else {
-		errResp := struct {
-			StatusCode int    `bson:"status" json:"status" yaml:"status"`
-			Message    string `bson:"message" json:"message" yaml:"message"`
-		}{}
-		j.AddError(utility.ReadJSON(resp.Body, &errResp))
-
-		grip.Error(message.Fields{
-			"job":      j.ID(),
+	if build.Held(time.Now()) {
+		grip.Info(message.Fields{
 			"job_type": j.Type().Name,
-			"task":     j.TaskID,
+			"op":       "deletion skipped",
+			"reason":   "build is held",
 			"build":    j.BuildID,
-			"code":     resp.StatusCode,
-			"msg":      errResp.Message,
+			"job":      j.ID(),
 		})
-
 		return
 	}
 
-	var num int
+	providerName := ""
+	if build.RetentionCategory() == model.RetentionPassed {
+		provider, err := getTaskStatusProvider()
+		if err != nil {
+			j.AddError(errors.Wrap(err, "getting task status provider"))
+			return
+		}
+		providerName = provider.Name()
 
-	if taskInfo.Status != "success" {
-		err = model.UpdateFailedBuild(j.BuildID)
+		succeeded, err := provider.TaskSucceeded(ctx, j.BuildID, j.TaskID)
 		if err != nil {
-			j.AddError(errors.Wrapf(err, "error updating failed status of build %v", j.BuildID))
+			j.AddError(errors.Wrapf(err, "problem getting task status for [task='%s' build='%s']", j.TaskID, j.BuildID))
+			grip.Error(message.WrapError(err, message.Fields{
+				"job":      j.ID(),
+				"job_type": j.Type().Name,
+				"task":     j.TaskID,
+				"build":    j.BuildID,
+				"provider": providerName,
+			}))
+			return
 		}
-	} else {
-		num, err = cleanupOldLogsAndTestsByBuild(j.BuildID)
+		if !succeeded {
+			if err = model.UpdateFailedBuild(j.BuildID); err != nil {
+				j.AddError(errors.Wrapf(err, "error updating failed status of build %v", j.BuildID))
+				return
+			}
+			build.Failed = true
+		}
+	}
+
+	var num int
+	var bucketStats storage.DeletionStats
+
+	category := build.RetentionCategory()
+	expired := getRetentionPolicies().Expired(build, time.Now())
+	if expired {
+		// Remove the bucket data first so that, if it fails, the build
+		// record is kept and the build is queued for cleanup again.
+		bucketStats, err = cleanupBucketDataByBuild(ctx, j.BuildID)
 		if err != nil {
-			j.AddError(errors.Wrapf(err, "error cleaning up old logs [%d]", num))
+			j.AddError(errors.Wrapf(err, "error cleaning up bucket data [%d objects]", bucketStats.Objects))
+		} else {
+			num, err = cleanupOldLogsAndTestsByBuild(j.BuildID)
+			if err != nil {
+				j.AddError(errors.Wrapf(err, "error cleaning up old logs [%d]", num))
+			}
 		}
 	}
 
@@ -135,14 +132,28 @@ func (j *cleanupOldLogDataJob) Run(ctx context.Context) {
 		"op":       "deletion complete",
 		"task":     j.TaskID,
 		"build":    j.BuildID,
+		"builder":  build.Builder,
 		"errors":   j.HasErrors(),
 		"job":      j.ID(),
 		"num":      num,
-		"status":   taskInfo.Status,
-		"code":     resp.StatusCode,
+		"objects":  bucketStats.Objects,
+		"category": category,
+		"expired":  expired,
+		"provider": providerName,
 	})
 }
 
+// cleanupBucketDataByBuild removes the build's objects from the bucket, if
+// one is configured.
+func cleanupBucketDataByBuild(ctx context.Context, buildID string) (storage.DeletionStats, error) {
+	bucket := getBucket()
+	if bucket == nil {
+		return storage.DeletionStats{}, nil
+	}
+
+	return bucket.DeleteBuild(ctx, buildID)
+}
+
 func cleanupOldLogsAndTestsByBuild(buildID string) (int, error) {
 	docsRemoved := 0
 
@@ -152,6 +163,12 @@ func cleanupOldLogsAndTestsByBuild(buildID string) (int, error) {
 	}
 	docsRemoved += removedCount
 
+	removedCount, err = model.RemovePendingWritesForBuild(buildID)
+	if err != nil {
+		return docsRemoved, errors.Wrap(err, "error deleting pending writes from old builds")
+	}
+	docsRemoved += removedCount
+
 	removedCount, err = model.RemoveTestsForBuild(buildID)
 	if err != nil {
 		return docsRemoved, errors.Wrap(err, "error deleting tests from old builds")
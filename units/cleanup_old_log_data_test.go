@@ -1,11 +1,13 @@
 package units
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/evergreen-ci/logkeeper/db"
 	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/mgo.v2/bson"
@@ -138,3 +140,25 @@ func insertLogs(t *testing.T, ids []string) {
 	log4 := model.Log{BuildId: newId}
 	assert.NoError(db.C(model.LogsCollection).Insert(log1, log2, log3, log4))
 }
+
+func TestCleanupBucketDataByBuild(t *testing.T) {
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, SetBucket(&bucket))
+
+	ctx := context.Background()
+	require.NoError(t, bucket.UploadBuildMetadata(ctx, model.Build{Id: "b0"}))
+	require.NoError(t, bucket.InsertLogChunks(ctx, "b0", "", []model.LogChunk{{{Time: time.Now(), Msg: "line"}}}))
+	require.NoError(t, bucket.UploadBuildMetadata(ctx, model.Build{Id: "b1"}))
+
+	stats, err := cleanupBucketDataByBuild(ctx, "b0")
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Objects)
+
+	build, err := bucket.FindBuildByID(ctx, "b0")
+	assert.NoError(t, err)
+	assert.Nil(t, build)
+	build, err = bucket.FindBuildByID(ctx, "b1")
+	assert.NoError(t, err)
+	assert.NotNil(t, build)
+}
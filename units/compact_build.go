@@ -0,0 +1,115 @@
+package units
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/mongodb/amboy"
+	"github.com/mongodb/amboy/dependency"
+	"github.com/mongodb/amboy/job"
+	"github.com/mongodb/amboy/registry"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	compactBuildJobName = "compact-build-chunks-job"
+
+	// compactionChunkBytes is the largest chunk that compaction merges small
+	// chunks into, matching the limit for appended logs.
+	compactionChunkBytes = 4 * 1024 * 1024
+)
+
+func init() {
+	registry.AddJobType(compactBuildJobName,
+		func() amboy.Job { return makeCompactBuildJob() })
+}
+
+type compactBuildJob struct {
+	BuildID  string `bson:"build_id" json:"build_id" yaml:"build_id"`
+	job.Base `bson:"job_base" json:"job_base" yaml:"job_base"`
+}
+
+// NewCompactBuildJob returns a job that merges the small log chunks of a
+// finished build in the bucket into larger ones. Its ID includes the time it
+// was queued at, since a build that a completed job skipped is queued again.
+func NewCompactBuildJob(buildID string, ts time.Time) amboy.Job {
+	j := makeCompactBuildJob()
+	j.BuildID = buildID
+	j.SetID(fmt.Sprintf("%s.%s.%d", compactBuildJobName, j.BuildID, ts.UnixNano()))
+	return j
+}
+
+func makeCompactBuildJob() *compactBuildJob {
+	j := &compactBuildJob{
+		Base: job.Base{
+			JobType: amboy.JobType{
+				Name:    compactBuildJobName,
+				Version: 1,
+			},
+		},
+	}
+	j.SetDependency(dependency.NewAlways())
+	return j
+}
+
+// Run merges the build's chunks and records when it did, so that the chunks
+// they replaced are removed by a remove retired chunks job later. A build
+// without any chunks to merge is marked as compacted right away. Builds that
+// aren't stored in the bucket, haven't finished, or have pending writes are
+// skipped, since their chunks may still change.
+func (j *compactBuildJob) Run(ctx context.Context) {
+	defer j.MarkComplete()
+
+	bucket := getBucket()
+	if bucket == nil {
+		j.AddError(errors.New("no bucket configured to compact builds in"))
+		return
+	}
+
+	build, err := model.FindBuildById(j.BuildID)
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "finding build '%s'", j.BuildID))
+		return
+	}
+	if build == nil || !build.S3 || !build.Finished() || build.Compacted || build.ChunksMerged != nil {
+		return
+	}
+	// Replaying a pending write adds chunks to the build, so it's compacted
+	// once they've all been replayed.
+	pending, err := model.CountPendingWritesForBuild(j.BuildID)
+	if err != nil {
+		j.AddError(err)
+		return
+	}
+	if pending > 0 {
+		return
+	}
+
+	stats, err := bucket.CompactBuild(ctx, j.BuildID, compactionChunkBytes)
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "compacting build '%s'", j.BuildID))
+		return
+	}
+	if stats.Merged == 0 {
+		err = build.SetCompacted()
+	} else {
+		err = build.SetChunksMerged(time.Now())
+	}
+	if err != nil {
+		j.AddError(err)
+		return
+	}
+
+	grip.Info(message.Fields{
+		"job_type": j.Type().Name,
+		"op":       "compaction complete",
+		"build":    j.BuildID,
+		"job":      j.ID(),
+		"merged":   stats.Merged,
+		"written":  stats.Written,
+	})
+}
@@ -0,0 +1,78 @@
+package units
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCompactBuildJob(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(model.BuildsCollection))
+
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, SetBucket(&bucket))
+
+	ctx := context.Background()
+	now := time.Now()
+	testID := bson.NewObjectId().Hex()
+	insertBuild := func(t *testing.T, build model.Build) {
+		require.NoError(t, build.Insert())
+		for i := 0; i < 3; i++ {
+			at := now.Add(time.Duration(i) * time.Second)
+			require.NoError(t, bucket.InsertLogChunks(ctx, build.Id, testID, []model.LogChunk{{{Time: at, Msg: "line"}}}))
+		}
+	}
+
+	t.Run("CompactsFinishedBuild", func(t *testing.T) {
+		build := model.Build{Id: "finished", Started: now, Ended: &now, S3: true}
+		insertBuild(t, build)
+
+		j := NewCompactBuildJob(build.Id, time.Now())
+		j.Run(ctx)
+		require.NoError(t, j.Error())
+
+		merged, err := model.FindBuildById(build.Id)
+		require.NoError(t, err)
+		assert.False(t, merged.Compacted, "the merged chunks aren't removed yet")
+		assert.NotNil(t, merged.ChunksMerged)
+		counts, err := bucket.CountLogLines(ctx, build.Id)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{testID: 3}, counts)
+	})
+
+	t.Run("NothingToMerge", func(t *testing.T) {
+		build := model.Build{Id: "single", Started: now, Ended: &now, S3: true}
+		require.NoError(t, build.Insert())
+		require.NoError(t, bucket.InsertLogChunks(ctx, build.Id, testID, []model.LogChunk{{{Time: now, Msg: "line"}}}))
+
+		j := NewCompactBuildJob(build.Id, time.Now())
+		j.Run(ctx)
+		require.NoError(t, j.Error())
+
+		found, err := model.FindBuildById(build.Id)
+		require.NoError(t, err)
+		assert.True(t, found.Compacted)
+	})
+
+	t.Run("SkipsUnfinishedBuild", func(t *testing.T) {
+		build := model.Build{Id: "unfinished", Started: now, S3: true}
+		insertBuild(t, build)
+
+		j := NewCompactBuildJob(build.Id, time.Now())
+		j.Run(ctx)
+		require.NoError(t, j.Error())
+
+		found, err := model.FindBuildById(build.Id)
+		require.NoError(t, err)
+		assert.False(t, found.Compacted)
+	})
+}
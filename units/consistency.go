@@ -0,0 +1,50 @@
+package units
+
+import (
+	"context"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/pkg/errors"
+)
+
+// ConsistencyReport compares the number of lines per test of a build in the
+// database and in the bucket. The global logs are keyed by the empty string.
+type ConsistencyReport struct {
+	BuildID  string         `json:"build_id"`
+	Database map[string]int `json:"database"`
+	Bucket   map[string]int `json:"bucket"`
+	// PendingWrites is the number of the build's appends that haven't been
+	// confirmed in the bucket, which account for some of any difference.
+	PendingWrites int `json:"pending_writes"`
+	// Mismatch describes the tests whose counts differ.
+	Mismatch string `json:"mismatch,omitempty"`
+}
+
+// Consistent returns whether the database and the bucket have the same number
+// of lines for every test.
+func (r ConsistencyReport) Consistent() bool {
+	return r.Mismatch == ""
+}
+
+// CheckBuildConsistency counts the build's lines in the database and in the
+// bucket and reports any tests whose counts differ.
+func CheckBuildConsistency(ctx context.Context, bucket *storage.Bucket, buildID string) (ConsistencyReport, error) {
+	report := ConsistencyReport{BuildID: buildID}
+
+	var err error
+	if report.Database, err = model.CountLogLines(buildID); err != nil {
+		return report, err
+	}
+	if report.Bucket, err = bucket.CountLogLines(ctx, buildID); err != nil {
+		return report, errors.Wrapf(err, "counting bucket lines for build '%s'", buildID)
+	}
+	if report.PendingWrites, err = model.CountPendingWritesForBuild(buildID); err != nil {
+		return report, err
+	}
+	if err = compareLineCounts(report.Database, report.Bucket); err != nil {
+		report.Mismatch = err.Error()
+	}
+
+	return report, nil
+}
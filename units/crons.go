@@ -12,7 +12,34 @@ import (
 	"github.com/mongodb/grip/message"
 )
 
-func StartCrons(ctx context.Context, cleaupQueue amboy.Queue) error {
+// CronOptions configures the background jobs.
+type CronOptions struct {
+	// MigrationInterval is how often builds are queued for migration from the
+	// database to the bucket. Builds aren't migrated if it's zero.
+	MigrationInterval time.Duration
+	// MigrationBatchSize is the most builds queued for migration per
+	// interval.
+	MigrationBatchSize int
+	// MigrationMinAge is how long ago builds must have finished before
+	// they're migrated, so that appends that were in flight when a build
+	// finished have been written.
+	MigrationMinAge time.Duration
+	// CompactionInterval is how often finished builds in the bucket are
+	// queued to have their log chunks compacted. Builds aren't compacted if
+	// it's zero.
+	CompactionInterval time.Duration
+	// CompactionBatchSize is the most builds queued for compaction per
+	// interval.
+	CompactionBatchSize int
+	// ReplayInterval is how often log appends that failed to reach the
+	// bucket are queued to be replayed. Appends aren't replayed if it's zero.
+	ReplayInterval time.Duration
+	// ReplayBatchSize is the most pending writes queued for replay per
+	// interval.
+	ReplayBatchSize int
+}
+
+func StartCrons(ctx context.Context, cleaupQueue amboy.Queue, cronOpts CronOptions) error {
 	if !logkeeper.IsLeader() {
 		grip.Notice("leader file does not exist, not submitting jobs")
 		return nil
@@ -34,6 +61,15 @@ func StartCrons(ctx context.Context, cleaupQueue amboy.Queue) error {
 	})
 
 	amboy.IntervalQueueOperation(ctx, cleaupQueue, 10*time.Second, time.Now(), opts, PopulateCleanupOldLogDataJobs(ctx))
+	if cronOpts.MigrationInterval > 0 && cronOpts.MigrationBatchSize > 0 {
+		amboy.IntervalQueueOperation(ctx, cleaupQueue, cronOpts.MigrationInterval, time.Now(), opts, PopulateMigrateBuildJobs(cronOpts.MigrationBatchSize, cronOpts.MigrationMinAge))
+	}
+	if cronOpts.CompactionInterval > 0 && cronOpts.CompactionBatchSize > 0 {
+		amboy.IntervalQueueOperation(ctx, cleaupQueue, cronOpts.CompactionInterval, time.Now(), opts, PopulateCompactBuildJobs(cronOpts.CompactionBatchSize))
+	}
+	if cronOpts.ReplayInterval > 0 && cronOpts.ReplayBatchSize > 0 {
+		amboy.IntervalQueueOperation(ctx, cleaupQueue, cronOpts.ReplayInterval, time.Now(), opts, PopulateReplayBucketWriteJobs(cronOpts.ReplayBatchSize))
+	}
 
 	return nil
 }
@@ -47,7 +83,7 @@ func PopulateCleanupOldLogDataJobs(ctx context.Context) amboy.QueueOperation {
 		catcher := grip.NewBasicCatcher()
 
 		seen := 0
-		builds, errs := model.StreamingGetOldBuilds(ctx)
+		builds, errs := model.StreamingGetOldBuilds(ctx, getRetentionPolicies())
 	addLoop:
 		for {
 			select {
@@ -56,7 +92,10 @@ func PopulateCleanupOldLogDataJobs(ctx context.Context) amboy.QueueOperation {
 			case err := <-errs:
 				catcher.Add(err)
 				break addLoop
-			case build := <-builds:
+			case build, ok := <-builds:
+				if !ok {
+					break addLoop
+				}
 				catcher.Add(queue.Put(ctx, NewCleanupOldLogDataJob(build.Id, build.Info.TaskID)))
 				seen++
 				continue
@@ -82,3 +121,124 @@ func PopulateCleanupOldLogDataJobs(ctx context.Context) amboy.QueueOperation {
 		return catcher.Resolve()
 	}
 }
+
+// PopulateMigrateBuildJobs queues migration jobs for up to batchSize builds
+// each time it runs. Successive runs sweep through the unmigrated builds in ID
+// order, starting over once they reach the end, so that builds whose migration
+// keeps failing don't hold up the others.
+func PopulateMigrateBuildJobs(batchSize int, minAge time.Duration) amboy.QueueOperation {
+	return populateSweepJobs("migration", batchSize, func(now time.Time, afterID string) ([]string, error) {
+		builds, err := model.FindUnmigratedBuilds(now.Add(-minAge), afterID, batchSize)
+		return buildIDs(builds), err
+	}, NewMigrateBuildJob)
+}
+
+// PopulateCompactBuildJobs queues compaction jobs for up to batchSize finished
+// builds in the bucket each time it runs, sweeping through the uncompacted
+// builds in ID order like PopulateMigrateBuildJobs. It also queues jobs that
+// remove the chunks that compaction replaced for up to batchSize builds whose
+// chunks were merged more than retiredChunkGracePeriod ago.
+func PopulateCompactBuildJobs(batchSize int) amboy.QueueOperation {
+	compact := populateSweepJobs("compaction", batchSize, func(_ time.Time, afterID string) ([]string, error) {
+		builds, err := model.FindUncompactedBuilds(afterID, batchSize)
+		return buildIDs(builds), err
+	}, NewCompactBuildJob)
+	removeRetired := populateSweepJobs("retired chunk removal", batchSize, func(now time.Time, afterID string) ([]string, error) {
+		builds, err := model.FindBuildsWithRetiredChunks(now.Add(-retiredChunkGracePeriod), afterID, batchSize)
+		return buildIDs(builds), err
+	}, NewRemoveRetiredChunksJob)
+
+	return func(ctx context.Context, queue amboy.Queue) error {
+		catcher := grip.NewBasicCatcher()
+		catcher.Add(compact(ctx, queue))
+		catcher.Add(removeRetired(ctx, queue))
+		return catcher.Resolve()
+	}
+}
+
+// PopulateReplayBucketWriteJobs queues replay jobs for up to batchSize pending
+// writes each time it runs, sweeping through them in ID order like
+// PopulateMigrateBuildJobs. Writes created within the last
+// pendingWriteMinAge are left alone, since their append may still be writing
+// to the bucket.
+func PopulateReplayBucketWriteJobs(batchSize int) amboy.QueueOperation {
+	return populateSweepJobs("replay", batchSize, func(now time.Time, afterID string) ([]string, error) {
+		writes, err := model.FindPendingWrites(now.Add(-pendingWriteMinAge), afterID, batchSize)
+		ids := make([]string, 0, len(writes))
+		for _, write := range writes {
+			ids = append(ids, write.Id.Hex())
+		}
+		return ids, err
+	}, NewReplayBucketWriteJob)
+}
+
+// populateSweepJobs returns a queue operation that queues a job made by
+// makeJob for each of the up to batchSize IDs that find returns after the last
+// ID of its previous run, in ID order. Once find returns fewer than batchSize
+// IDs the sweep starts over from the beginning. IDs whose previous job hasn't
+// completed yet are skipped.
+//
+// The queue keeps completed jobs, so makeJob is passed the time of the run,
+// which should be part of the job's ID so that IDs whose previous job
+// completed can be queued again.
+func populateSweepJobs(name string, batchSize int, find func(now time.Time, afterID string) ([]string, error), makeJob func(id string, ts time.Time) amboy.Job) amboy.QueueOperation {
+	lastID := ""
+	// jobIDs maps the IDs queued by previous runs to the IDs of their jobs,
+	// until those jobs complete.
+	jobIDs := map[string]string{}
+	return func(ctx context.Context, queue amboy.Queue) error {
+		startAt := time.Now()
+		catcher := grip.NewBasicCatcher()
+
+		for id, jobID := range jobIDs {
+			if j, ok := queue.Get(ctx, jobID); !ok || j.Status().Completed {
+				delete(jobIDs, id)
+			}
+		}
+
+		ids, err := find(startAt, lastID)
+		if err != nil {
+			return err
+		}
+		if len(ids) < batchSize {
+			lastID = ""
+		} else {
+			lastID = ids[len(ids)-1]
+		}
+
+		queued := 0
+		for _, id := range ids {
+			if _, ok := jobIDs[id]; ok {
+				continue
+			}
+
+			j := makeJob(id, startAt)
+			if err = queue.Put(ctx, j); err != nil {
+				catcher.Add(err)
+				continue
+			}
+			jobIDs[id] = j.ID()
+			queued++
+		}
+
+		grip.Info(message.Fields{
+			"message":    fmt.Sprintf("completed adding %s jobs", name),
+			"found":      len(ids),
+			"queued":     queued,
+			"num_errors": catcher.Len(),
+			"dur_secs":   time.Since(startAt).Seconds(),
+		})
+
+		return catcher.Resolve()
+	}
+}
+
+// buildIDs returns the IDs of the builds.
+func buildIDs(builds []model.Build) []string {
+	ids := make([]string, 0, len(builds))
+	for _, build := range builds {
+		ids = append(ids, build.Id)
+	}
+
+	return ids
+}
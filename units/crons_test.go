@@ -0,0 +1,75 @@
+package units
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mongodb/amboy"
+	"github.com/mongodb/amboy/dependency"
+	"github.com/mongodb/amboy/job"
+	"github.com/mongodb/amboy/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type blockingJob struct {
+	release chan struct{}
+	job.Base
+}
+
+func newBlockingJob(id string, ts time.Time, release chan struct{}) amboy.Job {
+	j := &blockingJob{
+		release: release,
+		Base: job.Base{
+			JobType: amboy.JobType{Name: "blocking-job", Version: 1},
+		},
+	}
+	j.SetDependency(dependency.NewAlways())
+	j.SetID(fmt.Sprintf("blocking-job.%s.%d", id, ts.UnixNano()))
+	return j
+}
+
+func (j *blockingJob) Run(ctx context.Context) {
+	defer j.MarkComplete()
+
+	select {
+	case <-j.release:
+	case <-ctx.Done():
+	}
+}
+
+func TestPopulateSweepJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := queue.NewLocalLimitedSize(2, 100)
+	require.NoError(t, q.Start(ctx))
+
+	release := make(chan struct{})
+	afterIDs := []string{}
+	populate := populateSweepJobs("test", 2, func(_ time.Time, afterID string) ([]string, error) {
+		afterIDs = append(afterIDs, afterID)
+		return []string{"a", "b"}, nil
+	}, func(id string, ts time.Time) amboy.Job {
+		return newBlockingJob(id, ts, release)
+	})
+
+	require.NoError(t, populate(ctx, q))
+	assert.Equal(t, 2, q.Stats(ctx).Total)
+
+	// The jobs of the first run haven't completed, so they aren't queued
+	// again.
+	require.NoError(t, populate(ctx, q))
+	assert.Equal(t, 2, q.Stats(ctx).Total)
+
+	// Once they've completed the IDs are queued again, even though the queue
+	// still has their completed jobs.
+	close(release)
+	require.True(t, amboy.WaitInterval(ctx, q, 10*time.Millisecond))
+	require.NoError(t, populate(ctx, q))
+	assert.Equal(t, 4, q.Stats(ctx).Total)
+
+	assert.Equal(t, []string{"", "b", "b"}, afterIDs)
+}
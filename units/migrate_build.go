@@ -0,0 +1,230 @@
+package units
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/mongodb/amboy"
+	"github.com/mongodb/amboy/dependency"
+	"github.com/mongodb/amboy/job"
+	"github.com/mongodb/amboy/registry"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	migrateBuildJobName = "migrate-build-to-bucket-job"
+
+	// migrationChunkBytes is the most log data written to a single chunk
+	// when migrating a build, matching the limit for appended logs.
+	migrationChunkBytes = 4 * 1024 * 1024
+)
+
+func init() {
+	registry.AddJobType(migrateBuildJobName,
+		func() amboy.Job { return makeMigrateBuildJob() })
+}
+
+type migrateBuildJob struct {
+	BuildID  string `bson:"build_id" json:"build_id" yaml:"build_id"`
+	job.Base `bson:"job_base" json:"job_base" yaml:"job_base"`
+}
+
+// NewMigrateBuildJob returns a job that copies a build's data from the
+// database to the bucket and then marks the build as stored in the bucket.
+// The time the job was queued at is part of its ID, so that a build can be
+// queued again after its previous migration completed.
+func NewMigrateBuildJob(buildID string, ts time.Time) amboy.Job {
+	j := makeMigrateBuildJob()
+	j.BuildID = buildID
+	j.SetID(fmt.Sprintf("%s.%s.%d", migrateBuildJobName, j.BuildID, ts.UnixNano()))
+	return j
+}
+
+func makeMigrateBuildJob() *migrateBuildJob {
+	j := &migrateBuildJob{
+		Base: job.Base{
+			JobType: amboy.JobType{
+				Name:    migrateBuildJobName,
+				Version: 1,
+			},
+		},
+	}
+	j.SetDependency(dependency.NewAlways())
+	return j
+}
+
+// Run writes the build's logs, then its tests' metadata, and then its own
+// metadata to the bucket. The build is only marked as stored in the bucket
+// once the number of lines in the bucket matches the database, so a failed
+// migration is retried from the start. Builds that haven't finished are left
+// alone, since lines appended to them while they're copied wouldn't reach the
+// bucket.
+func (j *migrateBuildJob) Run(ctx context.Context) {
+	defer j.MarkComplete()
+
+	bucket := getBucket()
+	if bucket == nil {
+		j.AddError(errors.New("no bucket configured to migrate builds to"))
+		return
+	}
+
+	build, err := model.FindBuildById(j.BuildID)
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "finding build '%s'", j.BuildID))
+		return
+	}
+	if build == nil || build.S3 || !build.Finished() {
+		return
+	}
+
+	tests, err := model.FindTestsForBuild(j.BuildID)
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "finding tests for build '%s'", j.BuildID))
+		return
+	}
+
+	// The build isn't read from the bucket yet, so anything there is left
+	// over from an earlier attempt and is replaced.
+	if _, err = bucket.DeleteBuild(ctx, j.BuildID); err != nil {
+		j.AddError(errors.Wrapf(err, "removing partially migrated data for build '%s'", j.BuildID))
+		return
+	}
+
+	expected, err := migrateBuildLogs(ctx, bucket, j.BuildID)
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "migrating logs for build '%s'", j.BuildID))
+		return
+	}
+
+	for _, test := range tests {
+		if err = bucket.UploadTestMetadata(ctx, test); err != nil {
+			j.AddError(errors.Wrapf(err, "migrating test '%s'", test.Id.Hex()))
+			return
+		}
+	}
+
+	actual, err := bucket.CountLogLines(ctx, j.BuildID)
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "counting migrated lines for build '%s'", j.BuildID))
+		return
+	}
+	if err = compareLineCounts(expected, actual); err != nil {
+		j.AddError(errors.Wrapf(err, "verifying migrated lines for build '%s'", j.BuildID))
+		return
+	}
+
+	migrated := *build
+	migrated.S3 = true
+	if err = bucket.UploadBuildMetadata(ctx, migrated); err != nil {
+		j.AddError(errors.Wrapf(err, "migrating build '%s'", j.BuildID))
+		return
+	}
+	if err = build.SetS3(); err != nil {
+		j.AddError(err)
+		return
+	}
+
+	lines := 0
+	for _, count := range expected {
+		lines += count
+	}
+	grip.Info(message.Fields{
+		"job_type": j.Type().Name,
+		"op":       "migration complete",
+		"build":    j.BuildID,
+		"job":      j.ID(),
+		"tests":    len(tests),
+		"lines":    lines,
+	})
+}
+
+// migrateBuildLogs writes the build's logs from the database to the bucket
+// and returns the number of lines written, keyed by test ID. Consecutive logs
+// of the same test are combined into chunks of up to migrationChunkBytes so
+// that small logs written within the same millisecond don't share a key.
+func migrateBuildLogs(ctx context.Context, bucket *storage.Bucket, buildID string) (map[string]int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	counts := map[string]int{}
+	var (
+		testID      string
+		lines       []model.LogLine
+		bufferBytes int
+	)
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		chunks, err := model.GroupLines(lines, migrationChunkBytes)
+		if err != nil {
+			return errors.Wrap(err, "grouping lines")
+		}
+		if err = bucket.InsertLogChunks(ctx, buildID, testID, chunks); err != nil {
+			return err
+		}
+		counts[testID] += len(lines)
+		lines = nil
+		bufferBytes = 0
+		return nil
+	}
+
+	logs, errs := model.StreamingGetBuildLogs(ctx, buildID)
+	for {
+		select {
+		case err := <-errs:
+			if err != nil {
+				return nil, err
+			}
+			if err = flush(); err != nil {
+				return nil, err
+			}
+			return counts, nil
+		case log, ok := <-logs:
+			if !ok {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				return counts, nil
+			}
+
+			logTestID := ""
+			if log.TestId != nil {
+				logTestID = log.TestId.Hex()
+			}
+			if logTestID != testID || bufferBytes >= migrationChunkBytes {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				testID = logTestID
+			}
+			for _, line := range log.Lines {
+				lines = append(lines, line)
+				bufferBytes += len(line.Msg)
+			}
+		}
+	}
+}
+
+// compareLineCounts returns an error if the number of lines for any test
+// differs between the two counts.
+func compareLineCounts(expected, actual map[string]int) error {
+	catcher := grip.NewBasicCatcher()
+	for testID, count := range expected {
+		if actual[testID] != count {
+			catcher.Errorf("expected %d lines for test '%s' but found %d", count, testID, actual[testID])
+		}
+	}
+	for testID, count := range actual {
+		if _, ok := expected[testID]; !ok && count != 0 {
+			catcher.Errorf("expected no lines for test '%s' but found %d", testID, count)
+		}
+	}
+
+	return catcher.Resolve()
+}
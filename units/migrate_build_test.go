@@ -0,0 +1,89 @@
+package units
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMigrateBuildJob(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(model.BuildsCollection, model.TestsCollection, model.LogsCollection))
+
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, SetBucket(&bucket))
+
+	now := time.Now().Truncate(time.Millisecond)
+	build := model.Build{Id: "b0", Builder: "builder", Started: now, Ended: &now, Info: model.BuildInfo{TaskID: "t0"}}
+	require.NoError(t, build.Insert())
+	test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Name: "test", Started: now}
+	require.NoError(t, test.Insert())
+
+	// Logs written within the same millisecond would have the same chunk key
+	// if they were migrated one at a time.
+	require.NoError(t, model.InsertLogChunks(build.Id, nil, 1, []model.LogChunk{{{Time: now, Msg: "global"}}}))
+	require.NoError(t, model.InsertLogChunks(build.Id, &test.Id, 2, []model.LogChunk{
+		{{Time: now, Msg: "line 0"}},
+		{{Time: now, Msg: "line 1"}},
+	}))
+
+	ctx := context.Background()
+	j := NewMigrateBuildJob(build.Id, time.Now())
+	j.Run(ctx)
+	require.NoError(t, j.Error())
+
+	migrated, err := model.FindBuildById(build.Id)
+	require.NoError(t, err)
+	assert.True(t, migrated.S3)
+
+	bucketBuild, err := bucket.FindBuildByID(ctx, build.Id)
+	require.NoError(t, err)
+	assert.Equal(t, build.Builder, bucketBuild.Builder)
+	assert.True(t, now.Equal(bucketBuild.Started))
+	bucketTest, err := bucket.FindTestByID(ctx, build.Id, test.Id.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, test.Name, bucketTest.Name)
+	assert.True(t, now.Equal(bucketTest.Started))
+
+	counts, err := bucket.CountLogLines(ctx, build.Id)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"": 1, test.Id.Hex(): 2}, counts)
+
+	t.Run("AlreadyMigrated", func(t *testing.T) {
+		j := NewMigrateBuildJob(build.Id, time.Now())
+		j.Run(ctx)
+		assert.NoError(t, j.Error())
+	})
+
+	t.Run("Unfinished", func(t *testing.T) {
+		unfinished := model.Build{Id: "b1", Builder: "builder", Started: now.Add(-time.Hour)}
+		require.NoError(t, unfinished.Insert())
+		require.NoError(t, model.InsertLogChunks(unfinished.Id, nil, 1, []model.LogChunk{{{Time: now, Msg: "global"}}}))
+
+		j := NewMigrateBuildJob(unfinished.Id, time.Now())
+		j.Run(ctx)
+		require.NoError(t, j.Error())
+
+		found, err := model.FindBuildById(unfinished.Id)
+		require.NoError(t, err)
+		assert.False(t, found.S3)
+		bucketBuild, err := bucket.FindBuildByID(ctx, unfinished.Id)
+		require.NoError(t, err)
+		assert.Nil(t, bucketBuild)
+	})
+}
+
+func TestCompareLineCounts(t *testing.T) {
+	assert.NoError(t, compareLineCounts(map[string]int{"": 1, "t0": 2}, map[string]int{"": 1, "t0": 2}))
+	assert.NoError(t, compareLineCounts(map[string]int{}, map[string]int{"t0": 0}))
+	assert.Error(t, compareLineCounts(map[string]int{"": 1, "t0": 2}, map[string]int{"": 1, "t0": 1}))
+	assert.Error(t, compareLineCounts(map[string]int{"": 1}, map[string]int{"": 1, "t0": 1}))
+}
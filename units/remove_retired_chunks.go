@@ -0,0 +1,100 @@
+package units
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/mongodb/amboy"
+	"github.com/mongodb/amboy/dependency"
+	"github.com/mongodb/amboy/job"
+	"github.com/mongodb/amboy/registry"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	removeRetiredChunksJobName = "remove-retired-chunks-job"
+
+	// retiredChunkGracePeriod is how long the chunks that compaction
+	// replaced are kept, so that readers that started before the compaction
+	// can still fetch them.
+	retiredChunkGracePeriod = time.Hour
+)
+
+func init() {
+	registry.AddJobType(removeRetiredChunksJobName,
+		func() amboy.Job { return makeRemoveRetiredChunksJob() })
+}
+
+type removeRetiredChunksJob struct {
+	BuildID  string `bson:"build_id" json:"build_id" yaml:"build_id"`
+	job.Base `bson:"job_base" json:"job_base" yaml:"job_base"`
+}
+
+// NewRemoveRetiredChunksJob returns a job that removes the chunks of a build
+// in the bucket that compaction replaced. Like NewCompactBuildJob, its ID
+// includes the time it was queued at.
+func NewRemoveRetiredChunksJob(buildID string, ts time.Time) amboy.Job {
+	j := makeRemoveRetiredChunksJob()
+	j.BuildID = buildID
+	j.SetID(fmt.Sprintf("%s.%s.%d", removeRetiredChunksJobName, j.BuildID, ts.UnixNano()))
+	return j
+}
+
+func makeRemoveRetiredChunksJob() *removeRetiredChunksJob {
+	j := &removeRetiredChunksJob{
+		Base: job.Base{
+			JobType: amboy.JobType{
+				Name:    removeRetiredChunksJobName,
+				Version: 1,
+			},
+		},
+	}
+	j.SetDependency(dependency.NewAlways())
+	return j
+}
+
+// Run removes the chunks that were retired more than retiredChunkGracePeriod
+// ago and marks the build as compacted once none remain.
+func (j *removeRetiredChunksJob) Run(ctx context.Context) {
+	defer j.MarkComplete()
+
+	bucket := getBucket()
+	if bucket == nil {
+		j.AddError(errors.New("no bucket configured to remove chunks from"))
+		return
+	}
+
+	build, err := model.FindBuildById(j.BuildID)
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "finding build '%s'", j.BuildID))
+		return
+	}
+	if build == nil || build.Compacted || build.ChunksMerged == nil {
+		return
+	}
+
+	removed, remaining, err := bucket.RemoveRetiredChunks(ctx, j.BuildID, time.Now().Add(-retiredChunkGracePeriod))
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "removing retired chunks for build '%s'", j.BuildID))
+		return
+	}
+	if remaining > 0 {
+		return
+	}
+	if err = build.SetCompacted(); err != nil {
+		j.AddError(err)
+		return
+	}
+
+	grip.Info(message.Fields{
+		"job_type": j.Type().Name,
+		"op":       "retired chunks removed",
+		"build":    j.BuildID,
+		"job":      j.ID(),
+		"removed":  removed,
+	})
+}
@@ -0,0 +1,64 @@
+package units
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRemoveRetiredChunksJob(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(model.BuildsCollection))
+
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, SetBucket(&bucket))
+
+	ctx := context.Background()
+	now := time.Now()
+	testID := bson.NewObjectId().Hex()
+	build := model.Build{Id: "b0", Started: now, Ended: &now, S3: true}
+	require.NoError(t, build.Insert())
+	for i := 0; i < 3; i++ {
+		at := now.Add(time.Duration(i) * time.Second)
+		require.NoError(t, bucket.InsertLogChunks(ctx, build.Id, testID, []model.LogChunk{{{Time: at, Msg: "line"}}}))
+	}
+
+	compact := NewCompactBuildJob(build.Id, time.Now())
+	compact.Run(ctx)
+	require.NoError(t, compact.Error())
+
+	t.Run("WithinGracePeriod", func(t *testing.T) {
+		j := NewRemoveRetiredChunksJob(build.Id, time.Now())
+		j.Run(ctx)
+		require.NoError(t, j.Error())
+
+		found, err := model.FindBuildById(build.Id)
+		require.NoError(t, err)
+		assert.False(t, found.Compacted)
+	})
+
+	t.Run("AfterGracePeriod", func(t *testing.T) {
+		_, remaining, err := bucket.RemoveRetiredChunks(ctx, build.Id, time.Now())
+		require.NoError(t, err)
+		require.Zero(t, remaining)
+
+		j := NewRemoveRetiredChunksJob(build.Id, time.Now())
+		j.Run(ctx)
+		require.NoError(t, j.Error())
+
+		found, err := model.FindBuildById(build.Id)
+		require.NoError(t, err)
+		assert.True(t, found.Compacted)
+		counts, err := bucket.CountLogLines(ctx, build.Id)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{testID: 3}, counts)
+	})
+}
@@ -0,0 +1,180 @@
+package units
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/mongodb/amboy"
+	"github.com/mongodb/amboy/dependency"
+	"github.com/mongodb/amboy/job"
+	"github.com/mongodb/amboy/registry"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	replayBucketWriteJobName = "replay-bucket-write-job"
+
+	// pendingWriteMinAge is how old a pending write must be before it's
+	// replayed, so that appends still writing to the bucket aren't replayed.
+	pendingWriteMinAge = time.Minute
+)
+
+func init() {
+	registry.AddJobType(replayBucketWriteJobName,
+		func() amboy.Job { return makeReplayBucketWriteJob() })
+}
+
+type replayBucketWriteJob struct {
+	WriteID  string `bson:"write_id" json:"write_id" yaml:"write_id"`
+	job.Base `bson:"job_base" json:"job_base" yaml:"job_base"`
+}
+
+// NewReplayBucketWriteJob returns a job that writes the logs of a pending
+// write from the database to the bucket. Its ID includes the time it was
+// queued at, so that a write whose replay failed can be replayed again.
+func NewReplayBucketWriteJob(writeID string, ts time.Time) amboy.Job {
+	j := makeReplayBucketWriteJob()
+	j.WriteID = writeID
+	j.SetID(fmt.Sprintf("%s.%s.%d", replayBucketWriteJobName, j.WriteID, ts.UnixNano()))
+	return j
+}
+
+func makeReplayBucketWriteJob() *replayBucketWriteJob {
+	j := &replayBucketWriteJob{
+		Base: job.Base{
+			JobType: amboy.JobType{
+				Name:    replayBucketWriteJobName,
+				Version: 1,
+			},
+		},
+	}
+	j.SetDependency(dependency.NewAlways())
+	return j
+}
+
+// Run writes the pending write's logs to the bucket and then removes the
+// pending write. The logs are grouped into the same chunks as the original
+// append and get the same keys, so they replace anything the append managed
+// to write.
+func (j *replayBucketWriteJob) Run(ctx context.Context) {
+	defer j.MarkComplete()
+
+	bucket := getBucket()
+	if bucket == nil {
+		j.AddError(errors.New("no bucket configured to replay writes to"))
+		return
+	}
+
+	write, err := model.FindPendingWriteByID(j.WriteID)
+	if err != nil {
+		j.AddError(err)
+		return
+	}
+	if write == nil {
+		return
+	}
+
+	build, err := model.FindBuildById(write.BuildId)
+	if err != nil {
+		j.AddError(errors.Wrapf(err, "finding build '%s'", write.BuildId))
+		return
+	}
+
+	lines := 0
+	if build != nil && build.S3 {
+		lines, err = j.replay(ctx, build, write)
+		if err != nil {
+			j.AddError(err)
+			j.AddError(write.RecordAttempt(err))
+			return
+		}
+	}
+	if err = write.Remove(); err != nil {
+		j.AddError(err)
+		return
+	}
+
+	grip.Info(message.Fields{
+		"job_type": j.Type().Name,
+		"op":       "replay complete",
+		"build":    write.BuildId,
+		"job":      j.ID(),
+		"attempts": write.Attempts + 1,
+		"lines":    lines,
+	})
+}
+
+// replay writes the pending write's logs to the bucket. A batch's logs are
+// found by its batch ID, whether or not its sequence numbers were recorded.
+// An append without a batch ID whose sequence numbers weren't recorded
+// replays every log without a batch ID after its first sequence number. Later
+// appends among them are rewritten under the keys they already have.
+func (j *replayBucketWriteJob) replay(ctx context.Context, build *model.Build, write *model.PendingWrite) (int, error) {
+	bucket := getBucket()
+
+	var (
+		logs []model.Log
+		err  error
+	)
+	switch {
+	case write.BatchId != "":
+		logs, err = model.FindLogsForBatch(write.BuildId, write.TestId, write.BatchId)
+	case write.Sequenced():
+		logs, err = model.FindLogsInSeqRange(write.BuildId, write.TestId, write.FirstSeq, write.LastSeq)
+	default:
+		var lastSeq int
+		if lastSeq, err = currentSeq(build, write.TestId); err != nil {
+			return 0, err
+		}
+		logs, err = model.FindLogsInSeqRange(write.BuildId, write.TestId, write.FirstSeq, lastSeq)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	chunks := make([]model.LogChunk, 0, len(logs))
+	lines := 0
+	for _, log := range logs {
+		if log.BatchId != write.BatchId {
+			continue
+		}
+		chunks = append(chunks, log.Lines)
+		lines += len(log.Lines)
+	}
+	if len(chunks) == 0 {
+		return 0, nil
+	}
+
+	testID := ""
+	if write.TestId != nil {
+		testID = write.TestId.Hex()
+	}
+	if _, err = bucket.InsertLogBatch(ctx, write.BuildId, testID, write.BatchId, chunks); err != nil {
+		return 0, errors.Wrapf(err, "replaying write '%s' to build '%s'", j.WriteID, write.BuildId)
+	}
+
+	return lines, nil
+}
+
+// currentSeq returns the last sequence number of the build's global log, if
+// testID is nil, or of the test's log.
+func currentSeq(build *model.Build, testID *bson.ObjectId) (int, error) {
+	if testID == nil {
+		return build.Seq, nil
+	}
+
+	test, err := model.FindTestByID(testID.Hex())
+	if err != nil {
+		return 0, errors.Wrapf(err, "finding test '%s'", testID.Hex())
+	}
+	if test == nil {
+		return 0, nil
+	}
+
+	return test.Seq, nil
+}
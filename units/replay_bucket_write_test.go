@@ -0,0 +1,98 @@
+package units
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReplayBucketWriteJob(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(model.BuildsCollection, model.TestsCollection, model.LogsCollection, model.PendingWritesCollection))
+
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, SetBucket(&bucket))
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	build := model.Build{Id: "b0", Started: now, Ended: &now, S3: true}
+	require.NoError(t, build.Insert())
+	testID := bson.NewObjectId()
+	chunks := []model.LogChunk{{{Time: now, Msg: "line 0"}}, {{Time: now.Add(time.Second), Msg: "line 1"}}}
+	require.NoError(t, bucket.InsertLogChunks(ctx, build.Id, testID.Hex(), chunks[:1]))
+	require.NoError(t, bucket.WriteManifest(ctx, build.Id))
+
+	// The second chunk only reached the database.
+	require.NoError(t, model.InsertLogChunks(build.Id, &testID, 2, chunks))
+	write := model.PendingWrite{Id: bson.NewObjectId(), BuildId: build.Id, TestId: &testID, FirstSeq: 2, LastSeq: 2, Created: now}
+	require.NoError(t, write.Insert())
+
+	report, err := CheckBuildConsistency(ctx, &bucket, build.Id)
+	require.NoError(t, err)
+	assert.False(t, report.Consistent())
+	assert.Equal(t, 1, report.PendingWrites)
+
+	j := NewReplayBucketWriteJob(write.Id.Hex(), time.Now())
+	j.Run(ctx)
+	require.NoError(t, j.Error())
+
+	found, err := model.FindPendingWriteByID(write.Id.Hex())
+	require.NoError(t, err)
+	assert.Nil(t, found)
+	report, err = CheckBuildConsistency(ctx, &bucket, build.Id)
+	require.NoError(t, err)
+	assert.True(t, report.Consistent(), report.Mismatch)
+	assert.Equal(t, map[string]int{testID.Hex(): 2}, report.Bucket, "the manifest includes the replayed chunk")
+
+	t.Run("AlreadyReplayed", func(t *testing.T) {
+		j := NewReplayBucketWriteJob(write.Id.Hex(), time.Now())
+		j.Run(ctx)
+		assert.NoError(t, j.Error())
+	})
+
+	t.Run("Unsequenced", func(t *testing.T) {
+		test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: now, Seq: 1}
+		require.NoError(t, test.Insert())
+		require.NoError(t, model.InsertLogChunks(build.Id, &test.Id, 1, chunks[:1]))
+		write := model.PendingWrite{Id: bson.NewObjectId(), BuildId: build.Id, TestId: &test.Id, FirstSeq: 1, LastSeq: 0, Created: now}
+		require.NoError(t, write.Insert())
+
+		j := NewReplayBucketWriteJob(write.Id.Hex(), time.Now())
+		j.Run(ctx)
+		require.NoError(t, j.Error())
+
+		report, err := CheckBuildConsistency(ctx, &bucket, build.Id)
+		require.NoError(t, err)
+		assert.True(t, report.Consistent(), report.Mismatch)
+		assert.Equal(t, 1, report.Bucket[test.Id.Hex()], "the logs after the write's first sequence number are replayed")
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		test := model.Test{Id: bson.NewObjectId(), BuildId: build.Id, Started: now, Seq: 2}
+		require.NoError(t, test.Insert())
+		require.NoError(t, model.InsertLogBatch(build.Id, &test.Id, "batch0", 1, chunks[:1]))
+		require.NoError(t, model.InsertLogChunks(build.Id, &test.Id, 2, chunks[1:]))
+		require.NoError(t, bucket.InsertLogChunks(ctx, build.Id, test.Id.Hex(), chunks[1:]))
+		// A retried batch is journaled after the sequence numbers it
+		// took, so its range doesn't cover it.
+		write := model.PendingWrite{Id: bson.NewObjectId(), BuildId: build.Id, TestId: &test.Id, BatchId: "batch0", FirstSeq: 3, LastSeq: 2, Created: now}
+		require.NoError(t, write.Insert())
+
+		j := NewReplayBucketWriteJob(write.Id.Hex(), time.Now())
+		j.Run(ctx)
+		require.NoError(t, j.Error())
+
+		report, err := CheckBuildConsistency(ctx, &bucket, build.Id)
+		require.NoError(t, err)
+		assert.True(t, report.Consistent(), report.Mismatch)
+		assert.Equal(t, 2, report.Bucket[test.Id.Hex()], "only the batch's logs are replayed")
+	})
+}
@@ -0,0 +1,34 @@
+package units
+
+import (
+	"sync"
+
+	"github.com/evergreen-ci/logkeeper/model"
+)
+
+var (
+	retentionPolicies     *model.RetentionPolicies
+	retentionPoliciesLock sync.RWMutex
+)
+
+// SetRetentionPolicies sets the retention policies that decide which builds
+// the cleanup jobs delete.
+func SetRetentionPolicies(policies model.RetentionPolicies) {
+	retentionPoliciesLock.Lock()
+	defer retentionPoliciesLock.Unlock()
+
+	retentionPolicies = &policies
+}
+
+// getRetentionPolicies returns the configured retention policies, or the
+// default policies if none were configured.
+func getRetentionPolicies() model.RetentionPolicies {
+	retentionPoliciesLock.RLock()
+	defer retentionPoliciesLock.RUnlock()
+
+	if retentionPolicies == nil {
+		return model.DefaultRetentionPolicies()
+	}
+
+	return *retentionPolicies
+}
@@ -0,0 +1,225 @@
+package units
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/utility"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TaskStatusEvergreen looks up task statuses in the Evergreen REST API.
+	TaskStatusEvergreen = "evergreen"
+	// TaskStatusBuild uses the build's own failed flag as the task status,
+	// for deployments without an external CI system.
+	TaskStatusBuild = "build"
+	// TaskStatusWebhook looks up task statuses from a configurable HTTP
+	// endpoint.
+	TaskStatusWebhook = "webhook"
+
+	defaultEvergreenURL  = "https://evergreen.mongodb.com/rest/v2/tasks"
+	defaultSuccessStatus = "success"
+)
+
+// TaskStatusProvider reports the outcome of the task that generated a build,
+// which determines whether the cleanup job may delete the build's data.
+type TaskStatusProvider interface {
+	// Name returns the name of the provider, for logging.
+	Name() string
+	// TaskSucceeded returns true if the task completed successfully.
+	TaskSucceeded(ctx context.Context, buildID, taskID string) (bool, error)
+}
+
+// TaskStatusOptions configures the task status provider used by the cleanup
+// jobs.
+type TaskStatusOptions struct {
+	// Provider is one of TaskStatusEvergreen, TaskStatusBuild, or
+	// TaskStatusWebhook. It defaults to TaskStatusEvergreen.
+	Provider string
+	// URL is the base URL of the Evergreen tasks API or the webhook. It's
+	// required for the webhook provider.
+	URL string
+	// User and Key are the Evergreen API credentials.
+	User string
+	Key  string
+	// Token, if set, is sent to the webhook as a bearer token.
+	Token string
+	// SuccessStatus is the status the webhook reports for successful
+	// tasks. It defaults to "success".
+	SuccessStatus string
+}
+
+// NewTaskStatusProvider returns the task status provider described by the
+// options.
+func NewTaskStatusProvider(opts TaskStatusOptions) (TaskStatusProvider, error) {
+	switch opts.Provider {
+	case TaskStatusEvergreen, "":
+		if opts.User == "" {
+			return nil, errors.New("cannot use the Evergreen task status provider without a user defined")
+		}
+		baseURL := opts.URL
+		if baseURL == "" {
+			baseURL = defaultEvergreenURL
+		}
+		return &evergreenTaskStatusProvider{baseURL: baseURL, user: opts.User, key: opts.Key}, nil
+	case TaskStatusBuild:
+		return &buildTaskStatusProvider{}, nil
+	case TaskStatusWebhook:
+		if opts.URL == "" {
+			return nil, errors.New("cannot use the webhook task status provider without a URL defined")
+		}
+		successStatus := opts.SuccessStatus
+		if successStatus == "" {
+			successStatus = defaultSuccessStatus
+		}
+		return &webhookTaskStatusProvider{url: opts.URL, token: opts.Token, successStatus: successStatus}, nil
+	default:
+		return nil, errors.Errorf("unrecognized task status provider '%s'", opts.Provider)
+	}
+}
+
+var (
+	taskStatusProvider     TaskStatusProvider
+	taskStatusProviderLock sync.RWMutex
+)
+
+// SetTaskStatusProvider sets the task status provider used by the cleanup
+// jobs.
+func SetTaskStatusProvider(provider TaskStatusProvider) error {
+	if provider == nil {
+		return errors.New("cannot set a nil task status provider")
+	}
+
+	taskStatusProviderLock.Lock()
+	defer taskStatusProviderLock.Unlock()
+
+	taskStatusProvider = provider
+	return nil
+}
+
+// getTaskStatusProvider returns the configured task status provider. If none
+// was configured it falls back to the Evergreen provider with credentials from
+// the EVG_API_USER and EVG_API_KEY environment variables.
+func getTaskStatusProvider() (TaskStatusProvider, error) {
+	taskStatusProviderLock.RLock()
+	defer taskStatusProviderLock.RUnlock()
+
+	if taskStatusProvider != nil {
+		return taskStatusProvider, nil
+	}
+
+	return NewTaskStatusProvider(TaskStatusOptions{
+		Provider: TaskStatusEvergreen,
+		User:     os.Getenv("EVG_API_USER"),
+		Key:      os.Getenv("EVG_API_KEY"),
+	})
+}
+
+type evergreenTaskStatusProvider struct {
+	baseURL string
+	user    string
+	key     string
+}
+
+func (p *evergreenTaskStatusProvider) Name() string { return TaskStatusEvergreen }
+
+func (p *evergreenTaskStatusProvider) TaskSucceeded(ctx context.Context, buildID, taskID string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s", p.baseURL, url.PathEscape(taskID)), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("Api-User", p.user)
+	req.Header.Add("Api-Key", p.key)
+
+	status, err := fetchTaskStatus(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "getting status of task '%s' from Evergreen", taskID)
+	}
+
+	return status == defaultSuccessStatus, nil
+}
+
+type buildTaskStatusProvider struct{}
+
+func (p *buildTaskStatusProvider) Name() string { return TaskStatusBuild }
+
+func (p *buildTaskStatusProvider) TaskSucceeded(_ context.Context, buildID, _ string) (bool, error) {
+	build, err := model.FindBuildById(buildID)
+	if err != nil {
+		return false, errors.Wrapf(err, "finding build '%s'", buildID)
+	}
+	if build == nil {
+		return false, errors.Errorf("build '%s' not found", buildID)
+	}
+
+	return !build.Failed, nil
+}
+
+type webhookTaskStatusProvider struct {
+	url           string
+	token         string
+	successStatus string
+}
+
+func (p *webhookTaskStatusProvider) Name() string { return TaskStatusWebhook }
+
+// TaskSucceeded requests the webhook URL with the build_id and task_id query
+// parameters, and expects a JSON response with the task's status.
+func (p *webhookTaskStatusProvider) TaskSucceeded(ctx context.Context, buildID, taskID string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	query := req.URL.Query()
+	query.Set("build_id", buildID)
+	query.Set("task_id", taskID)
+	req.URL.RawQuery = query.Encode()
+	if p.token != "" {
+		req.Header.Add("Authorization", "Bearer "+p.token)
+	}
+
+	status, err := fetchTaskStatus(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "getting status of task '%s' from webhook", taskID)
+	}
+
+	return status == p.successStatus, nil
+}
+
+// fetchTaskStatus sends the request and returns the status field of the JSON
+// response.
+func fetchTaskStatus(req *http.Request) (string, error) {
+	client := utility.GetDefaultHTTPRetryableClient()
+	defer utility.PutHTTPClient(client)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := struct {
+			Message string `json:"message"`
+		}{}
+		_ = utility.ReadJSON(resp.Body, &errResp)
+		return "", errors.Errorf("unexpected response code %d: %s", resp.StatusCode, errResp.Message)
+	}
+
+	taskInfo := struct {
+		Status string `json:"status"`
+	}{}
+	if err = utility.ReadJSON(resp.Body, &taskInfo); err != nil {
+		return "", errors.Wrap(err, "reading task status response")
+	}
+
+	return taskInfo.Status, nil
+}
@@ -0,0 +1,135 @@
+package units
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTaskStatusProvider(t *testing.T) {
+	for name, test := range map[string]struct {
+		opts         TaskStatusOptions
+		expectedName string
+		shouldErr    bool
+	}{
+		"EvergreenDefault":   {opts: TaskStatusOptions{User: "user"}, expectedName: TaskStatusEvergreen},
+		"EvergreenNoUser":    {opts: TaskStatusOptions{Provider: TaskStatusEvergreen}, shouldErr: true},
+		"Build":              {opts: TaskStatusOptions{Provider: TaskStatusBuild}, expectedName: TaskStatusBuild},
+		"Webhook":            {opts: TaskStatusOptions{Provider: TaskStatusWebhook, URL: "http://localhost"}, expectedName: TaskStatusWebhook},
+		"WebhookNoURL":       {opts: TaskStatusOptions{Provider: TaskStatusWebhook}, shouldErr: true},
+		"UnrecognizedOption": {opts: TaskStatusOptions{Provider: "jenkins"}, shouldErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			provider, err := NewTaskStatusProvider(test.opts)
+			if test.shouldErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedName, provider.Name())
+		})
+	}
+}
+
+func TestEvergreenTaskStatusProvider(t *testing.T) {
+	statuses := map[string]string{"t0": "success", "t1": "failed"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Api-User") != "user" || r.Header.Get("Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		status, ok := statuses[r.URL.Path[len("/rest/v2/tasks/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			assert.NoError(t, json.NewEncoder(w).Encode(map[string]string{"message": "task not found"}))
+			return
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(map[string]string{"status": status}))
+	}))
+	defer server.Close()
+
+	provider, err := NewTaskStatusProvider(TaskStatusOptions{
+		Provider: TaskStatusEvergreen,
+		URL:      server.URL + "/rest/v2/tasks",
+		User:     "user",
+		Key:      "key",
+	})
+	require.NoError(t, err)
+
+	succeeded, err := provider.TaskSucceeded(context.Background(), "b0", "t0")
+	assert.NoError(t, err)
+	assert.True(t, succeeded)
+
+	succeeded, err = provider.TaskSucceeded(context.Background(), "b1", "t1")
+	assert.NoError(t, err)
+	assert.False(t, succeeded)
+
+	_, err = provider.TaskSucceeded(context.Background(), "b2", "t2")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "task not found")
+}
+
+func TestWebhookTaskStatusProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		status := "failure"
+		if r.URL.Query().Get("build_id") == "b0" && r.URL.Query().Get("task_id") == "t0" {
+			status = "passed"
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(map[string]string{"status": status}))
+	}))
+	defer server.Close()
+
+	provider, err := NewTaskStatusProvider(TaskStatusOptions{
+		Provider:      TaskStatusWebhook,
+		URL:           server.URL,
+		Token:         "token",
+		SuccessStatus: "passed",
+	})
+	require.NoError(t, err)
+
+	succeeded, err := provider.TaskSucceeded(context.Background(), "b0", "t0")
+	assert.NoError(t, err)
+	assert.True(t, succeeded)
+
+	succeeded, err = provider.TaskSucceeded(context.Background(), "b0", "t1")
+	assert.NoError(t, err)
+	assert.False(t, succeeded)
+
+	provider, err = NewTaskStatusProvider(TaskStatusOptions{Provider: TaskStatusWebhook, URL: server.URL})
+	require.NoError(t, err)
+	_, err = provider.TaskSucceeded(context.Background(), "b0", "t0")
+	assert.Error(t, err)
+}
+
+func TestBuildTaskStatusProvider(t *testing.T) {
+	require.NoError(t, testutil.InitDB())
+	require.NoError(t, testutil.ClearCollections(model.BuildsCollection))
+
+	require.NoError(t, (&model.Build{Id: "b0"}).Insert())
+	require.NoError(t, (&model.Build{Id: "b1", Failed: true}).Insert())
+
+	provider, err := NewTaskStatusProvider(TaskStatusOptions{Provider: TaskStatusBuild})
+	require.NoError(t, err)
+
+	succeeded, err := provider.TaskSucceeded(context.Background(), "b0", "")
+	assert.NoError(t, err)
+	assert.True(t, succeeded)
+
+	succeeded, err = provider.TaskSucceeded(context.Background(), "b1", "")
+	assert.NoError(t, err)
+	assert.False(t, succeeded)
+
+	_, err = provider.TaskSucceeded(context.Background(), "b2", "")
+	assert.Error(t, err)
+}
@@ -1,10 +1,11 @@
 package logkeeper
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/evergreen-ci/logkeeper/env"
@@ -15,11 +16,23 @@ import (
 	"github.com/mongodb/amboy"
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/message"
-	"github.com/mongodb/grip/recovery"
 	"gopkg.in/mgo.v2/bson"
 )
 
-const maxLogBytes = 4 * 1024 * 1024 // 4 MB
+const (
+	maxLogBytes = 4 * 1024 * 1024 // 4 MB
+
+	ndjsonContentType = "application/x-ndjson"
+
+	// streamStatusTrailer is the trailer of a streamed log response that
+	// says whether every line was sent.
+	streamStatusTrailer = "X-Logkeeper-Status"
+	streamComplete      = "complete"
+	streamIncomplete    = "incomplete"
+
+	statusPassed = "passed"
+	statusFailed = "failed"
+)
 
 type Options struct {
 	//Base URL to append to relative paths
@@ -28,13 +41,22 @@ type Options struct {
 	// Maximum Request Size
 	MaxRequestSize int
 
-	// Bucket stores data in offline storage.
-	Bucket storage.Bucket
+	// Store holds the builds, tests, and logs.
+	Store storage.LogStore
+
+	// Bucket is checked and repaired by the admin router's build storage
+	// check endpoint, which is unavailable if it's nil.
+	Bucket *storage.Bucket
+
+	// RetentionPolicies decide which builds the cleanup jobs delete. The
+	// default policies are used if it's nil.
+	RetentionPolicies *model.RetentionPolicies
 }
 
 type logKeeper struct {
 	render *render.Render
 	opts   Options
+	broker *logBroker
 }
 
 type createdResponse struct {
@@ -58,7 +80,7 @@ func New(opts Options) *logKeeper {
 		},
 	})
 
-	return &logKeeper{render, opts}
+	return &logKeeper{render: render, opts: opts, broker: newLogBroker()}
 }
 
 type apiError struct {
@@ -67,10 +89,60 @@ type apiError struct {
 	code    int
 }
 
-type logFetchResponse struct {
-	logLines chan *model.LogLineItem
-	build    *model.Build
-	test     *model.Test
+type buildResponse struct {
+	Build *model.Build `json:"build"`
+	Tests []model.Test `json:"tests"`
+}
+
+type testResponse struct {
+	Build *model.Build `json:"build"`
+	Test  *model.Test  `json:"test"`
+}
+
+type testsResponse struct {
+	Tests []model.Test `json:"tests"`
+	// Next is the URL of the next page of results, if there may be more.
+	Next string `json:"next,omitempty"`
+}
+
+// logLineRecord is the representation of a single log line in an NDJSON
+// response. LineNum is nil for lines that aren't numbered by their position in
+// the whole log.
+type logLineRecord struct {
+	Timestamp time.Time      `json:"ts"`
+	LineNum   *int           `json:"line,omitempty"`
+	Msg       string         `json:"msg"`
+	TestId    *bson.ObjectId `json:"test_id"`
+	Global    bool           `json:"global"`
+}
+
+// newLogLineRecord returns the record of the line.
+func newLogLineRecord(line *model.LogLineItem) logLineRecord {
+	record := logLineRecord{
+		Timestamp: line.Timestamp,
+		Msg:       line.Data,
+		TestId:    line.TestId,
+		Global:    line.Global(),
+	}
+	if line.Numbered() {
+		lineNum := line.LineNum
+		record.LineNum = &lineNum
+	}
+
+	return record
+}
+
+// streamErrorRecord is the last record of an NDJSON response whose lines
+// stopped early because of an error.
+type streamErrorRecord struct {
+	Err string `json:"error"`
+}
+
+// searchLineRecord is the representation of a line returned by a search in
+// an NDJSON response.
+type searchLineRecord struct {
+	logLineRecord
+	Match bool `json:"match"`
 }
 
 func (lk *logKeeper) createBuild(w http.ResponseWriter, r *http.Request) {
@@ -95,7 +167,7 @@ func (lk *logKeeper) createBuild(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existingBuild, err := model.FindBuildByBuilder(buildParameters.Builder, buildParameters.BuildNum)
+	existingBuild, err := lk.opts.Store.FindBuildByBuilder(r.Context(), buildParameters.Builder, buildParameters.BuildNum)
 	if err != nil {
 		lk.logErrorf(r, "Error finding build by builder: %v", err)
 		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
@@ -123,20 +195,12 @@ func (lk *logKeeper) createBuild(w http.ResponseWriter, r *http.Request) {
 		Info:     model.BuildInfo{TaskID: buildParameters.TaskId},
 		S3:       buildParameters.S3,
 	}
-	if err = newBuild.Insert(); err != nil {
+	if err = lk.opts.Store.InsertBuild(r.Context(), newBuild); err != nil {
 		lk.logErrorf(r, "Error inserting build object: %v", err)
 		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
 		return
 	}
 
-	if buildParameters.S3 {
-		if err := lk.opts.Bucket.UploadBuildMetadata(r.Context(), newBuild); err != nil {
-			lk.logErrorf(r, "writing build metadata: %v", err)
-			lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
-			return
-		}
-	}
-
 	newBuildUri := fmt.Sprintf("%v/build/%v", lk.opts.URL, newBuildId)
 
 	response := createdResponse{newBuildId, newBuildUri}
@@ -152,17 +216,13 @@ func (lk *logKeeper) createTest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vars := mux.Vars(r)
-	buildID := vars["build_id"]
-
-	build, err := model.FindBuildById(buildID)
-	if err != nil {
-		lk.logErrorf(r, "error finding build: %v", err)
-		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+	build, buildErr := lk.findBuild(r, "creating test")
+	if buildErr != nil {
+		lk.render.WriteJSON(w, buildErr.code, *buildErr)
 		return
 	}
-	if build == nil {
-		lk.render.WriteJSON(w, http.StatusNotFound, apiError{Err: "creating test: build not found"})
+	if build.Finished() {
+		lk.render.WriteJSON(w, http.StatusConflict, apiError{Err: "creating test: build is finished"})
 		return
 	}
 
@@ -183,30 +243,148 @@ func (lk *logKeeper) createTest(w http.ResponseWriter, r *http.Request) {
 		Id:        bson.NewObjectId(),
 		BuildId:   build.Id,
 		BuildName: build.Name,
+		Builder:   build.Builder,
 		Name:      testParams.TestFilename,
 		Command:   testParams.Command,
 		Started:   time.Now(),
 		Phase:     testParams.Phase,
 		Info:      model.TestInfo{TaskID: testParams.TaskId},
 	}
-	if err := newTest.Insert(); err != nil {
+	if err := lk.opts.Store.InsertTest(r.Context(), build, newTest); err != nil {
 		lk.logErrorf(r, "Error inserting test: %v", err)
 		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
 		return
 	}
 
-	if build.S3 {
-		if err := lk.opts.Bucket.UploadTestMetadata(r.Context(), newTest); err != nil {
-			lk.logErrorf(r, "writing test metadata: %v", err)
-			lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
-			return
-		}
-	}
-
 	testUri := fmt.Sprintf("%s/build/%s/test/%s", lk.opts.URL, build.Id, newTest.Id.Hex())
 	lk.render.WriteJSON(w, http.StatusCreated, createdResponse{newTest.Id.Hex(), testUri})
 }
 
+func (lk *logKeeper) finishBuild(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if err := lk.checkContentLength(r); err != nil {
+		lk.logErrorf(r, "content length limit exceeded for finishBuild: %s", err.Err)
+		lk.render.WriteJSON(w, err.code, err)
+		return
+	}
+
+	build, buildErr := lk.findBuild(r, "finishing build")
+	if buildErr != nil {
+		lk.render.WriteJSON(w, buildErr.code, *buildErr)
+		return
+	}
+	if build.Finished() {
+		lk.render.WriteJSON(w, http.StatusConflict, apiError{Err: "finishing build: build is already finished"})
+		return
+	}
+
+	finishParams := struct {
+		Status string     `json:"status"`
+		Ended  *time.Time `json:"ended"`
+		Phases []string   `json:"phases"`
+	}{}
+	if err := readJSON(r.Body, lk.opts.MaxRequestSize, &finishParams); err != nil {
+		lk.logErrorf(r, "Bad request to finishBuild: %s", err.Err)
+		lk.render.WriteJSON(w, err.code, err)
+		return
+	}
+
+	failed, statusErr := parseStatus(finishParams.Status)
+	if statusErr != nil {
+		lk.render.WriteJSON(w, statusErr.code, *statusErr)
+		return
+	}
+	ended := time.Now()
+	if finishParams.Ended != nil {
+		ended = *finishParams.Ended
+	}
+
+	if err := lk.opts.Store.FinishBuild(r.Context(), build, ended, failed, finishParams.Phases); err != nil {
+		lk.logErrorf(r, "Error finishing build: %v", err)
+		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, build)
+}
+
+// pinBuild places a hold on the build so that the retention policies don't
+// delete it. The body is a JSON object with an optional reason and expiry.
+func (lk *logKeeper) pinBuild(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if err := lk.checkContentLength(r); err != nil {
+		lk.logErrorf(r, "content length limit exceeded for pinBuild: %s", err.Err)
+		lk.render.WriteJSON(w, err.code, err)
+		return
+	}
+
+	build, buildErr := lk.findBuild(r, "pinning build")
+	if buildErr != nil {
+		lk.render.WriteJSON(w, buildErr.code, *buildErr)
+		return
+	}
+
+	pinParams := struct {
+		Reason  string     `json:"reason"`
+		Expires *time.Time `json:"expires"`
+	}{}
+	if err := readJSON(r.Body, lk.opts.MaxRequestSize, &pinParams); err != nil {
+		lk.logErrorf(r, "Bad request to pinBuild: %s", err.Err)
+		lk.render.WriteJSON(w, err.code, err)
+		return
+	}
+
+	now := time.Now()
+	if pinParams.Expires != nil && !pinParams.Expires.After(now) {
+		lk.render.WriteJSON(w, http.StatusBadRequest, apiError{Err: "pinning build: expiry must be in the future"})
+		return
+	}
+
+	hold := model.BuildHold{Reason: pinParams.Reason, Created: now, Expires: pinParams.Expires}
+	if err := lk.opts.Store.SetBuildHold(r.Context(), build, &hold); err != nil {
+		lk.logErrorf(r, "Error pinning build: %v", err)
+		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, build)
+}
+
+// unpinBuild removes the build's hold, if it has one.
+func (lk *logKeeper) unpinBuild(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	build, buildErr := lk.findBuild(r, "unpinning build")
+	if buildErr != nil {
+		lk.render.WriteJSON(w, buildErr.code, *buildErr)
+		return
+	}
+
+	if err := lk.opts.Store.SetBuildHold(r.Context(), build, nil); err != nil {
+		lk.logErrorf(r, "Error unpinning build: %v", err)
+		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+		return
+	}
+
+	lk.render.WriteJSON(w, http.StatusOK, build)
+}
+
+// findBuild returns the build named in the request's path.
+func (lk *logKeeper) findBuild(r *http.Request, op string) (*model.Build, *apiError) {
+	build, err := lk.opts.Store.FindBuildByID(r.Context(), mux.Vars(r)["build_id"])
+	if err != nil {
+		lk.logErrorf(r, "error finding build: %v", err)
+		return nil, &apiError{Err: err.Error(), code: http.StatusInternalServerError}
+	}
+	if build == nil {
+		return nil, &apiError{Err: fmt.Sprintf("%s: build not found", op), code: http.StatusNotFound}
+	}
+
+	return build, nil
+}
+
 func (lk *logKeeper) appendLog(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -215,18 +393,27 @@ func (lk *logKeeper) appendLog(w http.ResponseWriter, r *http.Request) {
 		lk.render.WriteJSON(w, err.code, err)
 		return
 	}
+	batchID, batchErr := readBatchID(r)
+	if batchErr != nil {
+		lk.render.WriteJSON(w, batchErr.code, *batchErr)
+		return
+	}
 
 	vars := mux.Vars(r)
 	buildID := vars["build_id"]
 
-	build, err := model.FindBuildById(buildID)
+	build, err := lk.opts.Store.FindBuildByID(r.Context(), buildID)
 	if err != nil || build == nil {
 		lk.render.WriteJSON(w, http.StatusNotFound, apiError{Err: "appending log: build not found"})
 		return
 	}
+	if build.Finished() {
+		lk.render.WriteJSON(w, http.StatusConflict, apiError{Err: "appending log: build is finished"})
+		return
+	}
 
 	testID := vars["test_id"]
-	test, err := model.FindTestByID(testID)
+	test, err := lk.opts.Store.FindTestByID(r.Context(), build, testID)
 	if err != nil || test == nil {
 		lk.render.WriteJSON(w, http.StatusNotFound, apiError{Err: "test not found"})
 		return
@@ -252,30 +439,77 @@ func (lk *logKeeper) appendLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = test.IncrementSequence(len(chunks)); err != nil {
-		lk.logErrorf(r, "Error updating tests: %v", err)
-		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
-		return
-	}
-
-	if err = model.InsertLogChunks(build.Id, &test.Id, test.Seq, chunks); err != nil {
+	applied, err := lk.opts.Store.InsertLogChunks(r.Context(), build, test, batchID, chunks)
+	if err != nil {
 		lk.logErrorf(r, "Error inserting logs: %v", err)
 		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
 		return
 	}
 
-	if build.S3 {
-		if err := lk.opts.Bucket.InsertLogChunks(r.Context(), build.Id, test.Id.Hex(), chunks); err != nil {
-			lk.logErrorf(r, "appending S3 logs: %v", err)
-			lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
-			return
-		}
+	if applied {
+		lk.broker.publish(build.Id, &test.Id)
 	}
 
 	testUrl := fmt.Sprintf("%s/build/%s/test/%s", lk.opts.URL, build.Id, test.Id.Hex())
 	lk.render.WriteJSON(w, http.StatusCreated, createdResponse{"", testUrl})
 }
 
+func (lk *logKeeper) endTest(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if err := lk.checkContentLength(r); err != nil {
+		lk.logErrorf(r, "content length limit exceeded for endTest: %s", err.Err)
+		lk.render.WriteJSON(w, err.code, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	buildID := vars["build_id"]
+
+	build, err := lk.opts.Store.FindBuildByID(r.Context(), buildID)
+	if err != nil || build == nil {
+		lk.render.WriteJSON(w, http.StatusNotFound, apiError{Err: "ending test: build not found"})
+		return
+	}
+
+	testID := vars["test_id"]
+	test, err := lk.opts.Store.FindTestByID(r.Context(), build, testID)
+	if err != nil || test == nil {
+		lk.render.WriteJSON(w, http.StatusNotFound, apiError{Err: "test not found"})
+		return
+	}
+
+	endParams := struct {
+		Status string     `json:"status"`
+		Ended  *time.Time `json:"ended"`
+	}{}
+	if err := readJSON(r.Body, lk.opts.MaxRequestSize, &endParams); err != nil {
+		lk.logErrorf(r, "Bad request to endTest: %s", err.Err)
+		lk.render.WriteJSON(w, err.code, err)
+		return
+	}
+
+	failed, statusErr := parseStatus(endParams.Status)
+	if statusErr != nil {
+		lk.render.WriteJSON(w, statusErr.code, *statusErr)
+		return
+	}
+	ended := time.Now()
+	if endParams.Ended != nil {
+		ended = *endParams.Ended
+	}
+
+	if err = lk.opts.Store.EndTest(r.Context(), build, test, ended, failed); err != nil {
+		lk.logErrorf(r, "Error ending test: %v", err)
+		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+		return
+	}
+
+	lk.broker.endTest(build.Id, test.Id)
+
+	lk.render.WriteJSON(w, http.StatusOK, testResponse{Build: build, Test: test})
+}
+
 func (lk *logKeeper) appendGlobalLog(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -284,11 +518,16 @@ func (lk *logKeeper) appendGlobalLog(w http.ResponseWriter, r *http.Request) {
 		lk.render.WriteJSON(w, err.code, err)
 		return
 	}
+	batchID, batchErr := readBatchID(r)
+	if batchErr != nil {
+		lk.render.WriteJSON(w, batchErr.code, *batchErr)
+		return
+	}
 
 	vars := mux.Vars(r)
 	buildID := vars["build_id"]
 
-	build, err := model.FindBuildById(buildID)
+	build, err := lk.opts.Store.FindBuildByID(r.Context(), buildID)
 	if err != nil {
 		lk.logErrorf(r, "Error finding builds entry: %v", err)
 		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: "finding builds in append global log:" + err.Error()})
@@ -298,6 +537,10 @@ func (lk *logKeeper) appendGlobalLog(w http.ResponseWriter, r *http.Request) {
 		lk.render.WriteJSON(w, http.StatusNotFound, apiError{Err: "append global log: build not found"})
 		return
 	}
+	if build.Finished() {
+		lk.render.WriteJSON(w, http.StatusConflict, apiError{Err: "append global log: build is finished"})
+		return
+	}
 
 	var lines []model.LogLine
 	if err := readJSON(r.Body, lk.opts.MaxRequestSize, &lines); err != nil {
@@ -319,108 +562,40 @@ func (lk *logKeeper) appendGlobalLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = build.IncrementSequence(len(chunks)); err != nil {
-		lk.logErrorf(r, "Error updating tests: %v", err)
-		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
-		return
-	}
-
-	if err = model.InsertLogChunks(build.Id, nil, build.Seq, chunks); err != nil {
+	applied, err := lk.opts.Store.InsertLogChunks(r.Context(), build, nil, batchID, chunks)
+	if err != nil {
 		lk.logErrorf(r, "Error inserting logs: %v", err)
 		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
 		return
 	}
 
-	if build.S3 {
-		if err := lk.opts.Bucket.InsertLogChunks(r.Context(), build.Id, "", chunks); err != nil {
-			lk.logErrorf(r, "appending S3 logs: %v", err)
-			lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
-			return
-		}
+	if applied {
+		lk.broker.publish(build.Id, nil)
 	}
 
 	testUrl := fmt.Sprintf("%s/build/%s/", lk.opts.URL, build.Id)
 	lk.render.WriteJSON(w, http.StatusCreated, createdResponse{"", testUrl})
 }
 
-func (lk *logKeeper) viewBuildByIdInS3(r *http.Request, buildID string) (*model.Build, []model.Test, *apiError) {
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	var (
-		build    *model.Build
-		buildErr error
-	)
-	go func() {
-		defer recovery.LogStackTraceAndContinue("fetching build from s3 for test id")
-		defer wg.Done()
-		build, buildErr = lk.opts.Bucket.FindBuildByID(r.Context(), buildID)
-	}()
-
-	var (
-		tests    []model.Test
-		testsErr error
-	)
-	go func() {
-		defer recovery.LogStackTraceAndContinue("fetching build from s3 for test id")
-		defer wg.Done()
-		tests, testsErr = lk.opts.Bucket.FindTestsForBuild(r.Context(), buildID)
-	}()
-
-	wg.Wait()
-
-	if buildErr != nil {
-		lk.logErrorf(r, "Error finding build '%s': %v", buildID, buildErr)
-		return nil, nil, &apiError{Err: fmt.Sprintf("failed to find build '%s' in S3: %s", buildID, buildErr.Error()), code: http.StatusInternalServerError}
-	}
-	if build == nil {
-		return nil, nil, &apiError{Err: fmt.Sprintf("build '%s' not found in S3", buildID), code: http.StatusNotFound}
-	}
-	if testsErr != nil {
-		lk.logErrorf(r, "Error finding tests for build '%s': %v", buildID, testsErr)
-		return nil, nil, &apiError{Err: testsErr.Error(), code: http.StatusInternalServerError}
-	}
-	return build, tests, nil
-}
-
-func (lk *logKeeper) viewBuildByIdInDatabase(r *http.Request, buildID string) (*model.Build, []model.Test, *apiError) {
-	build, err := model.FindBuildById(buildID)
-	if err != nil {
-		lk.logErrorf(r, "Error finding build '%s': %v", buildID, err)
-		return nil, nil, &apiError{Err: fmt.Sprintf("failed to find build '%s': %s", buildID, err.Error()), code: http.StatusInternalServerError}
-	}
-	if build == nil {
-		return nil, nil, &apiError{Err: fmt.Sprintf("build '%s' not found", buildID), code: http.StatusNotFound}
-	}
-
-	tests, err := model.FindTestsForBuild(buildID)
-	if err != nil {
-		lk.logErrorf(r, "Error finding tests for build '%s': %v", buildID, err)
-		return nil, nil, &apiError{Err: err.Error(), code: http.StatusInternalServerError}
-	}
-	return build, tests, nil
-}
-
 func (lk *logKeeper) viewBuildById(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	defer r.Body.Close()
 
-	vars := mux.Vars(r)
-	buildID := vars["build_id"]
+	build, fetchError := lk.findBuild(r, "view build")
+	if fetchError != nil {
+		lk.render.WriteJSON(w, fetchError.code, *fetchError)
+		return
+	}
 
-	var (
-		build      *model.Build
-		tests      []model.Test
-		fetchError *apiError
-	)
-	if len(r.FormValue("s3")) > 0 {
-		build, tests, fetchError = lk.viewBuildByIdInS3(r, buildID)
-	} else {
-		build, tests, fetchError = lk.viewBuildByIdInDatabase(r, buildID)
+	tests, err := lk.opts.Store.FindTestsForBuild(r.Context(), build)
+	if err != nil {
+		lk.logErrorf(r, "Error finding tests for build '%s': %v", build.Id, err)
+		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+		return
 	}
 
-	if fetchError != nil {
-		lk.render.WriteJSON(w, fetchError.code, *fetchError)
+	if jsonRequested(r) {
+		lk.render.WriteJSON(w, http.StatusOK, buildResponse{Build: build, Tests: tests})
 		return
 	}
 
@@ -442,124 +617,116 @@ func (lk *logKeeper) viewAllLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	build, err := model.FindBuildById(buildID)
-	if err != nil || build == nil {
-		lk.render.WriteJSON(w, http.StatusNotFound, apiError{Err: "view all logs: build not found"})
+	window, windowErr := readLogWindow(r)
+	if windowErr != nil {
+		lk.render.WriteJSON(w, windowErr.code, *windowErr)
+		return
+	}
+
+	build, fetchError := lk.findBuild(r, "view all logs")
+	if fetchError != nil {
+		lk.render.WriteJSON(w, fetchError.code, *fetchError)
 		return
 	}
 
-	logsChannel, err := model.AllLogs(build.Id)
+	r, status, stop := withStreamStatus(r)
+	defer stop()
+	logsChannel, err := fetchLogLines(r, window, func(ctx context.Context, reverse bool) (chan *model.LogLineItem, error) {
+		return lk.opts.Store.GetAllLogLines(ctx, build, window.timeRange(), reverse)
+	})
 	if err != nil {
 		lk.logErrorf(r, "Error finding logs: %v", err)
 		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
 		return
 	}
 
+	if ndjsonRequested(r) {
+		lk.writeNDJSON(w, r, logsChannel, status)
+		return
+	}
+
+	announceStreamStatus(w)
 	if len(r.FormValue("raw")) > 0 || r.Header.Get("Accept") == "text/plain" {
 		for line := range logsChannel {
-			_, err = w.Write([]byte(line.Data + "\n"))
-			if err != nil {
+			if _, err := w.Write([]byte(line.Data + "\n")); err != nil {
 				return
 			}
 		}
+		lk.finishStream(w, r, status)
 		return
 	} else {
-		err = lk.render.StreamHTML(w, http.StatusOK, struct {
+		err := lk.render.StreamHTML(w, http.StatusOK, struct {
 			LogLines chan *model.LogLineItem
+			Status   *model.StreamStatus
 			BuildId  string
 			Builder  string
 			TestId   string
 			TestName string
 			Info     model.BuildInfo
-		}{logsChannel, build.Id, build.Builder, "", "All logs", build.Info}, "base", "test.html")
+		}{logsChannel, status, build.Id, build.Builder, "", "All logs", build.Info}, "base", "test.html")
 		if err != nil {
 			lk.logErrorf(r, "Error rendering template: %v", err)
 		}
+		lk.finishStream(w, r, status)
 	}
 }
 
-func (lk *logKeeper) viewTestInDatabase(r *http.Request, buildID string, testID string) (*logFetchResponse, *apiError) {
-	build, err := model.FindBuildById(buildID)
-	if err != nil || build == nil {
-		return nil, &apiError{Err: "view test by id: build not found", code: http.StatusNotFound}
+// findTest returns the build's test named in the request's path.
+func (lk *logKeeper) findTest(r *http.Request, build *model.Build) (*model.Test, *apiError) {
+	testID := mux.Vars(r)["test_id"]
+	test, err := lk.opts.Store.FindTestByID(r.Context(), build, testID)
+	if err != nil {
+		lk.logErrorf(r, "Error finding test '%s': %v", testID, err)
+		return nil, &apiError{Err: err.Error(), code: http.StatusInternalServerError}
 	}
-
-	test, err := model.FindTestByID(testID)
-	if err != nil || test == nil {
-		return nil, &apiError{Err: "test not found"}
+	if test == nil {
+		return nil, &apiError{Err: "test not found", code: http.StatusNotFound}
 	}
 
-	logsChan, err := model.MergedTestLogs(test)
+	return test, nil
+}
+
+// testLogs returns the test's log lines within the window.
+func (lk *logKeeper) testLogs(r *http.Request, build *model.Build, test *model.Test, window logWindow) (chan *model.LogLineItem, *apiError) {
+	logsChan, err := fetchLogLines(r, window, func(ctx context.Context, reverse bool) (chan *model.LogLineItem, error) {
+		return lk.opts.Store.GetTestLogLines(ctx, build, test, window.timeRange(), reverse)
+	})
 	if err != nil {
-		lk.logErrorf(r, "Error finding global logs during test: %v", err)
+		lk.logErrorf(r, "Error finding logs during test: %v", err)
 		return nil, &apiError{Err: err.Error(), code: http.StatusInternalServerError}
 	}
 
-	result := logFetchResponse{
-		logLines: logsChan,
-		build:    build,
-		test:     test,
-	}
-	return &result, nil
+	return logsChan, nil
 }
 
-func (lk *logKeeper) viewTestInS3(r *http.Request, buildID string, testID string) (*logFetchResponse, *apiError) {
-	var build *model.Build
-	var buildErr error
-	wg := sync.WaitGroup{}
-
-	wg.Add(3)
-	go func() {
-		defer recovery.LogStackTraceAndContinue("fetching build from s3 for test id")
-		defer wg.Done()
-		build, buildErr = lk.opts.Bucket.FindBuildByID(r.Context(), buildID)
-	}()
-
-	var test *model.Test
-	var testErr error
-	go func() {
-		defer recovery.LogStackTraceAndContinue("fetching test from s3 for test id")
-		defer wg.Done()
-		test, testErr = lk.opts.Bucket.FindTestByID(r.Context(), buildID, testID)
-	}()
-
-	var logsChan chan *model.LogLineItem
-	var logsChanErr error
-	go func() {
-		defer recovery.LogStackTraceAndContinue("fetching log lines from s3 for test id")
-		defer wg.Done()
-		logsChan, logsChanErr = lk.opts.Bucket.GetTestLogLines(r.Context(), buildID, testID)
-	}()
-
-	wg.Wait()
-
-	if buildErr != nil {
-		lk.logErrorf(r, "error fetching build: %v", buildErr)
-		return nil, &apiError{Err: "error fetching build", code: http.StatusInternalServerError}
-	}
-	if build == nil {
-		return nil, &apiError{Err: fmt.Sprintf("no matching build found for %s", buildID), code: http.StatusNotFound}
-	}
+// fetchLogLines returns the log lines that fetch returns for the window. A
+// tail is fetched newest first with a context that's canceled once the tail
+// has been read, so that the rest of the log isn't left waiting to be read
+// until the request ends. Lines are numbered by their position in the whole
+// log so that line anchors don't move when the window changes, except for the
+// lines of a window with a start time or a tail, which are left unnumbered
+// since their position isn't known without reading the rest of the log.
+func fetchLogLines(r *http.Request, window logWindow, fetch func(ctx context.Context, reverse bool) (chan *model.LogLineItem, error)) (chan *model.LogLineItem, error) {
+	if window.tail == 0 {
+		logs, err := fetch(r.Context(), false)
+		if err != nil {
+			return nil, err
+		}
+		if !window.numbered() {
+			return model.UnnumberLines(r.Context(), logs), nil
+		}
 
-	if testErr != nil {
-		lk.logErrorf(r, "error fetching test %v", testErr)
-		return nil, &apiError{Err: "error fetching test", code: http.StatusInternalServerError}
-	}
-	if test == nil {
-		return nil, &apiError{Err: fmt.Sprintf("no matching test found for build:%s, test:%s", buildID, testID), code: http.StatusNotFound}
+		return model.SelectLineRange(r.Context(), logs, window.fromLine, window.toLine), nil
 	}
 
-	if logsChanErr != nil {
-		lk.logErrorf(r, "Error finding logs during test: %v", logsChanErr)
-		return nil, &apiError{Err: logsChanErr.Error(), code: http.StatusInternalServerError}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	reversed, err := fetch(ctx, true)
+	if err != nil {
+		return nil, err
 	}
 
-	result := logFetchResponse{
-		logLines: logsChan,
-		build:    build,
-		test:     test,
-	}
-	return &result, nil
+	return model.UnnumberLines(r.Context(), model.TailLines(ctx, reversed, window.tail)), nil
 }
 
 func (lk *logKeeper) viewTestByBuildIdTestId(w http.ResponseWriter, r *http.Request) {
@@ -574,20 +741,63 @@ func (lk *logKeeper) viewTestByBuildIdTestId(w http.ResponseWriter, r *http.Requ
 		http.Redirect(w, r, fmt.Sprintf("/lobster/build/%s/test/%s", buildID, testID), http.StatusFound)
 		return
 	}
-	var result *logFetchResponse
-	var fetchError *apiError
-	if len(r.FormValue("s3")) > 0 {
-		result, fetchError = lk.viewTestInS3(r, buildID, testID)
-	} else {
-		result, fetchError = lk.viewTestInDatabase(r, buildID, testID)
+
+	build, fetchError := lk.findBuild(r, "view test by id")
+	if fetchError != nil {
+		lk.render.WriteJSON(w, fetchError.code, *fetchError)
+		return
 	}
+
+	if jsonRequested(r) {
+		test, fetchError := lk.findTest(r, build)
+		if fetchError != nil {
+			lk.render.WriteJSON(w, fetchError.code, *fetchError)
+			return
+		}
+
+		lk.render.WriteJSON(w, http.StatusOK, testResponse{Build: build, Test: test})
+		return
+	}
+
+	window, windowErr := readLogWindow(r)
+	if windowErr != nil {
+		lk.render.WriteJSON(w, windowErr.code, *windowErr)
+		return
+	}
+
+	// Start following before the lines are first read so that lines
+	// appended in between aren't left until the next poll.
+	var follower *logFollower
+	if followRequested(r) && bson.IsObjectIdHex(testID) {
+		if window.fromLine > 0 || window.toLine >= 0 {
+			lk.render.WriteJSON(w, http.StatusBadRequest, apiError{Err: "from_line and to_line can't be combined with follow"})
+			return
+		}
+		follower = lk.broker.follow(buildID, bson.ObjectIdHex(testID))
+		defer lk.broker.unfollow(buildID, follower)
+	}
+
+	test, fetchError := lk.findTest(r, build)
 	if fetchError != nil {
 		lk.render.WriteJSON(w, fetchError.code, *fetchError)
 		return
 	}
-	logsChan := result.logLines
-	build := result.build
-	test := result.test
+	r, status, stop := withStreamStatus(r)
+	defer stop()
+	if follower != nil {
+		lk.followTestLogs(w, r, follower, status, build, test, window)
+		return
+	}
+	logsChan, fetchError := lk.testLogs(r, build, test, window)
+	if fetchError != nil {
+		lk.render.WriteJSON(w, fetchError.code, *fetchError)
+		return
+	}
+	if ndjsonRequested(r) {
+		lk.writeNDJSON(w, r, logsChan, status)
+		return
+	}
+	announceStreamStatus(w)
 	if len(r.FormValue("raw")) > 0 || r.Header.Get("Accept") == "text/plain" {
 		emptyLog := true
 		for line := range logsChan {
@@ -599,28 +809,181 @@ func (lk *logKeeper) viewTestByBuildIdTestId(w http.ResponseWriter, r *http.Requ
 				return
 			}
 		}
-		if emptyLog {
+		if emptyLog && status.Err() == nil {
 			lk.render.WriteJSON(w, http.StatusOK, nil)
 		}
+		lk.finishStream(w, r, status)
 	} else {
 		err := lk.render.StreamHTML(w, http.StatusOK, struct {
 			LogLines chan *model.LogLineItem
+			Status   *model.StreamStatus
 			BuildId  string
 			Builder  string
 			TestId   string
 			TestName string
 			Info     model.TestInfo
-		}{logsChan, build.Id, build.Builder, test.Id.Hex(), test.Name, test.Info}, "base", "test.html")
+		}{logsChan, status, build.Id, build.Builder, test.Id.Hex(), test.Name, test.Info}, "base", "test.html")
 		// If there was an error, it won't show up in the UI since it's being streamed, so log it here
 		// instead
 		if err != nil {
 			lk.logErrorf(r, "Error rendering template: %v", err)
 		}
+		lk.finishStream(w, r, status)
 	}
 }
 
+func (lk *logKeeper) searchTest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	defer r.Body.Close()
+
+	search, searchErr := readLogSearch(r)
+	if searchErr != nil {
+		lk.render.WriteJSON(w, searchErr.code, *searchErr)
+		return
+	}
+	window, windowErr := readLogWindow(r)
+	if windowErr != nil {
+		lk.render.WriteJSON(w, windowErr.code, *windowErr)
+		return
+	}
+
+	build, fetchError := lk.findBuild(r, "search test")
+	if fetchError != nil {
+		lk.render.WriteJSON(w, fetchError.code, *fetchError)
+		return
+	}
+	test, fetchError := lk.findTest(r, build)
+	if fetchError != nil {
+		lk.render.WriteJSON(w, fetchError.code, *fetchError)
+		return
+	}
+	r, status, stop := withStreamStatus(r)
+	defer stop()
+	logsChan, fetchError := lk.testLogs(r, build, test, window)
+	if fetchError != nil {
+		lk.render.WriteJSON(w, fetchError.code, *fetchError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	announceStreamStatus(w)
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	for line := range model.SearchLines(r.Context(), logsChan, search.matches, search.context) {
+		record := searchLineRecord{
+			logLineRecord: newLogLineRecord(line.LogLineItem),
+			Match:         line.Match,
+		}
+		if err := encoder.Encode(record); err != nil {
+			lk.logErrorf(r, "Error writing search result: %v", err)
+			return
+		}
+	}
+	lk.finishNDJSON(w, r, encoder, status)
+}
+
+func (lk *logKeeper) findTests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	defer r.Body.Close()
+
+	query, queryErr := readTestQuery(r)
+	if queryErr != nil {
+		lk.render.WriteJSON(w, queryErr.code, *queryErr)
+		return
+	}
+
+	tests, err := lk.opts.Store.FindTests(r.Context(), query)
+	if err != nil {
+		lk.logErrorf(r, "Error finding tests: %v", err)
+		lk.render.WriteJSON(w, http.StatusInternalServerError, apiError{Err: err.Error()})
+		return
+	}
+
+	response := testsResponse{Tests: tests}
+	if len(tests) == query.Limit {
+		params := r.URL.Query()
+		params.Set("after", tests[len(tests)-1].Id.Hex())
+		response.Next = fmt.Sprintf("%s/tests?%s", lk.opts.URL, params.Encode())
+	}
+	lk.render.WriteJSON(w, http.StatusOK, response)
+}
+
 func lobsterRedirect(r *http.Request) bool {
-	return len(r.FormValue("html")) == 0 && len(r.FormValue("raw")) == 0 && r.Header.Get("Accept") != "text/plain"
+	return len(r.FormValue("html")) == 0 && len(r.FormValue("raw")) == 0 && r.Header.Get("Accept") != "text/plain" && !jsonRequested(r) && !ndjsonRequested(r) && !followRequested(r)
+}
+
+// jsonRequested returns true if the client asked for a JSON representation of
+// the resource, either through the Accept header or the format query
+// parameter.
+func jsonRequested(r *http.Request) bool {
+	return r.FormValue("format") == "json" || r.Header.Get("Accept") == "application/json"
+}
+
+// ndjsonRequested returns true if the client asked for log lines as
+// newline-delimited JSON.
+func ndjsonRequested(r *http.Request) bool {
+	return r.FormValue("format") == "ndjson" || r.Header.Get("Accept") == ndjsonContentType
+}
+
+// writeNDJSON streams the log lines to the response as one JSON object per
+// line. The lines are expected to be numbered by fetchLogLines so that
+// they match the line anchors in the HTML view. If the lines stop early
+// because of an error, the last object is a streamErrorRecord.
+func (lk *logKeeper) writeNDJSON(w http.ResponseWriter, r *http.Request, logLines chan *model.LogLineItem, status *model.StreamStatus) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	announceStreamStatus(w)
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	for line := range logLines {
+		if err := encoder.Encode(newLogLineRecord(line)); err != nil {
+			lk.logErrorf(r, "Error writing NDJSON log line: %v", err)
+			return
+		}
+	}
+	lk.finishNDJSON(w, r, encoder, status)
+}
+
+// finishNDJSON ends an NDJSON response with a streamErrorRecord if its lines
+// stopped early, and sets its stream status trailer.
+func (lk *logKeeper) finishNDJSON(w http.ResponseWriter, r *http.Request, encoder *json.Encoder, status *model.StreamStatus) {
+	if err := lk.finishStream(w, r, status); err != nil {
+		if err = encoder.Encode(streamErrorRecord{Err: err.Error()}); err != nil {
+			lk.logErrorf(r, "Error writing NDJSON error record: %v", err)
+		}
+	}
+}
+
+// withStreamStatus returns the request with a context that records errors
+// from the log streams started with it, the status they're recorded in, and a
+// function that stops the streams. Handlers stop the streams when they return,
+// since they may return before reading all of the lines.
+func withStreamStatus(r *http.Request) (*http.Request, *model.StreamStatus, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	ctx, status := model.WithStreamStatus(ctx)
+	return r.WithContext(ctx), status, cancel
+}
+
+// announceStreamStatus declares the stream status trailer, which has to be
+// done before the response is written.
+func announceStreamStatus(w http.ResponseWriter) {
+	w.Header().Set("Trailer", streamStatusTrailer)
+}
+
+// finishStream sets the stream status trailer once the log lines have been
+// written and returns the error that stopped them early, if any, so that
+// clients can tell a truncated log from a complete one.
+func (lk *logKeeper) finishStream(w http.ResponseWriter, r *http.Request, status *model.StreamStatus) error {
+	err := status.Err()
+	if err != nil {
+		lk.logErrorf(r, "Error streaming logs: %v", err)
+		w.Header().Set(streamStatusTrailer, streamIncomplete)
+		return err
+	}
+	w.Header().Set(streamStatusTrailer, streamComplete)
+
+	return nil
 }
 
 func (lk *logKeeper) viewInLobster(w http.ResponseWriter, r *http.Request) {
@@ -682,6 +1045,14 @@ func (lk *logKeeper) NewRouter() *mux.Router {
 	r.Path("/build/{build_id}/test").Methods("POST").HandlerFunc(lk.createTest)
 	r.Path("/build/{build_id}/test/{test_id}/").Methods("POST").HandlerFunc(lk.appendLog)
 	r.Path("/build/{build_id}/test/{test_id}").Methods("POST").HandlerFunc(lk.appendLog)
+	r.Path("/build/{build_id}/test/{test_id}/end/").Methods("POST").HandlerFunc(lk.endTest)
+	r.Path("/build/{build_id}/test/{test_id}/end").Methods("POST").HandlerFunc(lk.endTest)
+	r.Path("/build/{build_id}/finish/").Methods("POST").HandlerFunc(lk.finishBuild)
+	r.Path("/build/{build_id}/finish").Methods("POST").HandlerFunc(lk.finishBuild)
+	r.Path("/build/{build_id}/pin/").Methods("POST").HandlerFunc(lk.pinBuild)
+	r.Path("/build/{build_id}/pin").Methods("POST").HandlerFunc(lk.pinBuild)
+	r.Path("/build/{build_id}/unpin/").Methods("POST").HandlerFunc(lk.unpinBuild)
+	r.Path("/build/{build_id}/unpin").Methods("POST").HandlerFunc(lk.unpinBuild)
 	r.Path("/build/{build_id}/").Methods("POST").HandlerFunc(lk.appendGlobalLog)
 	r.Path("/build/{build_id}").Methods("POST").HandlerFunc(lk.appendGlobalLog)
 
@@ -689,6 +1060,9 @@ func (lk *logKeeper) NewRouter() *mux.Router {
 	r.StrictSlash(true).Path("/build/{build_id}").Methods("GET").HandlerFunc(lk.viewBuildById)
 	r.StrictSlash(true).Path("/build/{build_id}/all").Methods("GET").HandlerFunc(lk.viewAllLogs)
 	r.StrictSlash(true).Path("/build/{build_id}/test/{test_id}").Methods("GET").HandlerFunc(lk.viewTestByBuildIdTestId)
+	r.StrictSlash(true).Path("/build/{build_id}/test/{test_id}/search").Methods("GET").HandlerFunc(lk.searchTest)
+	r.StrictSlash(true).Path("/tests").Methods("GET").HandlerFunc(lk.findTests)
+	r.StrictSlash(true).Path("/retention/report").Methods("GET").HandlerFunc(lk.retentionReport)
 	r.PathPrefix("/lobster").Methods("GET").HandlerFunc(lk.viewInLobster)
 	//r.Path("/{builder}/builds/{buildnum:[0-9]+}/").HandlerFunc(viewBuild)
 	//r.Path("/{builder}/builds/{buildnum}/test/{test_phase}/{test_name}").HandlerFunc(app.MakeHandler(Name("view_test")))
@@ -0,0 +1,365 @@
+package logkeeper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/logkeeper/model"
+	"github.com/evergreen-ci/logkeeper/storage"
+	"github.com/evergreen-ci/logkeeper/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testdataBuildID = "5a75f537726934e4b62833ab6d5dca41"
+
+func serveTestRequest(t *testing.T, router http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(payload)))
+	return w
+}
+
+func rawLines(w *httptest.ResponseRecorder) []string {
+	return strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+}
+
+func TestViewAllLogsInBucket(t *testing.T) {
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: "testdata/simple"})
+	require.NoError(t, err)
+	router := New(Options{Store: storage.NewBucketStore(bucket)}).NewRouter()
+
+	w := serveTestRequest(t, router, http.MethodGet, "/build/"+testdataBuildID+"/all?raw=1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	lines := rawLines(w)
+	assert.Len(t, lines, 15)
+
+	w = serveTestRequest(t, router, http.MethodGet, "/build/"+testdataBuildID+"/all?raw=1&tail=2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, lines[len(lines)-2:], rawLines(w))
+
+	w = serveTestRequest(t, router, http.MethodGet, "/build/nonexistent/all?raw=1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// corruptTestdata copies the simple testdata to a temporary directory and
+// renames the build's global chunk to claim one more line than it has, so that
+// reading the build's logs fails partway through.
+func corruptTestdata(t *testing.T) string {
+	dir := t.TempDir()
+	require.NoError(t, filepath.Walk("testdata/simple", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, strings.TrimPrefix(path, "testdata/simple"))
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dest, data, 0644)
+	}))
+	chunk := filepath.Join(dir, "builds", testdataBuildID, "1658560532739000000_1658560535740000000_4")
+	require.NoError(t, os.Rename(chunk, strings.TrimSuffix(chunk, "4")+"5"))
+
+	return dir
+}
+
+func TestStreamStatus(t *testing.T) {
+	for name, path := range map[string]string{"Complete": "testdata/simple", "Incomplete": corruptTestdata(t)} {
+		t.Run(name, func(t *testing.T) {
+			bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: path})
+			require.NoError(t, err)
+			router := New(Options{Store: storage.NewBucketStore(bucket)}).NewRouter()
+			expected := streamComplete
+			if name == "Incomplete" {
+				expected = streamIncomplete
+			}
+
+			for _, query := range []string{"raw=1", "format=ndjson", "html=1"} {
+				w := serveTestRequest(t, router, http.MethodGet, "/build/"+testdataBuildID+"/all?"+query, nil)
+				require.Equal(t, http.StatusOK, w.Code)
+				assert.Equal(t, expected, w.Result().Trailer.Get(streamStatusTrailer), query)
+				if query == "html=1" {
+					assert.Equal(t, name == "Incomplete", strings.Contains(w.Body.String(), `class="stream-error"`))
+				}
+				if query != "format=ndjson" {
+					continue
+				}
+
+				lines := rawLines(w)
+				record := streamErrorRecord{}
+				require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &record))
+				if name == "Incomplete" {
+					assert.Contains(t, record.Err, "corrupt data")
+				} else {
+					assert.Empty(t, record.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamStopsOnDisconnect(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	build := model.Build{Id: "b0", Builder: "builder"}
+	require.NoError(t, store.InsertBuild(ctx, build))
+	now := time.Now()
+	chunk := model.LogChunk{}
+	for i := 0; i < 10000; i++ {
+		chunk = append(chunk, model.LogLine{Time: now, Msg: strings.Repeat("a", 1000)})
+	}
+	_, err := store.InsertLogChunks(ctx, &build, nil, "", []model.LogChunk{chunk})
+	require.NoError(t, err)
+	router := New(Options{Store: store}).NewRouter()
+
+	baseline := runtime.NumGoroutine()
+	server := httptest.NewServer(router)
+	client := &http.Client{Transport: &http.Transport{}}
+	for _, query := range []string{"raw=1", "format=ndjson", "html=1"} {
+		resp, err := client.Get(server.URL + "/build/b0/all?" + query)
+		require.NoError(t, err)
+		_, err = resp.Body.Read(make([]byte, 1024))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+	client.CloseIdleConnections()
+	server.Close()
+
+	assert.NoError(t, testutil.WaitForGoroutines(baseline, 5*time.Second), "the goroutines streaming the log stop once the client disconnects")
+}
+
+func TestCheckBuildStorage(t *testing.T) {
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: "testdata/simple"})
+	require.NoError(t, err)
+	lk := New(Options{Store: storage.NewBucketStore(bucket), Bucket: &bucket})
+	router := lk.NewAdminRouter()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := serveTestRequest(t, lk.NewRouter(), method, "/build/"+testdataBuildID+"/fsck", nil)
+		assert.NotEqual(t, http.StatusOK, w.Code, "the public router doesn't serve the check")
+
+		w = serveTestRequest(t, router, method, "/build/"+testdataBuildID+"/fsck", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		report := storage.CheckReport{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, testdataBuildID, report.BuildID)
+		assert.Equal(t, 2, report.Chunks)
+		assert.Empty(t, report.Problems)
+	}
+
+	w := serveTestRequest(t, router, http.MethodGet, "/build/nonexistent/fsck", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	router = New(Options{Store: storage.NewMemoryStore()}).NewAdminRouter()
+	w = serveTestRequest(t, router, http.MethodGet, "/build/"+testdataBuildID+"/fsck", nil)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestS3BuildJSONRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := storage.NewMemoryStore()
+	router := New(Options{MaxRequestSize: 1024 * 1024, Store: db}).NewRouter()
+
+	w := serveTestRequest(t, router, http.MethodPost, "/build", map[string]interface{}{"builder": "builder", "buildnum": 1, "task_id": "task"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	created := createdResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	buildID := created.Id
+	w = serveTestRequest(t, router, http.MethodPost, "/build/"+buildID+"/test", map[string]interface{}{"test_filename": "test", "command": "command", "phase": "phase"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	testPath := fmt.Sprintf("/build/%s/test/%s", buildID, created.Id)
+	now := time.Now().Unix()
+	w = serveTestRequest(t, router, http.MethodPost, testPath, [][]interface{}{{now, "line 0"}, {now + 1, "line 1"}})
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = serveTestRequest(t, router, http.MethodPost, testPath+"/end", map[string]interface{}{"status": statusPassed})
+	require.Equal(t, http.StatusOK, w.Code)
+	w = serveTestRequest(t, router, http.MethodPost, "/build/"+buildID+"/finish", map[string]interface{}{"status": statusPassed})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Write the build to the bucket the way it's migrated there.
+	bucket, err := storage.NewBucket(storage.BucketOpts{Location: storage.PailLocal, Path: t.TempDir()})
+	require.NoError(t, err)
+	build, err := db.FindBuildByID(ctx, buildID)
+	require.NoError(t, err)
+	require.NotNil(t, build)
+	tests, err := db.FindTestsForBuild(ctx, build)
+	require.NoError(t, err)
+	for _, test := range tests {
+		require.NoError(t, bucket.UploadTestMetadata(ctx, test))
+	}
+	build.S3 = true
+	require.NoError(t, bucket.UploadBuildMetadata(ctx, *build))
+	bucketRouter := New(Options{Store: storage.NewBucketStore(bucket)}).NewRouter()
+
+	for _, path := range []string{"/build/" + buildID, testPath} {
+		expected := serveTestRequest(t, router, http.MethodGet, path+"?format=json", nil)
+		require.Equal(t, http.StatusOK, expected.Code)
+		actual := serveTestRequest(t, bucketRouter, http.MethodGet, path+"?format=json", nil)
+		require.Equal(t, http.StatusOK, actual.Code)
+		expectedFields := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(expected.Body.Bytes(), &expectedFields))
+		actualFields := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(actual.Body.Bytes(), &actualFields))
+		expectedFields["build"].(map[string]interface{})["s3"] = true
+		assert.Equal(t, expectedFields, actualFields, path)
+	}
+}
+
+func TestHandlersWithMemoryStore(t *testing.T) {
+	router := New(Options{MaxRequestSize: 1024 * 1024, Store: storage.NewMemoryStore()}).NewRouter()
+
+	w := serveTestRequest(t, router, http.MethodPost, "/build", map[string]interface{}{"builder": "builder", "buildnum": 1})
+	require.Equal(t, http.StatusCreated, w.Code)
+	created := createdResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	buildID := created.Id
+
+	w = serveTestRequest(t, router, http.MethodPost, "/build", map[string]interface{}{"builder": "builder", "buildnum": 1})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, buildID, created.Id)
+
+	w = serveTestRequest(t, router, http.MethodPost, "/build/"+buildID+"/test", map[string]interface{}{"test_filename": "test"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	testID := created.Id
+	testPath := fmt.Sprintf("/build/%s/test/%s", buildID, testID)
+
+	now := time.Now().Unix()
+	w = serveTestRequest(t, router, http.MethodPost, testPath, [][]interface{}{{now + 1, "line 0"}, {now + 3, "line 1"}})
+	require.Equal(t, http.StatusCreated, w.Code)
+	w = serveTestRequest(t, router, http.MethodPost, "/build/"+buildID, [][]interface{}{{now + 2, "global"}})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	t.Run("ViewBuild", func(t *testing.T) {
+		w := serveTestRequest(t, router, http.MethodGet, "/build/"+buildID+"?format=json", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		resp := buildResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "builder", resp.Build.Builder)
+		require.Len(t, resp.Tests, 1)
+		assert.Equal(t, testID, resp.Tests[0].Id.Hex())
+
+		w = serveTestRequest(t, router, http.MethodGet, "/build/nonexistent?format=json", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("ViewTest", func(t *testing.T) {
+		w := serveTestRequest(t, router, http.MethodGet, testPath+"?raw=1", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []string{"line 0", "global", "line 1"}, rawLines(w))
+
+		w = serveTestRequest(t, router, http.MethodGet, testPath+"?raw=1&tail=1", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []string{"line 1"}, rawLines(w))
+
+		w = serveTestRequest(t, router, http.MethodGet, testPath+"?format=ndjson&from_line=2", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		record := logLineRecord{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &record))
+		assert.Equal(t, "line 1", record.Msg)
+		require.NotNil(t, record.LineNum)
+		assert.Equal(t, 2, *record.LineNum, "lines keep their numbers in the whole log")
+
+		for _, query := range []string{"tail=1", fmt.Sprintf("start=%d", (now+3)*1000)} {
+			w = serveTestRequest(t, router, http.MethodGet, testPath+"?format=ndjson&"+query, nil)
+			require.Equal(t, http.StatusOK, w.Code, query)
+			record = logLineRecord{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &record), query)
+			assert.Equal(t, "line 1", record.Msg, query)
+			assert.Nil(t, record.LineNum, "lines aren't numbered without the start of the log with %s", query)
+
+			w = serveTestRequest(t, router, http.MethodGet, testPath+"?html=1&"+query, nil)
+			require.Equal(t, http.StatusOK, w.Code, query)
+			assert.Contains(t, w.Body.String(), "line 1", query)
+			assert.NotContains(t, w.Body.String(), `id="L`, "lines without numbers have no anchors with %s", query)
+		}
+
+		w = serveTestRequest(t, router, http.MethodGet, "/build/"+buildID+"/test/nonexistent?raw=1", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("ViewAllLogs", func(t *testing.T) {
+		w := serveTestRequest(t, router, http.MethodGet, "/build/"+buildID+"/all?raw=1", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []string{"line 0", "global", "line 1"}, rawLines(w))
+	})
+
+	t.Run("RetriedAppend", func(t *testing.T) {
+		appendBatch := func(batchID string) *httptest.ResponseRecorder {
+			payload, err := json.Marshal([][]interface{}{{now + 2, "retried"}})
+			require.NoError(t, err)
+			req := httptest.NewRequest(http.MethodPost, "/build/"+buildID, bytes.NewReader(payload))
+			req.Header.Set(batchIDHeader, batchID)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		require.Equal(t, http.StatusCreated, appendBatch("batch-0").Code)
+		require.Equal(t, http.StatusCreated, appendBatch("batch-0").Code)
+		assert.Equal(t, http.StatusBadRequest, appendBatch("not a batch ID").Code)
+
+		w := serveTestRequest(t, router, http.MethodGet, "/build/"+buildID+"/all?raw=1", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []string{"line 0", "global", "retried", "line 1"}, rawLines(w))
+	})
+
+	t.Run("FindTests", func(t *testing.T) {
+		w := serveTestRequest(t, router, http.MethodGet, "/tests?builder=builder", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		resp := testsResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Tests, 1)
+		assert.Equal(t, testID, resp.Tests[0].Id.Hex())
+	})
+
+	t.Run("PinAndUnpin", func(t *testing.T) {
+		w := serveTestRequest(t, router, http.MethodPost, "/build/"+buildID+"/pin", map[string]interface{}{"reason": "investigating"})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "investigating")
+
+		w = serveTestRequest(t, router, http.MethodPost, "/build/"+buildID+"/unpin", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "investigating")
+	})
+
+	t.Run("Finish", func(t *testing.T) {
+		w := serveTestRequest(t, router, http.MethodPost, testPath+"/end", map[string]interface{}{"status": "failed"})
+		require.Equal(t, http.StatusOK, w.Code)
+		resp := testResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.True(t, resp.Test.Failed)
+		assert.NotNil(t, resp.Test.Ended)
+
+		w = serveTestRequest(t, router, http.MethodPost, "/build/"+buildID+"/finish", map[string]interface{}{"status": "failed"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = serveTestRequest(t, router, http.MethodPost, testPath, [][]interface{}{{now + 4, "late"}})
+		assert.Equal(t, http.StatusConflict, w.Code)
+		w = serveTestRequest(t, router, http.MethodPost, "/build/"+buildID+"/finish", map[string]interface{}{"status": "passed"})
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+}